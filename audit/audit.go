@@ -0,0 +1,78 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record is one audit log entry, written as a single JSON line. Event is
+// "connect" or "disconnect" for a WebSocket, "session_start" or
+// "session_end" for a terminal's process, or "login" or "login_failed".
+type Record struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	User       string    `json:"user,omitempty"`
+	TerminalID string    `json:"terminal_id,omitempty"`
+	ClientIP   string    `json:"client_ip,omitempty"`
+	Conn       int       `json:"conn,omitempty"` // per-session connection number
+	RequestID  string    `json:"request_id,omitempty"`
+
+	// Disconnect only.
+	ConnectedAt *time.Time `json:"connected_at,omitempty"`
+	BytesIn     int64      `json:"bytes_in,omitempty"`
+	BytesOut    int64      `json:"bytes_out,omitempty"`
+
+	// Session events only.
+	PID      int  `json:"pid,omitempty"`
+	ExitCode *int `json:"exit_code,omitempty"` // session_end
+}
+
+// Sink receives audit records. Logger and Webhook are sinks.
+type Sink interface {
+	Log(Record)
+}
+
+// Logger appends audit records to a writer as JSON lines. It is safe for
+// concurrent use; each record is written with a single Write call.
+type Logger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Open returns a Logger for dest: "stderr" or "stdout" write to those
+// streams, anything else is a file path opened for appending with 0600
+// permissions.
+func Open(dest string) (*Logger, error) {
+	switch dest {
+	case "stderr":
+		return &Logger{w: os.Stderr}, nil
+	case "stdout":
+		return &Logger{w: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	return &Logger{w: f}, nil
+}
+
+// Log writes rec. Failures are reported to the standard logger rather than
+// returned, so auditing never breaks a terminal connection.
+func (l *Logger) Log(rec Record) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("[AUDIT] encoding record: %v", err)
+		return
+	}
+	data = append(data, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(data); err != nil {
+		log.Printf("[AUDIT] writing record: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoggerWritesJSONLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	exit := 0
+	recs := []Record{
+		{Time: at, Event: "connect", TerminalID: "lxc/pve/100", ClientIP: "192.0.2.1", Conn: 1, RequestID: "r1"},
+		{Time: at, Event: "disconnect", TerminalID: "lxc/pve/100", ClientIP: "192.0.2.1", Conn: 1, RequestID: "r1",
+			ConnectedAt: &at, BytesIn: 12, BytesOut: 3400},
+		{Time: at, Event: "session_end", TerminalID: "lxc/pve/100", ExitCode: &exit},
+	}
+	for _, r := range recs {
+		l.Log(r)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("audit log mode = %#o, want 0600", perm)
+	}
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	want := []string{
+		`{"time":"2026-01-02T03:04:05Z","event":"connect","terminal_id":"lxc/pve/100","client_ip":"192.0.2.1","conn":1,"request_id":"r1"}`,
+		`{"time":"2026-01-02T03:04:05Z","event":"disconnect","terminal_id":"lxc/pve/100","client_ip":"192.0.2.1","conn":1,"request_id":"r1","connected_at":"2026-01-02T03:04:05Z","bytes_in":12,"bytes_out":3400}`,
+		// A zero exit code is still reported.
+		`{"time":"2026-01-02T03:04:05Z","event":"session_end","terminal_id":"lxc/pve/100","exit_code":0}`,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(want), data)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("line %d:\n got %s\nwant %s", i, lines[i], want[i])
+		}
+		if !json.Valid([]byte(lines[i])) {
+			t.Errorf("line %d isn't valid JSON", i)
+		}
+	}
+}
+
+func TestLoggerAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		l, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Log(Record{Event: "login"})
+	}
+	data, _ := os.ReadFile(path)
+	if n := strings.Count(string(data), "\n"); n != 2 {
+		t.Errorf("got %d records after reopening, want 2", n)
+	}
+}
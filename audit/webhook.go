@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// SignatureHeader carries the HMAC-SHA256 of a webhook body, as
+// "sha256=<hex>", when a secret is configured.
+const SignatureHeader = "X-Termbrowser-Signature"
+
+const (
+	webhookAttempts = 3
+	webhookTimeout  = 10 * time.Second
+)
+
+// Webhook POSTs records as JSON to a URL from a background goroutine.
+// Records wait in a bounded queue; when it is full they are dropped with a
+// logged warning, so a slow endpoint never holds up the caller.
+type Webhook struct {
+	url    string
+	secret []byte
+	queue  chan Record
+	client *http.Client
+}
+
+// NewWebhook starts delivering to url, keeping up to queueSize records
+// waiting. With a non-empty secret each request is signed (see
+// SignatureHeader).
+func NewWebhook(url, secret string, queueSize int) *Webhook {
+	w := &Webhook{
+		url:    url,
+		secret: []byte(secret),
+		queue:  make(chan Record, queueSize),
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+	go w.run()
+	return w
+}
+
+// Log queues rec for delivery without blocking.
+func (w *Webhook) Log(rec Record) {
+	select {
+	case w.queue <- rec:
+	default:
+		log.Printf("[AUDIT] webhook queue full, dropping %s event", rec.Event)
+	}
+}
+
+func (w *Webhook) run() {
+	for rec := range w.queue {
+		body, err := json.Marshal(rec)
+		if err != nil {
+			log.Printf("[AUDIT] encoding record: %v", err)
+			continue
+		}
+		for attempt := 1; ; attempt++ {
+			err := w.post(body)
+			if err == nil {
+				break
+			}
+			if attempt == webhookAttempts {
+				log.Printf("[AUDIT] webhook: giving up on %s event after %d attempts: %v", rec.Event, attempt, err)
+				break
+			}
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+}
+
+func (w *Webhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
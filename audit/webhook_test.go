@@ -0,0 +1,128 @@
+package audit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the requests a webhook makes, answering with
+// the statuses in fail first and 204 after that.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	fail     []int
+	bodies   [][]byte
+	sigs     []string
+	received chan struct{}
+}
+
+func newWebhookReceiver(t *testing.T, fail ...int) (*webhookReceiver, *httptest.Server) {
+	r := &webhookReceiver{fail: fail, received: make(chan struct{}, 100)}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if len(r.fail) > 0 {
+			w.WriteHeader(r.fail[0])
+			r.fail = r.fail[1:]
+			return
+		}
+		if ct := req.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		r.bodies = append(r.bodies, body)
+		r.sigs = append(r.sigs, req.Header.Get(SignatureHeader))
+		w.WriteHeader(http.StatusNoContent)
+		r.received <- struct{}{}
+	}))
+	t.Cleanup(ts.Close)
+	return r, ts
+}
+
+func (r *webhookReceiver) wait(t *testing.T, n int, within time.Duration) {
+	t.Helper()
+	deadline := time.After(within)
+	for range n {
+		select {
+		case <-r.received:
+		case <-deadline:
+			t.Fatalf("webhook didn't deliver %d records within %v", n, within)
+		}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+	}{
+		{"unsigned", ""},
+		{"signed", "s3cret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcv, ts := newWebhookReceiver(t)
+			w := NewWebhook(ts.URL, tt.secret, 10)
+			events := []string{"login", "session_start", "connect"}
+			for _, ev := range events {
+				w.Log(Record{Event: ev, TerminalID: "lxc/pve/100"})
+			}
+			rcv.wait(t, len(events), 5*time.Second)
+
+			rcv.mu.Lock()
+			defer rcv.mu.Unlock()
+			for i, body := range rcv.bodies {
+				var rec Record
+				if err := json.Unmarshal(body, &rec); err != nil {
+					t.Fatalf("body %q: %v", body, err)
+				}
+				if rec.Event != events[i] {
+					t.Errorf("record %d is %q, want %q", i, rec.Event, events[i])
+				}
+				want := ""
+				if tt.secret != "" {
+					mac := hmac.New(sha256.New, []byte(tt.secret))
+					mac.Write(body)
+					want = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+				}
+				if rcv.sigs[i] != want {
+					t.Errorf("record %d signature %q, want %q", i, rcv.sigs[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	rcv, ts := newWebhookReceiver(t, http.StatusServiceUnavailable)
+	w := NewWebhook(ts.URL, "", 10)
+	w.Log(Record{Event: "login_failure"})
+	rcv.wait(t, 1, 5*time.Second)
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	// An endpoint that doesn't answer until the test ends.
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { <-release }))
+	t.Cleanup(ts.Close)
+	t.Cleanup(func() { close(release) })
+
+	w := NewWebhook(ts.URL, "", 2)
+	start := time.Now()
+	for range 100 {
+		w.Log(Record{Event: "connect"})
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("logging to a stuck webhook took %v", elapsed)
+	}
+	if n := len(w.queue); n != cap(w.queue) {
+		t.Errorf("queue holds %d records, want it full at %d", n, cap(w.queue))
+	}
+}
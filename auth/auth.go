@@ -3,9 +3,11 @@ package auth
 import (
 	"errors"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -16,6 +18,37 @@ type Manager struct {
 	passwordHash []byte
 	totpSecret   string
 	jwtSecret    []byte
+
+	// TOTPSkew is the number of periods either side of the current one in
+	// which a code is still accepted, to tolerate phone clock drift.
+	TOTPSkew   uint
+	TOTPDigits otp.Digits
+	TOTPPeriod uint
+
+	// PreviousTOTPSecrets are also accepted, so an old authenticator keeps
+	// working while a new secret is rolled out. Replay protection covers
+	// all secrets together: a code is refused once any code for its time
+	// step has been used.
+	PreviousTOTPSecrets []string
+
+	// Session cookie attributes. CookieName defaults to "tb_session" and
+	// CookieSameSite to strict. CookieSecure decides when the cookie is
+	// marked HTTPS-only; a SameSite=None cookie always is, as browsers
+	// require.
+	CookieName     string
+	CookieSameSite http.SameSite
+	CookieSecure   CookieSecurity
+
+	// APITokens maps the SHA-256 of each API token to its name and scope.
+	APITokens map[[32]byte]APIToken
+
+	// Pepper is a server-side secret mixed into the password before bcrypt
+	// (see PepperPassword). It must match the one used at setup.
+	Pepper string
+
+	mu       sync.Mutex
+	lastStep int64        // TOTP time step of the last accepted code
+	pending  *pendingTOTP // secret awaiting confirmation; see BeginTOTPRotation
 }
 
 func NewManager(passwordHash, totpSecret string, jwtSecret []byte) *Manager {
@@ -23,18 +56,74 @@ func NewManager(passwordHash, totpSecret string, jwtSecret []byte) *Manager {
 		passwordHash: []byte(passwordHash),
 		totpSecret:   totpSecret,
 		jwtSecret:    jwtSecret,
+		TOTPSkew:     1,
+		TOTPDigits:   otp.DigitsSix,
+		TOTPPeriod:   30,
+		lastStep:     -1,
+
+		CookieName:     "tb_session",
+		CookieSameSite: http.SameSiteStrictMode,
 	}
 }
 
 func (m *Manager) Verify(password, totpCode string) error {
-	pwErr := bcrypt.CompareHashAndPassword(m.passwordHash, []byte(password))
-	totpOK := totp.Validate(totpCode, m.totpSecret)
+	pwErr := bcrypt.CompareHashAndPassword(m.passwordHash, PepperPassword(password, m.Pepper))
+	step, totpOK := m.matchTOTP(totpCode, time.Now())
 	if pwErr != nil || !totpOK {
 		return errInvalidCredentials
 	}
+
+	// A code stays valid for the whole skew window, so remember the step it
+	// was generated for and refuse it (or any older one) a second time.
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if step <= m.lastStep {
+		return errInvalidCredentials
+	}
+	m.lastStep = step
 	return nil
 }
 
+// matchTOTP checks code against each time step in the skew window, for
+// the current secret and then PreviousTOTPSecrets, and returns the step it
+// was generated for. Each step is validated on its own rather than with
+// ValidateOpts.Skew so the matching step is known.
+func (m *Manager) matchTOTP(code string, now time.Time) (int64, bool) {
+	m.mu.Lock()
+	secret := m.totpSecret
+	m.mu.Unlock()
+	if step, ok := m.matchTOTPSecret(secret, code, now); ok {
+		return step, true
+	}
+	for _, prev := range m.PreviousTOTPSecrets {
+		if step, ok := m.matchTOTPSecret(prev, code, now); ok {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// matchTOTPSecret is matchTOTP for a given secret.
+func (m *Manager) matchTOTPSecret(secret, code string, now time.Time) (int64, bool) {
+	period := int64(m.TOTPPeriod)
+	current := now.Unix() / period
+	for i := -int64(m.TOTPSkew); i <= int64(m.TOTPSkew); i++ {
+		step := current + i
+		if step < 0 {
+			continue
+		}
+		ok, err := totp.ValidateCustom(code, secret, time.Unix(step*period, 0).UTC(), totp.ValidateOpts{
+			Period:    m.TOTPPeriod,
+			Digits:    m.TOTPDigits,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err == nil && ok {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
 func (m *Manager) IssueToken() (string, error) {
 	claims := jwt.RegisteredClaims{
 		ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
@@ -44,49 +133,84 @@ func (m *Manager) IssueToken() (string, error) {
 	return token.SignedString(m.jwtSecret)
 }
 
-func (m *Manager) SetCookie(w http.ResponseWriter, tokenStr string) {
+// CookieSecurity is when the session cookie gets the Secure attribute.
+type CookieSecurity int
+
+const (
+	// CookieSecureAuto marks the cookie Secure on responses to requests
+	// that arrived over HTTPS.
+	CookieSecureAuto CookieSecurity = iota
+	CookieSecureAlways
+	CookieSecureNever
+)
+
+// secure reports whether a cookie sent in reply to a request that did
+// (https) or didn't arrive over HTTPS should be marked Secure.
+func (m *Manager) secure(https bool) bool {
+	if m.CookieSameSite == http.SameSiteNoneMode {
+		return true
+	}
+	switch m.CookieSecure {
+	case CookieSecureAlways:
+		return true
+	case CookieSecureNever:
+		return false
+	}
+	return https
+}
+
+// SetCookie sets the session cookie. https tells whether the request being
+// answered arrived over HTTPS, directly or through a trusted proxy.
+func (m *Manager) SetCookie(w http.ResponseWriter, tokenStr string, https bool) {
 	http.SetCookie(w, &http.Cookie{
-		Name:     "tb_session",
+		Name:     m.CookieName,
 		Value:    tokenStr,
 		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
+		Secure:   m.secure(https),
+		SameSite: m.CookieSameSite,
 		MaxAge:   86400,
 		Path:     "/",
 	})
 }
 
-func (m *Manager) ClearCookie(w http.ResponseWriter) {
+// ClearCookie removes the session cookie, with the same attributes
+// SetCookie would use so the browser matches it.
+func (m *Manager) ClearCookie(w http.ResponseWriter, https bool) {
 	http.SetCookie(w, &http.Cookie{
-		Name:   "tb_session",
-		Value:  "",
-		MaxAge: -1,
-		Path:   "/",
+		Name:     m.CookieName,
+		Value:    "",
+		Secure:   m.secure(https),
+		SameSite: m.CookieSameSite,
+		MaxAge:   -1,
+		Path:     "/",
 	})
 }
 
 func (m *Manager) ValidateRequest(r *http.Request) error {
-	cookie, err := r.Cookie("tb_session")
+	_, err := m.cookieClaims(r)
+	return err
+}
+
+// cookieClaims verifies the session cookie and returns its claims.
+func (m *Manager) cookieClaims(r *http.Request) (*jwt.RegisteredClaims, error) {
+	cookie, err := r.Cookie(m.CookieName)
 	if err != nil {
-		return errInvalidCredentials
+		return nil, errInvalidCredentials
 	}
-	token, err := jwt.Parse(cookie.Value, func(t *jwt.Token) (interface{}, error) {
+	var claims jwt.RegisteredClaims
+	token, err := jwt.ParseWithClaims(cookie.Value, &claims, func(t *jwt.Token) (interface{}, error) {
 		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, errInvalidCredentials
 		}
 		return m.jwtSecret, nil
 	})
 	if err != nil || !token.Valid {
-		return errInvalidCredentials
+		return nil, errInvalidCredentials
 	}
-	return nil
+	return &claims, nil
 }
 
+// Middleware requires full (admin) access; see Require.
 func (m *Manager) Middleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if err := m.ValidateRequest(r); err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
+	return m.Require(ScopeAdmin, next)
 }
@@ -0,0 +1,370 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testSecret = "JBSWY3DPEHPK3PXP"
+
+// newTestManager returns a manager for password "pw" and testSecret,
+// hashed at the minimum bcrypt cost to keep tests fast.
+func newTestManager(t *testing.T, pepper string) *Manager {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword(PepperPassword("pw", pepper), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(string(hash), testSecret, []byte("jwt-test-secret"))
+	m.Pepper = pepper
+	return m
+}
+
+// codeAt returns the code for secret at the given number of periods from
+// now.
+func codeAt(t *testing.T, m *Manager, secret string, now time.Time, periods int) string {
+	t.Helper()
+	at := now.Add(time.Duration(periods) * time.Duration(m.TOTPPeriod) * time.Second)
+	code, err := totp.GenerateCodeCustom(secret, at, totp.ValidateOpts{
+		Period:    m.TOTPPeriod,
+		Digits:    m.TOTPDigits,
+		Algorithm: otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestVerifySkew(t *testing.T) {
+	tests := []struct {
+		name    string
+		skew    uint
+		periods int
+		want    bool
+	}{
+		{"current code, skew 0", 0, 0, true},
+		{"one period behind, skew 0", 0, -1, false},
+		{"one period ahead, skew 0", 0, 1, false},
+		{"one period behind, skew 1", 1, -1, true},
+		{"one period ahead, skew 1", 1, 1, true},
+		{"two periods behind, skew 1", 1, -2, false},
+		{"two periods behind, skew 2", 2, -2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, "")
+			m.TOTPSkew = tt.skew
+			// Mid-period, so the steps either side are whole periods away.
+			now := time.Unix(1_700_000_015, 0)
+			_, got := m.matchTOTP(codeAt(t, m, testSecret, now, tt.periods), now)
+			if got != tt.want {
+				t.Errorf("code accepted = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsReplay(t *testing.T) {
+	m := newTestManager(t, "")
+	now := time.Now()
+	code := codeAt(t, m, testSecret, now, 0)
+	if err := m.Verify("pw", code); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := m.Verify("pw", code); err == nil {
+		t.Error("second use of the same code was accepted")
+	}
+	// An older code in the window is refused too once a newer one is used.
+	if err := m.Verify("pw", codeAt(t, m, testSecret, now, -1)); err == nil {
+		t.Error("older code was accepted after a newer one")
+	}
+}
+
+func TestPreviousTOTPSecrets(t *testing.T) {
+	const previous = "KRSXG5CTMVRXEZLU"
+	const other = "MFRGGZDFMZTWQ2LK"
+	tests := []struct {
+		name     string
+		previous []string
+		secret   string
+		periods  int
+		want     bool
+	}{
+		{"current secret", []string{previous}, testSecret, 0, true},
+		{"previous secret", []string{previous}, previous, 0, true},
+		{"previous secret, within skew", []string{previous}, previous, -1, true},
+		{"previous secret, outside skew", []string{previous}, previous, -2, false},
+		{"neither", []string{previous}, other, 0, false},
+		{"previous not configured", nil, previous, 0, false},
+		{"one of several", []string{other, previous}, previous, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, "")
+			m.PreviousTOTPSecrets = tt.previous
+			code := codeAt(t, m, tt.secret, time.Now(), tt.periods)
+			if err := m.Verify("pw", code); (err == nil) != tt.want {
+				t.Errorf("Verify = %v, want success %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreviousTOTPSecretReplay(t *testing.T) {
+	const previous = "KRSXG5CTMVRXEZLU"
+	m := newTestManager(t, "")
+	m.PreviousTOTPSecrets = []string{previous}
+	now := time.Now()
+	if err := m.Verify("pw", codeAt(t, m, testSecret, now, 0)); err != nil {
+		t.Fatalf("current secret: %v", err)
+	}
+	// The other secret's code for the same step is a replay as well.
+	if err := m.Verify("pw", codeAt(t, m, previous, now, 0)); err == nil {
+		t.Error("previous secret's code accepted for a step already used")
+	}
+	if err := m.Verify("pw", codeAt(t, m, previous, now, -1)); err == nil {
+		t.Error("previous secret's older code accepted")
+	}
+}
+
+func TestVerifyPepper(t *testing.T) {
+	tests := []struct {
+		name         string
+		setupPepper  string
+		verifyPepper string
+		password     string
+		want         bool
+	}{
+		{"no pepper", "", "", "pw", true},
+		{"matching pepper", "s3cret", "s3cret", "pw", true},
+		{"wrong password", "s3cret", "s3cret", "nope", false},
+		{"altered pepper", "s3cret", "s3cret2", "pw", false},
+		{"pepper dropped", "s3cret", "", "pw", false},
+		{"pepper added", "", "s3cret", "pw", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, tt.setupPepper)
+			m.Pepper = tt.verifyPepper
+			code := codeAt(t, m, testSecret, time.Now(), 0)
+			if err := m.Verify(tt.password, code); (err == nil) != tt.want {
+				t.Errorf("Verify = %v, want success %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPepperPassword(t *testing.T) {
+	if got := string(PepperPassword("pw", "")); got != "pw" {
+		t.Errorf("without a pepper the password should be unchanged, got %q", got)
+	}
+	a, b := PepperPassword("pw", "one"), PepperPassword("pw", "two")
+	if string(a) == string(b) {
+		t.Error("different peppers gave the same result")
+	}
+	if string(a) != string(PepperPassword("pw", "one")) {
+		t.Error("PepperPassword isn't deterministic")
+	}
+	// Long passwords must still fit bcrypt's 72-byte input limit.
+	long := PepperPassword(strings.Repeat("x", 200), "one")
+	if len(long) > 72 {
+		t.Errorf("peppered password is %d bytes, over bcrypt's limit", len(long))
+	}
+	if string(long) == string(PepperPassword(strings.Repeat("x", 199)+"y", "one")) {
+		t.Error("passwords differing past 72 bytes collide")
+	}
+}
+
+func TestCookieSecure(t *testing.T) {
+	tests := []struct {
+		name     string
+		sameSite http.SameSite
+		security CookieSecurity
+		want     [2]bool // over plain HTTP, over HTTPS
+	}{
+		{"auto", http.SameSiteStrictMode, CookieSecureAuto, [2]bool{false, true}},
+		{"always", http.SameSiteStrictMode, CookieSecureAlways, [2]bool{true, true}},
+		{"never", http.SameSiteLaxMode, CookieSecureNever, [2]bool{false, false}},
+		// Browsers refuse SameSite=None without Secure, so None forces it.
+		{"none, auto", http.SameSiteNoneMode, CookieSecureAuto, [2]bool{true, true}},
+		{"none, never", http.SameSiteNoneMode, CookieSecureNever, [2]bool{true, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, "")
+			m.CookieSameSite = tt.sameSite
+			m.CookieSecure = tt.security
+			for i, https := range []bool{false, true} {
+				rec := httptest.NewRecorder()
+				m.SetCookie(rec, "token", https)
+				m.ClearCookie(rec, https)
+				for _, c := range rec.Result().Cookies() {
+					if c.Secure != tt.want[i] {
+						t.Errorf("https=%v: cookie (max-age %d) secure %v, want %v", https, c.MaxAge, c.Secure, tt.want[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestParseScope(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Scope
+		wantErr bool
+	}{
+		{"read", ScopeRead, false},
+		{"terminal", ScopeTerminal, false},
+		{"admin", ScopeAdmin, false},
+		{"Admin", 0, true},
+		{"write", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseScope(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseScope(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+		if err == nil && got.String() != tt.in {
+			t.Errorf("%v.String() = %q, want %q", got, got.String(), tt.in)
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	m := NewManager("", "", []byte("jwt-test-secret"))
+	m.APITokens = map[[32]byte]APIToken{
+		sha256.Sum256([]byte("read-token")):     {Name: "monitoring", Scope: ScopeRead},
+		sha256.Sum256([]byte("terminal-token")): {Name: "scripts", Scope: ScopeTerminal},
+		sha256.Sum256([]byte("admin-token")):    {Name: "ops", Scope: ScopeAdmin},
+	}
+	cookie, err := m.IssueToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		bearer     string
+		withCookie bool
+		// status for a route requiring read, terminal and admin
+		want [3]int
+	}{
+		{"nothing", "", false, [3]int{401, 401, 401}},
+		{"unknown token", "nope", false, [3]int{401, 401, 401}},
+		{"unknown token beats a cookie", "nope", true, [3]int{401, 401, 401}},
+		{"read token", "read-token", false, [3]int{200, 403, 403}},
+		{"terminal token", "terminal-token", false, [3]int{200, 200, 403}},
+		{"admin token", "admin-token", false, [3]int{200, 200, 200}},
+		{"token scope beats a cookie", "read-token", true, [3]int{200, 403, 403}},
+		{"login cookie", "", true, [3]int{200, 200, 200}},
+	}
+	ok := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, scope := range []Scope{ScopeRead, ScopeTerminal, ScopeAdmin} {
+				r := httptest.NewRequest("GET", "/", nil)
+				if tt.bearer != "" {
+					r.Header.Set("Authorization", "Bearer "+tt.bearer)
+				}
+				if tt.withCookie {
+					r.AddCookie(&http.Cookie{Name: m.CookieName, Value: cookie})
+				}
+				rec := httptest.NewRecorder()
+				m.Require(scope, ok).ServeHTTP(rec, r)
+				if rec.Code != tt.want[i] {
+					t.Errorf("%v route: status %d, want %d", scope, rec.Code, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTOTPRotation(t *testing.T) {
+	m := newTestManager(t, "")
+	m.TOTPDigits = otp.DigitsEight
+	m.TOTPPeriod = 60
+	if err := m.ConfirmTOTPRotation("12345678", func(string) error { return nil }); err != ErrNoRotation {
+		t.Fatalf("confirm before starting: %v, want ErrNoRotation", err)
+	}
+
+	key, err := m.BeginTOTPRotation("termbrowser", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Secret() == testSecret || key.Digits() != otp.DigitsEight || key.Period() != 60 {
+		t.Errorf("new key %s doesn't follow the manager's settings", key.URL())
+	}
+	if key.Issuer() != "termbrowser" || key.AccountName() != "admin" {
+		t.Errorf("new key labelled %q/%q", key.Issuer(), key.AccountName())
+	}
+
+	now := time.Now()
+	steps := []struct {
+		name       string
+		code       string
+		saveErr    error
+		wantErr    error
+		wantSaved  bool
+		wantSecret string
+	}{
+		{"code from the old secret", codeAt(t, m, testSecret, now, 0), nil, ErrWrongCode, false, testSecret},
+		{"mistyped code", "00000000", nil, ErrWrongCode, false, testSecret},
+		{"saving fails", codeAt(t, m, key.Secret(), now, 0), errSaveFailed, errSaveFailed, true, testSecret},
+		{"confirmed", codeAt(t, m, key.Secret(), now, 0), nil, nil, true, key.Secret()},
+		{"confirmed twice", codeAt(t, m, key.Secret(), now, 0), nil, ErrNoRotation, false, key.Secret()},
+	}
+	for _, st := range steps {
+		var saved string
+		err := m.ConfirmTOTPRotation(st.code, func(secret string) error {
+			saved = secret
+			return st.saveErr
+		})
+		if err != st.wantErr {
+			t.Errorf("%s: err = %v, want %v", st.name, err, st.wantErr)
+		}
+		if m.totpSecret != st.wantSecret {
+			t.Errorf("%s: secret is %s, want %s", st.name, m.totpSecret, st.wantSecret)
+		}
+		if (saved == key.Secret()) != st.wantSaved {
+			t.Errorf("%s: saved %q, want saved %v", st.name, saved, st.wantSaved)
+		}
+	}
+
+	// The confirmation code can't be used to log in as well.
+	if err := m.Verify("pw", codeAt(t, m, key.Secret(), now, 0)); err == nil {
+		t.Error("confirmation code accepted for login")
+	}
+	if err := m.Verify("pw", codeAt(t, m, key.Secret(), now, 1)); err != nil {
+		t.Errorf("next code from the new secret: %v", err)
+	}
+}
+
+var errSaveFailed = errors.New("config not writable")
+
+func TestTOTPRotationExpires(t *testing.T) {
+	m := newTestManager(t, "")
+	key, err := m.BeginTOTPRotation("termbrowser", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.pending.expires = time.Now().Add(-time.Second)
+	err = m.ConfirmTOTPRotation(codeAt(t, m, key.Secret(), time.Now(), 0), func(string) error { return nil })
+	if err != ErrNoRotation {
+		t.Errorf("confirming an expired rotation: %v, want ErrNoRotation", err)
+	}
+	if m.totpSecret != testSecret {
+		t.Error("expired rotation replaced the secret")
+	}
+}
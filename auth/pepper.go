@@ -0,0 +1,23 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// PepperPassword mixes a server-side pepper into a password before it is
+// hashed or checked with bcrypt. The password is run through HMAC-SHA256
+// keyed with the pepper rather than having the pepper appended, so long
+// passwords can't push it past bcrypt's 72-byte input limit.
+//
+// An empty pepper returns the password unchanged, so configs hashed
+// without one keep working.
+func PepperPassword(password, pepper string) []byte {
+	if pepper == "" {
+		return []byte(password)
+	}
+	mac := hmac.New(sha256.New, []byte(pepper))
+	mac.Write([]byte(password))
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
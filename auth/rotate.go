@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// totpRotationTTL is how long a new TOTP secret waits for confirmation
+// before it has to be generated again.
+const totpRotationTTL = 10 * time.Minute
+
+var (
+	// ErrNoRotation is returned by ConfirmTOTPRotation when no rotation
+	// was started, or it expired.
+	ErrNoRotation = errors.New("no TOTP rotation in progress")
+	// ErrWrongCode is returned by ConfirmTOTPRotation when the code
+	// doesn't match the new secret.
+	ErrWrongCode = errors.New("code doesn't match the new secret")
+)
+
+// pendingTOTP is a generated secret awaiting confirmation.
+type pendingTOTP struct {
+	key     *otp.Key
+	expires time.Time
+}
+
+// BeginTOTPRotation generates a new TOTP secret with the manager's digits
+// and period, labelled with issuer and account, and holds it until
+// ConfirmTOTPRotation is given a code from it. The current secret keeps
+// working meanwhile. Starting again replaces the pending secret.
+func (m *Manager) BeginTOTPRotation(issuer, account string) (*otp.Key, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: account,
+		Period:      m.TOTPPeriod,
+		Digits:      m.TOTPDigits,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("generating TOTP: %w", err)
+	}
+	m.mu.Lock()
+	m.pending = &pendingTOTP{key: key, expires: time.Now().Add(totpRotationTTL)}
+	m.mu.Unlock()
+	return key, nil
+}
+
+// ConfirmTOTPRotation checks code against the pending secret, and if it
+// matches, calls save with the secret and then switches to it. If save
+// fails the current secret stays in use and the rotation stays pending, so
+// a mistyped scan or an unwritable config can't lock anyone out.
+func (m *Manager) ConfirmTOTPRotation(code string, save func(secret string) error) error {
+	m.mu.Lock()
+	p := m.pending
+	m.mu.Unlock()
+	if p == nil || time.Now().After(p.expires) {
+		return ErrNoRotation
+	}
+	step, ok := m.matchTOTPSecret(p.key.Secret(), code, time.Now())
+	if !ok {
+		return ErrWrongCode
+	}
+	if err := save(p.key.Secret()); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pending == p {
+		m.pending = nil
+	}
+	m.totpSecret = p.key.Secret()
+	// The confirmation code has been seen, so it can't log in as well.
+	m.lastStep = max(m.lastStep, step)
+	return nil
+}
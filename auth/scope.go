@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Scope is what a credential may do. Each scope includes the ones below
+// it; a logged-in browser session has ScopeAdmin.
+type Scope int
+
+const (
+	// ScopeRead lists containers, sessions and events.
+	ScopeRead Scope = iota + 1
+	// ScopeTerminal also opens terminals, runs commands and transfers
+	// files.
+	ScopeTerminal
+	// ScopeAdmin also closes sessions.
+	ScopeAdmin
+)
+
+// ParseScope converts a config value ("read", "terminal" or "admin").
+func ParseScope(s string) (Scope, error) {
+	switch s {
+	case "read":
+		return ScopeRead, nil
+	case "terminal":
+		return ScopeTerminal, nil
+	case "admin":
+		return ScopeAdmin, nil
+	}
+	return 0, fmt.Errorf("scope must be read, terminal or admin, got %q", s)
+}
+
+func (s Scope) String() string {
+	switch s {
+	case ScopeRead:
+		return "read"
+	case ScopeTerminal:
+		return "terminal"
+	case ScopeAdmin:
+		return "admin"
+	}
+	return fmt.Sprintf("Scope(%d)", int(s))
+}
+
+// APIToken is a bearer token for scripts and monitoring, sent as
+// "Authorization: Bearer <token>". Only its SHA-256 is kept.
+type APIToken struct {
+	Name  string
+	Scope Scope
+}
+
+// scopeOf returns the scope of the request's credentials: an API token if
+// it carries one, otherwise the session cookie.
+func (m *Manager) scopeOf(r *http.Request) (Scope, error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		t, found := m.APITokens[sha256.Sum256([]byte(token))]
+		if !found {
+			return 0, errInvalidCredentials
+		}
+		return t.Scope, nil
+	}
+	if err := m.ValidateRequest(r); err != nil {
+		return 0, err
+	}
+	return ScopeAdmin, nil
+}
+
+// Identity describes the credentials of a request, for clients checking
+// whether they are still logged in.
+type Identity struct {
+	// Kind is "session" for the login cookie or "token" for an API token.
+	Kind  string `json:"kind"`
+	Name  string `json:"name,omitempty"` // API token name
+	Scope string `json:"scope"`
+	// IssuedAt and ExpiresAt are set for the login cookie.
+	IssuedAt  *time.Time `json:"issued_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Identify returns who the request's credentials belong to, with the same
+// precedence as Require, or an error if they aren't valid.
+func (m *Manager) Identify(r *http.Request) (Identity, error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		t, found := m.APITokens[sha256.Sum256([]byte(token))]
+		if !found {
+			return Identity{}, errInvalidCredentials
+		}
+		return Identity{Kind: "token", Name: t.Name, Scope: t.Scope.String()}, nil
+	}
+	claims, err := m.cookieClaims(r)
+	if err != nil {
+		return Identity{}, err
+	}
+	id := Identity{Kind: "session", Scope: ScopeAdmin.String()}
+	if claims.IssuedAt != nil {
+		id.IssuedAt = &claims.IssuedAt.Time
+	}
+	if claims.ExpiresAt != nil {
+		id.ExpiresAt = &claims.ExpiresAt.Time
+	}
+	return id, nil
+}
+
+// HasScope reports whether the request's credentials have at least
+// scope, for handlers where only some options need more than the route's
+// Require.
+func (m *Manager) HasScope(r *http.Request, scope Scope) bool {
+	got, err := m.scopeOf(r)
+	return err == nil && got >= scope
+}
+
+// Require wraps next so it only runs for requests whose credentials have
+// at least scope: 401 without valid credentials, 403 with too narrow a
+// scope.
+func (m *Manager) Require(scope Scope, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, err := m.scopeOf(r)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "authentication required")
+			return
+		}
+		if got < scope {
+			writeError(w, http.StatusForbidden, "insufficient_scope", "this token's scope is "+got.String()+", "+scope.String()+" is required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeError writes the same JSON error shape as the server package.
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"code":%q,"message":%q}}`+"\n", code, msg)
+}
@@ -1,13 +1,25 @@
 package config
 
 import (
+	"cmp"
 	"crypto/rand"
+	"encoding/base32"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/chris/termbrowser/auth"
+	"github.com/chris/termbrowser/terminal"
 	"github.com/pquerna/otp/totp"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/term"
@@ -15,10 +27,464 @@ import (
 )
 
 type Config struct {
+	// Profile is the name of the profile the config was loaded from, ""
+	// for a single-config file. See LoadProfile.
+	Profile string `yaml:"-"`
+
 	PasswordHash string `yaml:"password_hash"`
 	TOTPSecret   string `yaml:"totp_secret"`
 	Port         int    `yaml:"port"`
 	JWTSecret    string `yaml:"jwt_secret"`
+
+	// AdminListenAddr, if set, is a host:port such as "127.0.0.1:9100"
+	// for a second listener serving /metrics, /healthz and the admin API,
+	// which are then no longer served on Port.
+	AdminListenAddr string `yaml:"admin_listen_addr,omitempty"`
+
+	// TOTP validation. Skew is the number of periods of clock drift to
+	// tolerate either side of now; nil means the default of 1.
+	TOTPSkew   *uint `yaml:"totp_skew,omitempty"`
+	TOTPDigits int   `yaml:"totp_digits,omitempty"`
+	TOTPPeriod uint  `yaml:"totp_period,omitempty"`
+
+	// TOTPSecretPrevious, if set, is accepted alongside TOTPSecret while
+	// moving to a new authenticator. Remove it once the switch is done.
+	TOTPSecretPrevious string `yaml:"totp_secret_previous,omitempty"`
+
+	// TOTPIssuer and TOTPAccount label the TOTP entry in authenticator
+	// apps, so several instances can be told apart, wherever a secret is
+	// generated: re-running setup and TOTP rotation. Default "termbrowser"
+	// and "admin"; the -totp-issuer and -totp-account flags override them
+	// during setup.
+	TOTPIssuer  string `yaml:"totp_issuer,omitempty"`
+	TOTPAccount string `yaml:"totp_account,omitempty"`
+
+	// ResizePolicy reconciles differing sizes from connections sharing a
+	// session: "smallest", "controller" or "latest" (default).
+	ResizePolicy string `yaml:"resize_policy,omitempty"`
+
+	// MaxSessionsPerNode caps concurrent sessions over ssh to one machine,
+	// counted by the address ssh connects to so that names resolving to
+	// it share the cap; more are refused until one ends. 0 means no limit.
+	MaxSessionsPerNode int `yaml:"max_sessions_per_node,omitempty"`
+
+	// OnDuplicateConnect is what a second connection to a live session
+	// does: "takeover" (default) closes the first, "reject" refuses the
+	// second, "share" attaches both.
+	OnDuplicateConnect string `yaml:"on_duplicate_connect,omitempty"`
+
+	// PveshRetries is how many times a failed pvesh query is retried, with
+	// a short doubling backoff, unless the error is clearly permanent.
+	// Defaults to 2; 0 disables retries.
+	PveshRetries *int `yaml:"pvesh_retries,omitempty"`
+
+	// WSWriteRetries is how many times a transient WebSocket write error is
+	// retried before the connection is detached; nil means the default of 3.
+	WSWriteRetries *int `yaml:"ws_write_retries,omitempty"`
+
+	// WSCompression offers permessage-deflate on WebSockets; nil means the
+	// default of true. Clients that don't ask for it connect uncompressed.
+	WSCompression *bool `yaml:"ws_compression,omitempty"`
+
+	// MaxCols and MaxRows clamp the terminal size clients may request
+	// (default 1000 each).
+	MaxCols uint16 `yaml:"max_cols,omitempty"`
+	MaxRows uint16 `yaml:"max_rows,omitempty"`
+
+	// DefaultCols and DefaultRows set the size new sessions start at, for
+	// clients that don't send a resize straight away. Unset leaves the
+	// PTY at 0x0, which most programs treat as 80x24.
+	DefaultCols uint16 `yaml:"default_cols,omitempty"`
+	DefaultRows uint16 `yaml:"default_rows,omitempty"`
+
+	// InputRateLimit caps terminal input per connection in bytes/sec, with
+	// bursts up to InputBurst. nil means the default of 1 MiB/s; 0 disables.
+	InputRateLimit *int `yaml:"input_rate_limit,omitempty"`
+	InputBurst     int  `yaml:"input_burst,omitempty"`
+
+	// OutputRateLimit caps terminal output per session in bytes/sec, with
+	// bursts up to OutputBurst. nil means the default of 8 MiB/s; 0
+	// disables.
+	OutputRateLimit *int `yaml:"output_rate_limit,omitempty"`
+	OutputBurst     int  `yaml:"output_burst,omitempty"`
+
+	// OutputFlushInterval batches terminal output arriving within this
+	// long into one WebSocket frame (e.g. 10ms). 0, the default, sends
+	// output as soon as it's read.
+	OutputFlushInterval time.Duration `yaml:"output_flush_interval,omitempty"`
+
+	// MaxMessageBytes caps a single WebSocket message from a client;
+	// larger ones close the connection. Default 1 MiB.
+	MaxMessageBytes int64 `yaml:"max_message_bytes,omitempty"`
+
+	// LXCMode is "exec" (pct exec + tmux, the default) or "enter"
+	// (pct enter, no tmux persistence).
+	LXCMode string `yaml:"lxc_mode,omitempty"`
+
+	// AllowedIDPatterns and DeniedIDPatterns restrict which terminal ids
+	// may be used, e.g. denied_id_patterns: [host] to disable the host
+	// shell. '*' matches anything including '/'. Denies take precedence;
+	// an empty allow list allows everything not denied.
+	AllowedIDPatterns []string `yaml:"allowed_id_patterns,omitempty"`
+	DeniedIDPatterns  []string `yaml:"denied_id_patterns,omitempty"`
+
+	// LegacyIDs controls bare numeric container ids: "local" (default)
+	// runs pct on this host, "resolve" looks up the container's node and
+	// connects over ssh as for lxc/{node}/{vmid}, "off" rejects them.
+	LegacyIDs string `yaml:"legacy_ids,omitempty"`
+
+	// SSHConnectTimeout bounds how long ssh waits for a node to accept a
+	// connection (default 10s), so an unreachable node fails with a clear
+	// error instead of hanging.
+	SSHConnectTimeout time.Duration `yaml:"ssh_connect_timeout,omitempty"`
+
+	// SSHJumpHost reaches nodes through a bastion with ssh -J
+	// ([user@]host[:port], comma-separated for several hops).
+	// SSHJumpHosts overrides it per node (or "ssh:{name}" for an
+	// ssh_hosts entry); map one to "" to connect to it directly.
+	SSHJumpHost  string            `yaml:"ssh_jump_host,omitempty"`
+	SSHJumpHosts map[string]string `yaml:"ssh_jump_hosts,omitempty"`
+
+	// SSHIdentityFile is a private key passed to ssh with -i and
+	// IdentitiesOnly=yes, so a dedicated key is used instead of whatever
+	// the agent or ~/.ssh offers. SSHIdentityFiles overrides it per node
+	// (or "ssh:{name}"); map one to "" to use ssh's defaults for it. The
+	// files must exist and be readable only by their owner.
+	SSHIdentityFile  string            `yaml:"ssh_identity_file,omitempty"`
+	SSHIdentityFiles map[string]string `yaml:"ssh_identity_files,omitempty"`
+
+	// SSHHosts are extra machines outside the cluster, such as a Proxmox
+	// Backup Server, listed under their type and opened over ssh like a
+	// node with the id "ssh:{name}":
+	//
+	//	ssh_hosts:
+	//	  - {name: pbs1, type: pbs, address: 10.0.0.5}
+	//	  - {name: nas, type: storage, address: nas.lan, user: admin}
+	SSHHosts []SSHHost `yaml:"ssh_hosts,omitempty"`
+
+	// CheckTmux checks that tmux is installed on a target before opening
+	// a terminal that needs it, and reports a clear error if not. With
+	// TmuxFallback a plain, non-persistent shell is opened instead.
+	CheckTmux    bool `yaml:"check_tmux,omitempty"`
+	TmuxFallback bool `yaml:"tmux_fallback,omitempty"`
+
+	// TmuxLayouts run extra tmux commands when a new tmux session is
+	// created for a matching terminal id, e.g.
+	//
+	//	tmux_layouts:
+	//	  - match: "lxc/*"
+	//	    commands:
+	//	      - [split-window, -h]
+	//	      - [send-keys, "journalctl -f", Enter]
+	//
+	// Only layout-related subcommands are allowed; see
+	// terminal.CheckTmuxLayout.
+	TmuxLayouts []TmuxLayout `yaml:"tmux_layouts,omitempty"`
+
+	// MeasureInputLatency records the time from client input to the next
+	// PTY output in a histogram served at /metrics. It's a heuristic, and
+	// timestamps every input message, so it's off by default.
+	MeasureInputLatency bool `yaml:"measure_input_latency,omitempty"`
+
+	// SessionWrapper is an argv that host and container shells are run
+	// under, e.g. [sudo, -u, someone] or [script, -q, -f,
+	// "/var/log/tb/{id}.log", -c, "{command}"]. See
+	// terminal.CheckSessionWrapper.
+	SessionWrapper []string `yaml:"session_wrapper,omitempty"`
+
+	// SessionMaxLifetime closes every session this long after it started,
+	// however active, with a warning a minute before. 0 (the default)
+	// means no limit.
+	SessionMaxLifetime time.Duration `yaml:"session_max_lifetime,omitempty"`
+
+	// AllowAddrOverride lets admin-scoped clients pass ?addr= on the
+	// terminal WebSocket to ssh to that IP instead of the node's resolved
+	// address, for diagnosing the resolver. Off by default.
+	AllowAddrOverride bool `yaml:"allow_addr_override,omitempty"`
+
+	// ClientIdleTimeout disconnects a browser that has sent no input for
+	// this long, so a forgotten tab doesn't hold the session; the session
+	// itself keeps running. 0 (the default) means never.
+	ClientIdleTimeout time.Duration `yaml:"client_idle_timeout,omitempty"`
+
+	// RequireResumeToken makes reattaching to a running session require the
+	// token it sent to its first connection (as ?resume= on the WebSocket
+	// URL), so one user can't take over another's session by id.
+	RequireResumeToken bool `yaml:"require_resume_token,omitempty"`
+
+	// Locale, e.g. en_US.UTF-8, is set as LANG and LC_ALL in every
+	// terminal. Unset leaves the target's default. The locale must exist
+	// on the target.
+	Locale string `yaml:"locale,omitempty"`
+
+	// Env is extra environment for every terminal, and TargetEnv for
+	// terminals whose id matches (later entries win), e.g.
+	//
+	//	env:
+	//	  EDITOR: vim
+	//	target_env:
+	//	  - match: "lxc/pve/*"
+	//	    env: {TZ: Europe/London}
+	//
+	// Values reach node and container shells through "env" on the remote
+	// command line, quoted for ssh.
+	Env       map[string]string `yaml:"env,omitempty"`
+	TargetEnv []TargetEnv       `yaml:"target_env,omitempty"`
+
+	// InheritEnv, if set, is the list of the server's own environment
+	// variables (NAME, or PREFIX* for several) that terminals and the ssh
+	// and pct commands behind them see; the rest, such as secrets given
+	// to the server, are dropped. Unset passes everything through.
+	// Recommended: [PATH, HOME, USER, LOGNAME, SHELL, LANG, "LC_*", SSH_AUTH_SOCK].
+	InheritEnv []string `yaml:"inherit_env,omitempty"`
+
+	// CheckGuestStatus looks up the target's status before opening a
+	// terminal and refuses stopped guests and offline nodes with a clear
+	// message instead of a failing ssh/pct command.
+	CheckGuestStatus bool `yaml:"check_guest_status,omitempty"`
+
+	// AutoStart starts a stopped guest before connecting and waits up to
+	// AutoStartTimeout (default 60s) for it to be running. Implies the
+	// status check above.
+	AutoStart        bool          `yaml:"auto_start,omitempty"`
+	AutoStartTimeout time.Duration `yaml:"auto_start_timeout,omitempty"`
+
+	// StaticMaxAge is the Cache-Control max-age for embedded web assets
+	// other than index.html. Defaults to 1h.
+	StaticMaxAge time.Duration `yaml:"static_max_age,omitempty"`
+
+	// APITokens let scripts authenticate with "Authorization: Bearer
+	// <token>" instead of logging in. Only the token's SHA-256 (hex) is
+	// stored. Scope is read (list containers, sessions and events),
+	// terminal (also terminals, exec and files) or admin (also closing
+	// sessions).
+	APITokens []APIToken `yaml:"api_tokens,omitempty"`
+
+	// Session cookie. CookieName defaults to "tb_session", so instances
+	// sharing a domain can set different names. CookieSameSite is
+	// "strict" (default), "lax" or "none"; "none", needed when embedding
+	// in a cross-origin iframe, needs a Secure cookie and so HTTPS in
+	// front of termbrowser. It also requires AllowedOrigins, since with
+	// "none" any site's page could otherwise open a terminal with the
+	// user's cookie. CookieSecure is "auto" (default), marking the cookie
+	// Secure when the request came over HTTPS, which behind a proxy means
+	// one in TrustedProxies sent X-Forwarded-Proto: https; "true", for
+	// proxies that don't send the header; or "false". "none" rules out
+	// "false" and turns "auto" into "true", since a SameSite=None cookie
+	// sent without Secure, as auto would over plain HTTP, is refused by
+	// browsers.
+	CookieName     string `yaml:"cookie_name,omitempty"`
+	CookieSameSite string `yaml:"cookie_samesite,omitempty"`
+	CookieSecure   string `yaml:"cookie_secure,omitempty"`
+
+	// RunAsUser and RunAsGroup (names or numeric ids) switch the process
+	// to an unprivileged account once the port is bound. Everything the
+	// server does afterwards runs as that account, so this only suits
+	// setups where it can still list the cluster and reach every target;
+	// local pct, qm and the host shell normally need root.
+	RunAsUser  string `yaml:"run_as_user,omitempty"`
+	RunAsGroup string `yaml:"run_as_group,omitempty"`
+
+	// HTTP server timeouts. Defaults: ReadHeaderTimeout 10s, ReadTimeout
+	// 30s, WriteTimeout 60s, IdleTimeout 120s; a negative value disables
+	// one. WebSockets and file transfers lift the read/write deadlines
+	// once they start, so these only bound ordinary requests.
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout,omitempty"`
+	ReadTimeout       time.Duration `yaml:"read_timeout,omitempty"`
+	WriteTimeout      time.Duration `yaml:"write_timeout,omitempty"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout,omitempty"`
+
+	// LogFile is where the server log goes: "stderr" (default), "stdout"
+	// or a file path. Files are rotated when they reach LogMaxSize bytes
+	// (default 10 MiB), keeping LogMaxBackups old files (default 5) and
+	// deleting any older than LogMaxAge if set.
+	LogFile       string        `yaml:"log_file,omitempty"`
+	LogMaxSize    int64         `yaml:"log_max_size,omitempty"`
+	LogMaxBackups int           `yaml:"log_max_backups,omitempty"`
+	LogMaxAge     time.Duration `yaml:"log_max_age,omitempty"`
+
+	// AuditLog records terminal connects and disconnects, session starts
+	// and ends, and logins as JSON lines: a file path, or
+	// "stderr"/"stdout". Empty disables auditing.
+	AuditLog string `yaml:"audit_log,omitempty"`
+
+	// WebhookURL receives the same events as AuditLog, one JSON POST
+	// each, signed with HMAC-SHA256 of WebhookSecret if set. Delivery is
+	// retried a few times; up to WebhookQueueSize events (default 1000)
+	// wait, and more are dropped with a warning.
+	WebhookURL       string `yaml:"webhook_url,omitempty"`
+	WebhookSecret    string `yaml:"webhook_secret,omitempty"`
+	WebhookQueueSize int    `yaml:"webhook_queue_size,omitempty"`
+
+	// TrustedProxies lists reverse proxies (CIDRs or addresses) whose
+	// X-Forwarded-For header is believed when determining client IPs.
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"`
+
+	// DefaultStatusFilter limits /api/containers to guests with these
+	// statuses (comma-separated, e.g. "running") unless the request
+	// passes its own ?status=, where "all" shows everything. Nodes are
+	// always listed.
+	DefaultStatusFilter string `yaml:"default_status_filter,omitempty"`
+
+	// NodeAddressPreference lists networks (CIDRs) in order of preference
+	// for reaching nodes over ssh, such as a WireGuard overlay ahead of
+	// the management network. Each node's addresses come from
+	// /cluster/status and its corosync links; the first one in the first
+	// matching network wins, otherwise the /cluster/status address.
+	NodeAddressPreference []string `yaml:"node_address_preference,omitempty"`
+
+	// AllowedOrigins, if set, restricts which pages may open terminal
+	// WebSockets: the request's Origin must be the server's own or match
+	// an entry (see OriginPattern), otherwise the upgrade is refused.
+	// AllowMissingOrigin decides whether a request with no Origin at all,
+	// as non-browser clients send, is let through. Unset allows any origin.
+	AllowedOrigins     []string `yaml:"allowed_origins,omitempty"`
+	AllowMissingOrigin bool     `yaml:"allow_missing_origin,omitempty"`
+
+	// MaxConnsPerIP caps the open terminal WebSockets from one client
+	// address (as determined with TrustedProxies). 0 means no limit.
+	MaxConnsPerIP int `yaml:"max_conns_per_ip,omitempty"`
+
+	// SessionCloseGrace is how long POST /api/sessions/{id}/close waits
+	// for the shell to exit before sending SIGTERM. Defaults to 5s.
+	SessionCloseGrace time.Duration `yaml:"session_close_grace,omitempty"`
+
+	// ScrollbackDir, if set, records each session's output to a file there,
+	// capped at ScrollbackMaxBytes (default 1 MiB).
+	ScrollbackDir      string `yaml:"scrollback_dir,omitempty"`
+	ScrollbackMaxBytes int64  `yaml:"scrollback_max_bytes,omitempty"`
+
+	// DeadSessionLinger keeps an exited session's recorded output for this
+	// long, showing it with a "session ended" notice to the next client
+	// that connects instead of starting a new shell. Needs ScrollbackDir.
+	DeadSessionLinger time.Duration `yaml:"dead_session_linger,omitempty"`
+
+	// File transfer via /api/files. FileReadPaths and FileWritePaths, if
+	// set, restrict downloads and uploads to those directories. Transfers
+	// are capped at FileTransferMaxBytes (default 100 MiB).
+	FileReadPaths        []string `yaml:"file_read_paths,omitempty"`
+	FileWritePaths       []string `yaml:"file_write_paths,omitempty"`
+	FileTransferMaxBytes int64    `yaml:"file_transfer_max_bytes,omitempty"`
+
+	// ProductName is shown as the web UI's title. Defaults to
+	// "termbrowser".
+	ProductName string `yaml:"product_name,omitempty"`
+
+	// MOTD is shown when a new terminal session opens, e.g. a usage
+	// policy banner. ANSI escapes are passed through.
+	MOTD string `yaml:"motd,omitempty"`
+
+	// TerminalEvents sends bells and window-title changes to the browser
+	// as JSON control messages as well as in the terminal output.
+	TerminalEvents bool `yaml:"terminal_events,omitempty"`
+
+	// ExecTimeout (default 30s) and ExecMaxOutputBytes (default 1 MiB, per
+	// stream) bound commands run through /api/exec.
+	ExecTimeout        time.Duration `yaml:"exec_timeout,omitempty"`
+	ExecMaxOutputBytes int64         `yaml:"exec_max_output_bytes,omitempty"`
+}
+
+// jumpHopRe matches one ssh -J hop: [user@]host[:port], with IPv6
+// addresses in brackets. Not starting with '-' keeps it from being read
+// as an ssh option.
+var jumpHopRe = regexp.MustCompile(`^([A-Za-z0-9._][A-Za-z0-9._-]*@)?([A-Za-z0-9.][A-Za-z0-9.-]*|\[[0-9A-Fa-f:.]+\])(:[0-9]{1,5})?$`)
+
+// statusFilterRe matches default_status_filter values: statuses such as
+// running or stopped, comma-separated.
+var statusFilterRe = regexp.MustCompile(`^[a-z]+(,[a-z]+)*$`)
+
+// localeRe matches locale names such as C.UTF-8, en_US.UTF-8 or
+// de_DE@euro.
+var localeRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.@-]*$`)
+
+var (
+	sshHostNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	sshHostTypeRe = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+	sshUserRe     = regexp.MustCompile(`^[A-Za-z0-9._][A-Za-z0-9._-]*$`)
+	sshAddrRe     = regexp.MustCompile(`^([A-Za-z0-9.][A-Za-z0-9.-]*|[0-9A-Fa-f:.]*:[0-9A-Fa-f:.]*)$`)
+)
+
+// validSSHHosts checks ssh_hosts entries. Types may not reuse the names of
+// cluster resource types, which the UI groups separately.
+func validSSHHosts(hosts []SSHHost) error {
+	seen := make(map[string]bool)
+	for i, h := range hosts {
+		switch {
+		case !sshHostNameRe.MatchString(h.Name):
+			return fmt.Errorf("ssh_hosts[%d]: name %q must be letters, digits, '.', '-' or '_'", i, h.Name)
+		case seen[h.Name]:
+			return fmt.Errorf("ssh_hosts[%d]: duplicate name %q", i, h.Name)
+		case !sshHostTypeRe.MatchString(h.Type):
+			return fmt.Errorf("ssh_hosts[%d]: type %q must be a lowercase word such as pbs", i, h.Type)
+		case h.Type == "node" || h.Type == "lxc" || h.Type == "qemu":
+			return fmt.Errorf("ssh_hosts[%d]: type %q is reserved for cluster resources", i, h.Type)
+		case !sshAddrRe.MatchString(h.Address):
+			return fmt.Errorf("ssh_hosts[%d]: address %q is not a host name or IP address", i, h.Address)
+		case h.User != "" && !sshUserRe.MatchString(h.User):
+			return fmt.Errorf("ssh_hosts[%d]: user %q is not a valid user name", i, h.User)
+		}
+		seen[h.Name] = true
+	}
+	return nil
+}
+
+// validIdentityFile checks that an ssh private key file exists and, as ssh
+// itself insists, isn't accessible to other users. Empty is allowed.
+func validIdentityFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("%s has mode %04o; ssh ignores keys readable by others (chmod 600)", path, perm)
+	}
+	return nil
+}
+
+// validJumpHost checks a ProxyJump value; empty means none.
+func validJumpHost(jump string) error {
+	if jump == "" {
+		return nil
+	}
+	for _, hop := range strings.Split(jump, ",") {
+		if !jumpHopRe.MatchString(hop) {
+			return fmt.Errorf("%q is not [user@]host[:port]", hop)
+		}
+	}
+	return nil
+}
+
+// TmuxLayout is one entry of tmux_layouts.
+type TmuxLayout struct {
+	Match    string     `yaml:"match"`
+	Commands [][]string `yaml:"commands"`
+}
+
+// APIToken is one entry of api_tokens.
+type APIToken struct {
+	Name   string `yaml:"name"`
+	SHA256 string `yaml:"sha256"`
+	Scope  string `yaml:"scope"`
+}
+
+// SSHHost is one entry of ssh_hosts. User defaults to root.
+type SSHHost struct {
+	Name    string `yaml:"name"`
+	Type    string `yaml:"type"`
+	Address string `yaml:"address"`
+	User    string `yaml:"user,omitempty"`
+}
+
+// TargetEnv is one entry of target_env.
+type TargetEnv struct {
+	Match string            `yaml:"match"`
+	Env   map[string]string `yaml:"env"`
 }
 
 func DefaultPath() string {
@@ -29,19 +495,337 @@ func DefaultPath() string {
 	return filepath.Join(filepath.Dir(exe), "config.yaml")
 }
 
+// Load reads the config file at path: a single config, or the default
+// profile of a file with profiles.
 func Load(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
+	return LoadProfile(path, "")
+}
+
+// OverridePort sets the listen port from the -port flag or the TB_PORT
+// environment variable, in that order of precedence, over the one in the
+// config file (or its default). Zero and "" mean not given.
+func (c *Config) OverridePort(flagPort int, envPort string) error {
+	switch {
+	case flagPort != 0:
+		if flagPort < 1 || flagPort > 65535 {
+			return fmt.Errorf("-port must be between 1 and 65535")
+		}
+		c.Port = flagPort
+	case envPort != "":
+		port, err := strconv.Atoi(envPort)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("TB_PORT=%q is not a port number between 1 and 65535", envPort)
+		}
+		c.Port = port
+	}
+	return nil
+}
+
+// applyDefaults fills in unset optional fields and rejects invalid values.
+// Defaults are applied after loading rather than saved, so config files
+// written by setup stay minimal.
+func (c *Config) applyDefaults() error {
+	if c.Port == 0 {
+		c.Port = 8765
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535")
+	}
+	if c.AdminListenAddr != "" {
+		if _, port, err := net.SplitHostPort(c.AdminListenAddr); err != nil || port == "" {
+			return fmt.Errorf("admin_listen_addr %q must be host:port", c.AdminListenAddr)
+		}
+	}
+	if c.TOTPSkew == nil {
+		skew := uint(1)
+		c.TOTPSkew = &skew
+	}
+	if c.TOTPDigits == 0 {
+		c.TOTPDigits = 6
+	}
+	if c.TOTPDigits != 6 && c.TOTPDigits != 8 {
+		return fmt.Errorf("totp_digits must be 6 or 8, got %d", c.TOTPDigits)
+	}
+	if c.TOTPPeriod == 0 {
+		c.TOTPPeriod = 30
+	}
+	if c.TOTPIssuer == "" {
+		c.TOTPIssuer = "termbrowser"
+	}
+	if c.TOTPAccount == "" {
+		c.TOTPAccount = "admin"
+	}
+	if c.TOTPSecretPrevious != "" {
+		if _, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(strings.TrimRight(c.TOTPSecretPrevious, "="))); err != nil {
+			return fmt.Errorf("totp_secret_previous is not a base32 secret")
+		}
+		if strings.EqualFold(c.TOTPSecretPrevious, c.TOTPSecret) {
+			return fmt.Errorf("totp_secret_previous is the same as totp_secret")
+		}
+	}
+	switch c.ResizePolicy {
+	case "":
+		c.ResizePolicy = "latest"
+	case "smallest", "controller", "latest":
+	default:
+		return fmt.Errorf("resize_policy must be smallest, controller or latest, got %q", c.ResizePolicy)
+	}
+	if c.MaxSessionsPerNode < 0 {
+		return fmt.Errorf("max_sessions_per_node cannot be negative")
+	}
+	switch c.OnDuplicateConnect {
+	case "":
+		c.OnDuplicateConnect = "takeover"
+	case "takeover", "reject", "share":
+	default:
+		return fmt.Errorf("on_duplicate_connect must be takeover, reject or share, got %q", c.OnDuplicateConnect)
+	}
+	if c.PveshRetries != nil && *c.PveshRetries < 0 {
+		return fmt.Errorf("pvesh_retries cannot be negative")
+	}
+	if c.WSWriteRetries != nil && *c.WSWriteRetries < 0 {
+		return fmt.Errorf("ws_write_retries cannot be negative")
+	}
+	if c.ScrollbackMaxBytes == 0 {
+		c.ScrollbackMaxBytes = 1 << 20
+	}
+	if c.ScrollbackMaxBytes < 4096 {
+		return fmt.Errorf("scrollback_max_bytes must be at least 4096")
+	}
+	if c.FileTransferMaxBytes == 0 {
+		c.FileTransferMaxBytes = 100 << 20
+	}
+	for _, p := range append(c.FileReadPaths, c.FileWritePaths...) {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("file_read_paths/file_write_paths: %q is not absolute", p)
+		}
+	}
+	if c.ProductName == "" {
+		c.ProductName = "termbrowser"
+	}
+	if c.SessionCloseGrace == 0 {
+		c.SessionCloseGrace = 5 * time.Second
+	}
+	if c.ExecTimeout == 0 {
+		c.ExecTimeout = 30 * time.Second
+	}
+	if c.ExecMaxOutputBytes == 0 {
+		c.ExecMaxOutputBytes = 1 << 20
+	}
+	if c.StaticMaxAge == 0 {
+		c.StaticMaxAge = time.Hour
+	}
+	if c.CookieName == "" {
+		c.CookieName = "tb_session"
+	}
+	if strings.ContainsAny(c.CookieName, " \t\"(),/:;<=>?@[\\]{}") {
+		return fmt.Errorf("cookie_name %q contains characters not allowed in a cookie name", c.CookieName)
 	}
-	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("parsing config: %w", err)
+	switch strings.ToLower(c.CookieSecure) {
+	case "":
+		c.CookieSecure = "auto"
+	case "auto", "true", "false":
+		c.CookieSecure = strings.ToLower(c.CookieSecure)
+	default:
+		return fmt.Errorf("cookie_secure must be auto, true or false, got %q", c.CookieSecure)
 	}
-	if cfg.Port == 0 {
-		cfg.Port = 8765
+	switch strings.ToLower(c.CookieSameSite) {
+	case "":
+		c.CookieSameSite = "strict"
+	case "strict", "lax":
+	case "none":
+		if c.CookieSecure == "false" {
+			return fmt.Errorf("cookie_samesite none needs a Secure cookie, so cookie_secure can't be false (and HTTPS must be in front of termbrowser)")
+		}
+		c.CookieSecure = "true"
+		if len(c.AllowedOrigins) == 0 {
+			return fmt.Errorf("cookie_samesite none sends the session cookie from any site, so allowed_origins must list the pages that may open terminals")
+		}
+	default:
+		return fmt.Errorf("cookie_samesite must be strict, lax or none, got %q", c.CookieSameSite)
 	}
-	return &cfg, nil
+	c.CookieSameSite = strings.ToLower(c.CookieSameSite)
+	if c.ReadHeaderTimeout == 0 {
+		c.ReadHeaderTimeout = 10 * time.Second
+	}
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = 30 * time.Second
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = 60 * time.Second
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = 120 * time.Second
+	}
+	if c.AutoStartTimeout == 0 {
+		c.AutoStartTimeout = 60 * time.Second
+	}
+	switch c.LXCMode {
+	case "":
+		c.LXCMode = "exec"
+	case "exec", "enter":
+	default:
+		return fmt.Errorf("lxc_mode must be exec or enter, got %q", c.LXCMode)
+	}
+	switch c.LegacyIDs {
+	case "":
+		c.LegacyIDs = "local"
+	case "local", "resolve", "off":
+	default:
+		return fmt.Errorf("legacy_ids must be local, resolve or off, got %q", c.LegacyIDs)
+	}
+	if c.SSHConnectTimeout == 0 {
+		c.SSHConnectTimeout = 10 * time.Second
+	}
+	if err := validJumpHost(c.SSHJumpHost); err != nil {
+		return fmt.Errorf("ssh_jump_host: %w", err)
+	}
+	for node, jump := range c.SSHJumpHosts {
+		if err := validJumpHost(jump); err != nil {
+			return fmt.Errorf("ssh_jump_hosts[%s]: %w", node, err)
+		}
+	}
+	if err := validIdentityFile(c.SSHIdentityFile); err != nil {
+		return fmt.Errorf("ssh_identity_file: %w", err)
+	}
+	for node, file := range c.SSHIdentityFiles {
+		if err := validIdentityFile(file); err != nil {
+			return fmt.Errorf("ssh_identity_files[%s]: %w", node, err)
+		}
+	}
+	names := make(map[string]bool)
+	for i, t := range c.APITokens {
+		if t.Name == "" || names[t.Name] {
+			return fmt.Errorf("api_tokens[%d]: name must be set and unique", i)
+		}
+		names[t.Name] = true
+		if b, err := hex.DecodeString(t.SHA256); err != nil || len(b) != 32 {
+			return fmt.Errorf("api_tokens[%d]: sha256 must be 64 hex digits", i)
+		}
+		if _, err := auth.ParseScope(t.Scope); err != nil {
+			return fmt.Errorf("api_tokens[%d]: %w", i, err)
+		}
+	}
+	if err := validSSHHosts(c.SSHHosts); err != nil {
+		return err
+	}
+	for i, l := range c.TmuxLayouts {
+		if l.Match == "" {
+			return fmt.Errorf("tmux_layouts[%d]: match is required", i)
+		}
+		if err := terminal.CheckTmuxLayout(terminal.TmuxLayout(l)); err != nil {
+			return fmt.Errorf("tmux_layouts[%d]: %w", i, err)
+		}
+	}
+	if c.Locale != "" && !localeRe.MatchString(c.Locale) {
+		return fmt.Errorf("locale %q is not a locale name like en_US.UTF-8", c.Locale)
+	}
+	for name := range c.Env {
+		if err := terminal.CheckEnvName(name); err != nil {
+			return fmt.Errorf("env: %w", err)
+		}
+	}
+	for _, p := range c.InheritEnv {
+		if err := terminal.CheckInheritEnv(p); err != nil {
+			return fmt.Errorf("inherit_env: %w", err)
+		}
+	}
+	for i, t := range c.TargetEnv {
+		if t.Match == "" {
+			return fmt.Errorf("target_env[%d]: match is required", i)
+		}
+		for name := range t.Env {
+			if err := terminal.CheckEnvName(name); err != nil {
+				return fmt.Errorf("target_env[%d]: %w", i, err)
+			}
+		}
+	}
+	if c.RunAsGroup != "" && c.RunAsUser == "" {
+		return fmt.Errorf("run_as_group requires run_as_user")
+	}
+	if c.LogMaxSize < 0 || c.LogMaxBackups < 0 || c.LogMaxAge < 0 {
+		return fmt.Errorf("log_max_size, log_max_backups and log_max_age cannot be negative")
+	}
+	if c.WebhookURL != "" {
+		if u, err := url.Parse(c.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook_url must be an http or https URL")
+		}
+	}
+	if c.WebhookQueueSize < 0 {
+		return fmt.Errorf("webhook_queue_size cannot be negative")
+	}
+	if c.WebhookQueueSize == 0 {
+		c.WebhookQueueSize = 1000
+	}
+	if len(c.SessionWrapper) > 0 {
+		if err := terminal.CheckSessionWrapper(c.SessionWrapper); err != nil {
+			return err
+		}
+	}
+	if c.ClientIdleTimeout < 0 {
+		return fmt.Errorf("client_idle_timeout cannot be negative")
+	}
+	if c.SessionMaxLifetime < 0 {
+		return fmt.Errorf("session_max_lifetime cannot be negative")
+	}
+	if c.DeadSessionLinger < 0 {
+		return fmt.Errorf("dead_session_linger cannot be negative")
+	}
+	if c.DeadSessionLinger > 0 && c.ScrollbackDir == "" {
+		return fmt.Errorf("dead_session_linger needs scrollback_dir to be set")
+	}
+	if c.MaxConnsPerIP < 0 {
+		return fmt.Errorf("max_conns_per_ip cannot be negative")
+	}
+	for _, p := range c.TrustedProxies {
+		if _, err := netip.ParsePrefix(p); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(p); err != nil {
+			return fmt.Errorf("trusted_proxies: %q is not a CIDR or IP address", p)
+		}
+	}
+	if c.DefaultStatusFilter != "" && !statusFilterRe.MatchString(c.DefaultStatusFilter) {
+		return fmt.Errorf("default_status_filter must be \"all\" or comma-separated statuses such as \"running\"")
+	}
+	for _, p := range c.NodeAddressPreference {
+		if _, err := netip.ParsePrefix(p); err != nil {
+			return fmt.Errorf("node_address_preference: %q is not a CIDR", p)
+		}
+	}
+	for _, o := range c.AllowedOrigins {
+		if _, err := OriginPattern(o); err != nil {
+			return err
+		}
+	}
+	if c.AllowMissingOrigin && len(c.AllowedOrigins) == 0 {
+		return fmt.Errorf("allow_missing_origin only applies with allowed_origins set")
+	}
+	if c.OutputFlushInterval < 0 || c.OutputFlushInterval > time.Second {
+		return fmt.Errorf("output_flush_interval must be between 0 and 1s")
+	}
+	if (c.DefaultCols == 0) != (c.DefaultRows == 0) {
+		return fmt.Errorf("default_cols and default_rows must be set together")
+	}
+	if maxCols := cmp.Or(c.MaxCols, 1000); c.DefaultCols > maxCols {
+		return fmt.Errorf("default_cols %d is larger than max_cols %d", c.DefaultCols, maxCols)
+	}
+	if maxRows := cmp.Or(c.MaxRows, 1000); c.DefaultRows > maxRows {
+		return fmt.Errorf("default_rows %d is larger than max_rows %d", c.DefaultRows, maxRows)
+	}
+	if c.MaxMessageBytes < 0 {
+		return fmt.Errorf("max_message_bytes cannot be negative")
+	}
+	if c.InputRateLimit != nil && *c.InputRateLimit < 0 {
+		return fmt.Errorf("input_rate_limit cannot be negative")
+	}
+	if c.OutputRateLimit != nil && *c.OutputRateLimit < 0 {
+		return fmt.Errorf("output_rate_limit cannot be negative")
+	}
+	if c.OutputBurst < 0 {
+		return fmt.Errorf("output_burst cannot be negative")
+	}
+	return nil
 }
 
 func Save(cfg *Config, path string) error {
@@ -56,38 +840,119 @@ func Save(cfg *Config, path string) error {
 	return os.Rename(tmp, path)
 }
 
-func RunFirstSetup(path string) (*Config, error) {
-	fmt.Println("=== termbrowser first-run setup ===")
-
-	fmt.Print("Enter password: ")
-	pw1, err := term.ReadPassword(int(syscall.Stdin))
-	fmt.Println()
+// SetTOTPSecret replaces totp_secret in the config file at path, in the
+// given profile if it has profiles, leaving the rest of the file, comments
+// included, as it is. Unlike Save it doesn't write out defaults or
+// command-line overrides.
+func SetTOTPSecret(path, profile, secret string) error {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("reading password: %w", err)
+		return err
 	}
-
-	fmt.Print("Confirm password: ")
-	pw2, err := term.ReadPassword(int(syscall.Stdin))
-	fmt.Println()
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	root, _, err := selectProfile(&doc, profile)
 	if err != nil {
-		return nil, fmt.Errorf("reading password: %w", err)
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if root == nil {
+		return fmt.Errorf("%s is empty", path)
+	}
+	found := false
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "totp_secret" {
+			root.Content[i+1].SetString(secret)
+			found = true
+		}
 	}
+	if !found {
+		var key, value yaml.Node
+		key.SetString("totp_secret")
+		value.SetString(secret)
+		root.Content = append(root.Content, &key, &value)
+	}
+	if data, err = yaml.Marshal(&doc); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
 
-	if string(pw1) != string(pw2) {
-		return nil, fmt.Errorf("passwords do not match")
+// CheckPermissions returns an error if the config file at path can be
+// read or written by anyone but its owner. Like ssh with private keys, a
+// config holding the password hash and secrets shouldn't be.
+func CheckPermissions(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
 	}
-	if len(pw1) == 0 {
-		return nil, fmt.Errorf("password cannot be empty")
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("%s has permissions %#o, which allow access by other users; it should be 0600", path, perm)
 	}
+	return nil
+}
+
+// SetupOptions controls how RunFirstSetup presents its results.
+type SetupOptions struct {
+	// NoQR suppresses the terminal QR code for the TOTP URI, e.g. when
+	// setup output is captured to a log instead of shown to a person.
+	NoQR bool
+
+	// NonInteractive skips the password prompts and uses Password instead,
+	// for provisioning tools that can't drive a terminal.
+	NonInteractive bool
+	Password       string
+
+	// Force allows a non-interactive setup to overwrite an existing config.
+	Force bool
+
+	// Issuer and Account label the TOTP entry in authenticator apps, so
+	// several instances can be told apart. Unset, they come from
+	// totp_issuer and totp_account in the config being replaced, or else
+	// default to "termbrowser" and "admin". The new config keeps them.
+	Issuer  string
+	Account string
+
+	// Pepper is mixed into the password before hashing; see
+	// auth.PepperPassword. It is never written to the config.
+	Pepper string
+
+	// Output receives the secret, URI and QR code; nil means os.Stdout.
+	Output io.Writer
+}
 
-	hash, err := bcrypt.GenerateFromPassword(pw1, 12)
+func RunFirstSetup(path string, opts SetupOptions) (*Config, error) {
+	var pw []byte
+	if opts.NonInteractive {
+		if _, err := os.Stat(path); err == nil && !opts.Force {
+			return nil, fmt.Errorf("%s already exists (use -force to overwrite)", path)
+		}
+		if opts.Password == "" {
+			return nil, fmt.Errorf("password cannot be empty")
+		}
+		pw = []byte(opts.Password)
+	} else {
+		var err error
+		if pw, err = promptPassword(); err != nil {
+			return nil, err
+		}
+	}
+
+	hash, err := bcrypt.GenerateFromPassword(auth.PepperPassword(string(pw), opts.Pepper), 12)
 	if err != nil {
 		return nil, fmt.Errorf("hashing password: %w", err)
 	}
 
+	issuer, account := savedTOTPLabels(path)
+	issuer, account = cmp.Or(opts.Issuer, issuer), cmp.Or(opts.Account, account)
 	key, err := totp.Generate(totp.GenerateOpts{
-		Issuer:      "termbrowser",
-		AccountName: "admin",
+		Issuer:      cmp.Or(issuer, "termbrowser"),
+		AccountName: cmp.Or(account, "admin"),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("generating TOTP: %w", err)
@@ -98,9 +963,13 @@ func RunFirstSetup(path string) (*Config, error) {
 		return nil, fmt.Errorf("generating JWT secret: %w", err)
 	}
 
+	// Labels that were chosen are kept; the defaults aren't written out,
+	// like every other default.
 	cfg := &Config{
 		PasswordHash: string(hash),
 		TOTPSecret:   key.Secret(),
+		TOTPIssuer:   issuer,
+		TOTPAccount:  account,
 		Port:         8765,
 		JWTSecret:    hex.EncodeToString(jwtBuf),
 	}
@@ -108,11 +977,69 @@ func RunFirstSetup(path string) (*Config, error) {
 	if err := Save(cfg, path); err != nil {
 		return nil, fmt.Errorf("saving config: %w", err)
 	}
+	if err := cfg.applyDefaults(); err != nil {
+		return nil, err
+	}
 
-	fmt.Printf("\nTOTP Secret: %s\n", key.Secret())
-	fmt.Printf("TOTP URI:    %s\n", key.URL())
-	fmt.Println("\nScan the URI with your authenticator app (e.g. Google Authenticator, Authy).")
-	fmt.Printf("Config saved to: %s\n\n", path)
+	out := opts.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	fmt.Fprintf(out, "\nTOTP Secret: %s\n", key.Secret())
+	fmt.Fprintf(out, "TOTP URI:    %s\n", key.URL())
+	if opts.NoQR {
+		fmt.Fprintln(out, "\nScan the URI with your authenticator app (e.g. Google Authenticator, Authy).")
+	} else {
+		fmt.Fprintln(out, "\nScan this code with your authenticator app (e.g. Google Authenticator, Authy):")
+		fmt.Fprintln(out)
+		if err := writeQR(out, key.URL()); err != nil {
+			fmt.Fprintf(out, "(could not render QR code: %v)\n", err)
+		}
+	}
+	fmt.Fprintf(out, "Config saved to: %s\n\n", path)
 
 	return cfg, nil
 }
+
+// savedTOTPLabels returns totp_issuer and totp_account from the config at
+// path that setup is about to replace, so an instance keeps its labels.
+// They are empty if there is no such config or it can't be read.
+func savedTOTPLabels(path string) (issuer, account string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", ""
+	}
+	var c Config
+	if yaml.Unmarshal(data, &c) != nil {
+		return "", ""
+	}
+	return c.TOTPIssuer, c.TOTPAccount
+}
+
+// promptPassword runs the interactive part of setup: it reads the password
+// twice without echo and checks that both entries match.
+func promptPassword() ([]byte, error) {
+	fmt.Println("=== termbrowser first-run setup ===")
+
+	fmt.Print("Enter password: ")
+	pw1, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	if err != nil {
+		return nil, fmt.Errorf("reading password: %w", err)
+	}
+
+	fmt.Print("Confirm password: ")
+	pw2, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	if err != nil {
+		return nil, fmt.Errorf("reading password: %w", err)
+	}
+
+	if string(pw1) != string(pw2) {
+		return nil, fmt.Errorf("passwords do not match")
+	}
+	if len(pw1) == 0 {
+		return nil, fmt.Errorf("password cannot be empty")
+	}
+	return pw1, nil
+}
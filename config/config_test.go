@@ -0,0 +1,564 @@
+package config
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chris/termbrowser/auth"
+	"github.com/pquerna/otp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestRunFirstSetupOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		noQR   bool
+		wantQR bool
+	}{
+		{"with QR code", false, true},
+		{"without QR code", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			cfg, err := RunFirstSetup(path, SetupOptions{
+				NonInteractive: true,
+				Password:       "hunter2",
+				NoQR:           tt.noQR,
+				Output:         &out,
+			})
+			if err != nil {
+				t.Fatalf("RunFirstSetup: %v", err)
+			}
+			uri := "otpauth://totp/termbrowser:admin?"
+			if !strings.Contains(out.String(), uri) {
+				t.Errorf("output has no %q:\n%s", uri, out.String())
+			}
+			if !strings.Contains(out.String(), "secret="+cfg.TOTPSecret) {
+				t.Errorf("URI doesn't carry the saved secret")
+			}
+			if got := strings.Contains(out.String(), "▀"); got != tt.wantQR {
+				t.Errorf("QR code in output = %v, want %v", got, tt.wantQR)
+			}
+		})
+	}
+}
+
+func TestRunFirstSetupNonInteractive(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+		force    bool
+		password string
+		wantErr  string
+	}{
+		{"new file", false, false, "hunter2", ""},
+		{"existing file", true, false, "hunter2", "already exists"},
+		{"existing file with force", true, true, "hunter2", ""},
+		{"empty password", false, false, "", "password cannot be empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			const old = "port: 1234\n"
+			if tt.existing {
+				if err := os.WriteFile(path, []byte(old), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg, err := RunFirstSetup(path, SetupOptions{
+				NonInteractive: true,
+				Password:       tt.password,
+				Force:          tt.force,
+				Output:         io.Discard,
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				if tt.existing {
+					if data, _ := os.ReadFile(path); string(data) != old {
+						t.Errorf("existing config was changed to %q", data)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RunFirstSetup: %v", err)
+			}
+
+			loaded, err := Load(path)
+			if err != nil {
+				t.Fatalf("loading the new config: %v", err)
+			}
+			if loaded.TOTPSecret != cfg.TOTPSecret || loaded.JWTSecret != cfg.JWTSecret {
+				t.Errorf("saved secrets don't match the returned config")
+			}
+			if err := bcrypt.CompareHashAndPassword([]byte(loaded.PasswordHash), []byte(tt.password)); err != nil {
+				t.Errorf("password hash doesn't match: %v", err)
+			}
+			if loaded.Port != 8765 {
+				t.Errorf("port = %d, want 8765", loaded.Port)
+			}
+		})
+	}
+}
+
+// loadYAML loads a config made of the required fields plus extra.
+func loadYAML(t *testing.T, extra string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	base := "password_hash: x\ntotp_secret: JBSWY3DPEHPK3PXP\njwt_secret: 00\n"
+	if err := os.WriteFile(path, []byte(base+extra), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path)
+}
+
+func TestLegacyIDs(t *testing.T) {
+	tests := []struct {
+		yaml    string
+		want    string
+		wantErr bool
+	}{
+		{"", "local", false},
+		{"legacy_ids: local\n", "local", false},
+		{"legacy_ids: resolve\n", "resolve", false},
+		{"legacy_ids: off\n", "off", false},
+		{"legacy_ids: remote\n", "", true},
+	}
+	for _, tt := range tests {
+		cfg, err := loadYAML(t, tt.yaml)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err = %v, want error %v", tt.yaml, err, tt.wantErr)
+			continue
+		}
+		if err == nil && cfg.LegacyIDs != tt.want {
+			t.Errorf("%q: LegacyIDs = %q, want %q", tt.yaml, cfg.LegacyIDs, tt.want)
+		}
+	}
+}
+
+// TestInvalidValues checks that applyDefaults rejects out-of-range and
+// malformed settings, naming the offending key.
+func TestInvalidValues(t *testing.T) {
+	tests := []struct {
+		yaml    string
+		wantErr string
+	}{
+		{"max_conns_per_ip: -1\n", "max_conns_per_ip"},
+		{"totp_secret_previous: not-base32!\n", "totp_secret_previous is not a base32 secret"},
+		{"totp_secret_previous: jbswy3dpehpk3pxp\n", "totp_secret_previous is the same as totp_secret"},
+		{"on_duplicate_connect: steal\n", "on_duplicate_connect"},
+		{"pvesh_retries: -1\n", "pvesh_retries"},
+		{"admin_listen_addr: \"9100\"\n", "admin_listen_addr"},
+		{"admin_listen_addr: \"127.0.0.1:\"\n", "admin_listen_addr"},
+		{"max_sessions_per_node: -1\n", "max_sessions_per_node"},
+		{"default_cols: 300\ndefault_rows: 50\nmax_cols: 200\n", "max_cols"},
+		{"default_cols: 80\ndefault_rows: 1200\n", "max_rows"},
+		{"default_cols: 120\n", "default_cols and default_rows must be set together"},
+		{"tmux_layouts:\n  - commands: [[split-window]]\n", "match is required"},
+		{"run_as_group: nogroup\n", "run_as_group requires run_as_user"},
+		{"max_message_bytes: -1\n", "max_message_bytes"},
+		{"output_rate_limit: -1\n", "output_rate_limit"},
+		{"output_burst: -1\n", "output_burst"},
+		{"webhook_url: ftp://audit.example.com/\n", "webhook_url"},
+		{"env:\n  TERM: vt100\n", "env: TERM"},
+		{"env:\n  BAD-NAME: x\n", "env:"},
+		{"target_env:\n  - env: {TZ: UTC}\n", "target_env[0]: match is required"},
+		{"ssh_hosts:\n  - {name: 'pbs;1', type: pbs, address: 192.0.2.5}\n", "ssh_hosts[0]: name"},
+		{"ssh_hosts:\n  - {name: pbs, type: pbs, address: 192.0.2.5}\n  - {name: pbs, type: pbs, address: 192.0.2.6}\n", "duplicate name"},
+		{"ssh_hosts:\n  - {name: pbs, type: lxc, address: 192.0.2.5}\n", "reserved"},
+		{"ssh_hosts:\n  - {name: pbs, type: PBS, address: 192.0.2.5}\n", "lowercase"},
+		{"ssh_hosts:\n  - {name: pbs, type: pbs, address: '-oProxyCommand=x'}\n", "address"},
+		{"ssh_hosts:\n  - {name: pbs, type: pbs, address: 192.0.2.5, user: '-l'}\n", "user"},
+		{"target_env:\n  - match: \"lxc/*\"\n    env: {TERM: dumb}\n", "target_env[0]"},
+		{"locale: \"en_US; rm -rf /\"\n", "locale"},
+		{"tmux_layouts:\n  - match: \"*\"\n    commands: [[run-shell, reboot]]\n", "tmux_layouts[0]"},
+		{"allowed_origins: [\"re:https://(tb\"]\n", "allowed_origins"},
+		{"allowed_origins: [portal.example.com]\n", "allowed_origins"},
+		{"allowed_origins: [\"https://portal.example.com/\"]\n", "allowed_origins"},
+		{"allow_missing_origin: true\n", "allow_missing_origin"},
+		{"port: 70000\n", "port must be"},
+		{"node_address_preference: [10.99.0.5]\n", "node_address_preference"},
+		{"default_status_filter: \"running, stopped\"\n", "default_status_filter"},
+		{"session_wrapper: [sudo, \"\"]\n", "session_wrapper"},
+		{"session_wrapper: [script, -c, \"{cmd}\"]\n", "session_wrapper"},
+	}
+	for _, tt := range tests {
+		_, err := loadYAML(t, tt.yaml)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%q: err = %v, want one mentioning %q", tt.yaml, err, tt.wantErr)
+		}
+	}
+}
+
+func TestOriginPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		origin  string
+		want    bool
+	}{
+		{"https://portal.example.com", "https://portal.example.com", true},
+		{"https://portal.example.com", "HTTPS://Portal.Example.com", true},
+		{"https://portal.example.com", "http://portal.example.com", false},
+		{"https://portal.example.com", "https://portal.example.com:8443", false},
+		{"https://*.mycompany.internal", "https://tb.mycompany.internal", true},
+		{"https://*.mycompany.internal", "https://a.b.mycompany.internal", true},
+		{"https://*.mycompany.internal", "https://mycompany.internal", false},
+		{"https://*.mycompany.internal", "https://evil.test/.mycompany.internal", false},
+		{"https://*.mycompany.internal", "https://tb.mycompany.internal.evil.test", false},
+		{"https://*.example.com:*", "https://tb.example.com:8443", true},
+		{`re:https://tb[0-9]+\.example\.com`, "https://tb12.example.com", true},
+		{`re:https://tb[0-9]+\.example\.com`, "https://tb12.example.com.evil.test", false},
+		{`re:https://tb[0-9]+\.example\.com`, "https://xtb1.example.com", false},
+	}
+	for _, tt := range tests {
+		re, err := OriginPattern(tt.pattern)
+		if err != nil {
+			t.Errorf("OriginPattern(%q): %v", tt.pattern, err)
+			continue
+		}
+		if got := re.MatchString(tt.origin); got != tt.want {
+			t.Errorf("OriginPattern(%q) matches %q = %v, want %v", tt.pattern, tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestOverridePort(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		flagPort int
+		envPort  string
+		want     int
+		wantErr  string
+	}{
+		{"default", "", 0, "", 8765, ""},
+		{"config", "port: 9000\n", 0, "", 9000, ""},
+		{"env over config", "port: 9000\n", 0, "9100", 9100, ""},
+		{"env over default", "", 0, "9100", 9100, ""},
+		{"flag over env and config", "port: 9000\n", 9200, "9100", 9200, ""},
+		{"flag over bad env", "", 9200, "http", 9200, ""},
+		{"bad env", "", 0, "http", 0, "TB_PORT"},
+		{"env out of range", "", 0, "65536", 0, "TB_PORT"},
+		{"env zero", "", 0, "0", 0, "TB_PORT"},
+		{"flag out of range", "", -1, "", 0, "-port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadYAML(t, tt.yaml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = cfg.OverridePort(tt.flagPort, tt.envPort)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("OverridePort = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Port != tt.want {
+				t.Errorf("port = %d, want %d", cfg.Port, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPermissions(t *testing.T) {
+	tests := []struct {
+		mode    os.FileMode
+		wantErr bool
+	}{
+		{0600, false},
+		{0400, false},
+		{0700, false},
+		{0644, true},
+		{0640, true},
+		{0604, true},
+		{0660, true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte("port: 8765\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, tt.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := CheckPermissions(path); (err != nil) != tt.wantErr {
+			t.Errorf("mode %#o: err = %v, want error %v", tt.mode, err, tt.wantErr)
+		}
+	}
+
+	err := CheckPermissions(filepath.Join(t.TempDir(), "missing.yaml"))
+	if !os.IsNotExist(err) {
+		t.Errorf("missing file: err = %v, want a not-exist error", err)
+	}
+}
+
+// Setup and login must agree on how the pepper is applied.
+func TestRunFirstSetupPepper(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	cfg, err := RunFirstSetup(path, SetupOptions{
+		NonInteractive: true,
+		Password:       "hunter2",
+		Pepper:         "s3cret",
+		NoQR:           true,
+		Output:         io.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := []byte(cfg.PasswordHash)
+	if err := bcrypt.CompareHashAndPassword(hash, auth.PepperPassword("hunter2", "s3cret")); err != nil {
+		t.Errorf("hash doesn't match the peppered password: %v", err)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte("hunter2")); err == nil {
+		t.Error("hash matches the password without its pepper")
+	}
+	if data, _ := os.ReadFile(path); strings.Contains(string(data), "s3cret") {
+		t.Error("pepper was written to the config file")
+	}
+}
+
+func TestRunFirstSetupIssuer(t *testing.T) {
+	saved := "password_hash: x\ntotp_secret: JBSWY3DPEHPK3PXP\ntotp_issuer: pve-prod\ntotp_account: ops\n"
+	tests := []struct {
+		name, issuer, account string
+		existing              string // config being replaced, if any
+		wantIssuer, wantAcct  string
+	}{
+		{"defaults", "", "", "", "termbrowser", "admin"},
+		{"custom", "pve-lab", "chris", "", "pve-lab", "chris"},
+		{"with spaces", "Home Lab", "ops team", "", "Home Lab", "ops team"},
+		{"from the config", "", "", saved, "pve-prod", "ops"},
+		{"flag overrides the config", "pve-lab", "", saved, "pve-lab", "ops"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if tt.existing != "" {
+				if err := os.WriteFile(path, []byte(tt.existing), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var out bytes.Buffer
+			cfg, err := RunFirstSetup(path, SetupOptions{
+				NonInteractive: true,
+				Force:          true,
+				Password:       "hunter2",
+				NoQR:           true,
+				Issuer:         tt.issuer,
+				Account:        tt.account,
+				Output:         &out,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, uri, ok := strings.Cut(out.String(), "TOTP URI:")
+			if !ok {
+				t.Fatalf("no URI in output:\n%s", out.String())
+			}
+			uri, _, _ = strings.Cut(strings.TrimSpace(uri), "\n")
+			key, err := otp.NewKeyFromURL(uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.Issuer() != tt.wantIssuer || key.AccountName() != tt.wantAcct {
+				t.Errorf("issuer %q, account %q; want %q, %q", key.Issuer(), key.AccountName(), tt.wantIssuer, tt.wantAcct)
+			}
+			if key.Secret() != cfg.TOTPSecret {
+				t.Error("URI secret doesn't match the saved one")
+			}
+			// The labels are saved for later setups and rotations.
+			loaded, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loaded.TOTPIssuer != tt.wantIssuer || loaded.TOTPAccount != tt.wantAcct {
+				t.Errorf("saved totp_issuer %q, totp_account %q; want %q, %q", loaded.TOTPIssuer, loaded.TOTPAccount, tt.wantIssuer, tt.wantAcct)
+			}
+		})
+	}
+}
+
+func TestCookieSettings(t *testing.T) {
+	origins := "allowed_origins: [\"https://portal.example.com\"]\n"
+	tests := []struct {
+		name         string
+		yaml         string
+		wantName     string
+		wantSameSite string
+		wantSecure   string
+		wantErr      string
+	}{
+		{"defaults", "", "tb_session", "strict", "auto", ""},
+		{"custom name", "cookie_name: tb_lab\n", "tb_lab", "strict", "auto", ""},
+		{"bad name", "cookie_name: \"tb session\"\n", "", "", "", "cookie_name"},
+		{"lax", "cookie_samesite: lax\n", "tb_session", "lax", "auto", ""},
+		{"case-insensitive", "cookie_samesite: Strict\n", "tb_session", "strict", "auto", ""},
+		{"unknown policy", "cookie_samesite: loose\n", "", "", "", "cookie_samesite must be"},
+		{"secure true", "cookie_secure: true\n", "tb_session", "strict", "true", ""},
+		{"secure false", "cookie_secure: false\n", "tb_session", "strict", "false", ""},
+		{"secure auto", "cookie_secure: Auto\n", "tb_session", "strict", "auto", ""},
+		{"secure unknown", "cookie_secure: yes please\n", "", "", "", "cookie_secure must be auto, true or false"},
+		{"none with secure false", "cookie_samesite: none\ncookie_secure: false\n" + origins, "", "", "", "cookie_secure can't be false"},
+		{"none without origins", "cookie_samesite: none\ncookie_secure: true\n", "", "", "", "allowed_origins"},
+		{"none", "cookie_samesite: none\ncookie_secure: true\n" + origins, "tb_session", "none", "true", ""},
+		{"none, auto", "cookie_samesite: none\n" + origins, "tb_session", "none", "true", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadYAML(t, tt.yaml)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.CookieName != tt.wantName || cfg.CookieSameSite != tt.wantSameSite || cfg.CookieSecure != tt.wantSecure {
+				t.Errorf("cookie %q samesite %q secure %q, want %q %q %q",
+					cfg.CookieName, cfg.CookieSameSite, cfg.CookieSecure, tt.wantName, tt.wantSameSite, tt.wantSecure)
+			}
+		})
+	}
+}
+
+func TestValidJumpHost(t *testing.T) {
+	tests := []struct {
+		jump    string
+		wantErr bool
+	}{
+		{"", false},
+		{"bastion", false},
+		{"admin@bastion", false},
+		{"admin@bastion.example.com:2222", false},
+		{"10.0.0.1:22", false},
+		{"[2001:db8::1]:22", false},
+		{"a@hop1,hop2:2200", false},
+		{"bastion:", true},
+		{"bastion:port", true},
+		{"@bastion", true},
+		{"a@hop1,", true},
+		{"-oProxyCommand=sh", true},
+		{"bastion; rm -rf /", true},
+		{"ad min@bastion", true},
+	}
+	for _, tt := range tests {
+		if err := validJumpHost(tt.jump); (err != nil) != tt.wantErr {
+			t.Errorf("validJumpHost(%q) = %v, want error %v", tt.jump, err, tt.wantErr)
+		}
+	}
+
+	for _, yaml := range []string{"ssh_jump_host: \"-J x\"\n", "ssh_jump_hosts: {pve2: \"bad host\"}\n"} {
+		if _, err := loadYAML(t, yaml); err == nil || !strings.Contains(err.Error(), "ssh_jump_host") {
+			t.Errorf("%q: err = %v, want an ssh_jump_host error", yaml, err)
+		}
+	}
+}
+
+func TestValidIdentityFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, mode os.FileMode) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("key"), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, mode); err != nil { // past the umask
+			t.Fatal(err)
+		}
+		return path
+	}
+	private := write("id_ed25519", 0600)
+	readOnly := write("id_ro", 0400)
+	shared := write("id_shared", 0644)
+	groupReadable := write("id_group", 0640)
+	tests := []struct {
+		path    string
+		wantErr string
+	}{
+		{"", ""},
+		{private, ""},
+		{readOnly, ""},
+		{shared, "chmod 600"},
+		{groupReadable, "mode 0640"},
+		{dir, "not a regular file"},
+		{filepath.Join(dir, "missing"), "no such file"},
+	}
+	for _, tt := range tests {
+		err := validIdentityFile(tt.path)
+		if (tt.wantErr == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("validIdentityFile(%q) = %v, want %q", tt.path, err, tt.wantErr)
+		}
+	}
+
+	if _, err := loadYAML(t, "ssh_identity_file: "+private+"\nssh_identity_files: {pve2: \"\", pve3: "+readOnly+"}\n"); err != nil {
+		t.Errorf("valid keys rejected: %v", err)
+	}
+	for yaml, want := range map[string]string{
+		"ssh_identity_file: " + shared + "\n":          "ssh_identity_file:",
+		"ssh_identity_files: {pve2: " + shared + "}\n": "ssh_identity_files[pve2]",
+	} {
+		if _, err := loadYAML(t, yaml); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: err = %v, want one mentioning %q", yaml, err, want)
+		}
+	}
+}
+
+func TestSetTOTPSecret(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want string
+	}{
+		{"replaces the secret, keeping comments",
+			"# termbrowser\npassword_hash: x\ntotp_secret: JBSWY3DPEHPK3PXP # old phone\njwt_secret: \"00\"\n",
+			"# termbrowser\npassword_hash: x\ntotp_secret: NEWSECRET # old phone\njwt_secret: \"00\"\n"},
+		{"adds a missing secret",
+			"password_hash: x\njwt_secret: \"00\"\n",
+			"password_hash: x\njwt_secret: \"00\"\ntotp_secret: NEWSECRET\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.file), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := SetTOTPSecret(path, "", "NEWSECRET"); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("file is\n%s\nwant\n%s", data, tt.want)
+			}
+			if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+				t.Errorf("file mode %v, %v, want 0600", info.Mode().Perm(), err)
+			}
+		})
+	}
+}
+
+func TestSetTOTPSecretNotMapping(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("- a\n- b\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetTOTPSecret(path, "", "NEWSECRET"); err == nil {
+		t.Error("rewrote a config that isn't a mapping")
+	}
+}
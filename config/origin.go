@@ -0,0 +1,30 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// OriginPattern compiles an allowed_origins entry into a regular
+// expression matching whole Origin header values, case-insensitively. An
+// entry starting with "re:" is a regular expression (anchored for you);
+// otherwise it is a literal origin in which "*" stands for one or more
+// letters, digits, '-' or '.', as in "https://*.example.internal".
+func OriginPattern(p string) (*regexp.Regexp, error) {
+	if expr, ok := strings.CutPrefix(p, "re:"); ok {
+		re, err := regexp.Compile(`(?i)^(?:` + expr + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("allowed_origins: %q: %v", p, err)
+		}
+		return re, nil
+	}
+	if !strings.Contains(p, "://") || strings.HasSuffix(p, "/") {
+		return nil, fmt.Errorf(`allowed_origins: %q is not an origin like "https://host[:port]" (use "re:" for a regular expression)`, p)
+	}
+	parts := strings.Split(p, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	return regexp.MustCompile(`(?i)^` + strings.Join(parts, `[A-Za-z0-9.-]+`) + `$`), nil
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A config file may hold several complete configs, one per profile, such
+// as separate credentials and node settings for two clusters:
+//
+//	default_profile: prod
+//	profiles:
+//	  prod:
+//	    password_hash: ...
+//	  staging:
+//	    password_hash: ...
+//
+// A file without a profiles key is a single config, as before.
+
+// LoadProfile reads the config file at path. In a file with profiles it
+// uses the named one, or default_profile if name is empty, or the only
+// one if there is just one. Naming a profile for a single-config file is
+// an error rather than being ignored.
+func LoadProfile(path, name string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parsing config: %w", err)
+	}
+	node, name, err := selectProfile(&doc, name)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if node != nil {
+		if err := node.Decode(&cfg); err != nil {
+			return nil, fmt.Errorf("parsing config: %w", err)
+		}
+	}
+	cfg.Profile = name
+	if err := cfg.applyDefaults(); err != nil {
+		if name != "" {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// selectProfile returns the mapping node holding the config to use from a
+// parsed file and the profile's name, "" for a single-config file. The
+// node is nil for an empty file.
+func selectProfile(doc *yaml.Node, name string) (*yaml.Node, string, error) {
+	if len(doc.Content) == 0 {
+		if name != "" {
+			return nil, "", fmt.Errorf("profile %q given but the config is empty", name)
+		}
+		return nil, "", nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, "", fmt.Errorf("config is not a YAML mapping")
+	}
+	var profiles *yaml.Node
+	var defaultProfile string
+	var others []string
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		switch key, value := root.Content[i].Value, root.Content[i+1]; key {
+		case "profiles":
+			profiles = value
+		case "default_profile":
+			defaultProfile = value.Value
+		default:
+			others = append(others, key)
+		}
+	}
+	if profiles == nil {
+		if name != "" {
+			return nil, "", fmt.Errorf("profile %q given but the config has no profiles", name)
+		}
+		return root, "", nil
+	}
+	if len(others) > 0 {
+		return nil, "", fmt.Errorf("config has profiles, so %s must be set inside a profile", strings.Join(others, ", "))
+	}
+	if profiles.Kind != yaml.MappingNode {
+		return nil, "", fmt.Errorf("profiles must be a mapping of name to config")
+	}
+	byName := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(profiles.Content); i += 2 {
+		byName[profiles.Content[i].Value] = profiles.Content[i+1]
+	}
+	names := slices.Sorted(maps.Keys(byName))
+	if name == "" {
+		name = defaultProfile
+	}
+	if name == "" {
+		if len(names) != 1 {
+			return nil, "", fmt.Errorf("config has profiles %s; choose one with -profile, TB_PROFILE or default_profile", strings.Join(names, ", "))
+		}
+		name = names[0]
+	}
+	node, ok := byName[name]
+	if !ok {
+		return nil, "", fmt.Errorf("no profile %q in config (have %s)", name, strings.Join(names, ", "))
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil, "", fmt.Errorf("profile %s is not a YAML mapping", name)
+	}
+	return node, name, nil
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testProfiles = `default_profile: prod
+profiles:
+  prod:
+    password_hash: x
+    totp_secret: JBSWY3DPEHPK3PXP
+    jwt_secret: "00"
+  staging:
+    password_hash: y
+    totp_secret: JBSWY3DPEHPK3PXQ
+    jwt_secret: "01"
+    port: 8766
+`
+
+// writeConfig writes a config file and returns its path.
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadProfile(t *testing.T) {
+	single := "password_hash: x\ntotp_secret: JBSWY3DPEHPK3PXP\njwt_secret: \"00\"\nport: 9000\n"
+	noDefault := strings.TrimPrefix(testProfiles, "default_profile: prod\n")
+	tests := []struct {
+		name        string
+		file        string
+		profile     string
+		wantProfile string
+		wantPort    int
+		wantErr     string
+	}{
+		{"single config", single, "", "", 9000, ""},
+		{"default profile", testProfiles, "", "prod", 8765, ""},
+		{"named profile", testProfiles, "staging", "staging", 8766, ""},
+		{"only profile", "profiles:\n  lab: {password_hash: x, totp_secret: JBSWY3DPEHPK3PXP, jwt_secret: \"00\"}\n", "", "lab", 8765, ""},
+		{"missing profile", testProfiles, "dev", "", 0, `no profile "dev" in config (have prod, staging)`},
+		{"no default among several", noDefault, "", "", 0, "config has profiles prod, staging; choose one"},
+		{"missing default", strings.Replace(testProfiles, "default_profile: prod", "default_profile: dev", 1), "", "", 0, `no profile "dev"`},
+		{"profile for a single config", single, "prod", "", 0, `profile "prod" given but the config has no profiles`},
+		{"settings outside profiles", "port: 1\n" + testProfiles, "", "", 0, "port must be set inside a profile"},
+		{"profiles not a mapping", "profiles: [prod]\n", "", "", 0, "profiles must be a mapping"},
+		{"profile not a mapping", "profiles:\n  prod: yes\n", "", "", 0, "profile prod is not a YAML mapping"},
+		{"invalid profile names it", strings.Replace(testProfiles, "port: 8766", "port: 70000", 1), "staging", "", 0, "profile staging: port must be"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadProfile(writeConfig(t, tt.file), tt.profile)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Profile != tt.wantProfile || cfg.Port != tt.wantPort {
+				t.Errorf("profile %q, port %d; want %q, %d", cfg.Profile, cfg.Port, tt.wantProfile, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestSetTOTPSecretProfile(t *testing.T) {
+	path := writeConfig(t, testProfiles)
+	if err := SetTOTPSecret(path, "staging", "NEWSECRET"); err != nil {
+		t.Fatal(err)
+	}
+	staging, err := LoadProfile(path, "staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prod, err := LoadProfile(path, "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if staging.TOTPSecret != "NEWSECRET" || prod.TOTPSecret != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("secrets are staging %q, prod %q; only staging's should change", staging.TOTPSecret, prod.TOTPSecret)
+	}
+	if err := SetTOTPSecret(path, "dev", "NEWSECRET"); err == nil {
+		t.Error("saved to a missing profile")
+	}
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/boombuler/barcode/qr"
+)
+
+// qrQuietZone is the number of light modules drawn around the code. The
+// spec asks for 4; 2 is enough for phone cameras and keeps the output
+// narrow enough for an 80-column terminal.
+const qrQuietZone = 2
+
+// writeQR renders content as a QR code using ANSI colours and half-block
+// characters, so each text line covers two module rows. Colours are set
+// explicitly rather than relying on the terminal's theme, which keeps the
+// code scannable on both dark and light backgrounds.
+func writeQR(w io.Writer, content string) error {
+	code, err := qr.Encode(content, qr.M, qr.Auto)
+	if err != nil {
+		return fmt.Errorf("encoding QR code: %w", err)
+	}
+	size := code.Bounds().Dx()
+
+	dark := func(x, y int) bool {
+		x -= qrQuietZone
+		y -= qrQuietZone
+		if x < 0 || y < 0 || x >= size || y >= size {
+			return false
+		}
+		r, _, _, _ := code.At(x, y).RGBA()
+		return r < 0x8000
+	}
+
+	// Foreground paints the upper half of the cell, background the lower.
+	fg := map[bool]string{true: "30", false: "97"}
+	bg := map[bool]string{true: "40", false: "107"}
+
+	total := size + 2*qrQuietZone
+	var b strings.Builder
+	for y := 0; y < total; y += 2 {
+		for x := 0; x < total; x++ {
+			fmt.Fprintf(&b, "\x1b[%s;%sm▀", fg[dark(x, y)], bg[dark(x, y+1)])
+		}
+		b.WriteString("\x1b[0m\n")
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
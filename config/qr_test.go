@@ -0,0 +1,43 @@
+package config
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteQR(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"short", "hello"},
+		{"totp uri", "otpauth://totp/termbrowser:admin?secret=JBSWY3DPEHPK3PXP&issuer=termbrowser"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeQR(&buf, tt.content); err != nil {
+				t.Fatalf("writeQR: %v", err)
+			}
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			if len(lines) < 10 {
+				t.Fatalf("got %d lines, want a full code", len(lines))
+			}
+			// Every line is the same width and ends by resetting colours.
+			width := strings.Count(lines[0], "▀")
+			for i, l := range lines {
+				if n := strings.Count(l, "▀"); n != width {
+					t.Errorf("line %d has %d cells, want %d", i, n, width)
+				}
+				if !strings.HasSuffix(l, "\x1b[0m") {
+					t.Errorf("line %d doesn't reset colours", i)
+				}
+			}
+			// Two module rows per line, quiet zone included.
+			if want := (width + 1) / 2; len(lines) != want {
+				t.Errorf("got %d lines for width %d, want %d", len(lines), width, want)
+			}
+		})
+	}
+}
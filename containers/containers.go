@@ -1,9 +1,11 @@
 package containers
 
 import (
-	"encoding/json"
 	"fmt"
+	"net/netip"
 	"os/exec"
+	"slices"
+	"strings"
 )
 
 type Container struct {
@@ -13,15 +15,19 @@ type Container struct {
 	Type   string `json:"type,omitempty"`
 	VMID   string `json:"vmid,omitempty"` // numeric ID for display
 	Node   string `json:"node,omitempty"` // node the resource lives on
+
+	// HAState is the guest's state in the HA manager ("started",
+	// "fence", ...), empty if it isn't HA-managed.
+	HAState string `json:"ha_state,omitempty"`
 }
 
 // NodeAddresses queries /cluster/status and returns a map of node name to
 // IP address. This is used to resolve Proxmox node names (like "pve2") to
 // routable IPs for SSH connections.
 func NodeAddresses() (map[string]string, error) {
-	out, err := exec.Command("pvesh", "get", "/cluster/status", "--output-format", "json").Output()
+	out, err := pveshGet("/cluster/status")
 	if err != nil {
-		return nil, fmt.Errorf("pvesh get /cluster/status: %w", err)
+		return nil, err
 	}
 	var entries []struct {
 		Type   string `json:"type"`
@@ -29,7 +35,7 @@ func NodeAddresses() (map[string]string, error) {
 		IP     string `json:"ip"`
 		Online int    `json:"online"`
 	}
-	if err := json.Unmarshal(out, &entries); err != nil {
+	if err := unmarshalPvesh(out, &entries); err != nil {
 		return nil, fmt.Errorf("parsing cluster status: %w", err)
 	}
 	addrs := make(map[string]string)
@@ -41,14 +47,107 @@ func NodeAddresses() (map[string]string, error) {
 	return addrs, nil
 }
 
+// NodeAddressCandidates returns every address known for each node: the
+// one in /cluster/status first, then its corosync link addresses
+// (ring0_addr, ring1_addr, ...) from /cluster/config/nodes, where an
+// overlay network such as WireGuard often shows up. The link addresses
+// are best effort; if that query fails only the first are returned.
+func NodeAddressCandidates() (map[string][]string, error) {
+	primary, err := NodeAddresses()
+	if err != nil {
+		return nil, err
+	}
+	cands := make(map[string][]string, len(primary))
+	for name, ip := range primary {
+		cands[name] = []string{ip}
+	}
+	out, err := pveshGet("/cluster/config/nodes")
+	if err != nil {
+		return cands, nil
+	}
+	var nodes []map[string]any
+	if unmarshalPvesh(out, &nodes) != nil {
+		return cands, nil
+	}
+	for _, n := range nodes {
+		name, _ := n["node"].(string)
+		if name == "" {
+			continue
+		}
+		for i := 0; i < 8; i++ {
+			addr, _ := n[fmt.Sprintf("ring%d_addr", i)].(string)
+			if addr != "" && !slices.Contains(cands[name], addr) {
+				cands[name] = append(cands[name], addr)
+			}
+		}
+	}
+	return cands, nil
+}
+
+// PreferredAddress picks from addrs the first address inside the first
+// prefix in prefs that contains any of them, falling back through prefs in
+// order and finally to addrs[0]. Entries that aren't IP addresses only
+// match as the fallback.
+func PreferredAddress(addrs []string, prefs []netip.Prefix) string {
+	if len(addrs) == 0 {
+		return ""
+	}
+	for _, p := range prefs {
+		for _, a := range addrs {
+			if ip, err := netip.ParseAddr(a); err == nil && p.Contains(ip.Unmap()) {
+				return a
+			}
+		}
+	}
+	return addrs[0]
+}
+
+// ClusterStatus is the cluster-wide part of /cluster/status.
+type ClusterStatus struct {
+	Name      string // empty on a standalone node
+	Clustered bool
+	Quorate   bool // always true on a standalone node
+}
+
+// Cluster queries /cluster/status for the cluster's name and quorum.
+func Cluster() (ClusterStatus, error) {
+	out, err := pveshGet("/cluster/status")
+	if err != nil {
+		return ClusterStatus{}, err
+	}
+	var entries []struct {
+		Type    string `json:"type"`
+		Name    string `json:"name"`
+		Quorate int    `json:"quorate"`
+	}
+	if err := unmarshalPvesh(out, &entries); err != nil {
+		return ClusterStatus{}, fmt.Errorf("parsing cluster status: %w", err)
+	}
+	for _, e := range entries {
+		if e.Type == "cluster" {
+			return ClusterStatus{Name: e.Name, Clustered: true, Quorate: e.Quorate == 1}, nil
+		}
+	}
+	return ClusterStatus{Quorate: true}, nil
+}
+
 // ListAll returns all cluster resources (nodes, LXC containers, VMs) by
 // querying pvesh /cluster/resources and /cluster/status. Container CTIDs
 // use the format "lxc/{node}/{vmid}" or "qemu/{node}/{vmid}" so the
 // terminal manager can route connections to the correct node.
+//
+// Guests managed by HA are annotated with their HA state, queried
+// alongside the resources. Clusters without HA, or where that query
+// fails, are listed without it.
 func ListAll() ([]Container, error) {
-	out, err := exec.Command("pvesh", "get", "/cluster/resources", "--output-format", "json").Output()
+	haCh := make(chan map[string]string, 1)
+	go func() {
+		ha, _ := haStates()
+		haCh <- ha
+	}()
+	out, err := pveshGet("/cluster/resources")
 	if err != nil {
-		return nil, fmt.Errorf("pvesh get /cluster/resources: %w", err)
+		return nil, err
 	}
 
 	var raw []struct {
@@ -58,7 +157,7 @@ func ListAll() ([]Container, error) {
 		Status string `json:"status"`
 		Type   string `json:"type"`
 	}
-	if err := json.Unmarshal(out, &raw); err != nil {
+	if err := unmarshalPvesh(out, &raw); err != nil {
 		return nil, fmt.Errorf("parsing cluster resources: %w", err)
 	}
 
@@ -111,5 +210,72 @@ func ListAll() ([]Container, error) {
 		}
 	}
 
+	ha := <-haCh
+	for i := range result {
+		if result[i].VMID != "" {
+			result[i].HAState = ha[result[i].VMID]
+		}
+	}
+
 	return result, nil
 }
+
+// haStates queries the HA manager and returns the state of each managed
+// guest by vmid.
+func haStates() (map[string]string, error) {
+	out, err := pveshGet("/cluster/ha/status/current")
+	if err != nil {
+		return nil, err
+	}
+	return parseHAStatus(out)
+}
+
+// parseHAStatus extracts the service entries, whose sid is "ct:{vmid}"
+// or "vm:{vmid}", from /cluster/ha/status/current output.
+func parseHAStatus(out []byte) (map[string]string, error) {
+	var entries []struct {
+		Type  string `json:"type"`
+		SID   string `json:"sid"`
+		State string `json:"state"`
+	}
+	if err := unmarshalPvesh(out, &entries); err != nil {
+		return nil, fmt.Errorf("parsing HA status: %w", err)
+	}
+	states := make(map[string]string)
+	for _, e := range entries {
+		if e.Type != "service" {
+			continue
+		}
+		_, vmid, ok := strings.Cut(e.SID, ":")
+		if ok && e.State != "" {
+			states[vmid] = e.State
+		}
+	}
+	return states, nil
+}
+
+// Start asks Proxmox to start a guest. typ is "lxc" or "qemu". The request
+// goes through the cluster API, so it works for guests on any node.
+func Start(node, typ, vmid string) error {
+	path := fmt.Sprintf("/nodes/%s/%s/%s/status/start", node, typ, vmid)
+	if out, err := exec.Command("pvesh", "create", path).CombinedOutput(); err != nil {
+		return fmt.Errorf("pvesh create %s: %w: %s", path, err, out)
+	}
+	return nil
+}
+
+// Status returns the current status ("running", "stopped", ...) of a guest.
+func Status(node, typ, vmid string) (string, error) {
+	path := fmt.Sprintf("/nodes/%s/%s/%s/status/current", node, typ, vmid)
+	out, err := pveshGet(path)
+	if err != nil {
+		return "", err
+	}
+	var st struct {
+		Status string `json:"status"`
+	}
+	if err := unmarshalPvesh(out, &st); err != nil {
+		return "", fmt.Errorf("parsing guest status: %w", err)
+	}
+	return st.Status, nil
+}
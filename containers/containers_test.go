@@ -0,0 +1,360 @@
+package containers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePvesh puts a pvesh on the PATH that answers "pvesh get <path>" with
+// responses[path], and fails like a missing path for anything else.
+func fakePvesh(t *testing.T, responses map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for path, out := range responses {
+		name := strings.ReplaceAll(path, "/", "_")
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(out), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	script := "#!/bin/sh\n" +
+		"f=\"" + dir + "/$(echo \"$2\" | tr / _)\"\n" +
+		"if [ -f \"$f\" ]; then cat \"$f\"; else echo \"no such path '$2'\" >&2; exit 2; fi\n"
+	if err := os.WriteFile(filepath.Join(dir, "pvesh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+const testHAStatus = `[
+	{"id":"quorum","type":"quorum","status":"OK","quorate":1},
+	{"id":"master","type":"master","node":"pve","status":"pve (active)"},
+	{"id":"service:ct:100","type":"service","sid":"ct:100","node":"pve","state":"started"},
+	{"id":"service:vm:200","type":"service","sid":"vm:200","node":"pve2","state":"fence"},
+	{"id":"service:vm:201","type":"service","sid":"vm:201","node":"pve2","state":""}
+]`
+
+func TestParseHAStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"services", testHAStatus, map[string]string{"100": "started", "200": "fence"}, false},
+		{"no HA configured", `[{"id":"quorum","type":"quorum","status":"OK"}]`, map[string]string{}, false},
+		{"empty list", `[]`, map[string]string{}, false},
+		{"malformed sid", `[{"type":"service","sid":"ct100","state":"started"}]`, map[string]string{}, false},
+		{"warnings around the JSON", "WARN: something\n" + testHAStatus + "\n", map[string]string{"100": "started", "200": "fence"}, false},
+		{"not JSON", "ipcc_send_rec failed", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHAStatus([]byte(tt.out))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+const testResources = `[
+	{"type":"node","node":"pve","status":"online"},
+	{"type":"node","node":"pve2","status":"online"},
+	{"type":"lxc","node":"pve","vmid":100,"name":"web","status":"running"},
+	{"type":"lxc","node":"pve","vmid":101,"name":"db","status":"stopped"},
+	{"type":"qemu","node":"pve2","vmid":200,"name":"win","status":"running"},
+	{"type":"storage","node":"pve","storage":"local","status":"available"}
+]`
+
+func TestListAllHAState(t *testing.T) {
+	tests := []struct {
+		name string
+		ha   string // "" for an HA query that fails
+		want map[string]string
+	}{
+		{"HA-managed guests annotated", testHAStatus, map[string]string{
+			"lxc/pve/100": "started", "qemu/pve2/200": "fence"}},
+		{"HA query fails", "", map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responses := map[string]string{"/cluster/resources": testResources}
+			if tt.ha != "" {
+				responses["/cluster/ha/status/current"] = tt.ha
+			}
+			fakePvesh(t, responses)
+			list, err := ListAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != 5 {
+				t.Fatalf("listed %d resources, want 5: %+v", len(list), list)
+			}
+			for _, c := range list {
+				if c.HAState != tt.want[c.CTID] {
+					t.Errorf("%s: HA state %q, want %q", c.CTID, c.HAState, tt.want[c.CTID])
+				}
+			}
+		})
+	}
+}
+
+func TestHAStateOmitted(t *testing.T) {
+	data, err := json.Marshal(Container{CTID: "lxc/pve/101", Name: "db", Status: "stopped"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "ha_state") {
+		t.Errorf("non-HA guest encodes as %s", data)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  string
+		want    ClusterStatus
+		wantErr bool
+	}{
+		{"quorate cluster", `[
+			{"type":"cluster","name":"homelab","nodes":2,"quorate":1},
+			{"type":"node","name":"pve","ip":"10.0.0.1","online":1},
+			{"type":"node","name":"pve2","ip":"10.0.0.2","online":0}
+		]`, ClusterStatus{Name: "homelab", Clustered: true, Quorate: true}, false},
+		{"cluster without quorum", `[{"type":"cluster","name":"homelab","quorate":0}]`,
+			ClusterStatus{Name: "homelab", Clustered: true}, false},
+		{"standalone node", `[{"type":"node","name":"pve","ip":"10.0.0.1","online":1}]`,
+			ClusterStatus{Quorate: true}, false},
+		{"not JSON", "ipcc_send_rec[1] failed", ClusterStatus{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakePvesh(t, map[string]string{"/cluster/status": tt.status})
+			got, err := Cluster()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Cluster() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreferredAddress(t *testing.T) {
+	overlay := netip.MustParsePrefix("10.99.0.0/24")
+	lan := netip.MustParsePrefix("192.168.1.0/24")
+	v6 := netip.MustParsePrefix("fd00:99::/64")
+	tests := []struct {
+		name  string
+		addrs []string
+		prefs []netip.Prefix
+		want  string
+	}{
+		{"overlay preferred", []string{"203.0.113.5", "192.168.1.5", "10.99.0.5"}, []netip.Prefix{overlay, lan}, "10.99.0.5"},
+		{"falls back to the next network", []string{"203.0.113.5", "192.168.1.5"}, []netip.Prefix{overlay, lan}, "192.168.1.5"},
+		{"falls back to the first address", []string{"203.0.113.5", "198.51.100.5"}, []netip.Prefix{overlay, lan}, "203.0.113.5"},
+		{"first match in a network wins", []string{"10.99.0.7", "10.99.0.5"}, []netip.Prefix{overlay}, "10.99.0.7"},
+		{"no preferences", []string{"203.0.113.5", "10.99.0.5"}, nil, "203.0.113.5"},
+		{"IPv6", []string{"192.168.1.5", "fd00:99::5"}, []netip.Prefix{v6, lan}, "fd00:99::5"},
+		{"IPv4-mapped", []string{"203.0.113.5", "::ffff:10.99.0.5"}, []netip.Prefix{overlay}, "::ffff:10.99.0.5"},
+		{"hostnames only as fallback", []string{"pve.lan", "10.99.0.5"}, []netip.Prefix{lan}, "pve.lan"},
+		{"no addresses", nil, []netip.Prefix{overlay}, ""},
+	}
+	for _, tt := range tests {
+		if got := PreferredAddress(tt.addrs, tt.prefs); got != tt.want {
+			t.Errorf("%s: PreferredAddress(%q) = %q, want %q", tt.name, tt.addrs, got, tt.want)
+		}
+	}
+}
+
+const testClusterStatus = `[
+	{"type":"cluster","name":"homelab","quorate":1},
+	{"type":"node","name":"pve","ip":"192.168.1.5","online":1},
+	{"type":"node","name":"pve2","ip":"192.168.1.6","online":1}
+]`
+
+func TestNodeAddressCandidates(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes string // "" for a /cluster/config/nodes query that fails
+		want  map[string][]string
+	}{
+		{"corosync links", `[
+			{"node":"pve","nodeid":"1","ring0_addr":"192.168.1.5","ring1_addr":"10.99.0.5"},
+			{"node":"pve2","nodeid":"2","ring0_addr":"10.99.0.6"},
+			{"node":"pve9","ring0_addr":"10.99.0.9"}
+		]`, map[string][]string{
+			"pve":  {"192.168.1.5", "10.99.0.5"},
+			"pve2": {"192.168.1.6", "10.99.0.6"},
+			"pve9": {"10.99.0.9"},
+		}},
+		{"links query fails", "", map[string][]string{
+			"pve":  {"192.168.1.5"},
+			"pve2": {"192.168.1.6"},
+		}},
+		{"links not JSON", "ipcc_send_rec failed", map[string][]string{
+			"pve":  {"192.168.1.5"},
+			"pve2": {"192.168.1.6"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responses := map[string]string{"/cluster/status": testClusterStatus}
+			if tt.nodes != "" {
+				responses["/cluster/config/nodes"] = tt.nodes
+			}
+			fakePvesh(t, responses)
+			got, err := NodeAddressCandidates()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("candidates = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalPvesh(t *testing.T) {
+	type node struct {
+		Name string `json:"name"`
+	}
+	clean := `[{"name":"pve"},{"name":"pve2"}]`
+	tests := []struct {
+		name    string
+		out     string
+		want    []node // when wantErr is false
+		wantErr bool
+	}{
+		{"clean", clean, []node{{"pve"}, {"pve2"}}, false},
+		{"trailing newline", clean + "\n", []node{{"pve"}, {"pve2"}}, false},
+		{"leading warning", "WARNING: storage 'nfs' is not online\n" + clean, []node{{"pve"}, {"pve2"}}, false},
+		{"trailing garbage", clean + "\nDone.\n\x00", []node{{"pve"}, {"pve2"}}, false},
+		{"both", "warn: [deprecated] option\n" + clean + "\nwarn: {x}\n", []node{{"pve"}, {"pve2"}}, false},
+		{"empty", "", nil, true},
+		{"whitespace", " \n\t", nil, true},
+		{"warning only", "ipcc_send_rec[1] failed: Connection refused\n", nil, true},
+		{"broken JSON", `[{"name":"pve"`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []node
+			err := unmarshalPvesh([]byte(tt.out), &got)
+			if tt.wantErr != errors.Is(err, errNoJSON) || (!tt.wantErr && err != nil) {
+				t.Fatalf("err = %v, want errNoJSON %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPollutedOutput(t *testing.T) {
+	fakePvesh(t, map[string]string{
+		"/cluster/status":    "WARN: plugin 'zfs' is deprecated\n" + testClusterStatus + "\n\n",
+		"/cluster/resources": "WARN: plugin 'zfs' is deprecated\n" + testResources + "\ntrailing noise\n",
+	})
+	addrs, err := NodeAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"pve": "192.168.1.5", "pve2": "192.168.1.6"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("NodeAddresses() = %v, want %v", addrs, want)
+	}
+	list, err := ListAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 5 {
+		t.Errorf("listed %d resources, want 5: %+v", len(list), list)
+	}
+}
+
+// flakyPvesh puts a pvesh on the PATH that fails fails times with stderr
+// msg before printing out, and returns a func counting the attempts. msg
+// and out are single-quoted for the shell, so can't contain '.
+func flakyPvesh(t *testing.T, fails int, msg, out string) func() int {
+	t.Helper()
+	dir := t.TempDir()
+	count := filepath.Join(dir, "count")
+	script := "#!/bin/sh\n" +
+		"echo x >> " + count + "\n" +
+		"if [ $(wc -l < " + count + ") -le " + strconv.Itoa(fails) + " ]; then echo '" + msg + "' >&2; exit 255; fi\n" +
+		"echo '" + out + "'\n"
+	if err := os.WriteFile(filepath.Join(dir, "pvesh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return func() int {
+		data, _ := os.ReadFile(count)
+		return strings.Count(string(data), "\n")
+	}
+}
+
+func TestPveshRetries(t *testing.T) {
+	const lock = "cfs-lock file-replication_cfg error: got lock request timeout"
+	const status = `[{"type":"node","name":"pve","ip":"10.0.0.1"}]`
+	tests := []struct {
+		name         string
+		retries      int
+		fails        int
+		msg          string
+		wantErr      bool
+		wantAttempts int
+	}{
+		{"succeeds on the second attempt", 2, 1, lock, false, 2},
+		{"succeeds on the last attempt", 2, 2, lock, false, 3},
+		{"gives up", 2, 5, lock, true, 3},
+		{"retries disabled", 0, 1, lock, true, 1},
+		{"permanent error", 2, 1, "no such cluster node pve9", true, 1},
+		{"permission denied", 2, 1, "Permission check failed (/, Sys.Audit)", true, 1},
+	}
+	defer func(r int, b time.Duration) { Retries, RetryBackoff = r, b }(Retries, RetryBackoff)
+	RetryBackoff = time.Millisecond
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Retries = tt.retries
+			attempts := flakyPvesh(t, tt.fails, tt.msg, status)
+			addrs, err := NodeAddresses()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.msg) {
+				t.Errorf("error %q doesn't carry pvesh's message", err)
+			}
+			if err == nil && addrs["pve"] != "10.0.0.1" {
+				t.Errorf("addresses = %v", addrs)
+			}
+			if n := attempts(); n != tt.wantAttempts {
+				t.Errorf("pvesh ran %d times, want %d", n, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestPveshNotInstalled(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	defer func(r int) { Retries = r }(Retries)
+	Retries = 5
+	start := time.Now()
+	if _, err := NodeAddresses(); err == nil {
+		t.Fatal("no error without pvesh")
+	}
+	// Not being able to run pvesh at all isn't retried.
+	if d := time.Since(start); d > RetryBackoff {
+		t.Errorf("took %v, as if retried", d)
+	}
+}
@@ -0,0 +1,92 @@
+package containers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Retries is how many more times a pvesh query is run after a failure
+// that may be transient, such as a timeout acquiring a cluster lock,
+// waiting RetryBackoff before the first retry and doubling it after each.
+var (
+	Retries      = 2
+	RetryBackoff = 200 * time.Millisecond
+)
+
+// permanentErrors are pvesh error messages that retrying won't fix.
+var permanentErrors = []string{
+	"no such",
+	"does not exist",
+	"not implemented",
+	"permission check failed",
+	"parameter verification failed",
+}
+
+// pveshGet runs "pvesh get path --output-format json" and returns its
+// stdout, retrying failures that may be transient. Failing to run pvesh at
+// all, or an error in permanentErrors, is returned at once.
+func pveshGet(path string) ([]byte, error) {
+	backoff := RetryBackoff
+	for attempt := 0; ; attempt++ {
+		out, err := exec.Command("pvesh", "get", path, "--output-format", "json").Output()
+		if err == nil {
+			return out, nil
+		}
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("pvesh get %s: %w", path, err)
+		}
+		msg := strings.TrimSpace(string(exitErr.Stderr))
+		if msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		if attempt >= Retries || isPermanent(msg) {
+			return nil, fmt.Errorf("pvesh get %s: %w", path, err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func isPermanent(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, p := range permanentErrors {
+		if strings.Contains(msg, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// errNoJSON is returned by unmarshalPvesh when no JSON value in the output
+// decodes, wrapping the decoding error if there was something to decode.
+var errNoJSON = errors.New("no valid JSON found in pvesh output")
+
+// unmarshalPvesh decodes pvesh output into v. Some storage and other
+// plugins print warnings to stdout around the JSON, so if the output as a
+// whole doesn't parse, the first value starting at a '[' or '{' that
+// decodes is used and anything after it is ignored.
+func unmarshalPvesh(out []byte, v any) error {
+	err := json.Unmarshal(out, v)
+	if err == nil {
+		return nil
+	}
+	for i := 0; i < len(out); i++ {
+		if out[i] != '[' && out[i] != '{' {
+			continue
+		}
+		var raw json.RawMessage
+		if json.NewDecoder(bytes.NewReader(out[i:])).Decode(&raw) == nil && json.Unmarshal(raw, v) == nil {
+			return nil
+		}
+	}
+	if len(bytes.TrimSpace(out)) == 0 || bytes.IndexAny(out, "[{") < 0 {
+		return errNoJSON
+	}
+	return fmt.Errorf("%w: %v", errNoJSON, err)
+}
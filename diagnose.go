@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/chris/termbrowser/containers"
+	"github.com/chris/termbrowser/terminal"
+)
+
+// diagResult is the outcome of checking one cluster node.
+type diagResult struct {
+	Node string
+	Addr string
+	Err  error
+}
+
+// runDiagnose lists cluster resources and checks ssh connectivity to every
+// node without starting the server. It returns the process exit code: 0 if
+// every check passed, 1 otherwise.
+func runDiagnose(w io.Writer, termMgr *terminal.Manager, timeout time.Duration) int {
+	failed := false
+
+	all, err := containers.ListAll()
+	if err != nil {
+		fmt.Fprintf(w, "cluster resources: FAIL (%v)\n", err)
+		failed = true
+	} else {
+		counts := make(map[string]int)
+		for _, c := range all {
+			counts[c.Type]++
+		}
+		fmt.Fprintf(w, "cluster resources: OK (%d nodes, %d lxc, %d qemu)\n",
+			counts["node"], counts["lxc"], counts["qemu"])
+	}
+
+	addrs, err := containers.NodeAddresses()
+	if err != nil {
+		fmt.Fprintf(w, "node addresses:    FAIL (%v)\n", err)
+		failed = true
+	} else {
+		fmt.Fprintf(w, "node addresses:    OK (%d resolved)\n", len(addrs))
+	}
+
+	nodes := make(map[string]bool)
+	for _, c := range all {
+		if c.Type == "node" {
+			nodes[c.Name] = true
+		}
+	}
+	for name := range addrs {
+		nodes[name] = true
+	}
+	names := make([]string, 0, len(nodes))
+	for name := range nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]diagResult, 0, len(names))
+	for _, name := range names {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		addr, err := termMgr.ProbeNode(ctx, name)
+		cancel()
+		results = append(results, diagResult{Node: name, Addr: addr, Err: err})
+	}
+
+	fmt.Fprintln(w)
+	if writeDiagReport(w, results) {
+		failed = true
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// writeDiagReport prints a pass/fail table of node checks and reports
+// whether any of them failed.
+func writeDiagReport(w io.Writer, results []diagResult) bool {
+	if len(results) == 0 {
+		fmt.Fprintln(w, "no nodes found")
+		return true
+	}
+	failed := false
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tADDRESS\tSSH\tDETAIL")
+	for _, r := range results {
+		status, detail := "PASS", ""
+		if r.Err != nil {
+			status, detail = "FAIL", r.Err.Error()
+			failed = true
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Node, r.Addr, status, detail)
+	}
+	tw.Flush()
+	return failed
+}
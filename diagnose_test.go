@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestWriteDiagReport(t *testing.T) {
+	tests := []struct {
+		name       string
+		results    []diagResult
+		wantFailed bool
+		want       string
+	}{
+		{
+			name:       "no nodes",
+			wantFailed: true,
+			want:       "no nodes found\n",
+		},
+		{
+			name: "all pass",
+			results: []diagResult{
+				{Node: "pve1", Addr: "10.0.0.1"},
+				{Node: "pve2", Addr: "10.0.0.2"},
+			},
+			want: "" +
+				"NODE  ADDRESS   SSH   DETAIL\n" +
+				"pve1  10.0.0.1  PASS  \n" +
+				"pve2  10.0.0.2  PASS  \n",
+		},
+		{
+			name: "one failure",
+			results: []diagResult{
+				{Node: "pve1", Addr: "10.0.0.1"},
+				{Node: "pve-backup", Addr: "10.0.0.20", Err: errors.New("timed out")},
+			},
+			wantFailed: true,
+			want: "" +
+				"NODE        ADDRESS    SSH   DETAIL\n" +
+				"pve1        10.0.0.1   PASS  \n" +
+				"pve-backup  10.0.0.20  FAIL  timed out\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			if failed := writeDiagReport(&b, tt.results); failed != tt.wantFailed {
+				t.Errorf("failed = %v, want %v", failed, tt.wantFailed)
+			}
+			if b.String() != tt.want {
+				t.Errorf("report:\n%s\nwant:\n%s", b.String(), tt.want)
+			}
+		})
+	}
+}
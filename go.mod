@@ -3,13 +3,14 @@ module github.com/chris/termbrowser
 go 1.24.4
 
 require (
-	github.com/boombuler/barcode v1.0.1-0.20190219062509-6c824513bacc // indirect
-	github.com/creack/pty v1.1.24 // indirect
-	github.com/golang-jwt/jwt/v5 v5.2.2 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
-	github.com/pquerna/otp v1.4.0 // indirect
-	golang.org/x/crypto v0.48.0 // indirect
-	golang.org/x/sys v0.41.0 // indirect
-	golang.org/x/term v0.40.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	github.com/boombuler/barcode v1.0.1-0.20190219062509-6c824513bacc
+	github.com/creack/pty v1.1.24
+	github.com/golang-jwt/jwt/v5 v5.2.2
+	github.com/gorilla/websocket v1.5.3
+	github.com/pquerna/otp v1.4.0
+	golang.org/x/crypto v0.48.0
+	golang.org/x/term v0.40.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/sys v0.41.0
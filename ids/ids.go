@@ -0,0 +1,184 @@
+// Package ids parses terminal ids, so that the server's validation and the
+// terminal manager's command building agree on what an id means.
+package ids
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Kind is the type of target a terminal id refers to.
+type Kind int
+
+const (
+	Host     Kind = iota + 1 // "host": the Proxmox host itself
+	Node                     // "node:{name}": ssh to a cluster node
+	SSH                      // "ssh:{name}": a configured ssh_hosts entry
+	LXC                      // "lxc/{node}/{vmid}": pct over ssh
+	QEMU                     // "qemu/{node}/{vmid}": qm terminal over ssh
+	LocalLXC                 // "{vmid}": legacy, pct on this host
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Host:
+		return "host"
+	case Node:
+		return "node"
+	case SSH:
+		return "ssh"
+	case LXC:
+		return "lxc"
+	case QEMU:
+		return "qemu"
+	case LocalLXC:
+		return "local lxc"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// ParsedID is a terminal id split into its parts.
+type ParsedID struct {
+	Kind     Kind
+	Node     string // node name for Node, LXC and QEMU; entry name for SSH
+	VMID     string // for LXC, QEMU and LocalLXC
+	Instance string // the "#{instance}" suffix without '#', if any
+}
+
+// String returns the id p was parsed from.
+func (p ParsedID) String() string {
+	var id string
+	switch p.Kind {
+	case Host:
+		id = "host"
+	case Node:
+		id = "node:" + p.Node
+	case SSH:
+		id = "ssh:" + p.Node
+	case LXC:
+		id = "lxc/" + p.Node + "/" + p.VMID
+	case QEMU:
+		id = "qemu/" + p.Node + "/" + p.VMID
+	case LocalLXC:
+		id = p.VMID
+	}
+	if p.Instance != "" {
+		id += "#" + p.Instance
+	}
+	return id
+}
+
+var (
+	nodeNameRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]{0,62}[A-Za-z0-9])?$`)
+	vmidRe     = regexp.MustCompile(`^[1-9][0-9]{0,8}$`)
+	hostNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+	instanceRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,16}$`)
+)
+
+// ValidNodeName reports whether s looks like a Proxmox node name: letters,
+// digits, '.' and '-', not starting or ending with punctuation.
+func ValidNodeName(s string) bool { return nodeNameRe.MatchString(s) }
+
+// ValidVMID reports whether s is a guest id: a positive integer of up to
+// nine digits, without leading zeros.
+func ValidVMID(s string) bool { return vmidRe.MatchString(s) }
+
+// SplitInstance separates an optional "#{instance}" suffix from a terminal
+// id at its first '#'. The suffix selects an independent session (and tmux
+// session) for the same target, so "lxc/pve/100" and "lxc/pve/100#2" are
+// two distinct shells.
+func SplitInstance(id string) (base, instance string) {
+	base, instance, _ = strings.Cut(id, "#")
+	return base, instance
+}
+
+// Parse checks id against the terminal id formats and splits it up,
+// explaining what's wrong if it doesn't match:
+//
+//	"host"              — the Proxmox host itself
+//	"node:{name}"       — SSH into a cluster node
+//	"lxc/{node}/{vmid}" — LXC container via pct exec over SSH
+//	"qemu/{node}/{vmid}"— QEMU VM via qm terminal over SSH
+//	"ssh:{name}"        — a configured ssh_hosts entry
+//	"{vmid}"            — legacy: local LXC by bare numeric ctid
+//
+// Any form except qemu may carry a "#{instance}" suffix (letters, digits,
+// '-' or '_', up to 16) to open an independent session to the same target.
+// A VM has only one serial console, so qemu ids can't.
+//
+// Commands are built as argv, not shell strings, so the character checks
+// are defence in depth: nothing that reaches ssh, pct or tmux can look
+// like an option or be reinterpreted by the remote shell.
+func Parse(id string) (ParsedID, error) {
+	base, instance := SplitInstance(id)
+	if base != id {
+		if strings.HasPrefix(base, "qemu/") {
+			return ParsedID{}, errors.New("qemu ids can't have an #instance suffix")
+		}
+		if !instanceRe.MatchString(instance) {
+			return ParsedID{}, errors.New("instance suffix must be 1-16 letters, digits, '-' or '_'")
+		}
+	}
+	p := ParsedID{Instance: instance}
+	switch {
+	case base == "host":
+		p.Kind = Host
+	case strings.HasPrefix(base, "node:"):
+		p.Kind, p.Node = Node, base[5:]
+		if p.Node == "" {
+			return ParsedID{}, errors.New("node id is missing the node name: node:{name}")
+		}
+		if !ValidNodeName(p.Node) {
+			return ParsedID{}, errors.New("node name may only contain letters, digits, '.' and '-'")
+		}
+	case strings.HasPrefix(base, "ssh:"):
+		p.Kind, p.Node = SSH, base[4:]
+		if p.Node == "" {
+			return ParsedID{}, errors.New("ssh id is missing the host name: ssh:{name}")
+		}
+		if !hostNameRe.MatchString(p.Node) {
+			return ParsedID{}, fmt.Errorf("invalid ssh host name %q", p.Node)
+		}
+	case strings.HasPrefix(base, "lxc/"):
+		p.Kind = LXC
+		if err := parseGuest(&p, "lxc", base[4:]); err != nil {
+			return ParsedID{}, err
+		}
+	case strings.HasPrefix(base, "qemu/"):
+		p.Kind = QEMU
+		if err := parseGuest(&p, "qemu", base[5:]); err != nil {
+			return ParsedID{}, err
+		}
+	default:
+		if _, err := strconv.Atoi(base); err != nil {
+			return ParsedID{}, errors.New("unrecognised id: expected host, node:{name}, ssh:{name}, lxc/{node}/{vmid}, qemu/{node}/{vmid} or a numeric container id")
+		}
+		if !ValidVMID(base) {
+			return ParsedID{}, errors.New("container id must be a positive number without leading zeros")
+		}
+		p.Kind, p.VMID = LocalLXC, base
+	}
+	return p, nil
+}
+
+// parseGuest fills in p from the "{node}/{vmid}" part of an lxc or qemu id.
+func parseGuest(p *ParsedID, typ, rest string) error {
+	node, vmid, _ := strings.Cut(rest, "/")
+	if node == "" {
+		return fmt.Errorf("%s id is missing the node: %s/{node}/{vmid}", typ, typ)
+	}
+	if vmid == "" {
+		return fmt.Errorf("%s id is missing the vmid: %s/{node}/{vmid}", typ, typ)
+	}
+	if !ValidNodeName(node) {
+		return errors.New("node name may only contain letters, digits, '.' and '-'")
+	}
+	if !ValidVMID(vmid) {
+		return fmt.Errorf("vmid must be a positive number without leading zeros, got %q", vmid)
+	}
+	p.Node, p.VMID = node, vmid
+	return nil
+}
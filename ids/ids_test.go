@@ -0,0 +1,191 @@
+package ids
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		id   string
+		want ParsedID
+	}{
+		{"host", ParsedID{Kind: Host}},
+		{"host#2", ParsedID{Kind: Host, Instance: "2"}},
+		{"node:pve2", ParsedID{Kind: Node, Node: "pve2"}},
+		{"node:10.0.0.2#work", ParsedID{Kind: Node, Node: "10.0.0.2", Instance: "work"}},
+		{"ssh:pbs_1", ParsedID{Kind: SSH, Node: "pbs_1"}},
+		{"ssh:pbs#a-b", ParsedID{Kind: SSH, Node: "pbs", Instance: "a-b"}},
+		{"lxc/pve/100", ParsedID{Kind: LXC, Node: "pve", VMID: "100"}},
+		{"lxc/pve/100#2", ParsedID{Kind: LXC, Node: "pve", VMID: "100", Instance: "2"}},
+		{"qemu/pve3/200", ParsedID{Kind: QEMU, Node: "pve3", VMID: "200"}},
+		{"101", ParsedID{Kind: LocalLXC, VMID: "101"}},
+		{"101#x", ParsedID{Kind: LocalLXC, VMID: "101", Instance: "x"}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.id)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.id, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.id, got, tt.want)
+		}
+		if s := got.String(); s != tt.id {
+			t.Errorf("Parse(%q).String() = %q", tt.id, s)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		id, want string
+	}{
+		{"", "unrecognised id"},
+		{"node:", "missing the node name"},
+		{"ssh:", "missing the host name"},
+		{"lxc//100", "missing the node"},
+		{"lxc/pve", "missing the vmid"},
+		{"lxc/pve/0100", "vmid must be a positive number"},
+		{"qemu/pve/200#2", "qemu ids can't have an #instance suffix"},
+		{"host#", "instance suffix must be"},
+		{"host#a#b", "instance suffix must be"},
+		{"host#" + strings.Repeat("a", 17), "instance suffix must be"},
+		{"0", "container id must be a positive number"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.id)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%q) error = %v, want one containing %q", tt.id, err, tt.want)
+		}
+	}
+}
+
+func TestSplitInstance(t *testing.T) {
+	tests := []struct {
+		id, base, instance string
+	}{
+		{"host", "host", ""},
+		{"host#2", "host", "2"},
+		{"lxc/pve/100#work", "lxc/pve/100", "work"},
+		{"host#", "host", ""},
+		// The first '#' splits, so Parse sees "a#b" and rejects it.
+		{"host#a#b", "host", "a#b"},
+		{"#2", "", "2"},
+	}
+	for _, tt := range tests {
+		base, instance := SplitInstance(tt.id)
+		if base != tt.base || instance != tt.instance {
+			t.Errorf("SplitInstance(%q) = %q, %q, want %q, %q", tt.id, base, instance, tt.base, tt.instance)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, id := range []string{"host", "host#2", "node:pve", "ssh:pbs#x", "lxc/pve/100#2", "qemu/pve/200", "100", "host#a#b", "lxc/pve/100/101"} {
+		f.Add(id)
+	}
+	f.Fuzz(func(t *testing.T, id string) {
+		p, err := Parse(id)
+		if err != nil {
+			return
+		}
+		if s := p.String(); s != id {
+			t.Fatalf("Parse(%q).String() = %q", id, s)
+		}
+		base, instance := SplitInstance(id)
+		if instance != p.Instance {
+			t.Errorf("SplitInstance(%q) instance = %q, Parse gave %q", id, instance, p.Instance)
+		}
+		if b, err := Parse(base); err != nil || b.Kind != p.Kind || b.Node != p.Node || b.VMID != p.VMID {
+			t.Errorf("Parse(%q) = %+v, %v; want %+v without the instance", base, b, err, p)
+		}
+		if strings.ContainsAny(p.Node+p.VMID+p.Instance, "#/:; \t\n$`'\"") {
+			t.Errorf("Parse(%q) = %+v holds a separator or metacharacter", id, p)
+		}
+	})
+}
+
+func TestParseRejectsMetacharacters(t *testing.T) {
+	tests := []string{
+		"node:pve;reboot",
+		"node:pve$(id)",
+		"node:pve`id`",
+		"node:pve|cat",
+		"node:pve&",
+		"node:-oProxyCommand=sh",
+		"node:pve\nid",
+		"node:pve name",
+		"node:../etc",
+		"ssh:pbs;id",
+		"ssh:-pbs",
+		"ssh:pbs>out",
+		"lxc/pve;id/100",
+		"lxc/pve/100;id",
+		"lxc/pve/100 && id",
+		"lxc/pve/$VMID",
+		"lxc/pve/100/../101",
+		"lxc/-opve/100",
+		"qemu/pve/200'",
+		"qemu/pve/\"200\"",
+		"100;id",
+		"100\x00",
+		"host#1;id",
+		"host#$(id)",
+		"host#a b",
+		"host;id",
+	}
+	for _, id := range tests {
+		if p, err := Parse(id); err == nil {
+			t.Errorf("Parse(%q) = %+v, want an error", id, p)
+		}
+	}
+}
+
+func TestValidNodeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"pve", true},
+		{"pve-2", true},
+		{"pve2.example.com", true},
+		{"a", true},
+		{"-pve", false},
+		{"pve-", false},
+		{".pve", false},
+		{"pve_2", false},
+		{"pve;id", false},
+		{"", false},
+		{strings.Repeat("a", 64), true},
+		{strings.Repeat("a", 65), false},
+	}
+	for _, tt := range tests {
+		if got := ValidNodeName(tt.name); got != tt.want {
+			t.Errorf("ValidNodeName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidVMID(t *testing.T) {
+	tests := []struct {
+		vmid string
+		want bool
+	}{
+		{"100", true},
+		{"1", true},
+		{"999999999", true},
+		{"1000000000", false},
+		{"0", false},
+		{"0100", false},
+		{"-1", false},
+		{"+100", false},
+		{"1e3", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := ValidVMID(tt.vmid); got != tt.want {
+			t.Errorf("ValidVMID(%q) = %v, want %v", tt.vmid, got, tt.want)
+		}
+	}
+}
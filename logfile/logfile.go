@@ -0,0 +1,130 @@
+// Package logfile writes the server log to a file with size-based
+// rotation.
+package logfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options control rotation. Zero values pick the defaults noted.
+type Options struct {
+	MaxSize    int64         // rotate once the file would exceed this; default 10 MiB
+	MaxBackups int           // rotated files to keep (path.1 is newest); default 5
+	MaxAge     time.Duration // also delete backups older than this; 0 keeps them
+}
+
+// File is an io.Writer that appends to a log file and rotates it when it
+// grows past MaxSize. Writes are serialised, and rotation happens between
+// writes, so every line ends up whole in exactly one file.
+type File struct {
+	path string
+	opts Options
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// Open returns a writer for dest: "stderr" or "stdout" write to those
+// streams unchanged, anything else is a file path rotated per opts.
+func Open(dest string, opts Options) (io.Writer, error) {
+	switch dest {
+	case "", "stderr":
+		return os.Stderr, nil
+	case "stdout":
+		return os.Stdout, nil
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = 10 << 20
+	}
+	if opts.MaxBackups <= 0 {
+		opts.MaxBackups = 5
+	}
+	l := &File{path: dest, opts: opts}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *File) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("opening log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("opening log file: %w", err)
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+func (l *File) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size > 0 && l.size+int64(len(p)) > l.opts.MaxSize {
+		if err := l.rotate(); err != nil {
+			// Keep logging to the current file rather than losing lines.
+			fmt.Fprintf(os.Stderr, "rotating %s: %v\n", l.path, err)
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate shifts path.N to path.N+1, moves the current file to path.1 and
+// reopens path, then prunes old backups. Callers must hold l.mu.
+func (l *File) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	for i := l.opts.MaxBackups - 1; i >= 1; i-- {
+		os.Rename(l.backup(i), l.backup(i+1))
+	}
+	if err := os.Rename(l.path, l.backup(1)); err != nil {
+		if oerr := l.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	l.prune()
+	return nil
+}
+
+func (l *File) backup(n int) string {
+	return l.path + "." + strconv.Itoa(n)
+}
+
+// prune deletes backups beyond MaxBackups and, if MaxAge is set, any
+// older than that.
+func (l *File) prune() {
+	matches, _ := filepath.Glob(l.path + ".*")
+	for _, m := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(m, l.path+"."))
+		if err != nil {
+			continue
+		}
+		if n > l.opts.MaxBackups {
+			os.Remove(m)
+			continue
+		}
+		if l.opts.MaxAge > 0 {
+			if info, err := os.Stat(m); err == nil && time.Since(info.ModTime()) > l.opts.MaxAge {
+				os.Remove(m)
+			}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOpenStreams(t *testing.T) {
+	tests := []struct {
+		dest string
+		want *os.File
+	}{
+		{"", os.Stderr},
+		{"stderr", os.Stderr},
+		{"stdout", os.Stdout},
+	}
+	for _, tt := range tests {
+		w, err := Open(tt.dest, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w != tt.want {
+			t.Errorf("Open(%q) = %v, want %v", tt.dest, w, tt.want.Name())
+		}
+	}
+}
+
+// readLines returns the lines of path and its backups, oldest first.
+func readLines(t *testing.T, path string, backups int) []string {
+	t.Helper()
+	var lines []string
+	for i := backups; i >= 0; i-- {
+		name := path
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", path, i)
+		}
+		data, err := os.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > 0 && !strings.HasSuffix(string(data), "\n") {
+			t.Errorf("%s ends mid-line: %q", name, data)
+		}
+		lines = append(lines, strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")...)
+	}
+	return lines
+}
+
+func TestRotate(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxSize    int64
+		maxBackups int
+		lines      int
+		wantFiles  []string // besides the log itself
+		wantKept   int      // most recent lines still on disk
+	}{
+		{"under the cap", 100, 2, 3, nil, 3},
+		{"one rotation", 100, 2, 5, []string{".1"}, 5},
+		{"backups capped", 100, 2, 20, []string{".1", ".2"}, 8},
+		{"single backup", 100, 1, 20, []string{".1"}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "termbrowser.log")
+			w, err := Open(path, Options{MaxSize: tt.maxSize, MaxBackups: tt.maxBackups})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 30-byte lines: three fit under 100 bytes, the fourth rotates.
+			for i := range tt.lines {
+				fmt.Fprintf(w, "line %03d %s\n", i, strings.Repeat("x", 20))
+			}
+
+			matches, _ := filepath.Glob(path + ".*")
+			var files []string
+			for _, m := range matches {
+				files = append(files, strings.TrimPrefix(m, path))
+			}
+			sort.Strings(files)
+			if strings.Join(files, " ") != strings.Join(tt.wantFiles, " ") {
+				t.Errorf("backups %q, want %q", files, tt.wantFiles)
+			}
+			for _, name := range append([]string{""}, files...) {
+				if info, err := os.Stat(path + name); err == nil && info.Size() > tt.maxSize {
+					t.Errorf("%s is %d bytes, over the %d cap", path+name, info.Size(), tt.maxSize)
+				}
+			}
+			lines := readLines(t, path, tt.maxBackups)
+			if len(lines) != tt.wantKept {
+				t.Fatalf("%d lines kept, want %d: %q", len(lines), tt.wantKept, lines)
+			}
+			for i, l := range lines {
+				if want := fmt.Sprintf("line %03d ", tt.lines-tt.wantKept+i); !strings.HasPrefix(l, want) {
+					t.Errorf("line %d = %q, want it to start %q", i, l, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAppendsToExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "termbrowser.log")
+	if err := os.WriteFile(path, []byte(strings.Repeat("o", 95)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	w, err := Open(path, Options{MaxSize: 100, MaxBackups: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The existing 96 bytes count toward the cap, so this rotates.
+	fmt.Fprintln(w, "new line")
+	if data, _ := os.ReadFile(path); string(data) != "new line\n" {
+		t.Errorf("log = %q, want only the new line", data)
+	}
+	if data, _ := os.ReadFile(path + ".1"); len(data) != 96 {
+		t.Errorf("backup is %d bytes, want the original 96", len(data))
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "termbrowser.log")
+	w, err := Open(path, Options{MaxSize: 10, MaxBackups: 5, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(w, "first....")
+	fmt.Fprintln(w, "second...") // rotates "first" to .1
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(path+".1", old, old); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(w, "third....") // .1 moves to .2, which is too old
+
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Errorf("backup older than max age survived: %v", err)
+	}
+	if data, _ := os.ReadFile(path + ".1"); string(data) != "second...\n" {
+		t.Errorf(".1 = %q, want the second line", data)
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	const writers, perWriter = 8, 200
+	path := filepath.Join(t.TempDir(), "termbrowser.log")
+	w, err := Open(path, Options{MaxSize: 2000, MaxBackups: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for g := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				fmt.Fprintf(w, "writer %d line %03d\n", g, i)
+			}
+		}()
+	}
+	wg.Wait()
+
+	seen := make(map[string]int)
+	for _, l := range readLines(t, path, 1000) {
+		seen[l]++
+	}
+	for g := range writers {
+		for i := range perWriter {
+			l := fmt.Sprintf("writer %d line %03d", g, i)
+			if seen[l] != 1 {
+				t.Errorf("%q appears %d times", l, seen[l])
+			}
+			delete(seen, l)
+		}
+	}
+	for l := range seen {
+		t.Errorf("unexpected line %q", l)
+	}
+}
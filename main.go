@@ -5,13 +5,21 @@ import (
 	"flag"
 	"io/fs"
 	"log"
+	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/chris/termbrowser/audit"
 	"github.com/chris/termbrowser/auth"
 	"github.com/chris/termbrowser/config"
 	"github.com/chris/termbrowser/containers"
+	"github.com/chris/termbrowser/logfile"
 	"github.com/chris/termbrowser/server"
 	"github.com/chris/termbrowser/terminal"
+	"github.com/pquerna/otp"
 
 	"embed"
 )
@@ -22,30 +30,110 @@ var webFiles embed.FS
 func main() {
 	configPath := flag.String("config", config.DefaultPath(), "config file path")
 	setupFlag := flag.Bool("setup", false, "re-run setup wizard")
+	noQR := flag.Bool("no-qr", false, "don't print the TOTP QR code during setup")
+	password := flag.String("password", "", "password for non-interactive setup (or set TB_PASSWORD)")
+	totpIssuer := flag.String("totp-issuer", "", "issuer shown in authenticator apps, set during setup (default totp_issuer from the config, or termbrowser)")
+	totpAccount := flag.String("totp-account", "", "account name shown in authenticator apps, set during setup (default totp_account from the config, or admin)")
+	force := flag.Bool("force", false, "allow non-interactive setup to overwrite an existing config")
+	diagnose := flag.Bool("diagnose", false, "check cluster listing and ssh connectivity to every node, then exit")
+	insecureConfig := flag.Bool("allow-insecure-config", false, "start even if the config file is readable by other users")
+	diagTimeout := flag.Duration("diagnose-timeout", 5*time.Second, "per-node timeout for -diagnose")
+	port := flag.Int("port", 0, "listen port, overriding TB_PORT and the config file")
+	profile := flag.String("profile", "", "profile to use from a config file with profiles (or set TB_PROFILE)")
 	flag.Parse()
 
+	setupOpts := config.SetupOptions{
+		NoQR:    *noQR,
+		Force:   *force,
+		Issuer:  *totpIssuer,
+		Account: *totpAccount,
+	}
+	pepper := os.Getenv("TB_PEPPER")
+	setupOpts.Pepper = pepper
+	if pw, ok := os.LookupEnv("TB_PASSWORD"); ok {
+		setupOpts.NonInteractive = true
+		setupOpts.Password = pw
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "password" {
+			setupOpts.NonInteractive = true
+			setupOpts.Password = *password
+		}
+	})
+
+	if *profile == "" {
+		*profile = os.Getenv("TB_PROFILE")
+	}
+
 	if *setupFlag {
-		if _, err := config.RunFirstSetup(*configPath); err != nil {
+		if *profile != "" {
+			log.Fatalf("setup writes a single config; run it with another -config and copy the result under profiles")
+		}
+		if _, err := config.RunFirstSetup(*configPath, setupOpts); err != nil {
 			log.Fatalf("setup failed: %v", err)
 		}
 		os.Exit(0)
 	}
 
-	cfg, err := config.Load(*configPath)
-	if os.IsNotExist(err) {
-		cfg, err = config.RunFirstSetup(*configPath)
+	if err := config.CheckPermissions(*configPath); err != nil && !os.IsNotExist(err) {
+		if !*insecureConfig {
+			log.Fatalf("config: %v (fix with chmod 600, or pass -allow-insecure-config)", err)
+		}
+		log.Printf("WARNING: config: %v", err)
+	}
+
+	cfg, err := config.LoadProfile(*configPath, *profile)
+	if os.IsNotExist(err) && flag.Arg(0) == "" && *profile == "" {
+		cfg, err = config.RunFirstSetup(*configPath, setupOpts)
 	}
 	if err != nil {
 		log.Fatalf("config: %v", err)
 	}
+	if err := cfg.OverridePort(*port, os.Getenv("TB_PORT")); err != nil {
+		log.Fatalf("config: %v", err)
+	}
+
+	if flag.Arg(0) == "sessions" {
+		os.Exit(runSessions(os.Stdout, os.Stderr, cfg, flag.Args()[1:]))
+	}
+
+	if cfg.LogFile != "" {
+		w, err := logfile.Open(cfg.LogFile, logfile.Options{
+			MaxSize:    cfg.LogMaxSize,
+			MaxBackups: cfg.LogMaxBackups,
+			MaxAge:     cfg.LogMaxAge,
+		})
+		if err != nil {
+			log.Fatalf("config: %v", err)
+		}
+		log.SetOutput(w)
+	}
+	if cfg.Profile != "" {
+		log.Printf("using config profile %s", cfg.Profile)
+	}
 
 	jwtSecret, err := hex.DecodeString(cfg.JWTSecret)
 	if err != nil {
 		log.Fatalf("invalid jwt_secret in config: %v", err)
 	}
 
-	authMgr := auth.NewManager(cfg.PasswordHash, cfg.TOTPSecret, jwtSecret)
+	authMgr := newAuthManager(cfg, jwtSecret, pepper)
+	if cfg.PveshRetries != nil {
+		containers.Retries = *cfg.PveshRetries
+	}
+	var addrPrefs []netip.Prefix
+	for _, p := range cfg.NodeAddressPreference {
+		addrPrefs = append(addrPrefs, netip.MustParsePrefix(p))
+	}
 	termMgr := terminal.NewManager(func(name string) string {
+		if len(addrPrefs) > 0 {
+			cands, err := containers.NodeAddressCandidates()
+			if err != nil {
+				log.Printf("resolving node %q: %v", name, err)
+				return ""
+			}
+			return containers.PreferredAddress(cands[name], addrPrefs)
+		}
 		addrs, err := containers.NodeAddresses()
 		if err != nil {
 			log.Printf("resolving node %q: %v", name, err)
@@ -53,6 +141,117 @@ func main() {
 		}
 		return addrs[name]
 	})
+	if cfg.ResizePolicy != "" {
+		termMgr.ResizePolicy = terminal.ResizePolicy(cfg.ResizePolicy)
+	}
+	termMgr.MaxSessionsPerNode = cfg.MaxSessionsPerNode
+	if cfg.OnDuplicateConnect != "" {
+		termMgr.OnDuplicate = terminal.DuplicatePolicy(cfg.OnDuplicateConnect)
+	}
+	if cfg.WSWriteRetries != nil {
+		termMgr.WriteRetries = *cfg.WSWriteRetries
+	}
+	if cfg.InputRateLimit != nil {
+		termMgr.InputRate = *cfg.InputRateLimit
+	}
+	if cfg.OutputRateLimit != nil {
+		termMgr.OutputRate = *cfg.OutputRateLimit
+	}
+	if cfg.LXCMode != "" {
+		termMgr.LXCMode = terminal.LXCMode(cfg.LXCMode)
+	}
+	termMgr.ScrollbackDir = cfg.ScrollbackDir
+	termMgr.DeadSessionLinger = cfg.DeadSessionLinger
+	if cfg.ScrollbackMaxBytes != 0 {
+		termMgr.ScrollbackMax = cfg.ScrollbackMaxBytes
+	}
+	if cfg.InputBurst != 0 {
+		termMgr.InputBurst = cfg.InputBurst
+	}
+	if cfg.OutputBurst != 0 {
+		termMgr.OutputBurst = cfg.OutputBurst
+	}
+	termMgr.OutputFlushInterval = cfg.OutputFlushInterval
+	if cfg.MaxMessageBytes != 0 {
+		termMgr.MaxMessageBytes = cfg.MaxMessageBytes
+	}
+	termMgr.MOTD = cfg.MOTD
+	for _, l := range cfg.TmuxLayouts {
+		termMgr.TmuxLayouts = append(termMgr.TmuxLayouts, terminal.TmuxLayout(l))
+	}
+	termMgr.SessionMaxLifetime = cfg.SessionMaxLifetime
+	termMgr.ClientIdleTimeout = cfg.ClientIdleTimeout
+	termMgr.SessionWrapper = cfg.SessionWrapper
+	termMgr.MeasureLatency = cfg.MeasureInputLatency
+	termMgr.RequireResumeToken = cfg.RequireResumeToken
+	termMgr.Locale = cfg.Locale
+	termMgr.Env = cfg.Env
+	termMgr.InheritEnv = cfg.InheritEnv
+	for _, t := range cfg.TargetEnv {
+		termMgr.TargetEnv = append(termMgr.TargetEnv, terminal.TargetEnv(t))
+	}
+	if cfg.MaxCols != 0 {
+		termMgr.MaxCols = cfg.MaxCols
+	}
+	if cfg.MaxRows != 0 {
+		termMgr.MaxRows = cfg.MaxRows
+	}
+	termMgr.DefaultCols, termMgr.DefaultRows = cfg.DefaultCols, cfg.DefaultRows
+	termMgr.CheckTmux = cfg.CheckTmux
+	termMgr.TmuxFallback = cfg.TmuxFallback
+	termMgr.SSHConnectTimeout = cfg.SSHConnectTimeout
+	termMgr.SSHJumpHost = cfg.SSHJumpHost
+	termMgr.SSHJumpHosts = cfg.SSHJumpHosts
+	termMgr.SSHIdentityFile = cfg.SSHIdentityFile
+	termMgr.SSHIdentityFiles = cfg.SSHIdentityFiles
+	if len(cfg.SSHHosts) > 0 {
+		termMgr.SSHHosts = make(map[string]terminal.SSHHost)
+		for _, h := range cfg.SSHHosts {
+			termMgr.SSHHosts[h.Name] = terminal.SSHHost{Address: h.Address, User: h.User}
+		}
+	}
+	termMgr.TerminalEvents = cfg.TerminalEvents
+
+	if *diagnose {
+		os.Exit(runDiagnose(os.Stdout, termMgr, *diagTimeout))
+	}
+
+	var sinks []audit.Sink
+	if cfg.AuditLog != "" {
+		auditLog, err := audit.Open(cfg.AuditLog)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		sinks = append(sinks, auditLog)
+	}
+	if cfg.WebhookURL != "" {
+		sinks = append(sinks, audit.NewWebhook(cfg.WebhookURL, cfg.WebhookSecret, cfg.WebhookQueueSize))
+	}
+	// record sends an event to the audit log, webhook and /api/events.
+	record := func(rec audit.Record) {
+		for _, s := range sinks {
+			s.Log(rec)
+		}
+	}
+	termMgr.OnConnEvent = func(ev terminal.ConnEvent) {
+		record(connRecord(ev))
+	}
+	termMgr.OnSessionStart = func(id string, pid int) {
+		record(audit.Record{Time: time.Now(), Event: "session_start", TerminalID: id, PID: pid})
+	}
+	termMgr.OnSessionEnd = func(id string, exitCode int) {
+		record(audit.Record{Time: time.Now(), Event: "session_end", TerminalID: id, ExitCode: &exitCode})
+	}
+
+	// SIGUSR1 dumps session state to the log, which works even when the
+	// HTTP side is wedged.
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			termMgr.DumpState()
+		}
+	}()
 
 	webRoot, err := fs.Sub(webFiles, "web")
 	if err != nil {
@@ -60,8 +259,95 @@ func main() {
 	}
 
 	srv := server.New(cfg, authMgr, termMgr, webRoot)
-	log.Printf("termbrowser listening on :%d", cfg.Port)
-	if err := srv.Run(); err != nil {
+	// Sessions only start once serving, so the hooks above see this.
+	sinks = append(sinks, srv.Events())
+	srv.OnLogin = func(ok bool, clientIP, requestID string) {
+		event := "login"
+		if !ok {
+			event = "login_failed"
+		}
+		record(audit.Record{Time: time.Now(), Event: event, ClientIP: clientIP, RequestID: requestID})
+	}
+	srv.SaveTOTPSecret = func(secret string) error {
+		return config.SetTOTPSecret(*configPath, cfg.Profile, secret)
+	}
+	ln, err := srv.Listen()
+	if err != nil {
+		log.Fatalf("server: %v", err)
+	}
+	if cfg.RunAsUser != "" {
+		creds, err := lookupCredentials(cfg.RunAsUser, cfg.RunAsGroup)
+		if err != nil {
+			log.Fatalf("config: %v", err)
+		}
+		if err := dropPrivileges(creds); err != nil {
+			log.Fatalf("dropping privileges: %v", err)
+		}
+		log.Printf("running as uid %d gid %d", creds.uid, creds.gid)
+	}
+	if err := srv.Serve(ln); err != nil {
 		log.Fatalf("server: %v", err)
 	}
 }
+
+// connRecord converts a terminal connection event to an audit record.
+func connRecord(ev terminal.ConnEvent) audit.Record {
+	rec := audit.Record{
+		Time:       ev.Time,
+		Event:      ev.Type,
+		User:       ev.Info.User,
+		TerminalID: ev.SessionID,
+		ClientIP:   ev.Info.ClientIP,
+		Conn:       ev.Conn,
+		RequestID:  ev.Info.RequestID,
+		BytesIn:    ev.BytesIn,
+		BytesOut:   ev.BytesOut,
+	}
+	if !ev.ConnectedAt.IsZero() {
+		rec.ConnectedAt = &ev.ConnectedAt
+	}
+	return rec
+}
+
+// newAuthManager sets up login checking and the session cookie as cfg
+// describes.
+func newAuthManager(cfg *config.Config, jwtSecret []byte, pepper string) *auth.Manager {
+	m := auth.NewManager(cfg.PasswordHash, cfg.TOTPSecret, jwtSecret)
+	m.Pepper = pepper
+	if cfg.TOTPSecretPrevious != "" {
+		m.PreviousTOTPSecrets = []string{cfg.TOTPSecretPrevious}
+		log.Printf("totp_secret_previous is set: codes from the old authenticator are still accepted")
+	}
+	m.CookieName = cfg.CookieName
+	switch cfg.CookieSecure {
+	case "true":
+		m.CookieSecure = auth.CookieSecureAlways
+	case "false":
+		m.CookieSecure = auth.CookieSecureNever
+	}
+	switch cfg.CookieSameSite {
+	case "lax":
+		m.CookieSameSite = http.SameSiteLaxMode
+	case "none":
+		m.CookieSameSite = http.SameSiteNoneMode
+	}
+	if len(cfg.APITokens) > 0 {
+		m.APITokens = make(map[[32]byte]auth.APIToken)
+		for _, t := range cfg.APITokens {
+			var sum [32]byte
+			hex.Decode(sum[:], []byte(t.SHA256))
+			scope, _ := auth.ParseScope(t.Scope)
+			m.APITokens[sum] = auth.APIToken{Name: t.Name, Scope: scope}
+		}
+	}
+	if cfg.TOTPSkew != nil {
+		m.TOTPSkew = *cfg.TOTPSkew
+	}
+	if cfg.TOTPDigits != 0 {
+		m.TOTPDigits = otp.Digits(cfg.TOTPDigits)
+	}
+	if cfg.TOTPPeriod != 0 {
+		m.TOTPPeriod = cfg.TOTPPeriod
+	}
+	return m
+}
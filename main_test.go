@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/chris/termbrowser/config"
+	"github.com/chris/termbrowser/terminal"
+)
+
+func TestConnRecord(t *testing.T) {
+	connected := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+	left := connected.Add(time.Hour)
+	info := terminal.ConnInfo{ClientIP: "192.0.2.1", User: "admin", RequestID: "r1"}
+	tests := []struct {
+		name string
+		ev   terminal.ConnEvent
+	}{
+		{"connect", terminal.ConnEvent{Type: "connect", SessionID: "lxc/pve/100", Conn: 2, Info: info, Time: connected}},
+		{"disconnect", terminal.ConnEvent{Type: "disconnect", SessionID: "lxc/pve/100", Conn: 2, Info: info, Time: left,
+			ConnectedAt: connected, BytesIn: 10, BytesOut: 2000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := connRecord(tt.ev)
+			if rec.Event != tt.ev.Type || rec.TerminalID != "lxc/pve/100" || rec.Conn != 2 ||
+				rec.ClientIP != "192.0.2.1" || rec.User != "admin" || rec.RequestID != "r1" || !rec.Time.Equal(tt.ev.Time) {
+				t.Errorf("record %+v doesn't match event %+v", rec, tt.ev)
+			}
+			if rec.BytesIn != tt.ev.BytesIn || rec.BytesOut != tt.ev.BytesOut {
+				t.Errorf("bytes %d/%d, want %d/%d", rec.BytesIn, rec.BytesOut, tt.ev.BytesIn, tt.ev.BytesOut)
+			}
+			if tt.ev.ConnectedAt.IsZero() {
+				if rec.ConnectedAt != nil {
+					t.Errorf("ConnectedAt = %v, want nil", rec.ConnectedAt)
+				}
+			} else if rec.ConnectedAt == nil || !rec.ConnectedAt.Equal(connected) {
+				t.Errorf("ConnectedAt = %v, want %v", rec.ConnectedAt, connected)
+			}
+		})
+	}
+}
+
+// loadConfig loads a config made of the required fields plus extra.
+func loadConfig(t *testing.T, extra string) *config.Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	base := "password_hash: x\ntotp_secret: JBSWY3DPEHPK3PXP\njwt_secret: 00\n"
+	if err := os.WriteFile(path, []byte(base+extra), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestAuthManagerPreviousTOTPSecret(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want []string
+	}{
+		{"", nil},
+		{"totp_secret_previous: KRSXG5CTMVRXEZLU\n", []string{"KRSXG5CTMVRXEZLU"}},
+	}
+	for _, tt := range tests {
+		m := newAuthManager(loadConfig(t, tt.yaml), []byte("secret"), "")
+		if !slices.Equal(m.PreviousTOTPSecrets, tt.want) {
+			t.Errorf("%q: PreviousTOTPSecrets = %q, want %q", tt.yaml, m.PreviousTOTPSecrets, tt.want)
+		}
+	}
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		wantName string
+		sameSite http.SameSite
+		secure   [2]bool // over plain HTTP, over HTTPS
+	}{
+		{"defaults", "", "tb_session", http.SameSiteStrictMode, [2]bool{false, true}},
+		{"custom name, lax", "cookie_name: tb_lab\ncookie_samesite: lax\n", "tb_lab", http.SameSiteLaxMode, [2]bool{false, true}},
+		{"secure auto", "cookie_secure: auto\n", "tb_session", http.SameSiteStrictMode, [2]bool{false, true}},
+		{"secure true", "cookie_secure: true\n", "tb_session", http.SameSiteStrictMode, [2]bool{true, true}},
+		{"secure false", "cookie_secure: false\n", "tb_session", http.SameSiteStrictMode, [2]bool{false, false}},
+		{"secure TRUE", "cookie_secure: \"TRUE\"\n", "tb_session", http.SameSiteStrictMode, [2]bool{true, true}},
+		{"none", "cookie_samesite: none\ncookie_secure: true\nallowed_origins: [\"https://portal.example.com\"]\n",
+			"tb_session", http.SameSiteNoneMode, [2]bool{true, true}},
+		{"none, auto", "cookie_samesite: none\nallowed_origins: [\"https://portal.example.com\"]\n",
+			"tb_session", http.SameSiteNoneMode, [2]bool{true, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newAuthManager(loadConfig(t, tt.yaml), []byte("secret"), "")
+			for i, https := range []bool{false, true} {
+				for _, set := range []func(http.ResponseWriter, bool){
+					func(w http.ResponseWriter, https bool) { m.SetCookie(w, "token", https) },
+					m.ClearCookie,
+				} {
+					rec := httptest.NewRecorder()
+					set(rec, https)
+					cookies := rec.Result().Cookies()
+					if len(cookies) != 1 {
+						t.Fatalf("%d cookies set", len(cookies))
+					}
+					c := cookies[0]
+					if c.Name != tt.wantName || c.SameSite != tt.sameSite || c.Secure != tt.secure[i] {
+						t.Errorf("https=%v: cookie %s samesite %v secure %v, want %s %v %v",
+							https, c.Name, c.SameSite, c.Secure, tt.wantName, tt.sameSite, tt.secure[i])
+					}
+				}
+			}
+
+			// The session is read back from the configured name only.
+			token, _ := m.IssueToken()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(&http.Cookie{Name: tt.wantName, Value: token})
+			if err := m.ValidateRequest(r); err != nil {
+				t.Errorf("ValidateRequest with %s: %v", tt.wantName, err)
+			}
+			r = httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(&http.Cookie{Name: tt.wantName + "_other", Value: token})
+			if err := m.ValidateRequest(r); err == nil {
+				t.Error("ValidateRequest accepted a cookie with another name")
+			}
+		})
+	}
+}
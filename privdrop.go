@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// credentials is the uid/gid to switch to with dropPrivileges.
+type credentials struct {
+	uid, gid int
+}
+
+// lookupCredentials resolves run_as_user and run_as_group, each a name or
+// a numeric id. Without a group, the user's primary group is used.
+func lookupCredentials(userName, groupName string) (credentials, error) {
+	u, err := user.Lookup(userName)
+	if _, ok := err.(user.UnknownUserError); ok {
+		u, err = user.LookupId(userName)
+	}
+	if err != nil {
+		return credentials{}, fmt.Errorf("run_as_user %q: %w", userName, err)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return credentials{}, fmt.Errorf("run_as_user %q: non-numeric uid %q", userName, u.Uid)
+	}
+
+	gidStr := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if _, ok := err.(user.UnknownGroupError); ok {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return credentials{}, fmt.Errorf("run_as_group %q: %w", groupName, err)
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return credentials{}, fmt.Errorf("non-numeric gid %q", gidStr)
+	}
+	return credentials{uid: uid, gid: gid}, nil
+}
+
+// dropPrivileges switches the process to c. Supplementary groups are
+// cleared and the gid set before the uid, since after setuid the process
+// would no longer be allowed to change its groups. Go applies these to
+// every thread.
+func dropPrivileges(c credentials) error {
+	if err := syscall.Setgroups([]int{c.gid}); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(c.gid); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(c.uid); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	// Make sure there's no way back.
+	if c.uid != 0 && syscall.Setuid(0) == nil {
+		return fmt.Errorf("privileges were not dropped: setuid(0) still succeeds")
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestLookupCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    string
+		group   string
+		want    credentials
+		wantErr string
+	}{
+		{"user name", "root", "", credentials{0, 0}, ""},
+		{"numeric uid", "0", "", credentials{0, 0}, ""},
+		{"primary group", "nobody", "", credentials{65534, 65534}, ""},
+		{"group name", "nobody", "root", credentials{65534, 0}, ""},
+		{"numeric gid", "root", "65534", credentials{0, 65534}, ""},
+		{"unknown user", "no-such-user-tb", "", credentials{}, `run_as_user "no-such-user-tb"`},
+		{"unknown uid", "4000000000", "", credentials{}, `run_as_user "4000000000"`},
+		{"unknown group", "root", "no-such-group-tb", credentials{}, `run_as_group "no-such-group-tb"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lookupCredentials(tt.user, tt.group)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Skipf("lookup failed, user database lacks the account: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDropPrivileges(t *testing.T) {
+	if os.Getenv("TB_TEST_DROP_CHILD") == "1" {
+		// Runs in the subprocess below, since the drop can't be undone.
+		if err := dropPrivileges(credentials{uid: 65534, gid: 65534}); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		groups, _ := os.Getgroups()
+		fmt.Printf("uid=%d euid=%d gid=%d egid=%d groups=%v\n", os.Getuid(), os.Geteuid(), os.Getgid(), os.Getegid(), groups)
+		os.Exit(0)
+	}
+	if os.Getuid() != 0 {
+		t.Skip("dropping privileges needs root")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivileges$")
+	cmd.Env = append(os.Environ(), "TB_TEST_DROP_CHILD=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("child: %v\n%s", err, out)
+	}
+	// Supplementary groups must be cleared too, or root's would linger.
+	want := "uid=65534 euid=65534 gid=65534 egid=65534 groups=[65534]\n"
+	if !strings.Contains(string(out), want) {
+		t.Errorf("after dropping privileges: %q, want %q", out, want)
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chris/termbrowser/containers"
+	"github.com/chris/termbrowser/ids"
+)
+
+// resourceCache holds the last cluster resource listing for a short time so
+// status lookups on every terminal connect don't each shell out to pvesh.
+type resourceCache struct {
+	ttl  time.Duration
+	list func() ([]containers.Container, error) // containers.ListAll, or a fake in tests
+
+	mu     sync.Mutex
+	at     time.Time
+	items  []containers.Container
+	byName map[string][]string // guest name to CTIDs, rebuilt with items
+}
+
+func (c *resourceCache) get() ([]containers.Container, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.items != nil && time.Since(c.at) < c.ttl {
+		return c.items, nil
+	}
+	items, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+	if items == nil {
+		items = []containers.Container{}
+	}
+	c.items, c.at = items, time.Now()
+	c.byName = make(map[string][]string)
+	for _, it := range items {
+		if (it.Type == "lxc" || it.Type == "qemu") && it.Name != "" {
+			c.byName[it.Name] = append(c.byName[it.Name], it.CTID)
+		}
+	}
+	return items, nil
+}
+
+// byGuestName returns the CTIDs of the guests called name: none, one, or
+// several when the name isn't unique in the cluster.
+func (c *resourceCache) byGuestName(name string) ([]string, error) {
+	if _, err := c.get(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.byName[name], nil
+}
+
+// invalidate drops the cached listing so the next get refetches it.
+func (c *resourceCache) invalidate() {
+	c.mu.Lock()
+	c.items = nil
+	c.mu.Unlock()
+}
+
+// lookup finds the resource a terminal id refers to. Bare numeric legacy
+// ids match an LXC container by vmid.
+func (c *resourceCache) lookup(id string) (containers.Container, bool, error) {
+	id, _ = ids.SplitInstance(id)
+	items, err := c.get()
+	if err != nil {
+		return containers.Container{}, false, err
+	}
+	for _, it := range items {
+		if it.CTID == id || (it.Type == "lxc" && it.VMID == id) {
+			return it, true, nil
+		}
+	}
+	return containers.Container{}, false, nil
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parseTrustedProxies turns the trusted_proxies config entries (CIDRs or
+// bare addresses) into prefixes. Entries were validated at config load, so
+// unparsable ones are skipped.
+func parseTrustedProxies(entries []string) []netip.Prefix {
+	var out []netip.Prefix
+	for _, e := range entries {
+		if p, err := netip.ParsePrefix(e); err == nil {
+			out = append(out, p.Masked())
+		} else if a, err := netip.ParseAddr(e); err == nil {
+			out = append(out, netip.PrefixFrom(a, a.BitLen()))
+		}
+	}
+	return out
+}
+
+func (s *Server) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range s.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client behind r. If the direct
+// peer is a trusted proxy, X-Forwarded-For is walked from the right and the
+// first address that isn't itself a trusted proxy is used; entries further
+// left could have been supplied by the client and are ignored. Otherwise
+// the header is ignored entirely so it can't be spoofed.
+func (s *Server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !s.trusted(peer) {
+		return host
+	}
+
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		for _, part := range strings.Split(h, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				hops = append(hops, part)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			// Garbage in the chain: stop at the last address we can vouch for.
+			break
+		}
+		if !s.trusted(addr) {
+			return addr.Unmap().String()
+		}
+		host = addr.Unmap().String()
+	}
+	return host
+}
+
+// isHTTPS reports whether r reached the client-facing side over HTTPS:
+// served with TLS, or from a trusted proxy whose X-Forwarded-Proto says
+// https. Only the last value counts, being the one the nearest proxy
+// added; anything before it could have come from the client.
+func (s *Server) isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !s.trusted(peer) {
+		return false
+	}
+	values := r.Header.Values("X-Forwarded-Proto")
+	if len(values) == 0 {
+		return false
+	}
+	last := values[len(values)-1]
+	if i := strings.LastIndex(last, ","); i >= 0 {
+		last = last[i+1:]
+	}
+	return strings.EqualFold(strings.TrimSpace(last), "https")
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/chris/termbrowser/auth"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		remote  string
+		xff     []string // one header line each
+		want    string
+	}{
+		{"no proxies configured", nil, "203.0.113.5:1234", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"untrusted peer sends XFF", []string{"10.0.0.0/8"}, "203.0.113.5:1234", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"trusted proxy, one hop", []string{"10.0.0.1"}, "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy, no header", []string{"10.0.0.1"}, "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"spoofed entry left of the client", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{"198.51.100.1, 10.0.0.2, 10.0.0.3"}, "198.51.100.1"},
+		{"split across header lines", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{"198.51.100.1", "10.0.0.2"}, "198.51.100.1"},
+		{"all hops trusted", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{"10.0.0.9, 10.0.0.2"}, "10.0.0.9"},
+		{"garbage stops the walk", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{"198.51.100.1, unknown, 10.0.0.2"}, "10.0.0.2"},
+		{"IPv6 client", []string{"10.0.0.1"}, "10.0.0.1:1234", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"IPv4-mapped proxy address", []string{"10.0.0.1"}, "[::ffff:10.0.0.1]:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"IPv6 trusted prefix", []string{"fd00::/8"}, "[fd00::1]:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{trustedProxies: parseTrustedProxies(tt.trusted)}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, h := range tt.xff {
+				r.Header.Add("X-Forwarded-For", h)
+			}
+			if got := s.clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsHTTPS(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		remote  string
+		proto   []string // one header line each
+		tls     bool
+		want    bool
+	}{
+		{"plain HTTP", nil, "203.0.113.5:1234", nil, false, false},
+		{"TLS", nil, "203.0.113.5:1234", nil, true, true},
+		{"untrusted peer claims https", []string{"10.0.0.0/8"}, "203.0.113.5:1234", []string{"https"}, false, false},
+		{"trusted proxy, https", []string{"10.0.0.1"}, "10.0.0.1:1234", []string{"https"}, false, true},
+		{"trusted proxy, HTTPS", []string{"10.0.0.1"}, "10.0.0.1:1234", []string{"HTTPS"}, false, true},
+		{"trusted proxy, http", []string{"10.0.0.1"}, "10.0.0.1:1234", []string{"http"}, false, false},
+		{"trusted proxy, no header", []string{"10.0.0.1"}, "10.0.0.1:1234", nil, false, false},
+		{"client's value left of the proxy's", []string{"10.0.0.1"}, "10.0.0.1:1234", []string{"https, http"}, false, false},
+		{"proxy's value last", []string{"10.0.0.1"}, "10.0.0.1:1234", []string{"http, https"}, false, true},
+		{"split across header lines", []string{"10.0.0.1"}, "10.0.0.1:1234", []string{"https", "http"}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{trustedProxies: parseTrustedProxies(tt.trusted)}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, h := range tt.proto {
+				r.Header.Add("X-Forwarded-Proto", h)
+			}
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if got := s.isHTTPS(r); got != tt.want {
+				t.Errorf("isHTTPS = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginCookieSecure(t *testing.T) {
+	tests := []struct {
+		name   string
+		secure auth.CookieSecurity
+		proto  string // X-Forwarded-Proto from the trusted proxy
+		want   bool
+	}{
+		{"auto over http", auth.CookieSecureAuto, "http", false},
+		{"auto over https", auth.CookieSecureAuto, "https", true},
+		{"true over http", auth.CookieSecureAlways, "http", true},
+		{"false over https", auth.CookieSecureNever, "https", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// httptest requests come from 192.0.2.1.
+			e := newTestEnv(t, "trusted_proxies: [192.0.2.1]\n")
+			e.auth.CookieSecure = tt.secure
+			body := `{"password":"pw","totp_code":"` + totpCode(t, e.srv.cfg.TOTPSecret) + `"}`
+			for _, r := range []*http.Request{
+				httptest.NewRequest("POST", "/api/login", strings.NewReader(body)),
+				httptest.NewRequest("POST", "/api/logout", nil),
+			} {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+				rec := e.do(t, r)
+				cookies := rec.Result().Cookies()
+				if rec.Code != http.StatusOK || len(cookies) != 1 {
+					t.Fatalf("%s: status %d, %d cookies", r.URL.Path, rec.Code, len(cookies))
+				}
+				if cookies[0].Secure != tt.want {
+					t.Errorf("%s: Secure = %v, want %v", r.URL.Path, cookies[0].Secure, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// compression reports the compression a WebSocket upgraded from r ended
+// up with. gorilla accepts permessage-deflate whenever compression is
+// enabled and the client offers it, and otherwise carries on without.
+func (s *Server) compression(r *http.Request) string {
+	if !s.upgrader.EnableCompression {
+		return "off"
+	}
+	for _, ext := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, offer := range strings.Split(ext, ",") {
+			name, _, _ := strings.Cut(offer, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return "permessage-deflate"
+			}
+		}
+	}
+	return "none offered"
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCompressionMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		offers  []string // Sec-WebSocket-Extensions lines
+		want    string
+	}{
+		{"disabled", false, []string{"permessage-deflate"}, "off"},
+		{"offered", true, []string{"permessage-deflate; client_max_window_bits"}, "permessage-deflate"},
+		{"one of several", true, []string{"x-webkit-deflate-frame, permessage-deflate"}, "permessage-deflate"},
+		{"second header line", true, []string{"x-webkit-deflate-frame", "permessage-deflate"}, "permessage-deflate"},
+		{"not offered", true, nil, "none offered"},
+		{"something else", true, []string{"x-webkit-deflate-frame"}, "none offered"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{upgrader: websocket.Upgrader{EnableCompression: tt.enabled}}
+			r := httptest.NewRequest("GET", "/", nil)
+			for _, h := range tt.offers {
+				r.Header.Add("Sec-WebSocket-Extensions", h)
+			}
+			if got := s.compression(r); got != tt.want {
+				t.Errorf("compression = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompressionFallback(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       string
+		clientOffers bool
+		wantDeflate  bool
+	}{
+		{"client offers", "", true, true},
+		{"old client", "", false, false},
+		{"disabled in config", "ws_compression: false\n", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, tt.config)
+			e.setResources(testResources...)
+			ts := e.startTerminals(t)
+			d := &websocket.Dialer{EnableCompression: tt.clientOffers}
+			conn, resp, err := e.dialTerminal(t, ts, "/ws/terminal/lxc/pve/100", d, nil)
+			if err != nil {
+				t.Fatalf("handshake failed: %v", err)
+			}
+			ext := resp.Header.Get("Sec-WebSocket-Extensions")
+			if got := strings.Contains(ext, "permessage-deflate"); got != tt.wantDeflate {
+				t.Errorf("Sec-WebSocket-Extensions = %q, want deflate %v", ext, tt.wantDeflate)
+			}
+			// Output that compresses well goes through either way.
+			line := strings.Repeat("abc", 200)
+			conn.WriteMessage(websocket.BinaryMessage, []byte(line+"\n"))
+			readUntil(t, conn, line+"\r\n"+line+"\r\n", nil)
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package server
+
+import "sync"
+
+// connLimiter counts open WebSocket terminals per client IP.
+type connLimiter struct {
+	max int // 0 means unlimited
+
+	mu    sync.Mutex
+	count map[string]int
+}
+
+// acquire reserves a connection slot for ip, reporting false if ip is
+// already at the limit. Each successful acquire must be paired with a
+// release.
+func (l *connLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.count[ip] >= l.max {
+		return false
+	}
+	if l.count == nil {
+		l.count = make(map[string]int)
+	}
+	l.count[ip]++
+	return true
+}
+
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.count[ip] <= 1 {
+		delete(l.count, ip)
+	} else {
+		l.count[ip]--
+	}
+}
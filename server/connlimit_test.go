@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConnLimiter(t *testing.T) {
+	l := &connLimiter{max: 2}
+	steps := []struct {
+		op   string
+		ip   string
+		want bool
+	}{
+		{"acquire", "192.0.2.1", true},
+		{"acquire", "192.0.2.1", true},
+		{"acquire", "192.0.2.1", false},
+		{"acquire", "192.0.2.2", true},
+		{"release", "192.0.2.1", true},
+		{"acquire", "192.0.2.1", true},
+		{"acquire", "192.0.2.1", false},
+	}
+	for i, st := range steps {
+		if st.op == "release" {
+			l.release(st.ip)
+			continue
+		}
+		if got := l.acquire(st.ip); got != st.want {
+			t.Errorf("step %d: acquire(%s) = %v, want %v", i, st.ip, got, st.want)
+		}
+	}
+
+	unlimited := &connLimiter{}
+	for range 100 {
+		if !unlimited.acquire("192.0.2.1") {
+			t.Fatal("a zero limit refused a connection")
+		}
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	e := newTestEnv(t, "max_conns_per_ip: 2\n")
+	e.setResources(testResources...)
+	ts := e.startTerminals(t)
+
+	var open []*websocket.Conn
+	for _, id := range []string{"lxc/pve/100%231", "lxc/pve/100%232"} {
+		conn, _, err := e.dialTerminal(t, ts, "/ws/terminal/"+id, nil, nil)
+		if err != nil {
+			t.Fatalf("dialing %s: %v", id, err)
+		}
+		open = append(open, conn)
+	}
+
+	_, resp, err := e.dialTerminal(t, ts, "/ws/terminal/lxc/pve/100%233", nil, nil)
+	if err == nil {
+		t.Fatal("third connection was accepted")
+	}
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("third connection: %v, want status 429", err)
+	}
+
+	// Closing one frees its slot once the server notices.
+	open[0].Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, _, err := e.dialTerminal(t, ts, "/ws/terminal/lxc/pve/100%233", nil, nil)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slot wasn't freed after closing a connection: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
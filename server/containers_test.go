@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/chris/termbrowser/containers"
+)
+
+// getContainers requests /api/containers with the given query and Accept
+// header, logged in.
+func getContainers(t *testing.T, e *testEnv, query, accept string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := e.login(t, httptest.NewRequest("GET", "/api/containers"+query, nil))
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	return e.do(t, r)
+}
+
+func TestContainersNDJSON(t *testing.T) {
+	e := newTestEnv(t, "")
+	e.setResources(testResources...)
+	rec := getContainers(t, e, "", "application/x-ndjson")
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q, want application/x-ndjson", ct)
+	}
+
+	var got []containers.Container
+	sc := bufio.NewScanner(rec.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.TrimSpace(line) == "" || line[0] != '{' {
+			t.Fatalf("line %q isn't a JSON object", line)
+		}
+		var c containers.Container
+		if err := json.Unmarshal([]byte(line), &c); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		got = append(got, c)
+	}
+	if len(got) != len(testResources) {
+		t.Fatalf("got %d lines, want %d", len(got), len(testResources))
+	}
+	for i := range got {
+		if got[i] != testResources[i] {
+			t.Errorf("line %d = %+v, want %+v", i, got[i], testResources[i])
+		}
+	}
+}
+
+func TestContainersDefaultJSON(t *testing.T) {
+	e := newTestEnv(t, "")
+	e.setResources(testResources...)
+	rec := getContainers(t, e, "", "")
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var got []containers.Container
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("body isn't a JSON array: %v", err)
+	}
+	if len(got) != len(testResources) {
+		t.Errorf("got %d items, want %d", len(got), len(testResources))
+	}
+}
+
+func TestContainersStatusFilter(t *testing.T) {
+	nodes := []string{"node:pve", "node:pve2"}
+	tests := []struct {
+		name  string
+		yaml  string
+		query string
+		want  []string
+	}{
+		{"no filter", "", "", append(nodes, "lxc/pve/100", "lxc/pve/101", "qemu/pve/200")},
+		{"default hides stopped", "default_status_filter: running\n", "", append(nodes, "lxc/pve/100")},
+		{"status=all overrides", "default_status_filter: running\n", "?status=all", append(nodes, "lxc/pve/100", "lxc/pve/101", "qemu/pve/200")},
+		{"status overrides", "default_status_filter: running\n", "?status=stopped", append(nodes, "lxc/pve/101", "qemu/pve/200")},
+		{"several statuses", "", "?status=running,stopped", append(nodes, "lxc/pve/100", "lxc/pve/101", "qemu/pve/200")},
+		{"no match keeps nodes", "", "?status=paused", nodes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, tt.yaml)
+			e.setResources(testResources...)
+			rec := getContainers(t, e, tt.query, "")
+			var got []containers.Container
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("body isn't a JSON array: %v", err)
+			}
+			var ctids []string
+			for _, c := range got {
+				ctids = append(ctids, c.CTID)
+			}
+			if !slices.Equal(ctids, tt.want) {
+				t.Errorf("listed %q, want %q", ctids, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainersCSV(t *testing.T) {
+	items := []containers.Container{
+		{CTID: "node:pve", Name: "pve", Type: "node", Status: "online"},
+		{CTID: "lxc/pve/100", Name: `web, "prod"`, Type: "lxc", Node: "pve", VMID: "100", Status: "running"},
+		{CTID: "qemu/pve/200", Name: "win\nbox", Type: "qemu", Node: "pve", VMID: "200", Status: "stopped"},
+	}
+	want := "ctid,name,type,node,vmid,status\n" +
+		"node:pve,pve,node,,,online\n" +
+		`lxc/pve/100,"web, ""prod""",lxc,pve,100,running` + "\n" +
+		"qemu/pve/200,\"win\nbox\",qemu,pve,200,stopped\n"
+	tests := []struct {
+		name, query, accept string
+		wantCSV             bool
+	}{
+		{"format param", "?format=csv", "", true},
+		{"Accept header", "", "text/csv", true},
+		{"Accept list", "", "text/csv;q=0.9, */*;q=0.1", true},
+		{"format param over NDJSON", "?format=csv", "application/x-ndjson", true},
+		{"JSON by default", "", "", false},
+		{"other format", "?format=xml", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, "")
+			e.setResources(items...)
+			rec := getContainers(t, e, tt.query, tt.accept)
+			ct := rec.Header().Get("Content-Type")
+			if !tt.wantCSV {
+				if ct != "application/json" {
+					t.Errorf("Content-Type = %q, want application/json", ct)
+				}
+				return
+			}
+			if ct != "text/csv; charset=utf-8" {
+				t.Errorf("Content-Type = %q, want text/csv", ct)
+			}
+			if cd := rec.Header().Get("Content-Disposition"); !strings.Contains(cd, "containers.csv") {
+				t.Errorf("Content-Disposition = %q", cd)
+			}
+			if rec.Body.String() != want {
+				t.Errorf("body:\n%s\nwant:\n%s", rec.Body, want)
+			}
+			records, err := csv.NewReader(strings.NewReader(rec.Body.String())).ReadAll()
+			if err != nil {
+				t.Fatalf("body isn't valid CSV: %v", err)
+			}
+			if len(records) != len(items)+1 || records[2][1] != items[1].Name || records[3][1] != items[2].Name {
+				t.Errorf("CSV doesn't round-trip: %q", records)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type errorBody struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeJSONError writes an error response in the shape every API endpoint
+// uses: {"error":{"code":"...","message":"..."}}. code is a stable,
+// machine-readable identifier; message is for humans.
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorBody{Error: errorDetail{Code: code, Message: message}})
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/chris/termbrowser/audit"
+)
+
+const (
+	// eventBuffer is how many events may wait for one /api/events client
+	// before further ones are dropped for it.
+	eventBuffer = 64
+
+	// eventKeepalive is how often an idle stream gets a comment line, so
+	// proxies don't time it out.
+	eventKeepalive = 30 * time.Second
+)
+
+// eventHub fans audit records out to /api/events subscribers. Publishing
+// never blocks: a subscriber whose buffer is full misses the event.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan audit.Record]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan audit.Record]struct{})}
+}
+
+// Log publishes rec to every subscriber, making the hub an audit.Sink.
+func (h *eventHub) Log(rec audit.Record) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- rec:
+		default:
+		}
+	}
+}
+
+func (h *eventHub) subscribe() chan audit.Record {
+	ch := make(chan audit.Record, eventBuffer)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan audit.Record) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+// Events returns the sink that feeds GET /api/events.
+func (s *Server) Events() audit.Sink {
+	return s.events
+}
+
+// handleEvents streams server activity as Server-Sent Events: one event
+// per audit record, named after its type, with the record as JSON data.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "streaming not supported")
+		return
+	}
+	clearDeadlines(w)
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	log.Printf("[EVENTS] %s req=%s: subscribed", s.clientIP(r), requestID(r))
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Printf("[EVENTS] %s req=%s: unsubscribed", s.clientIP(r), requestID(r))
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case rec := <-ch:
+			data, err := json.Marshal(rec)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", rec.Event, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chris/termbrowser/audit"
+)
+
+func (h *eventHub) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+func waitSubscribers(t *testing.T, h *eventHub, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); h.count() != n; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscribers, want %d", h.count(), n)
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	e := newTestEnv(t, "")
+	mux, _ := e.handlers(t)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/api/events", nil)
+	e.login(t, req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	waitSubscribers(t, e.srv.events, 1)
+
+	sent := audit.Record{Event: "session_start", TerminalID: "lxc/pve/100", PID: 4242}
+	e.srv.Events().Log(sent)
+
+	br := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stream: %v (so far %q)", err, lines)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	if lines[0] != "event: session_start" || lines[2] != "" {
+		t.Fatalf("event %q, want an event: line, a data: line and a blank line", lines)
+	}
+	var got audit.Record
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &got); err != nil {
+		t.Fatalf("data line %q: %v", lines[1], err)
+	}
+	if got.Event != sent.Event || got.TerminalID != sent.TerminalID || got.PID != sent.PID {
+		t.Errorf("received %+v, want %+v", got, sent)
+	}
+
+	cancel()
+	waitSubscribers(t, e.srv.events, 0)
+}
+
+func TestEventsRequireLogin(t *testing.T) {
+	e := newTestEnv(t, "")
+	rec := e.do(t, httptest.NewRequest("GET", "/api/events", nil))
+	wantJSONError(t, rec, http.StatusUnauthorized, "unauthorized")
+}
+
+func TestEventHubSlowSubscriber(t *testing.T) {
+	h := newEventHub()
+	slow := h.subscribe()
+	done := make(chan struct{})
+	go func() {
+		for range eventBuffer + 10 {
+			h.Log(audit.Record{Event: "connect"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing blocked on a subscriber that doesn't read")
+	}
+	if len(slow) != eventBuffer {
+		t.Errorf("subscriber holds %d events, want its buffer of %d", len(slow), eventBuffer)
+	}
+	h.unsubscribe(slow)
+	h.Log(audit.Record{Event: "connect"})
+	if len(slow) != eventBuffer {
+		t.Error("an unsubscribed channel still receives events")
+	}
+}
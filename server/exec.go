@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/chris/termbrowser/terminal"
+)
+
+type execRequest struct {
+	Command []string `json:"command"`
+}
+
+type execResponse struct {
+	Stdout    string `json:"stdout"`
+	Stderr    string `json:"stderr"`
+	Exit      int    `json:"exit"`
+	TimedOut  bool   `json:"timed_out,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// handleExec runs a one-off command on the target of a terminal id and
+// returns its output and exit code. The command is an argv list and is
+// never handed to a local shell; see terminal.Manager.Command for how it
+// is carried over ssh.
+func (s *Server) handleExec(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.terminalID(w, r)
+	if !ok {
+		return
+	}
+	var req execRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "request body must be JSON")
+		return
+	}
+	if len(req.Command) == 0 || req.Command[0] == "" {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "command must be a non-empty argv list")
+		return
+	}
+
+	clearDeadlines(w)
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.ExecTimeout)
+	defer cancel()
+	cmd, err := s.terminal.Command(ctx, id, req.Command...)
+	if errors.Is(err, terminal.ErrUnsupportedTarget) {
+		writeJSONError(w, http.StatusBadRequest, "unsupported_target", err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+	stdout := &cappedBuffer{max: s.cfg.ExecMaxOutputBytes}
+	stderr := &cappedBuffer{max: s.cfg.ExecMaxOutputBytes}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// Don't let a backgrounded grandchild holding the pipes open keep the
+	// request alive past the timeout.
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Run()
+	resp := execResponse{
+		Stdout:    string(stdout.buf),
+		Stderr:    string(stderr.buf),
+		TimedOut:  errors.Is(ctx.Err(), context.DeadlineExceeded),
+		Truncated: stdout.truncated || stderr.truncated,
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		resp.Exit = exitErr.ExitCode()
+	case resp.TimedOut:
+		resp.Exit = -1
+	default:
+		log.Printf("exec on %q req=%s: %v", id, requestID(r), err)
+		writeJSONError(w, http.StatusBadGateway, "exec_failed", err.Error())
+		return
+	}
+	log.Printf("exec on %q req=%s: %q exit=%d", id, requestID(r), req.Command[0], resp.Exit)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// cappedBuffer keeps the first max bytes written to it and silently drops
+// the rest, so a chatty command can't exhaust memory but still runs to
+// completion instead of failing on a write error.
+type cappedBuffer struct {
+	buf       []byte
+	max       int64
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	room := b.max - int64(len(b.buf))
+	if int64(len(p)) > room {
+		b.buf = append(b.buf, p[:max(room, 0)]...)
+		b.truncated = true
+	} else {
+		b.buf = append(b.buf, p...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExec(t *testing.T) {
+	e := newTestEnv(t, "exec_timeout: 500ms\nexec_max_output_bytes: 8\n")
+	tests := []struct {
+		name string
+		body string
+		want execResponse
+	}{
+		{"success", `{"command":["echo","hi"]}`, execResponse{Stdout: "hi\n"}},
+		{"argv isn't shell-interpreted", `{"command":["echo","$(id)"]}`, execResponse{Stdout: "$(id)\n"}},
+		{"non-zero exit", `{"command":["sh","-c","echo oops >&2; exit 3"]}`, execResponse{Stderr: "oops\n", Exit: 3}},
+		{"output cap", `{"command":["echo","0123456789"]}`, execResponse{Stdout: "01234567", Truncated: true}},
+		{"timeout", `{"command":["sleep","10"]}`, execResponse{Exit: -1, TimedOut: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			r := httptest.NewRequest("POST", "/api/exec/host", strings.NewReader(tt.body))
+			rec := e.do(t, e.login(t, r))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			var got execResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if d := time.Since(start); d > 5*time.Second {
+				t.Errorf("took %v", d)
+			}
+		})
+	}
+}
+
+func TestExecBadRequest(t *testing.T) {
+	e := newTestEnv(t, "")
+	tests := []struct {
+		name, id, body string
+		status         int
+		code           string
+	}{
+		{"not JSON", "host", `echo hi`, http.StatusBadRequest, "bad_request"},
+		{"empty command", "host", `{"command":[]}`, http.StatusBadRequest, "bad_request"},
+		{"empty program", "host", `{"command":[""]}`, http.StatusBadRequest, "bad_request"},
+		{"vm", "qemu/pve/200", `{"command":["ls"]}`, http.StatusBadRequest, "unsupported_target"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/exec/"+tt.id, strings.NewReader(tt.body))
+			wantJSONError(t, e.do(t, e.login(t, r)), tt.status, tt.code)
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/chris/termbrowser/terminal"
+)
+
+// checkFilePath validates a path for file transfer: it must be absolute and
+// clean, and when allow is non-empty it must be inside one of the listed
+// directories. It returns the cleaned path.
+func checkFilePath(p string, allow []string) (string, error) {
+	if !strings.HasPrefix(p, "/") {
+		return "", errors.New("path must be absolute")
+	}
+	p = path.Clean(p)
+	if len(allow) == 0 {
+		return p, nil
+	}
+	for _, dir := range allow {
+		dir = path.Clean(dir)
+		if p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/") {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not in an allowed directory", p)
+}
+
+// handleDownload streams a file from the target of a terminal id, read
+// with cat on the target. Files larger than file_transfer_max_bytes are cut
+// off by aborting the response, so a client never mistakes a truncated
+// download for a complete one.
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.terminalID(w, r)
+	if !ok {
+		return
+	}
+	p, err := checkFilePath(r.URL.Query().Get("path"), s.cfg.FileReadPaths)
+	if err != nil {
+		writeJSONError(w, http.StatusForbidden, "path_not_allowed", err.Error())
+		return
+	}
+
+	clearDeadlines(w)
+	cmd, err := s.terminal.Command(r.Context(), id, "cat", "--", p)
+	if errors.Is(err, terminal.ErrUnsupportedTarget) {
+		writeJSONError(w, http.StatusBadRequest, "unsupported_target", err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		log.Printf("download %s from %q req=%s: %v", p, id, requestID(r), err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "starting transfer failed")
+		return
+	}
+	defer cmd.Wait()
+
+	// Wait for the first byte (or EOF) before committing to a 200, so a
+	// missing file is reported as an error rather than an empty download.
+	br := bufio.NewReaderSize(stdout, 64<<10)
+	if _, err := br.Peek(1); err == io.EOF {
+		if werr := cmd.Wait(); werr != nil {
+			msg := strings.TrimSpace(stderr.String())
+			if msg == "" {
+				msg = werr.Error()
+			}
+			writeJSONError(w, http.StatusBadGateway, "transfer_failed", msg)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(p)}))
+	n, err := io.Copy(w, io.LimitReader(br, s.cfg.FileTransferMaxBytes+1))
+	if n > s.cfg.FileTransferMaxBytes {
+		log.Printf("download %s from %q req=%s: exceeds %d bytes, aborting", p, id, requestID(r), s.cfg.FileTransferMaxBytes)
+		cmd.Process.Kill()
+		panic(http.ErrAbortHandler)
+	}
+	if err != nil {
+		log.Printf("download %s from %q req=%s: %v", p, id, requestID(r), err)
+	}
+}
+
+// An upload is written to "<path>.tbpart" on the target and only renamed
+// into place once the whole body has been received, so a failed or
+// oversized upload never leaves a truncated file at the destination. The
+// rename is a separate command: cat exits cleanly when its input is cut
+// short, which can't be told apart from the end of the upload.
+const uploadSuffix = ".tbpart"
+
+// uploadScript writes stdin to $1. The path is passed as a positional
+// parameter, never interpolated.
+const uploadScript = `cat > "$1"`
+
+// uploadArgv is the command run on the target to write stdin to the
+// temporary file for p.
+func uploadArgv(p string) []string {
+	return []string{"sh", "-c", uploadScript, "termbrowser-upload", p + uploadSuffix}
+}
+
+type uploadResponse struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+// handleUpload writes the request body (raw, or the "file" part of a
+// multipart form) to a path on the target of a terminal id.
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.terminalID(w, r)
+	if !ok {
+		return
+	}
+	p, err := checkFilePath(r.URL.Query().Get("path"), s.cfg.FileWritePaths)
+	if err != nil {
+		writeJSONError(w, http.StatusForbidden, "path_not_allowed", err.Error())
+		return
+	}
+	max := s.cfg.FileTransferMaxBytes
+	if r.ContentLength > max {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("upload exceeds %d bytes", max))
+		return
+	}
+
+	clearDeadlines(w)
+	// Both the raw and the multipart path read through the limit; for
+	// multipart it covers the whole body, headers and boundaries included.
+	r.Body = http.MaxBytesReader(w, r.Body, max)
+	var body io.Reader = r.Body
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "multipart/form-data" {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		part, err := nextFilePart(mr)
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("upload exceeds %d bytes", max))
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		body = part
+	}
+
+	cmd, err := s.terminal.Command(r.Context(), id, uploadArgv(p)...)
+	if errors.Is(err, terminal.ErrUnsupportedTarget) {
+		writeJSONError(w, http.StatusBadRequest, "unsupported_target", err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+	counter := &countingReader{r: body}
+	var stderr bytes.Buffer
+	cmd.Stdin = counter
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if counter.err != nil || err != nil {
+		// Don't leave a partial upload behind, even if the client has gone.
+		s.runOnTarget(context.WithoutCancel(r.Context()), id, "rm", "-f", "--", p+uploadSuffix)
+	}
+	var tooBig *http.MaxBytesError
+	switch {
+	case errors.As(counter.err, &tooBig):
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("upload exceeds %d bytes", max))
+		return
+	case counter.err != nil:
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "reading upload: "+counter.err.Error())
+		return
+	case err != nil:
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		log.Printf("upload %s to %q req=%s: %v: %s", p, id, requestID(r), err, msg)
+		writeJSONError(w, http.StatusBadGateway, "transfer_failed", msg)
+		return
+	}
+	if msg, err := s.runOnTarget(r.Context(), id, "mv", "-f", "--", p+uploadSuffix, p); err != nil {
+		log.Printf("upload %s to %q req=%s: renaming: %v: %s", p, id, requestID(r), err, msg)
+		writeJSONError(w, http.StatusBadGateway, "transfer_failed", msg)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uploadResponse{Path: p, Bytes: counter.n})
+}
+
+// runOnTarget runs argv on the target of id and returns its trimmed
+// stderr, or the error itself if there was none, on failure.
+func (s *Server) runOnTarget(ctx context.Context, id string, argv ...string) (string, error) {
+	cmd, err := s.terminal.Command(ctx, id, argv...)
+	if err != nil {
+		return err.Error(), err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return msg, err
+		}
+		return err.Error(), err
+	}
+	return "", nil
+}
+
+// nextFilePart returns the "file" part of a multipart upload.
+func nextFilePart(mr *multipart.Reader) (*multipart.Part, error) {
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, errors.New(`multipart upload has no "file" part`)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+	}
+}
+
+// countingReader counts bytes read and remembers the first read error, so
+// a body-size failure can be told apart from a failure on the target.
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err != nil && err != io.EOF && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
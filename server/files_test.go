@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckFilePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		allow   []string
+		want    string
+		wantErr bool
+	}{
+		{"/var/log/syslog", nil, "/var/log/syslog", false},
+		{"var/log/syslog", nil, "", true},
+		{"", nil, "", true},
+		{"/var/log/../../etc/shadow", nil, "/etc/shadow", false},
+		{"/var/log/syslog", []string{"/var/log"}, "/var/log/syslog", false},
+		{"/var/log", []string{"/var/log/"}, "/var/log", false},
+		{"/var/logs/x", []string{"/var/log"}, "", true},
+		{"/var/log/../../etc/shadow", []string{"/var/log"}, "", true},
+		{"/tmp/x", []string{"/var/log", "/tmp"}, "/tmp/x", false},
+	}
+	for _, tt := range tests {
+		got, err := checkFilePath(tt.path, tt.allow)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("checkFilePath(%q, %q) = %q, %v; want %q, error %v", tt.path, tt.allow, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(file, []byte("hello\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	e := newTestEnv(t, "file_read_paths: ["+dir+"]\n")
+
+	tests := []struct {
+		name   string
+		id     string
+		path   string
+		status int
+		code   string
+	}{
+		{"ok", "host", file, http.StatusOK, ""},
+		{"relative path", "host", "notes.txt", http.StatusForbidden, "path_not_allowed"},
+		{"outside the allowlist", "host", "/etc/hostname", http.StatusForbidden, "path_not_allowed"},
+		{"escapes the allowlist", "host", dir + "/../../etc/hostname", http.StatusForbidden, "path_not_allowed"},
+		{"missing file", "host", filepath.Join(dir, "missing"), http.StatusBadGateway, "transfer_failed"},
+		{"vm", "qemu/pve/200", file, http.StatusBadRequest, "unsupported_target"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/files/"+tt.id+"?path="+url.QueryEscape(tt.path), nil)
+			rec := e.do(t, e.login(t, r))
+			if tt.code != "" {
+				wantJSONError(t, rec, tt.status, tt.code)
+				return
+			}
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if got := rec.Body.String(); got != "hello\n" {
+				t.Errorf("body %q, want %q", got, "hello\n")
+			}
+			if cd := rec.Header().Get("Content-Disposition"); cd != "attachment; filename=notes.txt" {
+				t.Errorf("Content-Disposition = %q", cd)
+			}
+		})
+	}
+}
+
+func TestUploadCommand(t *testing.T) {
+	script := "'" + uploadScript + "'"
+	ssh := []string{"ssh", "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=no", "root@pve"}
+	tests := []struct {
+		id   string
+		want []string
+	}{
+		{"host", []string{"sh", "-c", uploadScript, "termbrowser-upload", "/root/upload.txt.tbpart"}},
+		{"node:pve", append(slices.Clone(ssh), "sh", "-c", script, "termbrowser-upload", "/root/upload.txt.tbpart")},
+		{"lxc/pve/100", append(slices.Clone(ssh), "pct", "exec", "100", "--", "sh", "-c", script, "termbrowser-upload", "/root/upload.txt.tbpart")},
+		{"100", []string{"pct", "exec", "100", "--", "sh", "-c", uploadScript, "termbrowser-upload", "/root/upload.txt.tbpart"}},
+	}
+	e := newTestEnv(t, "")
+	for _, tt := range tests {
+		cmd, err := e.term.Command(context.Background(), tt.id, uploadArgv("/root/upload.txt")...)
+		if err != nil {
+			t.Errorf("%s: %v", tt.id, err)
+			continue
+		}
+		if !slices.Equal(cmd.Args, tt.want) {
+			t.Errorf("%s: args = %q\nwant %q", tt.id, cmd.Args, tt.want)
+		}
+	}
+}
+
+// multipartBody returns a multipart form with a "file" part holding data,
+// and its content type.
+func multipartBody(t *testing.T, data string) (*bytes.Buffer, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("file", "upload.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(fw, data)
+	mw.Close()
+	return &buf, mw.FormDataContentType()
+}
+
+func TestUpload(t *testing.T) {
+	dir := t.TempDir()
+	e := newTestEnv(t, "file_write_paths: ["+dir+"]\nfile_transfer_max_bytes: 512\n")
+	small, big := "hello\n", strings.Repeat("x", 513)
+
+	tests := []struct {
+		name      string
+		path      string
+		multipart bool
+		data      string
+		chunked   bool // no Content-Length, so only the body limit applies
+		status    int
+		code      string
+	}{
+		{"raw", "raw.txt", false, small, false, http.StatusOK, ""},
+		{"multipart", "form.txt", true, small, false, http.StatusOK, ""},
+		{"raw too large", "big.txt", false, big, false, http.StatusRequestEntityTooLarge, "too_large"},
+		{"raw too large, chunked", "big.txt", false, big, true, http.StatusRequestEntityTooLarge, "too_large"},
+		{"multipart too large, chunked", "big.txt", true, big, true, http.StatusRequestEntityTooLarge, "too_large"},
+		{"outside the allowlist", "../up.txt", false, small, false, http.StatusForbidden, "path_not_allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(dir, tt.path)
+			var body io.Reader = strings.NewReader(tt.data)
+			ct := "application/octet-stream"
+			if tt.multipart {
+				body, ct = multipartBody(t, tt.data)
+			}
+			r := httptest.NewRequest("POST", "/api/files/host?path="+url.QueryEscape(p), body)
+			r.Header.Set("Content-Type", ct)
+			if tt.chunked {
+				r.ContentLength = -1
+			}
+			rec := e.do(t, e.login(t, r))
+			if tt.code != "" {
+				wantJSONError(t, rec, tt.status, tt.code)
+				for _, f := range []string{p, p + uploadSuffix} {
+					if _, err := os.Stat(f); err == nil {
+						t.Errorf("%s was written", f)
+					}
+				}
+				return
+			}
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			var resp uploadResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Path != p || resp.Bytes != int64(len(tt.data)) {
+				t.Errorf("response %+v, want path %s, %d bytes", resp, p, len(tt.data))
+			}
+			if got, _ := os.ReadFile(p); string(got) != tt.data {
+				t.Errorf("%s holds %q, want %q", p, got, tt.data)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/chris/termbrowser/containers"
+	"github.com/gorilla/websocket"
+)
+
+// guestController starts guests and reports their status. The default
+// implementation calls pvesh; it is an interface so the start-then-connect
+// flow can run without a cluster.
+type guestController interface {
+	Start(node, typ, vmid string) error
+	Status(node, typ, vmid string) (string, error)
+}
+
+type pveGuests struct{}
+
+func (pveGuests) Start(node, typ, vmid string) error { return containers.Start(node, typ, vmid) }
+func (pveGuests) Status(node, typ, vmid string) (string, error) {
+	return containers.Status(node, typ, vmid)
+}
+
+// ensureRunning checks that the target of id can accept a terminal. With
+// auto_start enabled, a stopped guest is started and polled until running,
+// with progress written to conn. It returns an error describing why the
+// connection should be refused. Unknown ids and lookup failures are let
+// through so a pvesh hiccup doesn't block access.
+func (s *Server) ensureRunning(conn *websocket.Conn, id string) error {
+	if id == "host" {
+		return nil
+	}
+	res, ok, err := s.cache.lookup(id)
+	if err != nil {
+		log.Printf("checking status of %q: %v", id, err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+
+	switch res.Type {
+	case "node":
+		if res.Status != "online" {
+			return fmt.Errorf("node %s is %s", res.Name, res.Status)
+		}
+		return nil
+	case "lxc", "qemu":
+		if res.Status == "running" {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	kind := "container"
+	if res.Type == "qemu" {
+		kind = "VM"
+	}
+	if !s.cfg.AutoStart {
+		return fmt.Errorf("%s %s is %s", kind, res.VMID, res.Status)
+	}
+
+	progress := func(msg string) {
+		conn.WriteMessage(websocket.TextMessage, []byte(msg))
+	}
+	progress(fmt.Sprintf("Starting %s %s on %s...", kind, res.VMID, res.Node))
+	log.Printf("[WS] %q: auto-starting %s %s on %s", id, kind, res.VMID, res.Node)
+	if err := s.startAndWait(res, progress); err != nil {
+		progress("\r\n")
+		return fmt.Errorf("starting %s %s: %w", kind, res.VMID, err)
+	}
+	progress(" running.\r\n")
+	s.cache.invalidate()
+	return nil
+}
+
+// startAndWait starts res and polls its status until it is running or the
+// configured timeout elapses, calling progress on each poll.
+func (s *Server) startAndWait(res containers.Container, progress func(string)) error {
+	if err := s.guests.Start(res.Node, res.Type, res.VMID); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(s.cfg.AutoStartTimeout)
+	for {
+		status, err := s.guests.Status(res.Node, res.Type, res.VMID)
+		if err != nil {
+			log.Printf("polling status of %s: %v", res.CTID, err)
+		} else if status == "running" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("still %s after %v", status, s.cfg.AutoStartTimeout)
+		}
+		progress(".")
+		time.Sleep(time.Second)
+	}
+}
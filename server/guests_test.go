@@ -0,0 +1,202 @@
+package server
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chris/termbrowser/containers"
+	"github.com/gorilla/websocket"
+)
+
+// fakeGuests is a guestController whose guests report statuses in turn.
+type fakeGuests struct {
+	mu       sync.Mutex
+	statuses []string // returned by successive Status calls; the last repeats
+	startErr error
+	started  []string
+	polls    int
+}
+
+func (f *fakeGuests) Start(node, typ, vmid string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.started = append(f.started, typ+"/"+node+"/"+vmid)
+	return f.startErr
+}
+
+func (f *fakeGuests) Status(node, typ, vmid string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st := f.statuses[min(f.polls, len(f.statuses)-1)]
+	f.polls++
+	return st, nil
+}
+
+var testResources = []containers.Container{
+	{CTID: "node:pve", Name: "pve", Type: "node", Status: "online"},
+	{CTID: "node:pve2", Name: "pve2", Type: "node", Status: "offline"},
+	{CTID: "lxc/pve/100", Name: "web", Type: "lxc", Node: "pve", VMID: "100", Status: "running"},
+	{CTID: "lxc/pve/101", Name: "db", Type: "lxc", Node: "pve", VMID: "101", Status: "stopped"},
+	{CTID: "qemu/pve/200", Name: "win", Type: "qemu", Node: "pve", VMID: "200", Status: "stopped"},
+}
+
+// readClose reads from conn until the server closes it, returning the
+// text frames it sent on the way and the close error.
+func readClose(t *testing.T, conn *websocket.Conn) (string, *websocket.CloseError) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var text strings.Builder
+	for {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			ce, ok := err.(*websocket.CloseError)
+			if !ok {
+				t.Fatalf("reading: %v (text so far %q)", err, text.String())
+			}
+			return text.String(), ce
+		}
+		if typ == websocket.TextMessage {
+			text.Write(data)
+		}
+	}
+}
+
+func TestStoppedTargetRejected(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         string
+		wantReason string // empty if the connection should go through
+	}{
+		{"running container", "lxc/pve/100", ""},
+		{"stopped container", "lxc/pve/101", "container 101 is stopped"},
+		{"stopped container by legacy id", "101", "container 101 is stopped"},
+		{"stopped VM", "qemu/pve/200", "VM 200 is stopped"},
+		{"online node", "node:pve", ""},
+		{"offline node", "node:pve2", "node pve2 is offline"},
+		{"unknown guest", "lxc/pve/999", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, "check_guest_status: true\n")
+			e.setResources(testResources...)
+			ts := e.startTerminals(t)
+			conn, _, err := e.dialTerminal(t, ts, "/ws/terminal/"+tt.id, nil, nil)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			if tt.wantReason == "" {
+				conn.WriteMessage(websocket.BinaryMessage, []byte("ping\n"))
+				readUntil(t, conn, "ping", nil)
+				return
+			}
+			text, ce := readClose(t, conn)
+			if ce.Code != websocket.ClosePolicyViolation || ce.Text != tt.wantReason {
+				t.Errorf("closed with %d %q, want %d %q", ce.Code, ce.Text, websocket.ClosePolicyViolation, tt.wantReason)
+			}
+			if !strings.Contains(text, tt.wantReason) {
+				t.Errorf("error message %q doesn't mention %q", text, tt.wantReason)
+			}
+			if n := len(e.term.Sessions()); n != 0 {
+				t.Errorf("%d sessions started for a refused target", n)
+			}
+		})
+	}
+}
+
+func TestCheckGuestStatusOff(t *testing.T) {
+	e := newTestEnv(t, "")
+	e.setResources(testResources...)
+	ts := e.startTerminals(t)
+	conn, _, err := e.dialTerminal(t, ts, "/ws/terminal/lxc/pve/101", nil, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.WriteMessage(websocket.BinaryMessage, []byte("ping\n"))
+	readUntil(t, conn, "ping", nil)
+}
+
+func TestAutoStart(t *testing.T) {
+	tests := []struct {
+		name        string
+		id          string
+		statuses    []string
+		startErr    error
+		wantStarted []string
+		wantReason  string // empty if the connection should go through
+		wantText    []string
+	}{
+		{
+			name:        "stopped container comes up",
+			id:          "lxc/pve/101",
+			statuses:    []string{"stopped", "running"},
+			wantStarted: []string{"lxc/pve/101"},
+			wantText:    []string{"Starting container 101 on pve...", ".", " running.\r\n"},
+		},
+		{
+			name:        "stopped VM already running on first poll",
+			id:          "qemu/pve/200",
+			statuses:    []string{"running"},
+			wantStarted: []string{"qemu/pve/200"},
+			wantText:    []string{"Starting VM 200 on pve...", " running.\r\n"},
+		},
+		{
+			name:        "start fails",
+			id:          "lxc/pve/101",
+			statuses:    []string{"stopped"},
+			startErr:    errors.New("storage offline"),
+			wantStarted: []string{"lxc/pve/101"},
+			wantReason:  "starting container 101: storage offline",
+		},
+		{
+			name:        "never comes up",
+			id:          "lxc/pve/101",
+			statuses:    []string{"stopped"},
+			wantStarted: []string{"lxc/pve/101"},
+			wantReason:  "starting container 101: still stopped after 1s",
+		},
+		{
+			name:     "already running",
+			id:       "lxc/pve/100",
+			statuses: []string{"running"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, "auto_start: true\nauto_start_timeout: 1s\n")
+			e.setResources(testResources...)
+			guests := &fakeGuests{statuses: tt.statuses, startErr: tt.startErr}
+			e.srv.guests = guests
+			ts := e.startTerminals(t)
+
+			conn, _, err := e.dialTerminal(t, ts, "/ws/terminal/"+tt.id, nil, nil)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			var text strings.Builder
+			if tt.wantReason == "" {
+				conn.WriteMessage(websocket.BinaryMessage, []byte("ping\n"))
+				readUntil(t, conn, "ping", &text)
+			} else {
+				got, ce := readClose(t, conn)
+				text.WriteString(got)
+				if ce.Code != websocket.ClosePolicyViolation || ce.Text != tt.wantReason {
+					t.Errorf("closed with %d %q, want %d %q", ce.Code, ce.Text, websocket.ClosePolicyViolation, tt.wantReason)
+				}
+			}
+			for _, want := range tt.wantText {
+				if !strings.Contains(text.String(), want) {
+					t.Errorf("progress %q doesn't contain %q", text.String(), want)
+				}
+			}
+			guests.mu.Lock()
+			defer guests.mu.Unlock()
+			if !slices.Equal(guests.started, tt.wantStarted) {
+				t.Errorf("started %v, want %v", guests.started, tt.wantStarted)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"github.com/chris/termbrowser/ids"
+	"github.com/chris/termbrowser/terminal"
+)
+
+// idAllowed applies allowed_id_patterns and denied_id_patterns to a
+// terminal id, ignoring any #instance suffix. A deny match always wins;
+// with an allow list set, the id must also match one of its patterns.
+func (s *Server) idAllowed(id string) bool {
+	id, _ = ids.SplitInstance(id)
+	for _, p := range s.cfg.DeniedIDPatterns {
+		if terminal.MatchID(p, id) {
+			return false
+		}
+	}
+	if len(s.cfg.AllowedIDPatterns) == 0 {
+		return true
+	}
+	for _, p := range s.cfg.AllowedIDPatterns {
+		if terminal.MatchID(p, id) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIDAllowed(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+		id    string
+		want  bool
+	}{
+		{"no patterns", "", "host", true},
+		{"host denied", "denied_id_patterns: [host]\n", "host", false},
+		{"host denied, instance too", "denied_id_patterns: [host]\n", "host#2", false},
+		{"host denied, containers still allowed", "denied_id_patterns: [host]\n", "lxc/pve/100", true},
+		{"allow list only containers: lxc", "allowed_id_patterns: [lxc/*]\n", "lxc/pve/100", true},
+		{"allow list only containers: host", "allowed_id_patterns: [lxc/*]\n", "host", false},
+		{"allow list only containers: node", "allowed_id_patterns: [lxc/*]\n", "node:pve", false},
+		{"deny wins over allow", "allowed_id_patterns: [lxc/*]\ndenied_id_patterns: [lxc/pve/100]\n", "lxc/pve/100", false},
+		{"deny wins, others allowed", "allowed_id_patterns: [lxc/*]\ndenied_id_patterns: [lxc/pve/100]\n", "lxc/pve/101", true},
+		{"deny by node", "denied_id_patterns: ['lxc/pve2/*', 'node:pve2']\n", "lxc/pve2/100", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, tt.extra)
+			if got := e.srv.idAllowed(tt.id); got != tt.want {
+				t.Errorf("idAllowed(%q) = %v, want %v", tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeniedIDRejected(t *testing.T) {
+	e := newTestEnv(t, "denied_id_patterns: [host]\nallowed_id_patterns: ['lxc/*', host]\n")
+	e.setResources(testResources...)
+	ts := e.startTerminals(t)
+
+	_, resp, err := e.dialTerminal(t, ts, "/ws/terminal/host", nil, nil)
+	if err == nil {
+		t.Fatal("host terminal connected despite being denied")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("response %v, want 403", resp)
+	}
+	conn, _, err := e.dialTerminal(t, ts, "/ws/terminal/lxc/pve/100", nil, nil)
+	if err != nil {
+		t.Fatalf("lxc terminal: %v", err)
+	}
+	conn.Close()
+
+	rec := e.do(t, e.login(t, httptest.NewRequest("GET", "/api/sessions/host/scrollback", nil)))
+	wantJSONError(t, rec, http.StatusForbidden, "forbidden_id")
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/chris/termbrowser/ids"
+)
+
+var errLegacyDisabled = errors.New("bare numeric ids are disabled; use lxc/{node}/{vmid}")
+
+// terminalID reads and validates the {id} path value, resolving
+// "name:{guest}" ids to the guest's CTID, then applies the legacy_ids
+// setting to bare numeric container ids. The id pattern
+// lists are checked both before and after resolution. On failure it
+// writes the error response and returns false.
+func (s *Server) terminalID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id := r.PathValue("id")
+	if name, ok := strings.CutPrefix(id, "name:"); ok {
+		if id, ok = s.resolveGuestName(w, r, name); !ok {
+			return "", false
+		}
+	}
+	p, err := ids.Parse(id)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_id", "invalid terminal id: "+err.Error())
+		return "", false
+	}
+	if !s.idAllowed(id) {
+		writeJSONError(w, http.StatusForbidden, "forbidden_id", "terminal id not allowed on this server")
+		return "", false
+	}
+	if p.Kind == ids.SSH && !s.hasSSHHost(p.Node) {
+		writeJSONError(w, http.StatusNotFound, "not_found", "no ssh_hosts entry named "+p.Node)
+		return "", false
+	}
+	id, err = s.resolveLegacyID(p)
+	switch {
+	case errors.Is(err, errLegacyDisabled):
+		writeJSONError(w, http.StatusBadRequest, "invalid_id", err.Error())
+		return "", false
+	case err != nil:
+		log.Printf("resolving %q req=%s: %v", r.PathValue("id"), requestID(r), err)
+		writeJSONError(w, http.StatusNotFound, "not_found", err.Error())
+		return "", false
+	}
+	if !s.idAllowed(id) {
+		writeJSONError(w, http.StatusForbidden, "forbidden_id", "terminal id not allowed on this server")
+		return "", false
+	}
+	return id, true
+}
+
+// resolveLegacyID rewrites a bare numeric ctid according to legacy_ids:
+// "local" keeps it (pct exec on this host), "resolve" finds the node the
+// container runs on and returns the equivalent lxc/{node}/{ctid} id so it
+// is routed over ssh, and "off" rejects it. Other ids pass through.
+func (s *Server) resolveLegacyID(p ids.ParsedID) (string, error) {
+	id := p.String()
+	if p.Kind != ids.LocalLXC {
+		return id, nil
+	}
+	base, instance := p.VMID, p.Instance
+	switch s.cfg.LegacyIDs {
+	case "off":
+		return "", errLegacyDisabled
+	case "resolve":
+		ct, ok, err := s.cache.lookup(base)
+		if err != nil {
+			return "", fmt.Errorf("looking up container %s: %w", base, err)
+		}
+		if !ok || ct.Type != "lxc" || ct.Node == "" {
+			return "", fmt.Errorf("no container with id %s", base)
+		}
+		resolved := "lxc/" + ct.Node + "/" + ct.VMID
+		if instance != "" {
+			resolved += "#" + instance
+		}
+		return resolved, nil
+	}
+	return id, nil
+}
+
+// resolveGuestName turns the name of a container or VM, optionally with a
+// "#instance" suffix, into its CTID. Names must be unique in the cluster
+// to be used this way. On failure it writes the error response and
+// returns false.
+func (s *Server) resolveGuestName(w http.ResponseWriter, r *http.Request, name string) (string, bool) {
+	name, instance := ids.SplitInstance(name)
+	found, err := s.cache.byGuestName(name)
+	if err != nil {
+		log.Printf("resolving guest name %q req=%s: %v", name, requestID(r), err)
+		writeJSONError(w, http.StatusBadGateway, "lookup_failed", "could not list guests to resolve the name")
+		return "", false
+	}
+	switch len(found) {
+	case 0:
+		writeJSONError(w, http.StatusNotFound, "not_found", "no container or VM named "+name)
+		return "", false
+	case 1:
+	default:
+		writeJSONError(w, http.StatusConflict, "ambiguous_name",
+			fmt.Sprintf("%d guests are named %s (%s); use the full id", len(found), name, strings.Join(found, ", ")))
+		return "", false
+	}
+	id := found[0]
+	if instance != "" {
+		id += "#" + instance
+	}
+	return id, true
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/chris/termbrowser/ids"
+	"github.com/gorilla/websocket"
+)
+
+func TestResolveLegacyID(t *testing.T) {
+	errNotFound := errors.New("not found")
+	tests := []struct {
+		mode    string
+		id      string
+		want    string
+		wantErr error
+	}{
+		{"local", "100", "100", nil},
+		{"local", "100#2", "100#2", nil},
+		{"resolve", "100", "lxc/pve/100", nil},
+		{"resolve", "101#2", "lxc/pve/101#2", nil},
+		{"resolve", "999", "", errNotFound},
+		{"resolve", "200", "", errNotFound}, // a VM, not a container
+		{"resolve", "lxc/pve2/100", "lxc/pve2/100", nil},
+		{"resolve", "node:pve", "node:pve", nil},
+		{"off", "100", "", errLegacyDisabled},
+		{"off", "lxc/pve/100", "lxc/pve/100", nil},
+	}
+	for _, tt := range tests {
+		e := newTestEnv(t, "legacy_ids: "+tt.mode+"\n")
+		e.setResources(testResources...)
+		p, err := ids.Parse(tt.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := e.srv.resolveLegacyID(p)
+		switch {
+		case tt.wantErr == nil && (err != nil || got != tt.want):
+			t.Errorf("%s %q = %q, %v; want %q", tt.mode, tt.id, got, err, tt.want)
+		case tt.wantErr == errNotFound && err == nil:
+			t.Errorf("%s %q = %q, want an error", tt.mode, tt.id, got)
+		case tt.wantErr == errLegacyDisabled && !errors.Is(err, errLegacyDisabled):
+			t.Errorf("%s %q: err = %v, want %v", tt.mode, tt.id, err, errLegacyDisabled)
+		}
+	}
+}
+
+// With legacy_ids: resolve a bare ctid opens the lxc/{node}/{ctid}
+// session, which runs pct over ssh to the container's node.
+func TestLegacyIDResolvedTerminal(t *testing.T) {
+	e := newTestEnv(t, "legacy_ids: resolve\n")
+	e.setResources(testResources...)
+	ts := e.startTerminals(t)
+	var mu sync.Mutex
+	var built []string
+	e.term.BuildCommand = func(id string) *exec.Cmd {
+		mu.Lock()
+		built = append(built, id)
+		mu.Unlock()
+		return exec.Command("cat")
+	}
+	conn, _, err := e.dialTerminal(t, ts, "/ws/terminal/100", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteMessage(websocket.BinaryMessage, []byte("hi\n"))
+	readUntil(t, conn, "hi", nil)
+	mu.Lock()
+	if !slices.Equal(built, []string{"lxc/pve/100"}) {
+		t.Errorf("sessions built for %q, want [lxc/pve/100]", built)
+	}
+	mu.Unlock()
+
+	cmd, err := e.term.Command(context.Background(), "lxc/pve/100", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ssh", "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=no", "root@pve", "pct", "exec", "100", "--", "true"}
+	if !slices.Equal(cmd.Args, want) {
+		t.Errorf("args = %q, want %q", cmd.Args, want)
+	}
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation (SD_LISTEN_FDS_START).
+const listenFDsStart = 3
+
+// systemdListener returns the listening socket passed by systemd socket
+// activation, or nil if the process wasn't socket-activated. Only the first
+// socket is used. The activation variables are cleared so child processes
+// (shells included) don't try to claim the socket too.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(listenFDsStart, "systemd-socket")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("using systemd socket: %w", err)
+	}
+	return ln, nil
+}
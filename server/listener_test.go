@@ -0,0 +1,200 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSystemdListenerNotActivated(t *testing.T) {
+	tests := []struct {
+		name string
+		pid  string
+		fds  string
+	}{
+		{"no variables", "", ""},
+		{"another process's socket", "1", "1"},
+		{"no sockets", strconv.Itoa(os.Getpid()), "0"},
+		{"malformed count", strconv.Itoa(os.Getpid()), "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LISTEN_PID", tt.pid)
+			t.Setenv("LISTEN_FDS", tt.fds)
+			ln, err := systemdListener()
+			if ln != nil || err != nil {
+				t.Errorf("systemdListener() = %v, %v; want nil, nil", ln, err)
+			}
+		})
+	}
+}
+
+// TestSystemdListener passes a listening socket to a child process as fd
+// 3, the way systemd does, and checks the server in the child serves on it.
+func TestSystemdListener(t *testing.T) {
+	if os.Getenv("TB_TEST_SOCKET_CHILD") == "1" {
+		serveActivatedSocket(t)
+		return
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close() // the child's copy keeps the socket open
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdListener$")
+	cmd.Env = append(os.Environ(), "TB_TEST_SOCKET_CHILD=1", "TB_TEST_SOCKET_ADDR="+addr, "LISTEN_FDS=1")
+	cmd.ExtraFiles = []*os.File{f}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &syncBuffer{}
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get("http://" + addr + "/healthz")
+	if err == nil {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "ok\n" {
+			t.Errorf("GET /healthz = %q", body)
+		}
+	} else {
+		t.Errorf("GET /healthz: %v", err)
+	}
+
+	stdin.Close() // tells the child to stop
+	if err := cmd.Wait(); err != nil || !strings.Contains(out.String(), "PASS") {
+		t.Errorf("child: %v\n%s", err, out)
+	}
+}
+
+// serveActivatedSocket is the child side of TestSystemdListener.
+func serveActivatedSocket(t *testing.T) {
+	// systemd sets LISTEN_PID to the pid it just started, which the parent
+	// can't know in advance.
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	e := newTestEnv(t, "")
+	ln, err := e.srv.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ln.Addr().String(), os.Getenv("TB_TEST_SOCKET_ADDR"); got != want {
+		t.Fatalf("listening on %s, want the passed socket %s", got, want)
+	}
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS"} {
+		if _, ok := os.LookupEnv(v); ok {
+			t.Errorf("%s is still set for child processes", v)
+		}
+	}
+	go e.srv.Serve(ln)
+	io.Copy(io.Discard, os.Stdin)
+}
+
+func TestAdminListenerRoutes(t *testing.T) {
+	tests := []struct {
+		method, path string
+		admin        bool // served only on the admin listener
+	}{
+		{"GET", "/healthz", true},
+		{"GET", "/metrics", true},
+		{"POST", "/api/totp/rotate", true},
+		{"POST", "/api/totp/confirm", true},
+		{"POST", "/api/sessions/host/close", true},
+		{"POST", "/api/sessions/host/input", true},
+		{"GET", "/api/sessions", false},
+		{"GET", "/api/containers", false},
+		{"GET", "/api/config", false},
+	}
+	for _, split := range []bool{false, true} {
+		e := newTestEnv(t, "")
+		if split {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { ln.Close() })
+			e.srv.adminLn = ln
+		}
+		mux, admin := e.handlers(t)
+		for _, tt := range tests {
+			for _, h := range []struct {
+				name    string
+				handler http.Handler
+				serves  bool
+			}{
+				{"main", mux, !split || !tt.admin},
+				{"admin", admin, !split || tt.admin},
+			} {
+				rec := httptest.NewRecorder()
+				h.handler.ServeHTTP(rec, e.login(t, httptest.NewRequest(tt.method, tt.path, strings.NewReader("{}"))))
+				// Handlers' own 404s, for a missing session, are JSON.
+				unrouted := rec.Code == http.StatusNotFound && rec.Header().Get("Content-Type") != "application/json"
+				if served := !unrouted; served != h.serves {
+					t.Errorf("split=%v: %s %s on the %s listener: status %d, want served %v",
+						split, tt.method, tt.path, h.name, rec.Code, h.serves)
+				}
+			}
+		}
+	}
+}
+
+func TestAdminListenerServe(t *testing.T) {
+	e := newTestEnv(t, "")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.srv.adminLn = adminLn
+	done := make(chan error, 1)
+	go func() { done <- e.srv.Serve(ln) }()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	get := func(addr string) int {
+		resp, err := client.Get("http://" + addr + "/healthz")
+		if err != nil {
+			t.Fatalf("GET %s/healthz: %v", addr, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get(adminLn.Addr().String()); code != http.StatusOK {
+		t.Errorf("admin /healthz: status %d, want 200", code)
+	}
+	if code := get(ln.Addr().String()); code != http.StatusNotFound {
+		t.Errorf("main /healthz: status %d, want 404", code)
+	}
+
+	// Losing either listener stops both servers.
+	adminLn.Close()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Serve didn't return after the admin listener closed")
+	}
+	if _, err := client.Get("http://" + ln.Addr().String() + "/api/config"); err == nil {
+		t.Error("main listener still serving after the admin one stopped")
+	}
+}
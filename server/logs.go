@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/chris/termbrowser/terminal"
+	"github.com/gorilla/websocket"
+)
+
+// handleLogs streams a log from the target of a terminal id over a
+// WebSocket: ?unit=syslog (the default) or a systemd unit. The command is
+// fixed and read-only; anything the client sends is discarded. The socket
+// is closed when the command exits.
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.terminalID(w, r)
+	if !ok {
+		return
+	}
+	unit := r.URL.Query().Get("unit")
+	if unit == "" {
+		unit = "syslog"
+	}
+	if !terminal.ValidLogUnit(unit) {
+		writeJSONError(w, http.StatusBadRequest, "invalid_unit", "unit must be syslog or a systemd unit name")
+		return
+	}
+
+	ip := s.clientIP(r)
+	if !s.conns.acquire(ip) {
+		writeJSONError(w, http.StatusTooManyRequests, "too_many_connections", "too many terminal connections from this address")
+		return
+	}
+	defer s.conns.release(ip)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmd, err := s.terminal.LogCommand(ctx, id, unit)
+	if errors.Is(err, terminal.ErrUnsupportedTarget) {
+		writeJSONError(w, http.StatusBadRequest, "unsupported_target", err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	cmd.WaitDelay = time.Second
+
+	conn, err := s.upgrader.Upgrade(w, r, upgradeHeader(r))
+	if err != nil {
+		log.Printf("websocket upgrade req=%s: %v", requestID(r), err)
+		return
+	}
+	defer conn.Close()
+
+	if err := cmd.Start(); err != nil {
+		log.Printf("[LOGS] %q req=%s: starting: %v", id, requestID(r), err)
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "could not start log command"), time.Now().Add(time.Second))
+		return
+	}
+	log.Printf("[LOGS] %q req=%s: following %s for %s", id, requestID(r), unit, ip)
+	go func() {
+		err := cmd.Wait()
+		pw.CloseWithError(err)
+	}()
+	// Input is ignored, but reading notices the client going away.
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := pr.Read(buf)
+		if n > 0 {
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if werr := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
+				cancel()
+				break
+			}
+		}
+		if err != nil {
+			reason := "log command exited"
+			if err != io.EOF {
+				reason += ": " + err.Error()
+			}
+			log.Printf("[LOGS] %q req=%s: %s", id, requestID(r), reason)
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason), time.Now().Add(time.Second))
+			break
+		}
+	}
+	// Let cmd.Wait finish so the pipe's writer is released.
+	cancel()
+	io.Copy(io.Discard, pr)
+}
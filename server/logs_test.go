@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLogsEndpoint(t *testing.T) {
+	// A fake journalctl shows its arguments and whatever reaches its
+	// stdin, which should be nothing.
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho \"journalctl $*\"\ncat\necho done\n"
+	if err := os.WriteFile(filepath.Join(dir, "journalctl"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	e := newTestEnv(t, "")
+	e.setResources(testResources...)
+	ts := e.startTerminals(t)
+	conn, _, err := e.dialTerminal(t, ts, "/ws/logs/host?unit=nginx.service", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteMessage(websocket.BinaryMessage, []byte("ignored\n"))
+	got := readUntil(t, conn, "done\n", nil)
+	if want := "journalctl -f -n 100 --no-pager -u nginx.service\ndone\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+	_, ce := readClose(t, conn)
+	if ce.Code != websocket.CloseNormalClosure || ce.Text != "log command exited" {
+		t.Errorf("close = %d %q, want a normal close", ce.Code, ce.Text)
+	}
+}
+
+func TestLogsEndpointErrors(t *testing.T) {
+	tests := []struct {
+		path   string
+		status int
+		code   string
+	}{
+		{"/ws/logs/host?unit=a%20b", http.StatusBadRequest, "invalid_unit"},
+		{"/ws/logs/host?unit=x%3Breboot", http.StatusBadRequest, "invalid_unit"},
+		{"/ws/logs/qemu/pve/200", http.StatusBadRequest, "unsupported_target"},
+		{"/ws/logs/bogus", http.StatusBadRequest, "invalid_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			e := newTestEnv(t, "")
+			e.setResources(testResources...)
+			rec := e.do(t, e.login(t, httptest.NewRequest("GET", tt.path, nil)))
+			wantJSONError(t, rec, tt.status, tt.code)
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// handleMetrics serves a few gauges, and the input latency histogram when
+// measure_input_latency is on, in the Prometheus text format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	sessions := s.terminal.Sessions()
+	clients := 0
+	for _, si := range sessions {
+		clients += si.Clients
+	}
+	writeGauge(w, "termbrowser_sessions", "Running terminal sessions.", len(sessions))
+	writeGauge(w, "termbrowser_clients", "WebSockets attached to sessions.", clients)
+
+	if s.cfg.MeasureInputLatency {
+		const name = "termbrowser_input_latency_seconds"
+		snap := s.terminal.InputLatency.Snapshot()
+		fmt.Fprintf(w, "# HELP %s Time from client input to the next PTY output.\n", name)
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		for i, le := range snap.Buckets {
+			fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(le, 'g', -1, 64), snap.Counts[i])
+		}
+		total := snap.Counts[len(snap.Counts)-1]
+		fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, total)
+		fmt.Fprintf(w, "%s_sum %g\n", name, snap.Sum.Seconds())
+		fmt.Fprintf(w, "%s_count %d\n", name, total)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, v int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	tests := []struct {
+		name        string
+		yaml        string
+		wantLatency bool
+	}{
+		{"gauges only", "", false},
+		{"with input latency", "measure_input_latency: true\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, tt.yaml)
+			e.term.InputLatency.Observe(3 * time.Millisecond)
+			e.term.InputLatency.Observe(2 * time.Second)
+			rec := e.do(t, e.login(t, httptest.NewRequest("GET", "/metrics", nil)))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+				t.Errorf("Content-Type = %q, want text/plain", ct)
+			}
+			body := rec.Body.String()
+			for _, want := range []string{
+				"# TYPE termbrowser_sessions gauge\ntermbrowser_sessions 0\n",
+				"# TYPE termbrowser_clients gauge\ntermbrowser_clients 0\n",
+			} {
+				if !strings.Contains(body, want) {
+					t.Errorf("metrics lack %q:\n%s", want, body)
+				}
+			}
+			latency := []string{
+				"# TYPE termbrowser_input_latency_seconds histogram\n",
+				`termbrowser_input_latency_seconds_bucket{le="0.0025"} 0` + "\n",
+				`termbrowser_input_latency_seconds_bucket{le="0.005"} 1` + "\n",
+				`termbrowser_input_latency_seconds_bucket{le="2.5"} 2` + "\n",
+				`termbrowser_input_latency_seconds_bucket{le="+Inf"} 2` + "\n",
+				"termbrowser_input_latency_seconds_sum 2.003\n",
+				"termbrowser_input_latency_seconds_count 2\n",
+			}
+			for _, want := range latency {
+				if got := strings.Contains(body, want); got != tt.wantLatency {
+					t.Errorf("metrics contain %q = %v, want %v:\n%s", want, got, tt.wantLatency, body)
+				}
+			}
+		})
+	}
+}
+
+func TestMetricsRequireLogin(t *testing.T) {
+	e := newTestEnv(t, "")
+	wantJSONError(t, e.do(t, httptest.NewRequest("GET", "/metrics", nil)), http.StatusUnauthorized, "unauthorized")
+}
@@ -0,0 +1,17 @@
+package server
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPIDoc describes the HTTP API. It is maintained by hand next to the
+// handlers; update it when adding or changing an endpoint.
+//
+//go:embed openapi.json
+var openAPIDoc []byte
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDoc)
+}
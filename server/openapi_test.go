@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIDoc(t *testing.T) {
+	e := newTestEnv(t, "")
+	rec := e.do(t, httptest.NewRequest("GET", "/api/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var doc struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("document isn't valid JSON: %v", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Errorf("openapi = %q, want 3.x", doc.OpenAPI)
+	}
+
+	for _, want := range []struct{ method, path string }{
+		{"post", "/api/login"},
+		{"post", "/api/logout"},
+		{"get", "/api/containers"},
+		{"get", "/ws/terminal/{id}"},
+		{"get", "/api/sessions"},
+	} {
+		if _, ok := doc.Paths[want.path][want.method]; !ok {
+			t.Errorf("document has no %s %s", strings.ToUpper(want.method), want.path)
+		}
+	}
+
+	// Every documented operation must be routed: an unauthenticated request
+	// gets past the mux (not 404 or 405) to the handler or its auth check.
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			if method == "parameters" {
+				continue
+			}
+			target := strings.ReplaceAll(path, "{id}", "host")
+			rec := e.do(t, httptest.NewRequest(strings.ToUpper(method), target, strings.NewReader("{}")))
+			if rec.Code == http.StatusNotFound || rec.Code == http.StatusMethodNotAllowed {
+				t.Errorf("%s %s is documented but not routed (status %d)", strings.ToUpper(method), path, rec.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	restricted := "allowed_origins: [\"https://*.example.com\"]\n"
+	regex := "allowed_origins: [\"re:https://tb[0-9]+\\\\.example\\\\.org\"]\n"
+	tests := []struct {
+		name   string
+		yaml   string
+		origin string // "" sends none; "self" is the server's own
+		want   bool
+	}{
+		{"unrestricted", "", "https://evil.test", true},
+		{"own origin", restricted, "self", true},
+		{"listed origin", restricted, "https://portal.example.com", true},
+		{"cross-site origin", restricted, "https://evil.test", false},
+		{"lookalike origin", restricted, "https://example.com.evil.test", false},
+		{"regex origin", regex, "https://tb2.example.org", true},
+		{"regex mismatch", regex, "https://tbx.example.org", false},
+		{"no origin", restricted, "", false},
+		{"no origin, allowed", restricted + "allow_missing_origin: true\n", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, tt.yaml)
+			e.setResources(testResources...)
+			ts := e.startTerminals(t)
+			hdr := http.Header{}
+			switch tt.origin {
+			case "":
+			case "self":
+				hdr.Set("Origin", ts.URL)
+			default:
+				hdr.Set("Origin", tt.origin)
+			}
+			conn, resp, err := e.dialTerminal(t, ts, "/ws/terminal/lxc/pve/100", nil, hdr)
+			if got := err == nil; got != tt.want {
+				t.Fatalf("upgrade accepted = %v, want %v (err %v)", got, tt.want, err)
+			}
+			if !tt.want && (resp == nil || resp.StatusCode != http.StatusForbidden) {
+				t.Errorf("refusal: %v, want status 403", err)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+		})
+	}
+}
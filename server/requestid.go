@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+type ctxKey int
+
+const requestIDKey ctxKey = iota
+
+// withRequestID tags each request with a short random ID, stored in the
+// context and echoed in the X-Request-ID response header, so the HTTP log
+// lines for a request can be matched with the session logs it leads to.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 4)
+		rand.Read(buf)
+		id := hex.EncodeToString(buf)
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// requestID returns the ID assigned by withRequestID, or "" outside it.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// upgradeHeader carries the request ID into a WebSocket handshake
+// response, which the upgrader writes itself instead of using w.Header().
+func upgradeHeader(r *http.Request) http.Header {
+	h := http.Header{}
+	h.Set("X-Request-ID", requestID(r))
+	return h
+}
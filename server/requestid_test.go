@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// syncBuffer is a bytes.Buffer safe to use as the log output while
+// session goroutines write to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog sends the standard logger to a buffer for the rest of the test.
+func captureLog(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return buf
+}
+
+func TestRequestIDInSessionLogs(t *testing.T) {
+	e := newTestEnv(t, "")
+	e.setResources(testResources...)
+	ts := e.startTerminals(t)
+	logs := captureLog(t)
+
+	conn, resp, err := e.dialTerminal(t, ts, "/ws/terminal/lxc/pve/100", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := resp.Header.Get("X-Request-ID")
+	if id == "" {
+		t.Fatal("upgrade response has no X-Request-ID")
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, conn, "hello", nil)
+
+	want := "req=" + id
+	for _, prefix := range []string{"[WS]", "[SESSION]", "[PTY-READER]"} {
+		var found bool
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, prefix) && strings.Contains(line, want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("no %s line with %s in:\n%s", prefix, want, logs)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/chris/termbrowser/auth"
+)
+
+func TestTokenScopes(t *testing.T) {
+	endpoints := []struct {
+		method, path string
+		body         string
+		scope        auth.Scope
+	}{
+		{"GET", "/api/containers", "", auth.ScopeRead},
+		{"GET", "/api/sessions", "", auth.ScopeRead},
+		{"GET", "/api/cluster/summary", "", auth.ScopeRead},
+		{"GET", "/ws/terminal/host", "", auth.ScopeTerminal},
+		{"POST", "/api/exec/host", `{"argv":["true"]}`, auth.ScopeTerminal},
+		{"GET", "/api/files/host?path=/etc/hostname", "", auth.ScopeTerminal},
+		{"GET", "/api/sessions/host/scrollback", "", auth.ScopeTerminal},
+		{"POST", "/api/sessions/host/close", "", auth.ScopeAdmin},
+		{"POST", "/api/sessions/host/input", `{"data":"x"}`, auth.ScopeAdmin},
+		{"POST", "/api/totp/rotate", "", auth.ScopeAdmin},
+	}
+	for _, scope := range []auth.Scope{auth.ScopeRead, auth.ScopeTerminal, auth.ScopeAdmin} {
+		t.Run(scope.String(), func(t *testing.T) {
+			e := newTestEnv(t, "")
+			e.setResources(testResources...)
+			e.auth.APITokens = map[[32]byte]auth.APIToken{
+				sha256.Sum256([]byte("tok")): {Name: "test", Scope: scope},
+			}
+			_, admin := e.handlers(t)
+			for _, ep := range endpoints {
+				r := httptest.NewRequest(ep.method, ep.path, strings.NewReader(ep.body))
+				r.Header.Set("Authorization", "Bearer tok")
+				rec := httptest.NewRecorder()
+				admin.ServeHTTP(rec, r)
+				allowed := scope >= ep.scope
+				switch {
+				case rec.Code == http.StatusUnauthorized:
+					t.Errorf("%s %s: 401", ep.method, ep.path)
+				case !allowed:
+					wantJSONError(t, rec, http.StatusForbidden, "insufficient_scope")
+				case rec.Code == http.StatusForbidden:
+					t.Errorf("%s %s: 403 for a %v token", ep.method, ep.path, scope)
+				}
+			}
+		})
+	}
+}
@@ -1,17 +1,27 @@
 package server
 
 import (
+	"cmp"
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/chris/termbrowser/auth"
 	"github.com/chris/termbrowser/config"
 	"github.com/chris/termbrowser/containers"
+	"github.com/chris/termbrowser/ids"
 	"github.com/chris/termbrowser/terminal"
 	"github.com/gorilla/websocket"
 )
@@ -22,33 +32,187 @@ type Server struct {
 	terminal *terminal.Manager
 	webRoot  fs.FS
 	upgrader websocket.Upgrader
+	cache    *resourceCache
+	cluster  *clusterCache
+	guests   guestController
+	conns    *connLimiter
+	events   *eventHub
+
+	adminLn net.Listener // see Listen
+
+	trustedProxies []netip.Prefix
+	allowedOrigins []*regexp.Regexp
+
+	// OnLogin, if set, is called in its own goroutine after each login
+	// attempt.
+	OnLogin func(ok bool, clientIP, requestID string)
+
+	// SaveTOTPSecret persists a rotated TOTP secret. Without it rotations
+	// can be started but not confirmed.
+	SaveTOTPSecret func(secret string) error
 }
 
 func New(cfg *config.Config, a *auth.Manager, t *terminal.Manager, webRoot fs.FS) *Server {
-	return &Server{
+	s := &Server{
 		cfg:      cfg,
 		auth:     a,
 		terminal: t,
 		webRoot:  webRoot,
+		cache:    &resourceCache{ttl: 5 * time.Second, list: containers.ListAll},
+		cluster:  &clusterCache{ttl: 5 * time.Second},
+		guests:   pveGuests{},
+		conns:    &connLimiter{max: cfg.MaxConnsPerIP},
+		events:   newEventHub(),
+
+		trustedProxies: parseTrustedProxies(cfg.TrustedProxies),
+		allowedOrigins: compileOrigins(cfg.AllowedOrigins),
 		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool { return true },
+			// Echoed back when the client asks for it; clients that don't
+			// request a subprotocol still connect with the same framing.
+			Subprotocols: []string{terminal.Subprotocol},
+			// Only used when the client offers it, so clients and proxies
+			// that don't support it still connect, uncompressed.
+			EnableCompression: cfg.WSCompression == nil || *cfg.WSCompression,
 		},
 	}
+	s.upgrader.CheckOrigin = s.checkOrigin
+	s.upgrader.Error = upgradeError
+	return s
 }
 
+// Run listens on the configured port and serves until an error occurs.
 func (s *Server) Run() error {
-	mux := http.NewServeMux()
+	ln, err := s.Listen()
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Listen returns the listener the server should use: the socket passed by
+// systemd socket activation if there is one, otherwise a new one bound to
+// the configured port. Binding is separate from Serve so the caller can
+// drop privileges in between. The admin listener, if configured, is bound
+// here too and served by Serve.
+func (s *Server) Listen() (net.Listener, error) {
+	if s.cfg.AdminListenAddr != "" {
+		ln, err := net.Listen("tcp", s.cfg.AdminListenAddr)
+		if err != nil {
+			return nil, fmt.Errorf("admin listener: %w", err)
+		}
+		log.Printf("admin endpoints listening on %s", ln.Addr())
+		s.adminLn = ln
+	}
+	ln, err := systemdListener()
+	if err != nil {
+		return nil, err
+	}
+	if ln != nil {
+		log.Printf("listening on %s (systemd socket activation)", ln.Addr())
+		return ln, nil
+	}
+	addr := net.JoinHostPort("", strconv.Itoa(s.cfg.Port))
+	if ln, err = net.Listen("tcp", addr); err != nil {
+		return nil, err
+	}
+	log.Printf("listening on %s", addr)
+	return ln, nil
+}
+
+// Serve handles requests on ln, and on the admin listener if Listen bound
+// one, until an error occurs. When either server stops the other is shut
+// down too.
+func (s *Server) Serve(ln net.Listener) error {
+	mux, admin, err := s.routes()
+	if err != nil {
+		return err
+	}
+
+	srv := s.httpServer(mux)
+	if s.adminLn == nil {
+		return srv.Serve(ln)
+	}
+	adminSrv := s.httpServer(admin)
+	errc := make(chan error, 2)
+	go func() { errc <- srv.Serve(ln) }()
+	go func() { errc <- adminSrv.Serve(s.adminLn) }()
+	err = <-errc
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+	adminSrv.Shutdown(ctx)
+	<-errc
+	return err
+}
+
+// routes builds the handlers for the main listener and the admin one,
+// which are the same mux unless Listen bound an admin listener.
+func (s *Server) routes() (mux, admin *http.ServeMux, err error) {
+	mux = http.NewServeMux()
 
 	mux.HandleFunc("POST /api/login", s.handleLogin)
 	mux.HandleFunc("POST /api/logout", s.handleLogout)
-	mux.Handle("GET /api/containers", s.auth.Middleware(http.HandlerFunc(s.handleContainers)))
+	mux.HandleFunc("GET /api/openapi.json", handleOpenAPI)
+	mux.HandleFunc("GET /api/config", s.handleUIConfig)
+	mux.Handle("GET /api/session/validate", s.auth.Require(auth.ScopeRead, http.HandlerFunc(s.handleValidateSession)))
+	mux.Handle("GET /api/containers", s.auth.Require(auth.ScopeRead, http.HandlerFunc(s.handleContainers)))
+	mux.Handle("GET /api/cluster/summary", s.auth.Require(auth.ScopeRead, http.HandlerFunc(s.handleClusterSummary)))
+	mux.Handle("GET /api/files/{id...}", s.auth.Require(auth.ScopeTerminal, http.HandlerFunc(s.handleDownload)))
+	mux.Handle("POST /api/files/{id...}", s.auth.Require(auth.ScopeTerminal, http.HandlerFunc(s.handleUpload)))
+	mux.Handle("POST /api/exec/{id...}", s.auth.Require(auth.ScopeTerminal, http.HandlerFunc(s.handleExec)))
+	mux.Handle("GET /api/sessions", s.auth.Require(auth.ScopeRead, http.HandlerFunc(s.handleSessions)))
+	mux.Handle("GET /api/sessions/{id}/scrollback", s.auth.Require(auth.ScopeTerminal, http.HandlerFunc(s.handleScrollback)))
+	mux.Handle("PATCH /api/sessions/{id}", s.auth.Require(auth.ScopeTerminal, http.HandlerFunc(s.handlePatchSession)))
+	mux.Handle("GET /api/sessions/{id}/screen", s.auth.Require(auth.ScopeTerminal, http.HandlerFunc(s.handleScreen)))
 	// {id...} captures the full remaining path so IDs like "lxc/pve/100" work.
-	mux.Handle("GET /ws/terminal/{id...}", s.auth.Middleware(http.HandlerFunc(s.handleTerminal)))
-	mux.Handle("/", http.FileServer(http.FS(s.webRoot)))
+	mux.Handle("GET /api/events", s.auth.Require(auth.ScopeRead, http.HandlerFunc(s.handleEvents)))
+	mux.Handle("GET /ws/terminal/{id...}", s.auth.Require(auth.ScopeTerminal, http.HandlerFunc(s.handleTerminal)))
+	mux.Handle("GET /ws/logs/{id...}", s.auth.Require(auth.ScopeTerminal, http.HandlerFunc(s.handleLogs)))
+	static, err := newStaticHandler(s.webRoot, s.cfg.StaticMaxAge)
+	if err != nil {
+		return nil, nil, err
+	}
+	mux.Handle("/", static)
 
-	addr := net.JoinHostPort("", strconv.Itoa(s.cfg.Port))
-	log.Printf("listening on %s", addr)
-	return http.ListenAndServe(addr, mux)
+	// Operational endpoints go on the admin listener when there is one,
+	// so they can be kept off the user-facing port.
+	admin = mux
+	if s.adminLn != nil {
+		admin = http.NewServeMux()
+	}
+	admin.HandleFunc("GET /healthz", handleHealthz)
+	admin.Handle("GET /metrics", s.auth.Require(auth.ScopeRead, http.HandlerFunc(s.handleMetrics)))
+	admin.Handle("POST /api/totp/rotate", s.auth.Require(auth.ScopeAdmin, http.HandlerFunc(s.handleTOTPRotate)))
+	admin.Handle("POST /api/totp/confirm", s.auth.Require(auth.ScopeAdmin, http.HandlerFunc(s.handleTOTPConfirm)))
+	admin.Handle("POST /api/sessions/{id}/close", s.auth.Require(auth.ScopeAdmin, http.HandlerFunc(s.handleCloseSession)))
+	admin.Handle("POST /api/sessions/{id}/input", s.auth.Require(auth.ScopeAdmin, http.HandlerFunc(s.handleSessionInput)))
+	return mux, admin, nil
+}
+
+func (s *Server) httpServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           withRequestID(h),
+		ReadHeaderTimeout: s.cfg.ReadHeaderTimeout,
+		ReadTimeout:       s.cfg.ReadTimeout,
+		WriteTimeout:      s.cfg.WriteTimeout,
+		IdleTimeout:       s.cfg.IdleTimeout,
+	}
+}
+
+// handleHealthz reports that the process is up and serving. It needs no
+// login so load balancers and supervisors can poll it.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "ok\n")
+}
+
+// clearDeadlines lifts the server's read and write timeouts for a request
+// that legitimately runs long, such as a file transfer. WebSocket upgrades
+// don't need it: the upgrader clears deadlines on the hijacked connection.
+func clearDeadlines(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
 }
 
 type loginRequest struct {
@@ -59,76 +223,201 @@ type loginRequest struct {
 func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	var req loginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "bad request", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "request body must be JSON")
 		return
 	}
-	if err := s.auth.Verify(req.Password, req.TOTPCode); err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	err := s.auth.Verify(req.Password, req.TOTPCode)
+	if s.OnLogin != nil {
+		go s.OnLogin(err == nil, s.clientIP(r), requestID(r))
+	}
+	if err != nil {
+		log.Printf("login failed from %s req=%s", s.clientIP(r), requestID(r))
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized", "invalid password or TOTP code")
 		return
 	}
 	token, err := s.auth.IssueToken()
 	if err != nil {
-		http.Error(w, "internal error", http.StatusInternalServerError)
+		log.Printf("issuing token req=%s: %v", requestID(r), err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "internal error")
 		return
 	}
-	s.auth.SetCookie(w, token)
+	s.auth.SetCookie(w, token, s.isHTTPS(r))
 	w.WriteHeader(http.StatusOK)
 }
 
 func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
-	s.auth.ClearCookie(w)
+	s.auth.ClearCookie(w, s.isHTTPS(r))
 	w.WriteHeader(http.StatusOK)
 }
 
+// handleValidateSession lets a client check, on page load, whether its
+// cookie or token is still good. Require has already answered 401 if not.
+func (s *Server) handleValidateSession(w http.ResponseWriter, r *http.Request) {
+	id, err := s.auth.Identify(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized", "authentication required")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(id)
+}
+
 func (s *Server) handleContainers(w http.ResponseWriter, r *http.Request) {
-	all, err := containers.ListAll()
+	all, err := s.cache.get()
 	if err != nil {
 		log.Printf("listing resources: %v", err)
 		all = []containers.Container{}
 	}
+	all = filterStatus(all, cmp.Or(r.URL.Query().Get("status"), s.cfg.DefaultStatusFilter))
+	all = append(all[:len(all):len(all)], s.sshHosts()...)
+
+	accept := r.Header.Get("Accept")
+	if r.URL.Query().Get("format") == "csv" || strings.Contains(accept, "text/csv") {
+		writeCSV(w, all)
+		return
+	}
+	if strings.Contains(accept, "application/x-ndjson") {
+		writeNDJSON(w, all)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(all)
 }
 
-// validID returns true for the terminal ID formats we accept:
-//
-//	"host"            — the Proxmox host itself
-//	"node:{name}"     — SSH into a cluster node
-//	"lxc/{node}/{id}" — LXC container via pct exec over SSH
-//	"qemu/{node}/{id}"— QEMU VM via qm terminal over SSH
-//	"{digits}"        — legacy: local LXC by bare numeric ctid
-func validID(id string) bool {
-	switch {
-	case id == "host":
-		return true
-	case strings.HasPrefix(id, "node:"):
-		return len(id) > 5
-	case strings.HasPrefix(id, "lxc/"):
-		parts := strings.SplitN(id[4:], "/", 2)
-		return len(parts) == 2 && parts[0] != "" && parts[1] != ""
-	case strings.HasPrefix(id, "qemu/"):
-		parts := strings.SplitN(id[5:], "/", 2)
-		return len(parts) == 2 && parts[0] != "" && parts[1] != ""
-	default:
-		_, err := strconv.Atoi(id)
-		return err == nil
+// filterStatus keeps the guests whose status is in filter, a
+// comma-separated list such as "running" or "running,paused". Nodes are
+// always kept. An empty filter or "all" keeps everything.
+func filterStatus(items []containers.Container, filter string) []containers.Container {
+	if filter == "" || filter == "all" {
+		return items
+	}
+	want := strings.Split(filter, ",")
+	out := make([]containers.Container, 0, len(items))
+	for _, it := range items {
+		if it.Type == "node" || slices.Contains(want, it.Status) {
+			out = append(out, it)
+		}
+	}
+	return out
+}
+
+// writeCSV writes items as CSV with a header row, for spreadsheets.
+func writeCSV(w http.ResponseWriter, items []containers.Container) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="containers.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"ctid", "name", "type", "node", "vmid", "status"})
+	for _, it := range items {
+		cw.Write([]string{it.CTID, it.Name, it.Type, it.Node, it.VMID, it.Status})
+	}
+	cw.Flush()
+}
+
+// writeNDJSON streams items as newline-delimited JSON, flushing after each
+// line so large listings can be rendered as they arrive.
+func writeNDJSON(w http.ResponseWriter, items []containers.Container) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	for _, it := range items {
+		if err := enc.Encode(it); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
 	}
 }
 
 func (s *Server) handleTerminal(w http.ResponseWriter, r *http.Request) {
-	id := r.PathValue("id")
-	if !validID(id) {
-		http.Error(w, "invalid terminal id", http.StatusBadRequest)
+	id, ok := s.terminalID(w, r)
+	if !ok {
+		return
+	}
+
+	window := r.URL.Query().Get("window")
+	if window != "" && !terminal.ValidWindowName(window) {
+		writeJSONError(w, http.StatusBadRequest, "invalid_window", "window must be 1-32 letters, digits, '-' or '_'")
 		return
 	}
 
-	conn, err := s.upgrader.Upgrade(w, r, nil)
+	addr, ok := s.nodeAddrOverride(w, r, id)
+	if !ok {
+		return
+	}
+	label, err := terminal.CleanLabel(r.URL.Query().Get("label"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_label", err.Error())
+		return
+	}
+
+	ip := s.clientIP(r)
+	if !s.conns.acquire(ip) {
+		log.Printf("[WS] %q req=%s: %s is at the limit of %d connections", id, requestID(r), ip, s.cfg.MaxConnsPerIP)
+		writeJSONError(w, http.StatusTooManyRequests, "too_many_connections", "too many terminal connections from this address")
+		return
+	}
+	defer s.conns.release(ip)
+
+	conn, err := s.upgrader.Upgrade(w, r, upgradeHeader(r))
 	if err != nil {
-		log.Printf("websocket upgrade: %v", err)
+		log.Printf("websocket upgrade req=%s: %v", requestID(r), err)
 		return
 	}
 	defer conn.Close()
+	if p := conn.Subprotocol(); p != "" {
+		log.Printf("[WS] %q req=%s: negotiated subprotocol %s", id, requestID(r), p)
+	}
+	log.Printf("[WS] %q req=%s: compression: %s", id, requestID(r), s.compression(r))
 
-	s.terminal.ServeWebSocket(conn, id)
+	if s.cfg.CheckGuestStatus || s.cfg.AutoStart {
+		if err := s.ensureRunning(conn, id); err != nil {
+			log.Printf("[WS] %q req=%s: refusing connection: %v", id, requestID(r), err)
+			conn.WriteMessage(websocket.TextMessage, []byte("Error: "+err.Error()+"\r\n"))
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()), time.Now().Add(time.Second))
+			return
+		}
+	}
+
+	s.terminal.ServeWebSocket(conn, id, terminal.ConnInfo{
+		ClientIP:    ip,
+		RequestID:   requestID(r),
+		ResumeToken: r.URL.Query().Get("resume"),
+		Window:      window,
+		NodeAddr:    addr,
+		Label:       label,
+	})
+}
+
+// nodeAddrOverride checks the ?addr= parameter, an IP address to ssh to
+// instead of the node's resolved address. It needs allow_addr_override
+// and admin scope, and only applies to ids reached through a node. On
+// failure it writes the error response and returns false.
+func (s *Server) nodeAddrOverride(w http.ResponseWriter, r *http.Request, id string) (string, bool) {
+	addr := r.URL.Query().Get("addr")
+	if addr == "" {
+		return "", true
+	}
+	if !s.cfg.AllowAddrOverride {
+		writeJSONError(w, http.StatusForbidden, "addr_override_disabled", "addr needs allow_addr_override in the config")
+		return "", false
+	}
+	if !s.auth.HasScope(r, auth.ScopeAdmin) {
+		writeJSONError(w, http.StatusForbidden, "insufficient_scope", "addr needs admin scope")
+		return "", false
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil || ip.Zone() != "" {
+		writeJSONError(w, http.StatusBadRequest, "invalid_addr", "addr must be an IP address")
+		return "", false
+	}
+	if p, err := ids.Parse(id); err != nil || (p.Kind != ids.Node && p.Kind != ids.LXC && p.Kind != ids.QEMU) {
+		writeJSONError(w, http.StatusBadRequest, "invalid_addr", "addr only applies to node, lxc and qemu ids")
+		return "", false
+	}
+	log.Printf("[WS] %q req=%s: %s asked to connect via %s", id, requestID(r), s.clientIP(r), ip)
+	return ip.String(), true
 }
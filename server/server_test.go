@@ -0,0 +1,246 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/chris/termbrowser/auth"
+	"github.com/chris/termbrowser/config"
+	"github.com/chris/termbrowser/containers"
+	"github.com/chris/termbrowser/terminal"
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testConfig loads a config made of the required fields plus extra YAML,
+// so it gets the same defaults and validation as a real one.
+func testConfig(t *testing.T, extra string) *config.Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "password_hash: x\ntotp_secret: JBSWY3DPEHPK3PXP\njwt_secret: 00\n" + extra
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	return cfg
+}
+
+// testEnv is a Server with its routes, for password "pw".
+type testEnv struct {
+	srv   *Server
+	auth  *auth.Manager
+	term  *terminal.Manager
+	mux   http.Handler
+	admin http.Handler
+}
+
+func newTestEnv(t *testing.T, extra string) *testEnv {
+	t.Helper()
+	cfg := testConfig(t, extra)
+	hash, err := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := auth.NewManager(string(hash), cfg.TOTPSecret, []byte("jwt-test-secret"))
+	tm := terminal.NewManager(func(node string) string { return node })
+	web := fstest.MapFS{
+		"index.html": {Data: []byte("<!doctype html><title>termbrowser</title>")},
+		"app.js":     {Data: []byte(strings.Repeat("console.log('termbrowser');\n", 50))},
+	}
+	s := New(cfg, a, tm, web)
+	return &testEnv{srv: s, auth: a, term: tm}
+}
+
+// handlers builds the routes once the test has finished adjusting srv.
+func (e *testEnv) handlers(t *testing.T) (mux, admin http.Handler) {
+	t.Helper()
+	if e.mux == nil {
+		m, a, err := e.srv.routes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.mux, e.admin = withRequestID(m), withRequestID(a)
+	}
+	return e.mux, e.admin
+}
+
+// do sends r to the main listener's routes.
+func (e *testEnv) do(t *testing.T, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	mux, _ := e.handlers(t)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, r)
+	return rec
+}
+
+// login adds a valid session cookie to r.
+func (e *testEnv) login(t *testing.T, r *http.Request) *http.Request {
+	t.Helper()
+	token, err := e.auth.IssueToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddCookie(&http.Cookie{Name: e.auth.CookieName, Value: token})
+	return r
+}
+
+// wantJSONError checks that rec is an error response in the shape
+// writeJSONError produces, with the given status and code.
+func wantJSONError(t *testing.T, rec *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	if rec.Code != status {
+		t.Errorf("status = %d, want %d (body %q)", rec.Code, status, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var body errorBody
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q isn't JSON: %v", rec.Body, err)
+	}
+	if body.Error.Code != code {
+		t.Errorf("error code = %q, want %q", body.Error.Code, code)
+	}
+	if body.Error.Message == "" {
+		t.Error("error message is empty")
+	}
+}
+
+func TestErrorShape(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{"login with bad JSON", "POST", "/api/login", "{", http.StatusBadRequest, "bad_request"},
+		{"login with wrong password", "POST", "/api/login", `{"password":"nope","totp_code":"000000"}`, http.StatusUnauthorized, "unauthorized"},
+		{"login with wrong code", "POST", "/api/login", `{"password":"pw","totp_code":"000000"}`, http.StatusUnauthorized, "unauthorized"},
+		{"API without login", "GET", "/api/containers", "", http.StatusUnauthorized, "unauthorized"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, "")
+			rec := e.do(t, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			wantJSONError(t, rec, tt.status, tt.code)
+		})
+	}
+}
+
+func TestErrorShapeBadID(t *testing.T) {
+	e := newTestEnv(t, "")
+	rec := e.do(t, e.login(t, httptest.NewRequest("GET", "/ws/terminal/lxc/pve;rm/100", nil)))
+	wantJSONError(t, rec, http.StatusBadRequest, "invalid_id")
+}
+
+// startTerminals serves e's routes over HTTP, with new sessions running
+// cat instead of a shell, and ends every session when the test is over.
+func (e *testEnv) startTerminals(t *testing.T) *httptest.Server {
+	t.Helper()
+	e.term.BuildCommand = func(id string) *exec.Cmd { return exec.Command("cat") }
+	mux, _ := e.handlers(t)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		ts.Close()
+		for _, si := range e.term.Sessions() {
+			e.term.Close(si.ID, 0)
+		}
+	})
+	return ts
+}
+
+// dialTerminal opens a terminal WebSocket to path on ts, logged in, with
+// any extra headers.
+func (e *testEnv) dialTerminal(t *testing.T, ts *httptest.Server, path string, d *websocket.Dialer, hdr http.Header) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	token, err := e.auth.IssueToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr == nil {
+		hdr = http.Header{}
+	}
+	hdr.Add("Cookie", (&http.Cookie{Name: e.auth.CookieName, Value: token}).String())
+	if d == nil {
+		d = websocket.DefaultDialer
+	}
+	conn, resp, err := d.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+path, hdr)
+	if conn != nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+// readUntil reads binary frames from conn until their concatenation
+// contains want, failing the test after a few seconds. Text frames are
+// appended to text if it isn't nil.
+func readUntil(t *testing.T, conn *websocket.Conn, want string, text *strings.Builder) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	var got strings.Builder
+	for !strings.Contains(got.String(), want) {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %q, got %q: %v", want, got.String(), err)
+		}
+		switch {
+		case typ == websocket.BinaryMessage:
+			got.Write(data)
+		case text != nil:
+			text.Write(data)
+		}
+	}
+	return got.String()
+}
+
+func TestTerminalSubprotocol(t *testing.T) {
+	tests := []struct {
+		name      string
+		protocols []string
+		want      string
+	}{
+		{"requested", []string{terminal.Subprotocol}, terminal.Subprotocol},
+		{"among others", []string{"other.v9", terminal.Subprotocol}, terminal.Subprotocol},
+		{"not requested", nil, ""},
+		{"unknown only", []string{"other.v9"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, "")
+			ts := e.startTerminals(t)
+			d := &websocket.Dialer{Subprotocols: tt.protocols}
+			conn, _, err := e.dialTerminal(t, ts, "/ws/terminal/host", d, nil)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			if got := conn.Subprotocol(); got != tt.want {
+				t.Errorf("subprotocol = %q, want %q", got, tt.want)
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, []byte("hello\n")); err != nil {
+				t.Fatal(err)
+			}
+			readUntil(t, conn, "hello", nil)
+		})
+	}
+}
+
+// setResources makes the cluster listing return items instead of calling
+// pvesh.
+func (e *testEnv) setResources(items ...containers.Container) {
+	e.srv.cache.list = func() ([]containers.Container, error) { return items, nil }
+	e.srv.cache.invalidate()
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/chris/termbrowser/terminal"
+)
+
+// Session endpoints take the terminal id as a single path segment, so
+// clients must escape it: /api/sessions/lxc%2Fpve%2F100/scrollback.
+
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.terminal.Sessions())
+}
+
+func (s *Server) handleScrollback(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !s.idAllowed(id) {
+		writeJSONError(w, http.StatusForbidden, "forbidden_id", "terminal id not allowed on this server")
+		return
+	}
+	data, err := s.terminal.Scrollback(id)
+	if errors.Is(err, terminal.ErrNoScrollback) {
+		writeJSONError(w, http.StatusNotFound, "not_found", "no scrollback recorded for "+id)
+		return
+	}
+	if err != nil {
+		log.Printf("reading scrollback for %q req=%s: %v", id, requestID(r), err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "reading scrollback failed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
+
+type patchSessionRequest struct {
+	Label *string `json:"label"`
+}
+
+// handlePatchSession updates a session's metadata; for now just its label.
+func (s *Server) handlePatchSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !s.idAllowed(id) {
+		writeJSONError(w, http.StatusForbidden, "forbidden_id", "terminal id not allowed on this server")
+		return
+	}
+	var req patchSessionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "request body must be JSON")
+		return
+	}
+	if req.Label == nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "nothing to update; send {\"label\": \"...\"}")
+		return
+	}
+	label, err := terminal.CleanLabel(*req.Label)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_label", err.Error())
+		return
+	}
+	if err := s.terminal.SetLabel(id, label); errors.Is(err, terminal.ErrNoSession) {
+		writeJSONError(w, http.StatusNotFound, "not_found", "no running session "+id)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(patchSessionRequest{Label: &label})
+}
+
+// handleScreen returns what's on a session's screen as plain text, to
+// preview it before attaching.
+func (s *Server) handleScreen(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !s.idAllowed(id) {
+		writeJSONError(w, http.StatusForbidden, "forbidden_id", "terminal id not allowed on this server")
+		return
+	}
+	text, err := s.terminal.Screen(id)
+	switch {
+	case errors.Is(err, terminal.ErrNoSession):
+		writeJSONError(w, http.StatusNotFound, "not_found", "no running session "+id)
+		return
+	case errors.Is(err, terminal.ErrNoScrollback):
+		writeJSONError(w, http.StatusNotFound, "not_found", "session "+id+" isn't in tmux and has no scrollback to rebuild its screen from")
+		return
+	case err != nil:
+		log.Printf("reading screen of %q req=%s: %v", id, requestID(r), err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "reading the screen failed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(text))
+}
+
+type closeResponse struct {
+	Forced bool `json:"forced"`
+}
+
+// handleCloseSession ends a session gently: the shell is asked to exit and
+// only sent SIGTERM if it hasn't after session_close_grace.
+func (s *Server) handleCloseSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !s.idAllowed(id) {
+		writeJSONError(w, http.StatusForbidden, "forbidden_id", "terminal id not allowed on this server")
+		return
+	}
+	forced, err := s.terminal.Close(id, s.cfg.SessionCloseGrace)
+	if errors.Is(err, terminal.ErrNoSession) {
+		writeJSONError(w, http.StatusNotFound, "not_found", "no running session "+id)
+		return
+	}
+	if err != nil {
+		log.Printf("closing session %q req=%s: %v", id, requestID(r), err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+	log.Printf("closed session %q req=%s (forced=%v)", id, requestID(r), forced)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(closeResponse{Forced: forced})
+}
+
+type inputRequest struct {
+	Data     string `json:"data"`
+	Encoding string `json:"encoding"` // "base64", or empty for raw text
+}
+
+// handleSessionInput types into a running session, for scripts and
+// macros. Binary data such as control keys can be sent base64-encoded.
+func (s *Server) handleSessionInput(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !s.idAllowed(id) {
+		writeJSONError(w, http.StatusForbidden, "forbidden_id", "terminal id not allowed on this server")
+		return
+	}
+	var req inputRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "request body must be JSON")
+		return
+	}
+	data := []byte(req.Data)
+	switch req.Encoding {
+	case "":
+	case "base64":
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(req.Data); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", "data is not valid base64")
+			return
+		}
+	default:
+		writeJSONError(w, http.StatusBadRequest, "bad_request", `encoding must be "base64" or omitted`)
+		return
+	}
+	err := s.terminal.Input(id, data)
+	if errors.Is(err, terminal.ErrNoSession) {
+		writeJSONError(w, http.StatusNotFound, "not_found", "no running session "+id)
+		return
+	}
+	if err != nil {
+		log.Printf("writing input to session %q req=%s: %v", id, requestID(r), err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+	log.Printf("%d bytes of input to session %q from %s req=%s", len(data), id, s.clientIP(r), requestID(r))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chris/termbrowser/terminal"
+	"github.com/gorilla/websocket"
+)
+
+func TestScrollbackEndpoint(t *testing.T) {
+	e := newTestEnv(t, "")
+	e.setResources(testResources...)
+	e.term.ScrollbackDir = t.TempDir()
+	ts := e.startTerminals(t)
+	conn, _, err := e.dialTerminal(t, ts, "/ws/terminal/lxc/pve/100", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteMessage(websocket.BinaryMessage, []byte("hello\n"))
+	readUntil(t, conn, "hello\r\nhello\r\n", nil)
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/api/sessions/lxc%2Fpve%2F100/scrollback", http.StatusOK, "hello\r\nhello\r\n"},
+		{"/api/sessions/lxc%2Fpve%2F101/scrollback", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		rec := e.do(t, e.login(t, httptest.NewRequest("GET", tt.path, nil)))
+		if rec.Code != tt.status {
+			t.Errorf("GET %s: status %d, want %d", tt.path, rec.Code, tt.status)
+			continue
+		}
+		if tt.status == http.StatusOK && !strings.Contains(rec.Body.String(), tt.body) {
+			t.Errorf("GET %s: body %q, want it to contain %q", tt.path, rec.Body, tt.body)
+		}
+		if tt.status == http.StatusNotFound {
+			wantJSONError(t, rec, http.StatusNotFound, "not_found")
+		}
+	}
+}
+
+func TestCloseSessionEndpoint(t *testing.T) {
+	tests := []struct {
+		name       string
+		cmd        string
+		wantForced bool
+	}{
+		{"shell exits", "sh", false},
+		{"needs SIGTERM", "cat", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, "session_close_grace: 300ms\n")
+			e.setResources(testResources...)
+			ts := e.startTerminals(t)
+			e.term.BuildCommand = func(string) *exec.Cmd { return exec.Command(tt.cmd) }
+			conn, _, err := e.dialTerminal(t, ts, "/ws/terminal/lxc/pve/100", nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.WriteMessage(websocket.BinaryMessage, []byte("echo ready\n"))
+			readUntil(t, conn, "ready\r\n", nil)
+
+			_, admin := e.handlers(t)
+			rec := httptest.NewRecorder()
+			admin.ServeHTTP(rec, e.login(t, httptest.NewRequest("POST", "/api/sessions/lxc%2Fpve%2F100/close", nil)))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d, body %q", rec.Code, rec.Body)
+			}
+			var resp closeResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Forced != tt.wantForced {
+				t.Errorf("forced = %v, want %v", resp.Forced, tt.wantForced)
+			}
+			readClose(t, conn)
+			for deadline := time.Now().Add(5 * time.Second); len(e.term.Sessions()) != 0; time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("sessions left after close: %+v", e.term.Sessions())
+				}
+			}
+
+			rec = httptest.NewRecorder()
+			admin.ServeHTTP(rec, e.login(t, httptest.NewRequest("POST", "/api/sessions/lxc%2Fpve%2F100/close", nil)))
+			wantJSONError(t, rec, http.StatusNotFound, "not_found")
+		})
+	}
+}
+
+func TestSessionInputEndpoint(t *testing.T) {
+	e := newTestEnv(t, "")
+	e.setResources(testResources...)
+	ts := e.startTerminals(t)
+	conn, _, err := e.dialTerminal(t, ts, "/ws/terminal/lxc/pve/100", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteMessage(websocket.BinaryMessage, []byte("ready\n"))
+	readUntil(t, conn, "ready\r\nready\r\n", nil)
+
+	_, admin := e.handlers(t)
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, e.login(t, httptest.NewRequest("POST", path, strings.NewReader(body))))
+		return rec
+	}
+	const path = "/api/sessions/lxc%2Fpve%2F100/input"
+	tests := []struct {
+		name string
+		body string
+		want string // echoed by cat
+	}{
+		{"raw", `{"data":"typed\n"}`, "typed\r\ntyped\r\n"},
+		{"base64", `{"data":"` + base64.StdEncoding.EncodeToString([]byte("bin\x01\n")) + `","encoding":"base64"}`,
+			"bin^A\r\nbin\x01\r\n"},
+	}
+	for _, tt := range tests {
+		if rec := post(path, tt.body); rec.Code != http.StatusNoContent {
+			t.Fatalf("%s: status %d, body %q", tt.name, rec.Code, rec.Body)
+		}
+		readUntil(t, conn, tt.want, nil)
+	}
+
+	errs := []struct {
+		name, path, body string
+		status           int
+		code             string
+	}{
+		{"no session", "/api/sessions/lxc%2Fpve%2F101/input", `{"data":"x"}`, http.StatusNotFound, "not_found"},
+		{"not JSON", path, `data=x`, http.StatusBadRequest, "bad_request"},
+		{"bad base64", path, `{"data":"%%%","encoding":"base64"}`, http.StatusBadRequest, "bad_request"},
+		{"unknown encoding", path, `{"data":"x","encoding":"hex"}`, http.StatusBadRequest, "bad_request"},
+	}
+	for _, tt := range errs {
+		t.Run(tt.name, func(t *testing.T) {
+			wantJSONError(t, post(tt.path, tt.body), tt.status, tt.code)
+		})
+	}
+}
+
+func TestScreenEndpoint(t *testing.T) {
+	e := newTestEnv(t, "")
+	e.setResources(testResources...)
+	e.term.ScrollbackDir = t.TempDir()
+	e.term.LXCMode = terminal.LXCEnter // no tmux, so the screen comes from the scrollback
+	ts := e.startTerminals(t)
+	conn, _, err := e.dialTerminal(t, ts, "/ws/terminal/lxc/pve/100", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteMessage(websocket.BinaryMessage, []byte("hello\n"))
+	readUntil(t, conn, "hello\r\nhello\r\n", nil)
+
+	rec := e.do(t, e.login(t, httptest.NewRequest("GET", "/api/sessions/lxc%2Fpve%2F100/screen", nil)))
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello\nhello\n" {
+		t.Errorf("status %d, body %q", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	rec = e.do(t, e.login(t, httptest.NewRequest("GET", "/api/sessions/lxc%2Fpve%2F101/screen", nil)))
+	wantJSONError(t, rec, http.StatusNotFound, "not_found")
+}
+
+func TestSessionLabelEndpoints(t *testing.T) {
+	e := newTestEnv(t, "")
+	e.setResources(testResources...)
+	ts := e.startTerminals(t)
+
+	// Labels given on connect are checked like those sent later.
+	long := strings.Repeat("x", terminal.MaxLabelLen+1)
+	rec := e.do(t, e.login(t, httptest.NewRequest("GET", "/ws/terminal/lxc/pve/100?label="+long, nil)))
+	wantJSONError(t, rec, http.StatusBadRequest, "invalid_label")
+
+	conn, _, err := e.dialTerminal(t, ts, "/ws/terminal/lxc/pve/100?label=incident-4821%0A", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteMessage(websocket.BinaryMessage, []byte("ready\n"))
+	readUntil(t, conn, "ready\r\nready\r\n", nil)
+
+	listed := func() string {
+		t.Helper()
+		rec := e.do(t, e.login(t, httptest.NewRequest("GET", "/api/sessions", nil)))
+		var list []terminal.SessionInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || len(list) != 1 {
+			t.Fatalf("GET /api/sessions: %q, %v", rec.Body, err)
+		}
+		return list[0].Label
+	}
+	if got := listed(); got != "incident-4821" {
+		t.Errorf("listed label %q, want incident-4821", got)
+	}
+
+	const path = "/api/sessions/lxc%2Fpve%2F100"
+	patch := func(path, body string) *httptest.ResponseRecorder {
+		return e.do(t, e.login(t, httptest.NewRequest("PATCH", path, strings.NewReader(body))))
+	}
+	rec = patch(path, `{"label":"  resolved\u0007 "}`)
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"label":"resolved"}` {
+		t.Errorf("PATCH: status %d, body %q", rec.Code, rec.Body)
+	}
+	if got := listed(); got != "resolved" {
+		t.Errorf("listed label %q after PATCH, want resolved", got)
+	}
+
+	errs := []struct {
+		name, path, body string
+		status           int
+		code             string
+	}{
+		{"too long", path, `{"label":"` + long + `"}`, http.StatusBadRequest, "invalid_label"},
+		{"no label", path, `{}`, http.StatusBadRequest, "bad_request"},
+		{"not JSON", path, `label=x`, http.StatusBadRequest, "bad_request"},
+		{"no session", "/api/sessions/lxc%2Fpve%2F101", `{"label":"x"}`, http.StatusNotFound, "not_found"},
+	}
+	for _, tt := range errs {
+		t.Run(tt.name, func(t *testing.T) {
+			wantJSONError(t, patch(tt.path, tt.body), tt.status, tt.code)
+		})
+	}
+	if got := listed(); got != "resolved" {
+		t.Errorf("listed label %q after failed PATCHes, want resolved", got)
+	}
+}
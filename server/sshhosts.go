@@ -0,0 +1,28 @@
+package server
+
+import "github.com/chris/termbrowser/containers"
+
+// sshHosts returns the configured ssh_hosts as listing entries, typed by
+// their configured type so the UI groups them. Their status isn't
+// checked.
+func (s *Server) sshHosts() []containers.Container {
+	out := make([]containers.Container, 0, len(s.cfg.SSHHosts))
+	for _, h := range s.cfg.SSHHosts {
+		out = append(out, containers.Container{
+			CTID:   "ssh:" + h.Name,
+			Name:   h.Name,
+			Status: "unknown",
+			Type:   h.Type,
+		})
+	}
+	return out
+}
+
+func (s *Server) hasSSHHost(name string) bool {
+	for _, h := range s.cfg.SSHHosts {
+		if h.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/chris/termbrowser/containers"
+)
+
+const testSSHHosts = "ssh_hosts:\n" +
+	"  - {name: pbs1, type: pbs, address: 192.0.2.5, user: backup}\n" +
+	"  - {name: nas, type: storage, address: nas.lan}\n"
+
+func TestSSHHostsListed(t *testing.T) {
+	e := newTestEnv(t, testSSHHosts)
+	e.setResources(testResources...)
+	rec := getContainers(t, e, "", "")
+	var got []containers.Container
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("body %q: %v", rec.Body, err)
+	}
+	want := []containers.Container{
+		{CTID: "ssh:pbs1", Name: "pbs1", Status: "unknown", Type: "pbs"},
+		{CTID: "ssh:nas", Name: "nas", Status: "unknown", Type: "storage"},
+	}
+	if len(got) != len(testResources)+len(want) {
+		t.Fatalf("got %d entries, want %d", len(got), len(testResources)+len(want))
+	}
+	for i, w := range want {
+		if g := got[len(testResources)+i]; g != w {
+			t.Errorf("entry %d = %+v, want %+v", len(testResources)+i, g, w)
+		}
+	}
+}
+
+func TestSSHHostTerminalID(t *testing.T) {
+	tests := []struct {
+		id        string
+		wantFound bool
+	}{
+		{"ssh:pbs1", true},
+		{"ssh:nas#2", true},
+		{"ssh:other", false},
+	}
+	for _, tt := range tests {
+		e := newTestEnv(t, testSSHHosts)
+		path := "/ws/terminal/" + strings.ReplaceAll(tt.id, "#", "%23")
+		rec := e.do(t, e.login(t, httptest.NewRequest("GET", path, nil)))
+		if !tt.wantFound {
+			wantJSONError(t, rec, http.StatusNotFound, "not_found")
+		} else if rec.Code == http.StatusNotFound {
+			t.Errorf("%s: not found (body %q)", tt.id, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// staticHandler serves the embedded web UI with caching headers. The assets
+// can't change without a new binary, so each file gets a strong ETag from
+// its content and a public max-age; index.html is always revalidated so a
+// new build is picked up on the next load.
+//
+// Text assets are gzipped once at startup and served compressed to clients
+// that accept it, with their own ETag so caches never mix the two forms.
+type staticHandler struct {
+	files  http.Handler
+	etags  map[string]string    // cleaned path (no leading slash) → quoted ETag
+	gz     map[string]gzipAsset // cleaned path → precompressed content
+	maxAge time.Duration
+}
+
+type gzipAsset struct {
+	data    []byte
+	etag    string
+	modTime time.Time
+}
+
+// compressibleExts lists the asset types worth gzipping; images and fonts
+// are already compressed.
+var compressibleExts = map[string]bool{
+	".html": true, ".js": true, ".css": true, ".json": true, ".svg": true, ".txt": true,
+}
+
+func newStaticHandler(root fs.FS, maxAge time.Duration) (*staticHandler, error) {
+	etags := make(map[string]string)
+	gz := make(map[string]gzipAsset)
+	err := fs.WalkDir(root, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(root, p)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		tag := hex.EncodeToString(sum[:16])
+		etags[p] = `"` + tag + `"`
+
+		if !compressibleExts[path.Ext(p)] {
+			return nil
+		}
+		var buf bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		if buf.Len() >= len(data) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		gz[p] = gzipAsset{data: buf.Bytes(), etag: `"` + tag + `-gz"`, modTime: info.ModTime()}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("preparing web assets: %w", err)
+	}
+	return &staticHandler{
+		files:  http.FileServer(http.FS(root)),
+		etags:  etags,
+		gz:     gz,
+		maxAge: maxAge,
+	}, nil
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "index.html"
+	}
+	if name == "index.html" {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(h.maxAge.Seconds())))
+	}
+
+	if asset, ok := h.gz[name]; ok {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			ctype := mime.TypeByExtension(path.Ext(name))
+			if ctype == "" {
+				ctype = "application/octet-stream"
+			}
+			w.Header().Set("Content-Type", ctype)
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("ETag", asset.etag)
+			http.ServeContent(w, r, name, asset.modTime, bytes.NewReader(asset.data))
+			return
+		}
+	}
+
+	// http.FileServer checks If-None-Match against this header and answers
+	// 304 itself when it matches.
+	if etag, ok := h.etags[name]; ok {
+		w.Header().Set("ETag", etag)
+	}
+	h.files.ServeHTTP(w, r)
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(coding) != "gzip" && strings.TrimSpace(coding) != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok && strings.Trim(q, "0.") == "" {
+			return false // q=0 explicitly refuses it
+		}
+		return true
+	}
+	return false
+}
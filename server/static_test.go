@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+var testAssets = fstest.MapFS{
+	"index.html": {Data: []byte("<!doctype html><title>x</title>")},
+	"app.js":     {Data: []byte(strings.Repeat("console.log('termbrowser');\n", 50))},
+	"logo.png":   {Data: []byte("\x89PNG\r\n\x1a\n not really")},
+}
+
+func newTestStatic(t *testing.T) *staticHandler {
+	t.Helper()
+	h, err := newStaticHandler(testAssets, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestStaticCacheHeaders(t *testing.T) {
+	tests := []struct {
+		path         string
+		cacheControl string
+	}{
+		{"/", "no-cache"},
+		{"/app.js", "public, max-age=3600"},
+		{"/logo.png", "public, max-age=3600"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			h := newTestStatic(t)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != tt.cacheControl {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.cacheControl)
+			}
+			etag := rec.Header().Get("ETag")
+			if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) || len(etag) < 10 {
+				t.Fatalf("ETag = %q, want a strong ETag", etag)
+			}
+
+			// The same request with the ETag is answered 304, no body.
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header.Set("If-None-Match", etag)
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusNotModified {
+				t.Errorf("conditional request: status = %d, want 304", rec.Code)
+			}
+			if rec.Body.Len() != 0 {
+				t.Errorf("conditional request: got a %d-byte body", rec.Body.Len())
+			}
+
+			// A stale ETag gets the full response.
+			req.Header.Set("If-None-Match", `"stale"`)
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Errorf("stale ETag: status = %d, want 200", rec.Code)
+			}
+		})
+	}
+}
+
+func TestStaticGzip(t *testing.T) {
+	tests := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		wantGzip       bool
+	}{
+		{"gzip client", "/app.js", "gzip, deflate, br", true},
+		{"gzip with quality", "/app.js", "br;q=1.0, gzip;q=0.8", true},
+		{"wildcard", "/app.js", "*", true},
+		{"gzip refused", "/app.js", "gzip;q=0", false},
+		{"no Accept-Encoding", "/app.js", "", false},
+		{"other codings only", "/app.js", "br, deflate", false},
+		{"already compressed type", "/logo.png", "gzip", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestStatic(t)
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			want := testAssets[strings.TrimPrefix(tt.path, "/")].Data
+
+			if !tt.wantGzip {
+				if ce := rec.Header().Get("Content-Encoding"); ce != "" {
+					t.Errorf("Content-Encoding = %q, want none", ce)
+				}
+				if !bytes.Equal(rec.Body.Bytes(), want) {
+					t.Errorf("body differs from the asset")
+				}
+				return
+			}
+			if ce := rec.Header().Get("Content-Encoding"); ce != "gzip" {
+				t.Fatalf("Content-Encoding = %q, want gzip", ce)
+			}
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/javascript") {
+				t.Errorf("Content-Type = %q, want text/javascript", ct)
+			}
+			if v := rec.Header().Get("Vary"); v != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", v)
+			}
+			if etag := rec.Header().Get("ETag"); !strings.HasSuffix(etag, `-gz"`) {
+				t.Errorf("ETag = %q, want the gzip variant's", etag)
+			}
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("body isn't gzip: %v", err)
+			}
+			got, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("decompressed body differs from the asset")
+			}
+		})
+	}
+}
+
+func TestStaticGzipConditional(t *testing.T) {
+	h := newTestStatic(t)
+	get := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/app.js", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	etag := get("").Header().Get("ETag")
+	if rec := get(etag); rec.Code != http.StatusNotModified {
+		t.Errorf("status = %d with the gzip ETag, want 304", rec.Code)
+	}
+	// The identity ETag doesn't validate the gzipped form.
+	if rec := get(h.etags["app.js"]); rec.Code != http.StatusOK {
+		t.Errorf("status = %d with the identity ETag, want 200", rec.Code)
+	}
+}
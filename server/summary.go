@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/chris/termbrowser/containers"
+)
+
+// clusterSummary is the response of GET /api/cluster/summary.
+type clusterSummary struct {
+	Cluster string      `json:"cluster,omitempty"`
+	Quorate bool        `json:"quorate"`
+	Nodes   nodeCounts  `json:"nodes"`
+	LXC     guestCounts `json:"lxc"`
+	QEMU    guestCounts `json:"qemu"`
+}
+
+type nodeCounts struct {
+	Total   int `json:"total"`
+	Online  int `json:"online"`
+	Offline int `json:"offline"`
+}
+
+// guestCounts counts guests by status. Anything not running, such as a
+// paused VM, counts as stopped.
+type guestCounts struct {
+	Total   int `json:"total"`
+	Running int `json:"running"`
+	Stopped int `json:"stopped"`
+}
+
+// summarize counts the nodes and guests in a resource listing.
+func summarize(items []containers.Container, cluster containers.ClusterStatus) clusterSummary {
+	sum := clusterSummary{Cluster: cluster.Name, Quorate: cluster.Quorate}
+	for _, it := range items {
+		switch it.Type {
+		case "node":
+			sum.Nodes.Total++
+			if it.Status == "online" {
+				sum.Nodes.Online++
+			} else {
+				sum.Nodes.Offline++
+			}
+		case "lxc":
+			sum.LXC.add(it.Status)
+		case "qemu":
+			sum.QEMU.add(it.Status)
+		}
+	}
+	return sum
+}
+
+func (c *guestCounts) add(status string) {
+	c.Total++
+	if status == "running" {
+		c.Running++
+	} else {
+		c.Stopped++
+	}
+}
+
+// clusterCache holds the last /cluster/status answer for as long as
+// resourceCache holds the listing.
+type clusterCache struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	at     time.Time
+	status *containers.ClusterStatus
+}
+
+func (c *clusterCache) get() (containers.ClusterStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.status != nil && time.Since(c.at) < c.ttl {
+		return *c.status, nil
+	}
+	st, err := containers.Cluster()
+	if err != nil {
+		return containers.ClusterStatus{}, err
+	}
+	c.status, c.at = &st, time.Now()
+	return st, nil
+}
+
+// handleClusterSummary returns node and guest counts and quorum status,
+// querying the resources and the cluster status concurrently.
+func (s *Server) handleClusterSummary(w http.ResponseWriter, r *http.Request) {
+	var (
+		wg         sync.WaitGroup
+		cluster    containers.ClusterStatus
+		clusterErr error
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cluster, clusterErr = s.cluster.get()
+	}()
+	items, err := s.cache.get()
+	wg.Wait()
+	if err == nil {
+		err = clusterErr
+	}
+	if err != nil {
+		log.Printf("cluster summary req=%s: %v", requestID(r), err)
+		writeJSONError(w, http.StatusBadGateway, "pvesh_failed", "querying the cluster failed: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summarize(items, cluster))
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakePvesh puts a pvesh on the PATH that answers "pvesh get <path>" with
+// responses[path], and fails like a missing path for anything else.
+func fakePvesh(t *testing.T, responses map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for path, out := range responses {
+		name := strings.ReplaceAll(path, "/", "_")
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(out), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	script := "#!/bin/sh\n" +
+		"f=\"" + dir + "/$(echo \"$2\" | tr / _)\"\n" +
+		"if [ -f \"$f\" ]; then cat \"$f\"; else echo \"no such path '$2'\" >&2; exit 2; fi\n"
+	if err := os.WriteFile(filepath.Join(dir, "pvesh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestClusterSummary(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources string
+		status    string
+		want      clusterSummary
+	}{
+		{"cluster", `[
+			{"type":"node","node":"pve","status":"online"},
+			{"type":"node","node":"pve2","status":"online"},
+			{"type":"node","node":"pve3","status":"offline"},
+			{"type":"lxc","node":"pve","vmid":100,"name":"web","status":"running"},
+			{"type":"lxc","node":"pve","vmid":101,"name":"db","status":"stopped"},
+			{"type":"lxc","node":"pve2","vmid":102,"name":"dns","status":"running"},
+			{"type":"qemu","node":"pve2","vmid":200,"name":"win","status":"paused"},
+			{"type":"storage","node":"pve","status":"available"}
+		]`, `[{"type":"cluster","name":"homelab","quorate":1}]`, clusterSummary{
+			Cluster: "homelab", Quorate: true,
+			Nodes: nodeCounts{Total: 3, Online: 2, Offline: 1},
+			LXC:   guestCounts{Total: 3, Running: 2, Stopped: 1},
+			QEMU:  guestCounts{Total: 1, Stopped: 1},
+		}},
+		{"all stopped, no quorum", `[
+			{"type":"node","node":"pve","status":"online"},
+			{"type":"node","node":"pve2","status":"offline"},
+			{"type":"lxc","node":"pve","vmid":100,"status":"stopped"},
+			{"type":"qemu","node":"pve","vmid":200,"status":"stopped"}
+		]`, `[{"type":"cluster","name":"homelab","quorate":0}]`, clusterSummary{
+			Cluster: "homelab",
+			Nodes:   nodeCounts{Total: 2, Online: 1, Offline: 1},
+			LXC:     guestCounts{Total: 1, Stopped: 1},
+			QEMU:    guestCounts{Total: 1, Stopped: 1},
+		}},
+		{"single node", `[
+			{"type":"node","node":"pve","status":"online"},
+			{"type":"lxc","node":"pve","vmid":100,"status":"running"}
+		]`, `[{"type":"node","name":"pve","ip":"10.0.0.1","online":1}]`, clusterSummary{
+			Quorate: true,
+			Nodes:   nodeCounts{Total: 1, Online: 1},
+			LXC:     guestCounts{Total: 1, Running: 1},
+		}},
+		{"no guests", `[{"type":"node","node":"pve","status":"online"}]`,
+			`[{"type":"node","name":"pve","ip":"10.0.0.1","online":1}]`, clusterSummary{
+				Quorate: true,
+				Nodes:   nodeCounts{Total: 1, Online: 1},
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakePvesh(t, map[string]string{"/cluster/resources": tt.resources, "/cluster/status": tt.status})
+			e := newTestEnv(t, "")
+			rec := e.do(t, e.login(t, httptest.NewRequest("GET", "/api/cluster/summary", nil)))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			var got clusterSummary
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("summary = %+v\nwant      %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClusterSummaryPveshFails(t *testing.T) {
+	fakePvesh(t, map[string]string{"/cluster/resources": `[{"type":"node","node":"pve","status":"online"}]`})
+	e := newTestEnv(t, "")
+	rec := e.do(t, e.login(t, httptest.NewRequest("GET", "/api/cluster/summary", nil)))
+	wantJSONError(t, rec, http.StatusBadGateway, "pvesh_failed")
+}
+
+func TestClusterSummaryCached(t *testing.T) {
+	fakePvesh(t, map[string]string{
+		"/cluster/resources": `[{"type":"node","node":"pve","status":"online"}]`,
+		"/cluster/status":    `[{"type":"cluster","name":"homelab","quorate":1}]`,
+	})
+	e := newTestEnv(t, "")
+	get := func() string {
+		rec := e.do(t, e.login(t, httptest.NewRequest("GET", "/api/cluster/summary", nil)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+		return rec.Body.String()
+	}
+	first := get()
+	// pvesh is gone, so only the cache can answer.
+	t.Setenv("PATH", t.TempDir())
+	if second := get(); second != first {
+		t.Errorf("second summary %s, want the cached %s", second, first)
+	}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/chris/termbrowser/auth"
+	"github.com/chris/termbrowser/containers"
+	"github.com/gorilla/websocket"
+)
+
+func TestInvalidIDReason(t *testing.T) {
+	tests := []struct {
+		path   string // after /ws/terminal/
+		reason string
+	}{
+		{"bogus", "unrecognised id: expected host, node:{name}, ssh:{name}, lxc/{node}/{vmid}, qemu/{node}/{vmid} or a numeric container id"},
+		{"node:", "node id is missing the node name: node:{name}"},
+		{"node:-pve", "node name may only contain letters, digits, '.' and '-'"},
+		{"ssh:", "ssh id is missing the host name: ssh:{name}"},
+		{"ssh:.backup", `invalid ssh host name ".backup"`},
+		{"lxc/", "lxc id is missing the node: lxc/{node}/{vmid}"},
+		{"lxc/pve", "lxc id is missing the vmid: lxc/{node}/{vmid}"},
+		{"lxc/pve/", "lxc id is missing the vmid: lxc/{node}/{vmid}"},
+		{"lxc/p_ve/100", "node name may only contain letters, digits, '.' and '-'"},
+		{"lxc/pve/abc", `vmid must be a positive number without leading zeros, got "abc"`},
+		{"lxc/pve/0100", `vmid must be a positive number without leading zeros, got "0100"`},
+		{"qemu/pve", "qemu id is missing the vmid: qemu/{node}/{vmid}"},
+		{"qemu/pve/200%232", "qemu ids can't have an #instance suffix"},
+		{"host%23", "instance suffix must be 1-16 letters, digits, '-' or '_'"},
+		{"host%23a.b", "instance suffix must be 1-16 letters, digits, '-' or '_'"},
+		{"0", "container id must be a positive number without leading zeros"},
+		{"-5", "container id must be a positive number without leading zeros"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			e := newTestEnv(t, "")
+			rec := e.do(t, e.login(t, httptest.NewRequest("GET", "/ws/terminal/"+tt.path, nil)))
+			wantJSONError(t, rec, http.StatusBadRequest, "invalid_id")
+			var body errorBody
+			json.Unmarshal(rec.Body.Bytes(), &body)
+			if want := "invalid terminal id: " + tt.reason; body.Error.Message != want {
+				t.Errorf("message = %q, want %q", body.Error.Message, want)
+			}
+		})
+	}
+}
+
+func TestTerminalWindowParam(t *testing.T) {
+	tests := []struct {
+		window string
+		valid  bool
+	}{
+		{"", true},
+		{"deploy", true},
+		{"logs_2", true},
+		{"a.b", false},
+		{"main:1", false},
+		{"two%20words", false},
+		{strings.Repeat("w", 33), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.window, func(t *testing.T) {
+			e := newTestEnv(t, "")
+			rec := e.do(t, e.login(t, httptest.NewRequest("GET", "/ws/terminal/node:pve2?window="+tt.window, nil)))
+			if !tt.valid {
+				wantJSONError(t, rec, http.StatusBadRequest, "invalid_window")
+				return
+			}
+			// Valid windows get as far as the upgrade, which a plain GET
+			// fails.
+			var body errorBody
+			json.Unmarshal(rec.Body.Bytes(), &body)
+			if body.Error.Code == "invalid_window" {
+				t.Errorf("window %q refused", tt.window)
+			}
+		})
+	}
+}
+
+func TestTerminalByName(t *testing.T) {
+	guests := append(slices.Clone(testResources),
+		containers.Container{CTID: "lxc/pve2/102", Name: "db", Type: "lxc", Node: "pve2", VMID: "102", Status: "running"})
+	tests := []struct {
+		name   string
+		path   string // after /ws/terminal/
+		want   string // the resolved session id
+		status int
+		code   string
+	}{
+		{"container", "name:web", "lxc/pve/100", 0, ""},
+		{"VM", "name:win", "qemu/pve/200", 0, ""},
+		{"with instance", "name:web%232", "lxc/pve/100#2", 0, ""},
+		{"ambiguous", "name:db", "", http.StatusConflict, "ambiguous_name"},
+		{"not found", "name:mail", "", http.StatusNotFound, "not_found"},
+		// Only guests have names for this; nodes use node:{name}.
+		{"node name", "name:pve", "", http.StatusNotFound, "not_found"},
+		{"denied after resolving", "name:web", "", http.StatusForbidden, "forbidden_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := ""
+			if tt.code == "forbidden_id" {
+				cfg = "denied_id_patterns: [lxc/pve/100]\n"
+			}
+			e := newTestEnv(t, cfg)
+			e.setResources(guests...)
+			if tt.status != 0 {
+				rec := e.do(t, e.login(t, httptest.NewRequest("GET", "/ws/terminal/"+tt.path, nil)))
+				wantJSONError(t, rec, tt.status, tt.code)
+				return
+			}
+			ts := e.startTerminals(t)
+			var started []string
+			e.term.BuildCommand = func(id string) *exec.Cmd {
+				started = append(started, id)
+				return exec.Command("cat")
+			}
+			conn, _, err := e.dialTerminal(t, ts, "/ws/terminal/"+tt.path, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.WriteMessage(websocket.BinaryMessage, []byte("x\n"))
+			readUntil(t, conn, "x\r\n", nil)
+			if !slices.Equal(started, []string{tt.want}) {
+				t.Errorf("started %q, want %q", started, tt.want)
+			}
+		})
+	}
+}
+
+func TestTerminalByNameLookupFails(t *testing.T) {
+	e := newTestEnv(t, "")
+	e.srv.cache.list = func() ([]containers.Container, error) { return nil, errors.New("pvesh: exit status 2") }
+	rec := e.do(t, e.login(t, httptest.NewRequest("GET", "/ws/terminal/name:web", nil)))
+	wantJSONError(t, rec, http.StatusBadGateway, "lookup_failed")
+}
+
+func TestNodeAddrOverride(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		scope   auth.Scope
+		path    string // after /ws/terminal/
+		status  int    // 0 if the request gets as far as the upgrade
+		code    string
+	}{
+		{"no addr, disabled", false, auth.ScopeTerminal, "node:pve2", 0, ""},
+		{"disabled", false, auth.ScopeAdmin, "node:pve2?addr=10.9.9.9", http.StatusForbidden, "addr_override_disabled"},
+		{"not admin", true, auth.ScopeTerminal, "node:pve2?addr=10.9.9.9", http.StatusForbidden, "insufficient_scope"},
+		{"node", true, auth.ScopeAdmin, "node:pve2?addr=10.9.9.9", 0, ""},
+		{"lxc", true, auth.ScopeAdmin, "lxc/pve/100?addr=fd00::9", 0, ""},
+		{"qemu", true, auth.ScopeAdmin, "qemu/pve/200?addr=10.9.9.9", 0, ""},
+		{"host name", true, auth.ScopeAdmin, "node:pve2?addr=pve2.lan", http.StatusBadRequest, "invalid_addr"},
+		{"zone", true, auth.ScopeAdmin, "node:pve2?addr=fe80::1%25eth0", http.StatusBadRequest, "invalid_addr"},
+		{"host id", true, auth.ScopeAdmin, "host?addr=10.9.9.9", http.StatusBadRequest, "invalid_addr"},
+		{"ssh host id", true, auth.ScopeAdmin, "ssh:pbs?addr=10.9.9.9", http.StatusBadRequest, "invalid_addr"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := "ssh_hosts:\n  - {name: pbs, type: pbs, address: 192.0.2.5}\n"
+			if tt.enabled {
+				cfg += "allow_addr_override: true\n"
+			}
+			e := newTestEnv(t, cfg)
+			e.setResources(testResources...)
+			e.auth.APITokens = map[[32]byte]auth.APIToken{
+				sha256.Sum256([]byte("tok")): {Name: "test", Scope: tt.scope},
+			}
+			r := httptest.NewRequest("GET", "/ws/terminal/"+tt.path, nil)
+			r.Header.Set("Authorization", "Bearer tok")
+			rec := e.do(t, r)
+			if tt.status != 0 {
+				wantJSONError(t, rec, tt.status, tt.code)
+				return
+			}
+			// A plain GET gets past every check and fails the upgrade.
+			wantJSONError(t, rec, http.StatusBadRequest, "bad_request")
+			if !strings.Contains(rec.Body.String(), "websocket") {
+				t.Errorf("body %q, want the upgrade to be attempted", rec.Body)
+			}
+		})
+	}
+}
+
+func TestNodeAddrOverrideUsed(t *testing.T) {
+	// A stand-in for ssh that shows where it was asked to connect.
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ssh"), []byte("#!/bin/sh\necho \"ssh $*\"\nexec cat\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	e := newTestEnv(t, "allow_addr_override: true\n")
+	e.setResources(testResources...)
+	ts := e.startTerminals(t)
+	conn, _, err := e.dialTerminal(t, ts, "/ws/terminal/node:pve2?addr=10.9.9.9", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, conn, "root@10.9.9.9 ", nil)
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// serve starts a test server configured by httpServer, so the configured
+// timeouts apply, with the main listener's routes.
+func (e *testEnv) serve(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux, _, err := e.srv.routes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = e.srv.httpServer(mux)
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	e := newTestEnv(t, "read_header_timeout: 200ms\n")
+	addr := e.serve(t).Listener.Addr().String()
+
+	tests := []struct {
+		name    string
+		request string
+		want    string // start of the response; "" means closed without one
+	}{
+		{"complete headers", "GET /healthz HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n", "HTTP/1.1 200"},
+		{"slow headers", "GET /healthz HTTP/1.1\r\nHost: x\r\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			io.WriteString(conn, tt.request)
+			start := time.Now()
+			conn.SetReadDeadline(start.Add(3 * time.Second))
+			resp, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("connection wasn't closed: %v", err)
+			}
+			if tt.want == "" {
+				if len(resp) != 0 && !strings.HasPrefix(string(resp), "HTTP/1.1 408") {
+					t.Errorf("got response %q", resp)
+				}
+				if d := time.Since(start); d < 150*time.Millisecond {
+					t.Errorf("closed after %v, before the timeout", d)
+				}
+			} else if !strings.HasPrefix(string(resp), tt.want) {
+				t.Errorf("response %q, want it to start with %q", resp, tt.want)
+			}
+		})
+	}
+}
+
+// The read and write timeouts are for plain requests; a terminal must keep
+// working well past them.
+func TestWebSocketOutlivesTimeouts(t *testing.T) {
+	e := newTestEnv(t, "read_timeout: 200ms\nwrite_timeout: 200ms\nidle_timeout: 200ms\n")
+	e.setResources(testResources...)
+	e.term.BuildCommand = func(string) *exec.Cmd { return exec.Command("cat") }
+	ts := e.serve(t)
+	t.Cleanup(func() {
+		for _, si := range e.term.Sessions() {
+			e.term.Close(si.ID, 0)
+		}
+	})
+
+	conn, _, err := e.dialTerminal(t, ts, "/ws/terminal/lxc/pve/100", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"first", "second"} {
+		time.Sleep(500 * time.Millisecond)
+		if err := conn.WriteMessage(websocket.BinaryMessage, []byte(msg+"\n")); err != nil {
+			t.Fatal(err)
+		}
+		readUntil(t, conn, msg+"\r\n"+msg+"\r\n", nil)
+	}
+}
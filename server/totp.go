@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/chris/termbrowser/auth"
+)
+
+type totpRotateRequest struct {
+	Issuer  string `json:"issuer"`
+	Account string `json:"account"`
+}
+
+type totpRotateResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+	QR     string `json:"qr"` // PNG as a data: URL
+}
+
+type totpConfirmRequest struct {
+	Code string `json:"code"`
+}
+
+// handleTOTPRotate starts a TOTP secret rotation and returns the new
+// secret for the authenticator app. Nothing changes until it is confirmed
+// with handleTOTPConfirm. The body is optional.
+func (s *Server) handleTOTPRotate(w http.ResponseWriter, r *http.Request) {
+	req := totpRotateRequest{Issuer: s.cfg.TOTPIssuer, Account: s.cfg.TOTPAccount}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil && err != io.EOF {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "request body must be JSON")
+		return
+	}
+	key, err := s.auth.BeginTOTPRotation(req.Issuer, req.Account)
+	if err != nil {
+		log.Printf("totp rotation req=%s: %v", requestID(r), err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "internal error")
+		return
+	}
+	resp := totpRotateResponse{Secret: key.Secret(), URI: key.URL()}
+	if img, err := key.Image(256, 256); err == nil {
+		var buf bytes.Buffer
+		if png.Encode(&buf, img) == nil {
+			resp.QR = "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+		}
+	}
+	log.Printf("totp rotation started by %s req=%s", s.clientIP(r), requestID(r))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleTOTPConfirm commits a rotation started by handleTOTPRotate once
+// given a code from the new secret, saving it with SaveTOTPSecret.
+func (s *Server) handleTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	var req totpConfirmRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "request body must be JSON")
+		return
+	}
+	if s.SaveTOTPSecret == nil {
+		writeJSONError(w, http.StatusNotImplemented, "not_supported", "this server can't save a new TOTP secret")
+		return
+	}
+	err := s.auth.ConfirmTOTPRotation(req.Code, s.SaveTOTPSecret)
+	switch {
+	case errors.Is(err, auth.ErrNoRotation):
+		writeJSONError(w, http.StatusConflict, "no_rotation", "no TOTP rotation in progress (or it expired); start one first")
+		return
+	case errors.Is(err, auth.ErrWrongCode):
+		writeJSONError(w, http.StatusBadRequest, "wrong_code", "the code doesn't match the new secret")
+		return
+	case err != nil:
+		log.Printf("saving new totp secret req=%s: %v", requestID(r), err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "could not save the new secret; the old one is still in use")
+		return
+	}
+	log.Printf("totp secret rotated by %s req=%s", s.clientIP(r), requestID(r))
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+// postTOTP sends a logged-in POST to a /api/totp endpoint.
+func postTOTP(t *testing.T, e *testEnv, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return e.do(t, e.login(t, httptest.NewRequest("POST", "/api/totp/"+path, strings.NewReader(body))))
+}
+
+// rotateTOTP starts a rotation and returns the new secret.
+func rotateTOTP(t *testing.T, e *testEnv) string {
+	t.Helper()
+	rec := postTOTP(t, e, "rotate", `{"account":"root@pve"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rotate: status %d: %s", rec.Code, rec.Body)
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", cc)
+	}
+	var resp totpRotateResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Secret == "" || !strings.Contains(resp.URI, "secret="+resp.Secret) || !strings.Contains(resp.URI, "root@pve") {
+		t.Errorf("rotate response %+v doesn't carry the new secret", resp)
+	}
+	if !strings.HasPrefix(resp.QR, "data:image/png;base64,") {
+		t.Errorf("QR = %.40q, want a PNG data URL", resp.QR)
+	}
+	return resp.Secret
+}
+
+// totpCode returns the current code for secret.
+func totpCode(t *testing.T, secret string) string {
+	t.Helper()
+	c, err := totp.GenerateCode(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTOTPRotateConfirm(t *testing.T) {
+	e := newTestEnv(t, "")
+	var saved string
+	e.srv.SaveTOTPSecret = func(secret string) error {
+		saved = secret
+		return nil
+	}
+	old := e.srv.cfg.TOTPSecret
+
+	wantJSONError(t, postTOTP(t, e, "confirm", `{"code":"123456"}`), http.StatusConflict, "no_rotation")
+
+	secret := rotateTOTP(t, e)
+	wantJSONError(t, postTOTP(t, e, "confirm", `{"code":"`+totpCode(t, old)+`"}`), http.StatusBadRequest, "wrong_code")
+	wantJSONError(t, postTOTP(t, e, "confirm", `{`), http.StatusBadRequest, "bad_request")
+	if saved != "" {
+		t.Fatalf("saved %q before confirmation", saved)
+	}
+
+	if rec := postTOTP(t, e, "confirm", `{"code":"`+totpCode(t, secret)+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("confirm: status %d: %s", rec.Code, rec.Body)
+	}
+	if saved != secret {
+		t.Errorf("saved %q, want the new secret %q", saved, secret)
+	}
+	wantJSONError(t, postTOTP(t, e, "confirm", `{"code":"`+totpCode(t, secret)+`"}`), http.StatusConflict, "no_rotation")
+}
+
+func TestTOTPConfirmSaveFails(t *testing.T) {
+	tests := []struct {
+		name   string
+		save   func(string) error
+		status int
+		code   string
+	}{
+		{"no SaveTOTPSecret", nil, http.StatusNotImplemented, "not_supported"},
+		{"saving fails", func(string) error { return errors.New("read-only file system") },
+			http.StatusInternalServerError, "internal_error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, "")
+			e.srv.SaveTOTPSecret = tt.save
+			secret := rotateTOTP(t, e)
+			wantJSONError(t, postTOTP(t, e, "confirm", `{"code":"`+totpCode(t, secret)+`"}`), tt.status, tt.code)
+			// The old secret is still the one that logs in.
+			body := `{"password":"pw","totp_code":"` + totpCode(t, e.srv.cfg.TOTPSecret) + `"}`
+			rec := e.do(t, httptest.NewRequest("POST", "/api/login", strings.NewReader(body)))
+			if rec.Code != http.StatusOK {
+				t.Errorf("login with the old secret: status %d: %s", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestTOTPRotateLabels(t *testing.T) {
+	tests := []struct {
+		name, yaml, body string
+		want             []string // in the URI
+	}{
+		{"defaults", "", "", []string{"issuer=termbrowser", "termbrowser:admin"}},
+		{"from the config", "totp_issuer: pve-prod\ntotp_account: ops\n", "", []string{"issuer=pve-prod", "pve-prod:ops"}},
+		{"from the body", "totp_issuer: pve-prod\n", `{"account":"root@pve"}`, []string{"issuer=pve-prod", "pve-prod:root@pve"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, tt.yaml)
+			rec := postTOTP(t, e, "rotate", tt.body)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("rotate: status %d: %s", rec.Code, rec.Body)
+			}
+			var resp totpRotateResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			uri, err := url.PathUnescape(resp.URI)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(uri, want) {
+					t.Errorf("URI %q doesn't contain %q", uri, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTOTPRotateRequiresAdmin(t *testing.T) {
+	e := newTestEnv(t, "")
+	rec := e.do(t, httptest.NewRequest("POST", "/api/totp/rotate", nil))
+	wantJSONError(t, rec, http.StatusUnauthorized, "unauthorized")
+}
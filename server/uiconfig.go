@@ -0,0 +1,45 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/chris/termbrowser/terminal"
+)
+
+// uiConfig is the configuration the web UI may read. Every field is
+// listed explicitly so nothing from config.Config is exposed by accident;
+// don't embed or copy the config struct here.
+type uiConfig struct {
+	ProductName     string     `json:"product_name"`
+	ProtocolVersion int        `json:"protocol_version"`
+	MOTD            string     `json:"motd,omitempty"`
+	Features        uiFeatures `json:"features"`
+}
+
+type uiFeatures struct {
+	Scrollback     bool `json:"scrollback"`
+	FileTransfer   bool `json:"file_transfer"`
+	Exec           bool `json:"exec"`
+	TerminalEvents bool `json:"terminal_events"`
+	AutoStart      bool `json:"auto_start"`
+}
+
+// handleUIConfig serves the non-secret settings the frontend needs at load
+// time. It doesn't require a session, so the login screen can use it too.
+func (s *Server) handleUIConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(uiConfig{
+		ProductName:     s.cfg.ProductName,
+		ProtocolVersion: terminal.ProtocolVersion,
+		MOTD:            s.cfg.MOTD,
+		Features: uiFeatures{
+			Scrollback:     s.cfg.ScrollbackDir != "",
+			FileTransfer:   true,
+			Exec:           true,
+			TerminalEvents: s.cfg.TerminalEvents,
+			AutoStart:      s.cfg.AutoStart,
+		},
+	})
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestUIConfig(t *testing.T) {
+	const tokenHash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	e := newTestEnv(t, `product_name: Lab Terminals
+motd: Authorized use only
+scrollback_dir: /var/lib/tb-private-scrollback
+terminal_events: true
+api_tokens:
+  - name: ci
+    sha256: `+tokenHash+`
+    scope: read
+`)
+	// No login: the login screen reads it too.
+	rec := e.do(t, httptest.NewRequest("GET", "/api/config", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	body := rec.Body.String()
+
+	var got map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	wantKeys := []string{"features", "motd", "product_name", "protocol_version"}
+	if keys := slices.Sorted(maps.Keys(got)); !slices.Equal(keys, wantKeys) {
+		t.Errorf("fields %q, want exactly %q", keys, wantKeys)
+	}
+	var features map[string]bool
+	if err := json.Unmarshal(got["features"], &features); err != nil {
+		t.Fatal(err)
+	}
+	wantFeatures := map[string]bool{
+		"scrollback": true, "file_transfer": true, "exec": true, "terminal_events": true, "auto_start": false,
+	}
+	if !maps.Equal(features, wantFeatures) {
+		t.Errorf("features %v, want %v", features, wantFeatures)
+	}
+	if string(got["product_name"]) != `"Lab Terminals"` || string(got["motd"]) != `"Authorized use only"` {
+		t.Errorf("product_name %s, motd %s", got["product_name"], got["motd"])
+	}
+
+	for _, secret := range []string{
+		e.srv.cfg.TOTPSecret,
+		tokenHash, "/var/lib/tb-private-scrollback", "password", "secret", "jwt", "token",
+	} {
+		if strings.Contains(body, secret) {
+			t.Errorf("response contains %q: %s", secret, body)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chris/termbrowser/auth"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signedToken returns a session token signed with secret that expires at
+// exp.
+func signedToken(t *testing.T, secret string, exp time.Time) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		IssuedAt:  jwt.NewNumericDate(exp.Add(-24 * time.Hour)),
+		ExpiresAt: jwt.NewNumericDate(exp),
+	}).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestValidateSession(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	tests := []struct {
+		name      string
+		cookie    string
+		bearer    string
+		status    int
+		wantKind  string
+		wantScope string
+		wantName  string
+	}{
+		{"valid cookie", signedToken(t, "jwt-test-secret", exp), "", http.StatusOK, "session", "admin", ""},
+		{"expired cookie", signedToken(t, "jwt-test-secret", time.Now().Add(-time.Minute)), "", http.StatusUnauthorized, "", "", ""},
+		{"forged cookie", signedToken(t, "another-secret", exp), "", http.StatusUnauthorized, "", "", ""},
+		{"garbage cookie", "not-a-jwt", "", http.StatusUnauthorized, "", "", ""},
+		{"no credentials", "", "", http.StatusUnauthorized, "", "", ""},
+		{"API token", "", "tok", http.StatusOK, "token", "read", "dashboard"},
+		{"unknown API token", "", "nope", http.StatusUnauthorized, "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t, "")
+			e.auth.APITokens = map[[32]byte]auth.APIToken{
+				sha256.Sum256([]byte("tok")): {Name: "dashboard", Scope: auth.ScopeRead},
+			}
+			r := httptest.NewRequest("GET", "/api/session/validate", nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: e.auth.CookieName, Value: tt.cookie})
+			}
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			rec := e.do(t, r)
+			if tt.status != http.StatusOK {
+				wantJSONError(t, rec, tt.status, "unauthorized")
+				return
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			if cc := rec.Header().Get("Cache-Control"); cc != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", cc)
+			}
+			var id auth.Identity
+			if err := json.Unmarshal(rec.Body.Bytes(), &id); err != nil {
+				t.Fatal(err)
+			}
+			if id.Kind != tt.wantKind || id.Scope != tt.wantScope || id.Name != tt.wantName {
+				t.Errorf("identity %+v, want kind %s scope %s name %q", id, tt.wantKind, tt.wantScope, tt.wantName)
+			}
+			if tt.wantKind == "session" && (id.ExpiresAt == nil || !id.ExpiresAt.Equal(exp)) {
+				t.Errorf("expires_at = %v, want %v", id.ExpiresAt, exp)
+			}
+			if tt.wantKind == "token" && id.ExpiresAt != nil {
+				t.Errorf("expires_at = %v for an API token", id.ExpiresAt)
+			}
+		})
+	}
+}
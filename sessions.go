@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/chris/termbrowser/auth"
+	"github.com/chris/termbrowser/config"
+	"github.com/chris/termbrowser/terminal"
+)
+
+const sessionsUsage = `usage: termbrowser [-config path] sessions list
+       termbrowser [-config path] sessions kill <id>`
+
+// runSessions implements the "sessions" subcommand, which manages the
+// sessions of a running server through its HTTP API on localhost, calling
+// admin endpoints on admin_listen_addr when that's set. It signs its own
+// token with the config's jwt_secret, so only someone who can read the
+// config can use it. It returns the process exit code.
+func runSessions(stdout, stderr io.Writer, cfg *config.Config, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, sessionsUsage)
+		return 2
+	}
+	jwtSecret, err := hex.DecodeString(cfg.JWTSecret)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid jwt_secret in config: %v\n", err)
+		return 1
+	}
+	token, err := auth.NewManager(cfg.PasswordHash, cfg.TOTPSecret, jwtSecret).IssueToken()
+	if err != nil {
+		fmt.Fprintf(stderr, "signing token: %v\n", err)
+		return 1
+	}
+	c := &sessionsClient{
+		base:   "http://127.0.0.1:" + strconv.Itoa(cfg.Port),
+		cookie: &http.Cookie{Name: cfg.CookieName, Value: token},
+		http:   &http.Client{Timeout: 30 * time.Second},
+	}
+	c.admin = c.base
+	if cfg.AdminListenAddr != "" {
+		c.admin = "http://" + dialAddr(cfg.AdminListenAddr)
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		list, err := c.list()
+		if err != nil {
+			fmt.Fprintf(stderr, "listing sessions: %v\n", err)
+			return 1
+		}
+		printSessions(stdout, list, time.Now())
+		return 0
+	case args[0] == "kill" && len(args) == 2:
+		forced, err := c.kill(args[1])
+		if err != nil {
+			fmt.Fprintf(stderr, "killing %s: %v\n", args[1], err)
+			return 1
+		}
+		if forced {
+			fmt.Fprintf(stdout, "%s: terminated (SIGTERM)\n", args[1])
+		} else {
+			fmt.Fprintf(stdout, "%s: exited\n", args[1])
+		}
+		return 0
+	}
+	fmt.Fprintln(stderr, sessionsUsage)
+	return 2
+}
+
+// printSessions writes list as a table.
+func printSessions(w io.Writer, list []terminal.SessionInfo, now time.Time) {
+	if len(list) == 0 {
+		fmt.Fprintln(w, "no sessions")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tPID\tCLIENTS\tAGE\tIN\tOUT\tLABEL")
+	for _, s := range list {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%v\t%d\t%d\t%s\n",
+			s.ID, s.PID, s.Clients, now.Sub(s.CreatedAt).Round(time.Second), s.BytesIn, s.BytesOut, s.Label)
+	}
+	tw.Flush()
+}
+
+// dialAddr turns a listen address into one to connect to, replacing an
+// empty or unspecified host with loopback.
+func dialAddr(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if ip, err := netip.ParseAddr(host); host == "" || (err == nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+		if err == nil && ip.Is6() {
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// sessionsClient calls the session endpoints of a running server.
+type sessionsClient struct {
+	base   string // the main listener
+	admin  string // the admin listener, the same as base without one
+	cookie *http.Cookie
+	http   *http.Client
+}
+
+func (c *sessionsClient) list() ([]terminal.SessionInfo, error) {
+	var list []terminal.SessionInfo
+	err := c.do("GET", c.base+"/api/sessions", &list)
+	return list, err
+}
+
+func (c *sessionsClient) kill(id string) (bool, error) {
+	var resp struct {
+		Forced bool `json:"forced"`
+	}
+	err := c.do("POST", c.admin+"/api/sessions/"+url.PathEscape(id)+"/close", &resp)
+	return resp.Forced, err
+}
+
+// do sends a request and decodes the JSON response into out, turning the
+// server's error envelope into a Go error.
+func (c *sessionsClient) do(method, target string, out any) error {
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return err
+	}
+	req.AddCookie(c.cookie)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("is termbrowser running? %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error.Message != "" {
+			return fmt.Errorf("%s: %s", resp.Status, e.Error.Message)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chris/termbrowser/auth"
+	"github.com/chris/termbrowser/config"
+	"github.com/chris/termbrowser/terminal"
+)
+
+// stubSessionsServer stands in for a running termbrowser on 127.0.0.1,
+// checking the CLI's token, and points cfg.Port at it. With admin set, the
+// close endpoint is only served on a second listener, given as
+// cfg.AdminListenAddr without its host.
+func stubSessionsServer(t *testing.T, cfg *config.Config, admin bool) {
+	t.Helper()
+	secret, _ := hex.DecodeString(cfg.JWTSecret)
+	a := auth.NewManager(cfg.PasswordHash, cfg.TOTPSecret, secret)
+	a.CookieName = cfg.CookieName
+	created := time.Now().Add(-90 * time.Second)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/sessions", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]terminal.SessionInfo{
+			{ID: "lxc/pve/100", PID: 4242, CreatedAt: created, Clients: 2, BytesIn: 10, BytesOut: 2048, Label: "web"},
+		})
+	})
+	adminMux := mux
+	if admin {
+		adminMux = http.NewServeMux()
+	}
+	adminMux.HandleFunc("POST /api/sessions/{id}/close", func(w http.ResponseWriter, r *http.Request) {
+		switch r.PathValue("id") {
+		case "lxc/pve/100":
+			w.Write([]byte(`{"forced":false}`))
+		case "host":
+			w.Write([]byte(`{"forced":true}`))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"not_found","message":"no running session ` + r.PathValue("id") + `"}}`))
+		}
+	})
+	serve := func(h http.Handler) string {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := a.ValidateRequest(r); err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error":{"code":"unauthorized","message":"` + err.Error() + `"}}`))
+				return
+			}
+			h.ServeHTTP(w, r)
+		}))
+		t.Cleanup(ts.Close)
+		_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+		return port
+	}
+	cfg.Port, _ = strconv.Atoi(serve(mux))
+	if admin {
+		cfg.AdminListenAddr = ":" + serve(adminMux)
+	}
+}
+
+func TestRunSessions(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStdout string
+		wantStderr string
+	}{
+		{"no command", nil, 2, "", "usage: termbrowser"},
+		{"unknown command", []string{"restart"}, 2, "", "usage: termbrowser"},
+		{"list with extra args", []string{"list", "now"}, 2, "", "usage: termbrowser"},
+		{"kill without id", []string{"kill"}, 2, "", "usage: termbrowser"},
+		{"list", []string{"list"}, 0, "lxc/pve/100  4242  2        1m30s  10  2048  web", ""},
+		{"kill", []string{"kill", "lxc/pve/100"}, 0, "lxc/pve/100: exited\n", ""},
+		{"kill forced", []string{"kill", "host"}, 0, "host: terminated (SIGTERM)\n", ""},
+		{"kill unknown", []string{"kill", "node:pve"}, 1, "", "killing node:pve: 404 Not Found: no running session node:pve"},
+	}
+	for _, tt := range tests {
+		for _, admin := range []bool{false, true} {
+			name := tt.name
+			if admin {
+				name += ", admin listener"
+			}
+			t.Run(name, func(t *testing.T) {
+				cfg := loadConfig(t, "")
+				stubSessionsServer(t, cfg, admin)
+				var stdout, stderr bytes.Buffer
+				if code := runSessions(&stdout, &stderr, cfg, tt.args); code != tt.wantCode {
+					t.Errorf("exit code %d, want %d (stderr %q)", code, tt.wantCode, stderr.String())
+				}
+				if !strings.Contains(stdout.String(), tt.wantStdout) {
+					t.Errorf("stdout = %q, want it to contain %q", stdout.String(), tt.wantStdout)
+				}
+				if !strings.Contains(stderr.String(), tt.wantStderr) || (tt.wantStderr == "" && stderr.Len() > 0) {
+					t.Errorf("stderr = %q, want %q", stderr.String(), tt.wantStderr)
+				}
+			})
+		}
+	}
+}
+
+func TestDialAddr(t *testing.T) {
+	tests := []struct {
+		listen, want string
+	}{
+		{"127.0.0.1:9100", "127.0.0.1:9100"},
+		{"10.0.0.5:9100", "10.0.0.5:9100"},
+		{":9100", "127.0.0.1:9100"},
+		{"0.0.0.0:9100", "127.0.0.1:9100"},
+		{"[::]:9100", "[::1]:9100"},
+		{"[::1]:9100", "[::1]:9100"},
+		{"localhost:9100", "localhost:9100"},
+	}
+	for _, tt := range tests {
+		if got := dialAddr(tt.listen); got != tt.want {
+			t.Errorf("dialAddr(%q) = %q, want %q", tt.listen, got, tt.want)
+		}
+	}
+}
+
+func TestRunSessionsNotRunning(t *testing.T) {
+	cfg := loadConfig(t, "")
+	// A port nothing listens on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Port = ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	var stdout, stderr bytes.Buffer
+	if code := runSessions(&stdout, &stderr, cfg, []string{"list"}); code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+	if !strings.Contains(stderr.String(), "is termbrowser running?") {
+		t.Errorf("stderr = %q, want a hint that the server isn't running", stderr.String())
+	}
+}
+
+func TestPrintSessions(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name string
+		list []terminal.SessionInfo
+		want string
+	}{
+		{"empty", nil, "no sessions\n"},
+		{"two", []terminal.SessionInfo{
+			{ID: "host", PID: 1, CreatedAt: now.Add(-time.Hour), Clients: 0},
+			{ID: "lxc/pve/100#2", PID: 31337, CreatedAt: now.Add(-1500 * time.Millisecond), Clients: 1, BytesIn: 5, BytesOut: 123456, Label: "db"},
+		}, "" +
+			"ID             PID    CLIENTS  AGE     IN  OUT     LABEL\n" +
+			"host           1      0        1h0m0s  0   0       \n" +
+			"lxc/pve/100#2  31337  1        2s      5   123456  db\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			printSessions(&buf, tt.list, now)
+			if buf.String() != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", buf.String(), tt.want)
+			}
+		})
+	}
+}
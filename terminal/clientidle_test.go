@@ -0,0 +1,56 @@
+package terminal
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClientIdleTimeout(t *testing.T) {
+	m := newTestManager(t)
+	m.ClientIdleTimeout = 300 * time.Millisecond
+	ts := serveWS(t, m)
+	conn := dialWS(t, ts, "host")
+	start := time.Now()
+
+	// Input keeps the connection open past the timeout.
+	for range 4 {
+		conn.WriteMessage(websocket.BinaryMessage, []byte("x\n"))
+		readUntil(t, conn, "x\r\nx\r\n", nil)
+		time.Sleep(100 * time.Millisecond)
+	}
+	ce := readCloseFrame(t, conn)
+	if ce.Code != CloseClientIdle {
+		t.Fatalf("close code %d %q, want %d", ce.Code, ce.Text, CloseClientIdle)
+	}
+	if d := time.Since(start); d < 600*time.Millisecond {
+		t.Errorf("closed after %v despite input", d)
+	}
+
+	// The session is still there to reattach to.
+	if n := len(m.Sessions()); n != 1 {
+		t.Fatalf("%d sessions after the idle disconnect, want 1", n)
+	}
+	conn = dialWS(t, ts, "host")
+	conn.WriteMessage(websocket.BinaryMessage, []byte("back\n"))
+	readUntil(t, conn, "back\r\n", nil)
+}
+
+func TestClientIdleTimeoutOff(t *testing.T) {
+	m := newTestManager(t)
+	ts := serveWS(t, m)
+	conn := dialWS(t, ts, "host")
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	for {
+		_, _, err := conn.ReadMessage()
+		var ce *websocket.CloseError
+		if errors.As(err, &ce) {
+			t.Fatalf("closed without ClientIdleTimeout: %v", err)
+		}
+		if err != nil {
+			break // the read deadline
+		}
+	}
+}
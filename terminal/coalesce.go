@@ -0,0 +1,76 @@
+package terminal
+
+import (
+	"sync"
+	"time"
+)
+
+// coalesceMax is how much output a coalescer holds before flushing early.
+const coalesceMax = 32 << 10
+
+// coalescer batches PTY output into fewer WebSocket frames. The first
+// write after a quiet period is flushed at once, so keystroke echo isn't
+// delayed; writes that follow within interval are held and sent together
+// when the timer fires or the buffer fills. Flushes are serialised, so
+// output order is kept.
+type coalescer struct {
+	interval time.Duration
+	flush    func([]byte)
+
+	mu    sync.Mutex
+	buf   []byte
+	timer *time.Timer // non-nil while a flush window is open
+}
+
+func newCoalescer(interval time.Duration, flush func([]byte)) *coalescer {
+	return &coalescer{interval: interval, flush: flush}
+}
+
+// Write queues p for sending. p may be reused once Write returns.
+func (c *coalescer) Write(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buf = append(c.buf, p...)
+	switch {
+	case c.timer == nil:
+		c.flushLocked()
+		c.timer = time.AfterFunc(c.interval, c.tick)
+	case len(c.buf) >= coalesceMax:
+		c.flushLocked()
+	}
+}
+
+// tick ends a flush window, sending anything held. If there was output
+// the window is renewed, since more is likely on its way.
+func (c *coalescer) tick() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer == nil {
+		return // closed
+	}
+	if len(c.buf) == 0 {
+		c.timer = nil
+		return
+	}
+	c.flushLocked()
+	c.timer.Reset(c.interval)
+}
+
+// Close sends anything held and stops the timer.
+func (c *coalescer) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.buf) > 0 {
+		c.flushLocked()
+	}
+}
+
+func (c *coalescer) flushLocked() {
+	data := c.buf
+	c.buf = nil
+	c.flush(data)
+}
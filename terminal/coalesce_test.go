@@ -0,0 +1,123 @@
+package terminal
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// frameRecorder collects the frames a coalescer flushes.
+type frameRecorder struct {
+	mu     sync.Mutex
+	frames []string
+}
+
+func (r *frameRecorder) flush(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.frames = append(r.frames, string(p))
+}
+
+func (r *frameRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.frames...)
+}
+
+func TestCoalescer(t *testing.T) {
+	big := strings.Repeat("x", coalesceMax/32)
+	tests := []struct {
+		name   string
+		writes []string
+		// frames flushed straight away, and after the window or Close
+		wantNow, wantLater []string
+	}{
+		{"keystroke echo isn't delayed", []string{"a"}, []string{"a"}, []string{"a"}},
+		{"burst is coalesced", []string{"a", "b", "c", "d"}, []string{"a"}, []string{"a", "bcd"}},
+		{"full buffer flushes early", append([]string{"a"}, repeated(big, 32)...),
+			[]string{"a", strings.Repeat(big, 32)}, []string{"a", strings.Repeat(big, 32)}},
+	}
+	for _, tt := range tests {
+		for _, closeEarly := range []bool{false, true} {
+			name := tt.name
+			if closeEarly {
+				name += ", closed"
+			}
+			t.Run(name, func(t *testing.T) {
+				rec := &frameRecorder{}
+				c := newCoalescer(time.Hour, rec.flush)
+				if !closeEarly {
+					c.interval = 20 * time.Millisecond
+				}
+				for _, w := range tt.writes {
+					c.Write([]byte(w))
+				}
+				if got := rec.get(); !equalStrings(got, tt.wantNow) {
+					t.Errorf("flushed at once: %d frames, want %d", len(got), len(tt.wantNow))
+				}
+				if closeEarly {
+					c.Close()
+				} else {
+					waitFor(t, "the window to close", func() bool { return len(rec.get()) >= len(tt.wantLater) })
+					time.Sleep(50 * time.Millisecond) // nothing more should come
+				}
+				if got := rec.get(); !equalStrings(got, tt.wantLater) {
+					t.Errorf("frames %d (%.20q...), want %d", len(got), got, len(tt.wantLater))
+				}
+			})
+		}
+	}
+}
+
+func TestCoalescerQuietAgain(t *testing.T) {
+	rec := &frameRecorder{}
+	c := newCoalescer(20*time.Millisecond, rec.flush)
+	defer c.Close()
+	c.Write([]byte("a"))
+	c.Write([]byte("b"))
+	// After a window with output and one without, the next write is
+	// the first of a new burst and goes out at once.
+	time.Sleep(100 * time.Millisecond)
+	c.Write([]byte("c"))
+	if got, want := rec.get(), []string{"a", "b", "c"}; !equalStrings(got, want) {
+		t.Errorf("frames %q, want %q", got, want)
+	}
+}
+
+func repeated(s string, n int) []string {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = s
+	}
+	return out
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func BenchmarkCoalescer(b *testing.B) {
+	line := bytes.Repeat([]byte("y"), 80)
+	for _, interval := range []time.Duration{time.Millisecond, 10 * time.Millisecond} {
+		b.Run(interval.String(), func(b *testing.B) {
+			var frames int
+			c := newCoalescer(interval, func([]byte) { frames++ })
+			b.SetBytes(int64(len(line)))
+			for b.Loop() {
+				c.Write(line)
+			}
+			c.Close()
+			b.ReportMetric(float64(b.N)/float64(frames), "writes/frame")
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package terminal
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+
+	"github.com/chris/termbrowser/ids"
+)
+
+// ErrUnsupportedTarget is returned for targets that can't run arbitrary
+// non-interactive commands, such as VMs reached over a serial console.
+var ErrUnsupportedTarget = errors.New("commands aren't supported for this target type")
+
+// Command builds a non-interactive command that runs argv on the target of
+// a terminal id, using the same routing as interactive sessions but without
+// a PTY or tmux. Any #instance suffix is ignored.
+//
+// Arguments are passed as argv locally; over ssh, where the remote side
+// joins them into a shell command line, each one is quoted so it arrives as
+// a single literal word.
+func (m *Manager) Command(ctx context.Context, id string, argv ...string) (*exec.Cmd, error) {
+	if len(argv) == 0 {
+		return nil, errors.New("empty command")
+	}
+	p, err := ids.Parse(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var cmd *exec.Cmd
+	switch p.Kind {
+	case ids.Host:
+		cmd = exec.CommandContext(ctx, argv[0], argv[1:]...)
+
+	case ids.Node:
+		cmd = m.batchSSH(ctx, p.Node, argv)
+
+	case ids.SSH:
+		cmd = m.batchSSH(ctx, "ssh:"+p.Node, argv)
+
+	case ids.LXC:
+		remote := append([]string{"pct", "exec", p.VMID, "--"}, argv...)
+		cmd = m.batchSSH(ctx, p.Node, remote)
+
+	case ids.LocalLXC:
+		args := append([]string{"exec", p.VMID, "--"}, argv...)
+		cmd = exec.CommandContext(ctx, "pct", args...)
+
+	default:
+		return nil, ErrUnsupportedTarget
+	}
+	cmd.Env = m.buildEnv(id)
+	return cmd, nil
+}
+
+// batchSSH builds a non-interactive ssh command to node (or an "ssh:{name}"
+// host) that never prompts.
+func (m *Manager) batchSSH(ctx context.Context, node string, remote []string) *exec.Cmd {
+	args := append([]string{"-o", "BatchMode=yes"}, m.sshArgs(node, m.sshDest(node))...)
+	for _, a := range remote {
+		args = append(args, shellQuote(a))
+	}
+	return exec.CommandContext(ctx, "ssh", args...)
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:@,+") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
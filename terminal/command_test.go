@@ -0,0 +1,218 @@
+package terminal
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommand(t *testing.T) {
+	ssh := []string{"ssh", "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=no"}
+	tests := []struct {
+		id      string
+		want    []string
+		wantErr error
+	}{
+		{"host", []string{"cat", "--", "/var/log/my log"}, nil},
+		{"host#2", []string{"cat", "--", "/var/log/my log"}, nil},
+		{"node:pve2", append(slices.Clone(ssh), "root@10.0.0.2", "cat", "--", "'/var/log/my log'"), nil},
+		{"ssh:pbs", append(slices.Clone(ssh), "backup@192.0.2.5", "cat", "--", "'/var/log/my log'"), nil},
+		{"lxc/pve2/100", append(slices.Clone(ssh), "root@10.0.0.2", "pct", "exec", "100", "--", "cat", "--", "'/var/log/my log'"), nil},
+		{"lxc/pve2/100#2", append(slices.Clone(ssh), "root@10.0.0.2", "pct", "exec", "100", "--", "cat", "--", "'/var/log/my log'"), nil},
+		{"100", []string{"pct", "exec", "100", "--", "cat", "--", "/var/log/my log"}, nil},
+		{"qemu/pve/200", nil, ErrUnsupportedTarget},
+	}
+	m := NewManager(func(node string) string { return map[string]string{"pve2": "10.0.0.2"}[node] })
+	m.SSHHosts = map[string]SSHHost{"pbs": {Address: "192.0.2.5", User: "backup"}}
+	for _, tt := range tests {
+		cmd, err := m.Command(context.Background(), tt.id, "cat", "--", "/var/log/my log")
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("Command(%q): err = %v, want %v", tt.id, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !slices.Equal(cmd.Args, tt.want) {
+			t.Errorf("Command(%q) args = %q\nwant %q", tt.id, cmd.Args, tt.want)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"/var/log/syslog", "/var/log/syslog"},
+		{"", "''"},
+		{"a b", "'a b'"},
+		{"it's", `'it'\''s'`},
+		{"$(rm -rf /)", "'$(rm -rf /)'"},
+		{"a;b", "'a;b'"},
+	}
+	for _, tt := range tests {
+		if got := shellQuote(tt.in); got != tt.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+// jumpArg returns the value of args' -J option, or "" if there is none.
+func jumpArg(args []string) string {
+	if i := slices.Index(args, "-J"); i >= 0 && i+1 < len(args) {
+		return args[i+1]
+	}
+	return ""
+}
+
+func TestJumpHost(t *testing.T) {
+	tests := []struct {
+		name    string
+		global  string
+		perNode map[string]string
+		id      string
+		want    string
+	}{
+		{"none configured", "", nil, "node:pve2", ""},
+		{"global", "admin@bastion:2222", nil, "node:pve2", "admin@bastion:2222"},
+		{"global, container", "bastion", nil, "lxc/pve2/100", "bastion"},
+		{"global, VM", "bastion", nil, "qemu/pve2/200", "bastion"},
+		{"chained", "a@hop1,hop2:2200", nil, "node:pve2", "a@hop1,hop2:2200"},
+		{"per node", "bastion", map[string]string{"pve2": "inner"}, "lxc/pve2/100", "inner"},
+		{"per node, direct", "bastion", map[string]string{"pve2": ""}, "node:pve2", ""},
+		{"per node, only that node", "", map[string]string{"pve3": "inner"}, "node:pve2", ""},
+		{"ssh host", "bastion", map[string]string{"ssh:pbs": "pbs-jump"}, "ssh:pbs", "pbs-jump"},
+		{"host is local", "bastion", nil, "host", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(func(node string) string { return map[string]string{"pve2": "10.0.0.2"}[node] })
+			m.SSHJumpHost = tt.global
+			m.SSHJumpHosts = tt.perNode
+			m.SSHHosts = map[string]SSHHost{"pbs": {Address: "192.0.2.5"}}
+
+			shell := m.shellCommand(tt.id, false, "")
+			if got := jumpArg(shell.Args); got != tt.want {
+				t.Errorf("shell -J %q, want %q (args %q)", got, tt.want, shell.Args)
+			}
+			cmd, err := m.Command(context.Background(), tt.id, "true")
+			if errors.Is(err, ErrUnsupportedTarget) {
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := jumpArg(cmd.Args); got != tt.want {
+				t.Errorf("command -J %q, want %q (args %q)", got, tt.want, cmd.Args)
+			}
+		})
+	}
+}
+
+// identityArgs returns the -i key of args and whether IdentitiesOnly=yes
+// is set.
+func identityArgs(args []string) (key string, only bool) {
+	if i := slices.Index(args, "-i"); i >= 0 && i+1 < len(args) {
+		key = args[i+1]
+	}
+	return key, slices.Contains(args, "IdentitiesOnly=yes")
+}
+
+func TestIdentityFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		global  string
+		perNode map[string]string
+		id      string
+		want    string
+	}{
+		{"none configured", "", nil, "node:pve2", ""},
+		{"global", "/etc/tb/id_ed25519", nil, "node:pve2", "/etc/tb/id_ed25519"},
+		{"global, container", "/etc/tb/id_ed25519", nil, "lxc/pve2/100", "/etc/tb/id_ed25519"},
+		{"global, VM", "/etc/tb/id_ed25519", nil, "qemu/pve2/200", "/etc/tb/id_ed25519"},
+		{"per node", "/etc/tb/id_ed25519", map[string]string{"pve2": "/etc/tb/pve2"}, "lxc/pve2/100", "/etc/tb/pve2"},
+		{"per node, ssh defaults", "/etc/tb/id_ed25519", map[string]string{"pve2": ""}, "node:pve2", ""},
+		{"per node, only that node", "", map[string]string{"pve3": "/etc/tb/pve3"}, "node:pve2", ""},
+		{"ssh host", "/etc/tb/id_ed25519", map[string]string{"ssh:pbs": "/etc/tb/pbs"}, "ssh:pbs", "/etc/tb/pbs"},
+		{"host is local", "/etc/tb/id_ed25519", nil, "host", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(func(node string) string { return map[string]string{"pve2": "10.0.0.2"}[node] })
+			m.SSHIdentityFile = tt.global
+			m.SSHIdentityFiles = tt.perNode
+			m.SSHJumpHost = "bastion" // composes with the other ssh options
+			m.SSHHosts = map[string]SSHHost{"pbs": {Address: "192.0.2.5"}}
+
+			check := func(kind string, args []string) {
+				t.Helper()
+				key, only := identityArgs(args)
+				if key != tt.want || only != (tt.want != "") {
+					t.Errorf("%s: -i %q IdentitiesOnly %v, want -i %q (args %q)", kind, key, only, tt.want, args)
+				}
+				if i, j := slices.Index(args, "-i"), slices.IndexFunc(args, func(a string) bool { return strings.Contains(a, "@") }); i > j {
+					t.Errorf("%s: -i after the destination in %q", kind, args)
+				}
+			}
+			check("shell", m.shellCommand(tt.id, false, "").Args)
+			cmd, err := m.Command(context.Background(), tt.id, "true")
+			if errors.Is(err, ErrUnsupportedTarget) {
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			check("command", cmd.Args)
+		})
+	}
+}
+
+func TestSSHConnectTimeout(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		want    string // "" means no ConnectTimeout option
+	}{
+		{0, ""},
+		{10 * time.Second, "ConnectTimeout=10"},
+		{1500 * time.Millisecond, "ConnectTimeout=2"},
+		{100 * time.Millisecond, "ConnectTimeout=1"},
+	}
+	for _, tt := range tests {
+		m := NewManager(func(string) string { return "10.0.0.2" })
+		m.SSHConnectTimeout = tt.timeout
+		for _, id := range []string{"node:pve2", "lxc/pve2/100", "qemu/pve2/200"} {
+			args := m.shellCommand(id, false, "")
+			var got string
+			for i, a := range args.Args {
+				if i > 0 && args.Args[i-1] == "-o" && strings.HasPrefix(a, "ConnectTimeout=") {
+					got = a
+				}
+			}
+			if got != tt.want {
+				t.Errorf("%v, %s: got %q, want %q in %q", tt.timeout, id, got, tt.want, args.Args)
+			}
+		}
+	}
+}
+
+func TestSSHHostShell(t *testing.T) {
+	tests := []struct {
+		id   string
+		tmux bool
+		want []string
+	}{
+		{"ssh:pbs1", true, []string{"ssh", "-tt", "-o", "StrictHostKeyChecking=no", "backup@192.0.2.5",
+			"env", "TERM=xterm-256color", "tmux", "new-session", "-A", "-s", "tb-ssh-pbs1", "--", "/bin/bash"}},
+		{"ssh:pbs1", false, []string{"ssh", "-tt", "-o", "StrictHostKeyChecking=no", "backup@192.0.2.5"}},
+		{"ssh:nas.lan#2", true, []string{"ssh", "-tt", "-o", "StrictHostKeyChecking=no", "root@nas.lan",
+			"env", "TERM=xterm-256color", "tmux", "new-session", "-A", "-s", "tb-ssh-nas-lan-2", "--", "/bin/bash"}},
+	}
+	m := NewManager(nil)
+	m.SSHHosts = map[string]SSHHost{
+		"pbs1":    {Address: "192.0.2.5", User: "backup"},
+		"nas.lan": {Address: "nas.lan"},
+	}
+	for _, tt := range tests {
+		if got := m.shellCommand(tt.id, tt.tmux, "").Args; !slices.Equal(got, tt.want) {
+			t.Errorf("shellCommand(%q, tmux=%v) = %q\nwant %q", tt.id, tt.tmux, got, tt.want)
+		}
+	}
+}
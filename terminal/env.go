@@ -0,0 +1,86 @@
+package terminal
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/chris/termbrowser/ids"
+)
+
+// TargetEnv is extra environment for terminals whose id matches Match (see
+// MatchID).
+type TargetEnv struct {
+	Match string
+	Env   map[string]string
+}
+
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// CheckEnvName rejects names that aren't valid shell variable names, and
+// TERM, which the server always sets itself.
+func CheckEnvName(name string) error {
+	if !envNameRe.MatchString(name) {
+		return fmt.Errorf("%q is not a valid environment variable name", name)
+	}
+	if name == "TERM" {
+		return fmt.Errorf("TERM is always xterm-256color")
+	}
+	return nil
+}
+
+// envVars returns the configured variables for terminal id as sorted
+// NAME=value pairs: LANG and LC_ALL from Locale, overridden by Env, then
+// by each matching TargetEnv in order.
+func (m *Manager) envVars(id string) []string {
+	base, _ := ids.SplitInstance(id)
+	vars := make(map[string]string)
+	if m.Locale != "" {
+		vars["LANG"] = m.Locale
+		vars["LC_ALL"] = m.Locale
+	}
+	maps.Copy(vars, m.Env)
+	for _, t := range m.TargetEnv {
+		if MatchID(t.Match, base) {
+			maps.Copy(vars, t.Env)
+		}
+	}
+	out := make([]string, 0, len(vars))
+	for _, k := range slices.Sorted(maps.Keys(vars)) {
+		out = append(out, k+"="+vars[k])
+	}
+	return out
+}
+
+// envPrefix returns the "env TERM=... NAME=value..." argv prefix used to
+// set the environment of a command started on a node or in a container.
+// Over ssh the values are quoted by sshCommand like any other argument.
+func (m *Manager) envPrefix(id string) []string {
+	return append([]string{"env", "TERM=xterm-256color"}, m.envVars(id)...)
+}
+
+// CheckInheritEnv rejects an inherit_env entry that isn't a variable name,
+// optionally ending in "*".
+func CheckInheritEnv(pattern string) error {
+	if !envNameRe.MatchString(strings.TrimSuffix(pattern, "*")) {
+		return fmt.Errorf("%q is not a variable name or prefix*", pattern)
+	}
+	return nil
+}
+
+// inherited reports whether the server's variable name is let through by
+// the InheritEnv patterns.
+func inherited(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package terminal
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEnvVars(t *testing.T) {
+	m := NewManager(nil)
+	m.Locale = "en_US.UTF-8"
+	m.Env = map[string]string{"EDITOR": "vim", "LC_ALL": "C.UTF-8"}
+	m.TargetEnv = []TargetEnv{
+		{Match: "lxc/*", Env: map[string]string{"EDITOR": "nano", "TZ": "UTC"}},
+		{Match: "lxc/pve/100", Env: map[string]string{"TZ": "Europe/Berlin"}},
+	}
+	tests := []struct {
+		id   string
+		want []string
+	}{
+		{"host", []string{"EDITOR=vim", "LANG=en_US.UTF-8", "LC_ALL=C.UTF-8"}},
+		{"lxc/pve/101", []string{"EDITOR=nano", "LANG=en_US.UTF-8", "LC_ALL=C.UTF-8", "TZ=UTC"}},
+		{"lxc/pve/100", []string{"EDITOR=nano", "LANG=en_US.UTF-8", "LC_ALL=C.UTF-8", "TZ=Europe/Berlin"}},
+		{"lxc/pve/100#2", []string{"EDITOR=nano", "LANG=en_US.UTF-8", "LC_ALL=C.UTF-8", "TZ=Europe/Berlin"}},
+	}
+	for _, tt := range tests {
+		if got := m.envVars(tt.id); !slices.Equal(got, tt.want) {
+			t.Errorf("envVars(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestRemoteEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		mode LXCMode
+		want []string // the remote command after the ssh destination
+	}{
+		{"lxc exec", "lxc/pve2/100", LXCExec, []string{"pct", "exec", "100", "--",
+			"env", "TERM=xterm-256color", "'GREETING=hello world'", "'QUOTE=it'\\''s'", "TZ=UTC",
+			"tmux", "new-session", "-A", "-s", "tb-100", "--", "/bin/bash"}},
+		{"lxc enter", "lxc/pve2/100", LXCEnter, []string{
+			"env", "TERM=xterm-256color", "'GREETING=hello world'", "'QUOTE=it'\\''s'", "TZ=UTC",
+			"pct", "enter", "100"}},
+		{"node", "node:pve2", LXCExec, []string{
+			"env", "TERM=xterm-256color", "'GREETING=hello world'", "'QUOTE=it'\\''s'",
+			"tmux", "new-session", "-A", "-s", "tb-pve2", "--", "/bin/bash"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(func(string) string { return "10.0.0.2" })
+			m.LXCMode = tt.mode
+			m.Env = map[string]string{"GREETING": "hello world", "QUOTE": "it's"}
+			m.TargetEnv = []TargetEnv{{Match: "lxc/*", Env: map[string]string{"TZ": "UTC"}}}
+			args := m.shellCommand(tt.id, true, "").Args
+			i := slices.Index(args, "root@10.0.0.2")
+			if i < 0 {
+				t.Fatalf("no ssh destination in %q", args)
+			}
+			if got := args[i+1:]; !slices.Equal(got, tt.want) {
+				t.Errorf("remote command = %q\nwant             %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckEnvName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr string
+	}{
+		{"LANG", ""},
+		{"_private", ""},
+		{"MY_VAR2", ""},
+		{"TERM", "TERM is always"},
+		{"2FAST", "not a valid"},
+		{"WITH-DASH", "not a valid"},
+		{"A=B", "not a valid"},
+		{"", "not a valid"},
+	}
+	for _, tt := range tests {
+		err := CheckEnvName(tt.name)
+		if (tt.wantErr == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("CheckEnvName(%q) = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLocale(t *testing.T) {
+	tests := []struct {
+		name      string
+		locale    string
+		serverEnv string // LANG of the server process, if set
+		want      []string
+	}{
+		{"unset by default", "", "", nil},
+		{"server's LANG passed through locally", "", "C", []string{"LANG=C"}},
+		{"configured", "en_US.UTF-8", "", []string{"LANG=en_US.UTF-8", "LC_ALL=en_US.UTF-8"}},
+		{"configured overrides the server's", "de_DE.UTF-8", "C", []string{"LANG=de_DE.UTF-8", "LC_ALL=de_DE.UTF-8"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LANG", tt.serverEnv)
+			t.Setenv("LC_ALL", "")
+			os.Unsetenv("LC_ALL")
+			if tt.serverEnv == "" {
+				os.Unsetenv("LANG")
+			}
+			m := NewManager(func(string) string { return "10.0.0.2" })
+			m.Locale = tt.locale
+
+			if got := localeVars(m.buildEnv("host")); !slices.Equal(got, tt.want) {
+				t.Errorf("local env has %q, want %q", got, tt.want)
+			}
+			// The server's own environment doesn't reach remote targets.
+			wantRemote := tt.want
+			if tt.locale == "" {
+				wantRemote = nil
+			}
+			for _, id := range []string{"lxc/pve2/100", "node:pve2"} {
+				if got := localeVars(m.shellCommand(id, true, "").Args); !slices.Equal(got, wantRemote) {
+					t.Errorf("%s: remote env has %q, want %q", id, got, wantRemote)
+				}
+			}
+		})
+	}
+}
+
+// localeVars returns the LANG and LC_ALL assignments among args.
+func localeVars(args []string) []string {
+	var out []string
+	for _, a := range args {
+		if strings.HasPrefix(a, "LANG=") || strings.HasPrefix(a, "LC_ALL=") {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func TestInheritEnv(t *testing.T) {
+	t.Setenv("TB_KEEP", "1")
+	t.Setenv("TB_SECRET", "hunter2")
+	t.Setenv("LC_TIME", "C")
+	t.Setenv("TERM", "dumb")
+	tests := []struct {
+		name    string
+		inherit []string
+		want    []string // of the variables set above, sorted
+	}{
+		{"everything by default", nil, []string{"LC_TIME=C", "TB_KEEP=1", "TB_SECRET=hunter2", "TERM=xterm-256color"}},
+		{"names", []string{"TB_KEEP", "PATH"}, []string{"TB_KEEP=1", "TERM=xterm-256color"}},
+		{"prefix", []string{"LC_*"}, []string{"LC_TIME=C", "TERM=xterm-256color"}},
+		{"nothing", []string{}, []string{"TERM=xterm-256color"}},
+		// The server's TERM is never passed through, allowed or not.
+		{"TERM allowed", []string{"TERM"}, []string{"TERM=xterm-256color"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(nil)
+			m.InheritEnv = tt.inherit
+			if got := testVars(m.buildEnv("host")); !slices.Equal(got, tt.want) {
+				t.Errorf("session env has %q, want %q", got, tt.want)
+			}
+			// Non-interactive commands get the same environment.
+			cmd, err := m.Command(context.Background(), "host", "env")
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := testVars(strings.Split(strings.TrimSpace(string(out)), "\n")); !slices.Equal(got, tt.want) {
+				t.Errorf("command env has %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// testVars returns the variables TestInheritEnv sets, sorted.
+func testVars(env []string) []string {
+	var out []string
+	for _, e := range env {
+		name, _, _ := strings.Cut(e, "=")
+		if slices.Contains([]string{"TB_KEEP", "TB_SECRET", "LC_TIME", "TERM"}, name) {
+			out = append(out, e)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
@@ -0,0 +1,94 @@
+package terminal
+
+// maxTitleLen bounds the OSC payload collected for a title event. Longer
+// sequences are still passed through to clients but produce no event.
+const maxTitleLen = 1024
+
+// scanState is where an eventScanner is within an escape sequence.
+type scanState int
+
+const (
+	scanGround scanState = iota
+	scanEsc              // after ESC
+	scanOSC              // inside ESC ] ... collecting the payload
+	scanOSCEsc           // ESC inside an OSC, possibly the start of ST
+)
+
+// eventScanner watches PTY output for the terminal bell and OSC 0/2
+// window-title sequences so they can be reported as control messages. It
+// only observes the stream; output is forwarded to clients unchanged.
+// State carries over between calls, so sequences split across reads are
+// still recognised.
+type eventScanner struct {
+	state    scanState
+	payload  []byte
+	overflow bool // payload exceeded maxTitleLen; drop this sequence
+}
+
+// scan consumes the next chunk of output and returns any events completed
+// in it: {"type":"bell"} and {"type":"title","title":"..."}.
+func (e *eventScanner) scan(p []byte) []controlMsg {
+	var events []controlMsg
+	for _, b := range p {
+		switch e.state {
+		case scanGround:
+			switch b {
+			case 0x07:
+				events = append(events, controlMsg{Type: "bell"})
+			case 0x1b:
+				e.state = scanEsc
+			}
+		case scanEsc:
+			if b == ']' {
+				e.state = scanOSC
+				e.payload = e.payload[:0]
+				e.overflow = false
+			} else {
+				e.state = scanGround
+			}
+		case scanOSC:
+			switch b {
+			case 0x07: // BEL terminates an OSC; it isn't a bell here
+				events = e.finishOSC(events)
+			case 0x1b:
+				e.state = scanOSCEsc
+			case 0x18, 0x1a: // CAN and SUB abort the sequence
+				e.state = scanGround
+			default:
+				if len(e.payload) < maxTitleLen {
+					e.payload = append(e.payload, b)
+				} else {
+					e.overflow = true
+				}
+			}
+		case scanOSCEsc:
+			if b == '\\' {
+				events = e.finishOSC(events)
+			} else if b == ']' {
+				// ESC ] abandons the OSC and starts a new one.
+				e.state = scanOSC
+				e.payload = e.payload[:0]
+				e.overflow = false
+			} else {
+				e.state = scanGround
+			}
+		}
+	}
+	return events
+}
+
+// finishOSC ends the current OSC and appends a title event if it set the
+// window or icon-and-window title (OSC 0 or 2).
+func (e *eventScanner) finishOSC(events []controlMsg) []controlMsg {
+	e.state = scanGround
+	if e.overflow {
+		return events
+	}
+	payload := string(e.payload)
+	for _, prefix := range []string{"0;", "2;"} {
+		if len(payload) >= len(prefix) && payload[:len(prefix)] == prefix {
+			return append(events, controlMsg{Type: "title", Title: payload[len(prefix):]})
+		}
+	}
+	return events
+}
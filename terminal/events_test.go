@@ -0,0 +1,97 @@
+package terminal
+
+import (
+	"encoding/json"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEventScanner(t *testing.T) {
+	bell := controlMsg{Type: "bell"}
+	title := func(s string) controlMsg { return controlMsg{Type: "title", Title: s} }
+	tests := []struct {
+		name string
+		in   string
+		want []controlMsg
+	}{
+		{"plain text", "hello\r\n", nil},
+		{"bell", "done\a", []controlMsg{bell}},
+		{"two bells", "\a\a", []controlMsg{bell, bell}},
+		{"OSC 0 ended by BEL", "\x1b]0;vim main.go\a", []controlMsg{title("vim main.go")}},
+		{"OSC 2 ended by ST", "\x1b]2;htop\x1b\\", []controlMsg{title("htop")}},
+		{"BEL ending an OSC isn't a bell", "\x1b]2;t\a\a", []controlMsg{title("t"), bell}},
+		{"OSC 1 (icon only) ignored", "\x1b]1;icon\a", nil},
+		{"other OSC ignored", "\x1b]7;file://host/root\a", nil},
+		{"empty title", "\x1b]0;\a", []controlMsg{title("")}},
+		{"CAN aborts", "\x1b]0;abc\x18\a", []controlMsg{bell}},
+		{"ESC ] restarts", "\x1b]0;old\x1b]2;new\a", []controlMsg{title("new")}},
+		{"CSI isn't an OSC", "\x1b[31mred\x1b[0m", nil},
+		{"overlong title dropped", "\x1b]0;" + strings.Repeat("x", maxTitleLen+1) + "\a", nil},
+		{"longest title kept", "\x1b]0;" + strings.Repeat("x", maxTitleLen-2) + "\a", []controlMsg{title(strings.Repeat("x", maxTitleLen-2))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every split into two reads must give the same events as one
+			// read, so sequences across buffer boundaries are recognised.
+			for i := 0; i <= len(tt.in); i++ {
+				var sc eventScanner
+				got := append(sc.scan([]byte(tt.in[:i])), sc.scan([]byte(tt.in[i:]))...)
+				if !slices.Equal(got, tt.want) {
+					t.Fatalf("split at %d: got %+v, want %+v", i, got, tt.want)
+				}
+			}
+			var sc eventScanner
+			var got []controlMsg
+			for i := range len(tt.in) {
+				got = append(got, sc.scan([]byte{tt.in[i]})...)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("byte at a time: got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTerminalEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		want    []string
+	}{
+		{"enabled", true, []string{`{"type":"bell"}`, `{"type":"title","title":"build"}`}},
+		{"disabled", false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			m.TerminalEvents = tt.enabled
+			m.BuildCommand = func(string) *exec.Cmd {
+				return exec.Command("sh", "-c", `sleep 0.2; printf 'a\007b\033]2;build\007c\n'; exec cat`)
+			}
+			ts := serveWS(t, m)
+			var got []string
+			onText := func(data []byte) {
+				var msg controlMsg
+				if json.Unmarshal(data, &msg) == nil && (msg.Type == "bell" || msg.Type == "title") {
+					got = append(got, string(data))
+				}
+			}
+			conn := dialWS(t, ts, "host")
+			out := readUntil(t, conn, "c\r\n", onText)
+			// The binary stream is passed through untouched.
+			if want := "a\ab\x1b]2;build\ac\r\n"; out != want {
+				t.Errorf("output %q, want %q", out, want)
+			}
+			// Events follow the output they were found in; read past them.
+			conn.WriteMessage(websocket.BinaryMessage, []byte("end\n"))
+			readUntil(t, conn, "end\r\nend\r\n", onText)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("events %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package terminal
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxLabelLen is the longest session label accepted, in characters.
+const MaxLabelLen = 64
+
+// CleanLabel prepares a session label from a client: control and
+// formatting characters are dropped and surrounding space trimmed.
+// Labels longer than MaxLabelLen afterwards are rejected rather than cut,
+// so a client never stores something other than it asked for.
+func CleanLabel(label string) (string, error) {
+	label = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, label))
+	if n := utf8.RuneCountInString(label); n > MaxLabelLen {
+		return "", fmt.Errorf("label is %d characters, the limit is %d", n, MaxLabelLen)
+	}
+	return label, nil
+}
+
+// SetLabel sets the label of session id, shown in Sessions. An empty
+// label removes it. label should have been through CleanLabel.
+func (m *Manager) SetLabel(id, label string) error {
+	m.mu.RLock()
+	s := m.sessions[id]
+	m.mu.RUnlock()
+	if s == nil {
+		return ErrNoSession
+	}
+	s.mu.Lock()
+	s.label = label
+	s.mu.Unlock()
+	log.Printf("[SESSION] S%d (%q): label set to %q", s.seqNo, s.id, label)
+	return nil
+}
@@ -0,0 +1,72 @@
+package terminal
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCleanLabel(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"incident-4821", "incident-4821", false},
+		{"  padded\t", "padded", false},
+		{"", "", false},
+		{"two\nlines", "twolines", false},
+		{"bell\x07 and escape\x1b[31m", "bell and escape[31m", false},
+		{"rtl‮override", "rtloverride", false},
+		{"zero​width", "zerowidth", false},
+		{"Störung 🔥", "Störung 🔥", false},
+		{strings.Repeat("x", MaxLabelLen), strings.Repeat("x", MaxLabelLen), false},
+		{strings.Repeat("ü", MaxLabelLen), strings.Repeat("ü", MaxLabelLen), false},
+		{strings.Repeat("x", MaxLabelLen+1), "", true},
+		// Stripped characters don't count towards the limit.
+		{strings.Repeat("x", MaxLabelLen) + "\x00\x00 ", strings.Repeat("x", MaxLabelLen), false},
+	}
+	for _, tt := range tests {
+		got, err := CleanLabel(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("CleanLabel(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSessionLabel(t *testing.T) {
+	m := newTestManager(t)
+	ts := serveWS(t, m)
+	if err := m.SetLabel("host", "x"); !errors.Is(err, ErrNoSession) {
+		t.Errorf("SetLabel with no session: err = %v, want ErrNoSession", err)
+	}
+
+	label := func() string {
+		t.Helper()
+		list := m.Sessions()
+		if len(list) != 1 {
+			t.Fatalf("%d sessions, want 1", len(list))
+		}
+		return list[0].Label
+	}
+	conn := dialWS(t, ts, "host")
+	conn.WriteMessage(websocket.BinaryMessage, []byte("ready\n"))
+	readUntil(t, conn, "ready\r\nready\r\n", nil)
+	if got := label(); got != "" {
+		t.Errorf("label %q, want none", got)
+	}
+	if err := m.SetLabel("host", "incident-4821"); err != nil {
+		t.Fatal(err)
+	}
+	if got := label(); got != "incident-4821" {
+		t.Errorf("label %q after SetLabel", got)
+	}
+	if err := m.SetLabel("host", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := label(); got != "" {
+		t.Errorf("label %q after clearing it", got)
+	}
+}
@@ -0,0 +1,74 @@
+package terminal
+
+import (
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the input latency
+// histogram buckets.
+var LatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// Histogram counts durations into LatencyBuckets.
+type Histogram struct {
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative; the last is +Inf
+	sum    time.Duration
+}
+
+// HistogramSnapshot is a copy of a Histogram's state. Counts are
+// cumulative, as Prometheus expects, with one more entry than Buckets
+// for +Inf, which is also the total count.
+type HistogramSnapshot struct {
+	Buckets []float64
+	Counts  []uint64
+	Sum     time.Duration
+}
+
+func newHistogram() *Histogram {
+	return &Histogram{counts: make([]uint64, len(LatencyBuckets)+1)}
+}
+
+// Observe records one duration.
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(LatencyBuckets) && d.Seconds() > LatencyBuckets[i] {
+		i++
+	}
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += d
+	h.mu.Unlock()
+}
+
+// Snapshot returns the current counts.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	snap := HistogramSnapshot{Buckets: LatencyBuckets, Counts: make([]uint64, len(h.counts)), Sum: h.sum}
+	var total uint64
+	for i, c := range h.counts {
+		total += c
+		snap.Counts[i] = total
+	}
+	return snap
+}
+
+// markInput notes that a client just sent input, unless earlier input is
+// still waiting for output.
+func (s *Session) markInput() {
+	if s.latency != nil {
+		s.inputAt.CompareAndSwap(0, time.Now().UnixNano())
+	}
+}
+
+// markOutput records the time from the oldest unanswered input to now,
+// when the PTY produced output.
+func (s *Session) markOutput() {
+	if s.latency == nil {
+		return
+	}
+	if at := s.inputAt.Swap(0); at != 0 {
+		s.latency.Observe(time.Duration(time.Now().UnixNano() - at))
+	}
+}
@@ -0,0 +1,74 @@
+package terminal
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHistogram(t *testing.T) {
+	tests := []struct {
+		name       string
+		durations  []time.Duration
+		wantCounts []uint64 // cumulative, for LatencyBuckets and +Inf
+	}{
+		{"empty", nil, []uint64{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{"bucket bounds are inclusive", []time.Duration{time.Millisecond, 10 * time.Millisecond},
+			[]uint64{1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2}},
+		{"just over a bound", []time.Duration{time.Millisecond + 1},
+			[]uint64{0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+		{"over the largest bucket", []time.Duration{3 * time.Second, 200 * time.Microsecond},
+			[]uint64{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHistogram()
+			var sum time.Duration
+			for _, d := range tt.durations {
+				h.Observe(d)
+				sum += d
+			}
+			snap := h.Snapshot()
+			if !slices.Equal(snap.Counts, tt.wantCounts) {
+				t.Errorf("counts = %v, want %v", snap.Counts, tt.wantCounts)
+			}
+			if snap.Sum != sum {
+				t.Errorf("sum = %v, want %v", snap.Sum, sum)
+			}
+		})
+	}
+}
+
+func TestInputLatencyRecorded(t *testing.T) {
+	tests := []struct {
+		name      string
+		measure   bool
+		wantCount uint64
+	}{
+		{"measuring", true, 2},
+		{"off", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			m.MeasureLatency = tt.measure
+			conn := dialWS(t, serveWS(t, m), "host")
+			// cat echoes each line, so each one is followed by output.
+			for _, line := range []string{"one", "two"} {
+				if err := conn.WriteMessage(websocket.BinaryMessage, []byte(line+"\n")); err != nil {
+					t.Fatal(err)
+				}
+				readUntil(t, conn, line+"\r\n"+line+"\r\n", nil)
+			}
+			snap := m.InputLatency.Snapshot()
+			if total := snap.Counts[len(snap.Counts)-1]; total != tt.wantCount {
+				t.Fatalf("recorded %d latencies, want %d", total, tt.wantCount)
+			}
+			if tt.measure && (snap.Sum <= 0 || snap.Sum > 10*time.Second) {
+				t.Errorf("latency sum %v isn't plausible for an echo", snap.Sum)
+			}
+		})
+	}
+}
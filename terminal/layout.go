@@ -0,0 +1,160 @@
+package terminal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/chris/termbrowser/ids"
+)
+
+// TmuxLayout is a set of tmux commands run when a new tmux session is
+// created for a terminal id matching Match (see MatchID), e.g. to split
+// the window and start tailing a log. Each command is an argv without the
+// leading "tmux", such as ["split-window", "-h"].
+type TmuxLayout struct {
+	Match    string
+	Commands [][]string
+}
+
+// tmuxLayoutCommands is the curated set of tmux subcommands a layout may
+// use. All of them take a -t target, which is filled in with the
+// session's name.
+var tmuxLayoutCommands = map[string]bool{
+	"split-window":  true,
+	"new-window":    true,
+	"select-layout": true,
+	"select-pane":   true,
+	"select-window": true,
+	"resize-pane":   true,
+	"rename-window": true,
+	"send-keys":     true,
+}
+
+// CheckTmuxLayout rejects layouts with empty commands, subcommands outside
+// the curated set, or their own -t target.
+func CheckTmuxLayout(l TmuxLayout) error {
+	for _, c := range l.Commands {
+		if len(c) == 0 {
+			return fmt.Errorf("empty tmux command")
+		}
+		if !tmuxLayoutCommands[c[0]] {
+			return fmt.Errorf("tmux command %q is not allowed in a layout", c[0])
+		}
+		for _, a := range c[1:] {
+			if a == "-t" {
+				return fmt.Errorf("%s: -t is set automatically", c[0])
+			}
+		}
+	}
+	return nil
+}
+
+// MatchID reports whether terminal id s matches pattern, where '*'
+// matches any run of characters (including '/') and '?' any single
+// character. Unlike path.Match, "lxc/*" therefore covers every container
+// on every node.
+func MatchID(pattern, s string) bool {
+	// Iterative wildcard matching with backtracking to the last '*'.
+	p, i := 0, 0
+	star, mark := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+		case star >= 0:
+			p = star + 1
+			mark++
+			i = mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// layoutFor returns the commands of the first layout matching id, ignoring
+// any #instance suffix.
+func (m *Manager) layoutFor(id string) [][]string {
+	base, _ := ids.SplitInstance(id)
+	for _, l := range m.TmuxLayouts {
+		if MatchID(l.Match, base) {
+			return l.Commands
+		}
+	}
+	return nil
+}
+
+// tmuxSession returns the name of the tmux session the default command
+// for id attaches to, or "" for targets that don't use tmux.
+func (m *Manager) tmuxSession(id string) string {
+	if !m.usesTmux(id) {
+		return ""
+	}
+	p, _ := ids.Parse(id)
+	switch p.Kind {
+	case ids.Host:
+		return tmuxName("tb-host", p.Instance)
+	case ids.Node:
+		return tmuxName("tb-"+strings.ReplaceAll(p.Node, ".", "-"), p.Instance)
+	case ids.SSH:
+		return tmuxName("tb-ssh-"+strings.ReplaceAll(p.Node, ".", "-"), p.Instance)
+	default:
+		// lxc and local lxc, the only others usesTmux accepts.
+		return tmuxName("tb-"+p.VMID, p.Instance)
+	}
+}
+
+// tmuxSessionExists reports whether the tmux session for id is already
+// running on its target, so a layout is only applied to new sessions.
+func (m *Manager) tmuxSessionExists(ctx context.Context, id, session string) bool {
+	cmd, err := m.Command(ctx, id, "tmux", "has-session", "-t", session)
+	if err != nil {
+		return false
+	}
+	return cmd.Run() == nil
+}
+
+// waitTmuxSession polls until the tmux session for id is running, which
+// for a new session is a moment after its PTY starts. It reports false if
+// ctx ends first.
+func (m *Manager) waitTmuxSession(ctx context.Context, id, session string) bool {
+	for !m.tmuxSessionExists(ctx, id, session) {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+	return true
+}
+
+// applyLayout runs layout commands against a newly created tmux session,
+// once it has come up.
+func (m *Manager) applyLayout(id, session string, cmds [][]string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if !m.waitTmuxSession(ctx, id, session) {
+		log.Printf("[SESSION] %q: tmux session %s never appeared, skipping layout", id, session)
+		return
+	}
+	for _, c := range cmds {
+		argv := append([]string{"tmux", c[0], "-t", session}, c[1:]...)
+		cmd, err := m.Command(ctx, id, argv...)
+		if err == nil {
+			err = cmd.Run()
+		}
+		if err != nil {
+			log.Printf("[SESSION] %q: layout command %q: %v", id, c, err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package terminal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchID(t *testing.T) {
+	tests := []struct {
+		pattern, id string
+		want        bool
+	}{
+		{"host", "host", true},
+		{"host", "hostile", false},
+		{"lxc/*", "lxc/pve/100", true},
+		{"lxc/*", "qemu/pve/200", false},
+		{"lxc/pve/*", "lxc/pve2/100", false},
+		{"lxc/*/100", "lxc/pve2/100", true},
+		{"lxc/pve/10?", "lxc/pve/101", true},
+		{"lxc/pve/10?", "lxc/pve/1010", false},
+		{"node:*", "node:pve", true},
+		{"*", "ssh:backup", true},
+		{"*:pve", "node:pve", true},
+		{"", "host", false},
+	}
+	for _, tt := range tests {
+		if got := MatchID(tt.pattern, tt.id); got != tt.want {
+			t.Errorf("MatchID(%q, %q) = %v, want %v", tt.pattern, tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTmuxLayout(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands [][]string
+		wantErr  string
+	}{
+		{"allowed", [][]string{{"split-window", "-h"}, {"send-keys", "journalctl -f", "Enter"}}, ""},
+		{"empty command", [][]string{{}}, "empty tmux command"},
+		{"not curated", [][]string{{"run-shell", "reboot"}}, `"run-shell" is not allowed`},
+		{"kill-server", [][]string{{"split-window"}, {"kill-server"}}, `"kill-server" is not allowed`},
+		{"own target", [][]string{{"select-pane", "-t", "other"}}, "-t is set automatically"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckTmuxLayout(TmuxLayout{Match: "*", Commands: tt.commands})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("err = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLayoutFor(t *testing.T) {
+	logs := [][]string{{"split-window", "-h"}, {"send-keys", "journalctl -f", "Enter"}}
+	web := [][]string{{"new-window"}}
+	m := NewManager(nil)
+	m.TmuxLayouts = []TmuxLayout{
+		{Match: "lxc/pve/100", Commands: web},
+		{Match: "lxc/*", Commands: logs},
+	}
+	tests := []struct {
+		id   string
+		want [][]string
+	}{
+		{"lxc/pve/100", web},
+		{"lxc/pve/100#2", web},
+		{"lxc/pve/101", logs},
+		{"lxc/pve2/100", logs},
+		{"host", nil},
+		{"node:pve", nil},
+	}
+	for _, tt := range tests {
+		if got := m.layoutFor(tt.id); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("layoutFor(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestApplyLayout(t *testing.T) {
+	// A stand-in tmux that records its arguments and reports every session
+	// as running.
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$*\" >> " + calls + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "tmux"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	m := NewManager(nil)
+	m.applyLayout("host#2", m.tmuxSession("host#2"), [][]string{
+		{"split-window", "-h"},
+		{"send-keys", "journalctl -f", "Enter"},
+	})
+	data, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "has-session -t tb-host-2\n" +
+		"split-window -t tb-host-2 -h\n" +
+		"send-keys -t tb-host-2 journalctl -f Enter\n"
+	if string(data) != want {
+		t.Errorf("tmux was run with\n%s\nwant\n%s", data, want)
+	}
+}
@@ -0,0 +1,60 @@
+package terminal
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// lifetimeWarning is how long before SessionMaxLifetime runs out that
+	// attached clients are warned.
+	lifetimeWarning = time.Minute
+
+	// lifetimeCloseGrace is how long the shell has to exit after being
+	// asked to when its lifetime is up, before it is sent SIGTERM.
+	lifetimeCloseGrace = 5 * time.Second
+)
+
+// enforceLifetime closes s once it is m.SessionMaxLifetime old, whatever
+// its activity, after warning attached clients a minute beforehand. It
+// returns early if the session ends first.
+func (m *Manager) enforceLifetime(s *Session) {
+	wait := func(d time.Duration) bool {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-s.done:
+			return false
+		case <-t.C:
+			return true
+		}
+	}
+
+	limit := m.SessionMaxLifetime
+	if limit > lifetimeWarning {
+		if !wait(limit - lifetimeWarning) {
+			return
+		}
+		log.Printf("[SESSION] S%d (%q): reaches max lifetime %v in %v, warning clients", s.seqNo, s.id, limit, lifetimeWarning)
+		s.notice("This session reaches its maximum lifetime and will be closed in 1 minute.")
+		limit = lifetimeWarning
+	}
+	if !wait(limit) {
+		return
+	}
+	log.Printf("[SESSION] S%d (%q): max lifetime %v reached, closing", s.seqNo, s.id, m.SessionMaxLifetime)
+	s.notice("Maximum session lifetime reached, closing.")
+	if _, err := s.close(lifetimeCloseGrace); err != nil {
+		log.Printf("[SESSION] S%d (%q): closing at max lifetime: %v", s.seqNo, s.id, err)
+	}
+}
+
+// notice writes a highlighted line to every attached client, outside the
+// shell's own output.
+func (s *Session) notice(text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.clients {
+		s.writeOutput(c, []byte("\r\n\x1b[33m["+text+"]\x1b[0m\r\n"))
+	}
+}
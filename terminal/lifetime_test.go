@@ -0,0 +1,69 @@
+package terminal
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSessionMaxLifetime(t *testing.T) {
+	tests := []struct {
+		name       string
+		lifetime   time.Duration
+		wantClosed bool
+	}{
+		{"closed despite activity", 500 * time.Millisecond, true},
+		{"disabled", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			m.BuildCommand = func(string) *exec.Cmd { return exec.Command("sh") }
+			m.SessionMaxLifetime = tt.lifetime
+			conn := dialWS(t, serveWS(t, m), "host")
+			start := time.Now()
+
+			// Keep the session busy throughout.
+			stop := make(chan struct{})
+			defer close(stop)
+			go func() {
+				tick := time.NewTicker(50 * time.Millisecond)
+				defer tick.Stop()
+				for {
+					select {
+					case <-stop:
+						return
+					case <-tick.C:
+						if conn.WriteMessage(websocket.BinaryMessage, []byte("echo busy\n")) != nil {
+							return
+						}
+					}
+				}
+			}()
+
+			if !tt.wantClosed {
+				readUntil(t, conn, "busy", nil)
+				time.Sleep(time.Second)
+				if len(m.Sessions()) != 1 {
+					t.Fatal("session ended without a max lifetime")
+				}
+				return
+			}
+			out := readUntil(t, conn, "Maximum session lifetime reached, closing.", nil)
+			if elapsed := time.Since(start); elapsed < tt.lifetime {
+				t.Errorf("closed after %v, before the %v lifetime", elapsed, tt.lifetime)
+			}
+			if !strings.Contains(out, "busy") {
+				t.Errorf("no activity seen before the close: %q", out)
+			}
+			ce := readCloseFrame(t, conn)
+			if ce.Code != CloseSessionEnded {
+				t.Errorf("closed with %d %q, want %d", ce.Code, ce.Text, CloseSessionEnded)
+			}
+			waitFor(t, "the session to be removed", func() bool { return len(m.Sessions()) == 0 })
+		})
+	}
+}
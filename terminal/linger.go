@@ -0,0 +1,71 @@
+package terminal
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// endedSession is what remains of a session whose process has exited
+// while it lingers; see Manager.DeadSessionLinger.
+type endedSession struct {
+	seqNo    int
+	endedAt  time.Time
+	exitCode int
+}
+
+// lingerLocked keeps a record of s, which has just exited, for
+// m.DeadSessionLinger so a client reconnecting in that time is shown its
+// final output instead of getting a new shell. Only sessions with recorded
+// scrollback linger, and not ssh failures, which clients are told to retry.
+// Callers must hold m.mu for writing.
+func (m *Manager) lingerLocked(s *Session, exitCode int) {
+	if m.DeadSessionLinger <= 0 || s.scrollback == nil || (s.viaSSH && exitCode == 255) {
+		return
+	}
+	if m.ended == nil {
+		m.ended = make(map[string]*endedSession)
+	}
+	e := &endedSession{seqNo: s.seqNo, endedAt: time.Now(), exitCode: exitCode}
+	m.ended[s.id] = e
+	log.Printf("[SESSION] S%d (%q): lingering for %v", s.seqNo, s.id, m.DeadSessionLinger)
+	time.AfterFunc(m.DeadSessionLinger, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.ended[s.id] == e {
+			delete(m.ended, s.id)
+			log.Printf("[SESSION] S%d (%q): linger expired, purged", s.seqNo, s.id)
+		}
+	})
+}
+
+// serveEnded handles a connection to id while it lingers after exiting:
+// it replays the recorded output, says the session has ended and closes
+// with CloseSessionEnded. The record is consumed, so connecting again
+// starts a new session. It reports whether id was lingering.
+func (m *Manager) serveEnded(conn *websocket.Conn, id string, info ConnInfo) bool {
+	m.mu.Lock()
+	e := m.ended[id]
+	delete(m.ended, id)
+	m.mu.Unlock()
+	if e == nil {
+		return false
+	}
+	log.Printf("[WS] S%d (%q) req=%s: session ended %v ago, replaying scrollback",
+		e.seqNo, id, info.RequestID, time.Since(e.endedAt).Round(time.Second))
+	if data, err := os.ReadFile(scrollbackPath(m.ScrollbackDir, id)); err == nil && len(data) > 0 {
+		conn.WriteMessage(websocket.BinaryMessage, data)
+	}
+	msg := fmt.Sprintf("\r\n\x1b[33m[This session ended at %s", e.endedAt.Format("15:04:05"))
+	if e.exitCode >= 0 {
+		msg += fmt.Sprintf(" with exit status %d", e.exitCode)
+	}
+	conn.WriteMessage(websocket.BinaryMessage, []byte(msg+". Reconnect to start a new one.]\x1b[0m\r\n"))
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(CloseSessionEnded, "session ended"), time.Now().Add(time.Second))
+	conn.Close()
+	return true
+}
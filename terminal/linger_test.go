@@ -0,0 +1,83 @@
+package terminal
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func (m *Manager) lingering(id string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.ended[id] != nil
+}
+
+func TestDeadSessionLinger(t *testing.T) {
+	tests := []struct {
+		name       string
+		linger     time.Duration
+		scrollback bool
+		wait       time.Duration // between the exit and reconnecting
+		wantLinger bool
+		wantReplay bool
+	}{
+		{"reconnect while lingering", 5 * time.Second, true, 0, true, true},
+		{"reconnect after the purge", 200 * time.Millisecond, true, 500 * time.Millisecond, true, false},
+		{"no scrollback, no linger", 5 * time.Second, false, 0, false, false},
+		{"linger disabled", 0, true, 0, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			m.BuildCommand = func(string) *exec.Cmd { return exec.Command("sh") }
+			m.DeadSessionLinger = tt.linger
+			if tt.scrollback {
+				m.ScrollbackDir = t.TempDir()
+			}
+			ts := serveWS(t, m)
+
+			conn := dialWS(t, ts, "host")
+			conn.WriteMessage(websocket.BinaryMessage, []byte("echo last words; exit 3\n"))
+			readCloseFrame(t, conn)
+			waitFor(t, "the session to end", func() bool { return len(m.Sessions()) == 0 })
+			if got := m.lingering("host"); got != tt.wantLinger {
+				t.Fatalf("lingering = %v, want %v", got, tt.wantLinger)
+			}
+			if tt.wait > 0 {
+				time.Sleep(tt.wait)
+				if m.lingering("host") {
+					t.Fatal("still lingering after the linger period")
+				}
+			}
+
+			again := dialWS(t, ts, "host")
+			if !tt.wantReplay {
+				// A fresh shell.
+				again.WriteMessage(websocket.BinaryMessage, []byte("echo new shell\n"))
+				readUntil(t, again, "new shell\r\n", nil)
+				return
+			}
+			out := readUntil(t, again, "Reconnect to start a new one.", nil)
+			if !strings.Contains(out, "last words") {
+				t.Errorf("replay %q lacks the final output", out)
+			}
+			if !strings.Contains(out, "with exit status 3") {
+				t.Errorf("replay %q lacks the exit status", out)
+			}
+			if ce := readCloseFrame(t, again); ce.Code != CloseSessionEnded {
+				t.Errorf("closed with %d %q, want %d", ce.Code, ce.Text, CloseSessionEnded)
+			}
+			if len(m.Sessions()) != 0 {
+				t.Error("reconnecting while lingering started a session")
+			}
+
+			// The replay consumed the record; the next connect is fresh.
+			third := dialWS(t, ts, "host")
+			third.WriteMessage(websocket.BinaryMessage, []byte("echo new shell\n"))
+			readUntil(t, third, "new shell\r\n", nil)
+		})
+	}
+}
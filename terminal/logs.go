@@ -0,0 +1,40 @@
+package terminal
+
+import (
+	"context"
+	"os/exec"
+	"regexp"
+)
+
+var logUnitRe = regexp.MustCompile(`^[A-Za-z0-9@._:-]{1,64}$`)
+
+// ValidLogUnit reports whether unit can be passed to LogCommand: "syslog"
+// or a systemd unit name.
+func ValidLogUnit(unit string) bool {
+	return logUnitRe.MatchString(unit)
+}
+
+// logTailArgv is the fixed, read-only command that follows a log on the
+// target. "syslog" follows the whole journal, or /var/log/syslog or
+// /var/log/messages where there is no journald; anything else is a
+// systemd unit. unit must have passed ValidLogUnit, and is only ever an
+// argument, never part of the script.
+func logTailArgv(unit string) []string {
+	if unit == "syslog" {
+		return []string{"sh", "-c", `if command -v journalctl >/dev/null 2>&1; then exec journalctl -f -n 100 --no-pager; fi
+for f in /var/log/syslog /var/log/messages; do [ -r "$f" ] && exec tail -n 100 -F "$f"; done
+echo "no journal or syslog file found" >&2; exit 1`}
+	}
+	return []string{"journalctl", "-f", "-n", "100", "--no-pager", "-u", unit}
+}
+
+// LogCommand builds a command that follows unit's log on the target of a
+// terminal id, routed like Command. It never gets a PTY or any input.
+func (m *Manager) LogCommand(ctx context.Context, id, unit string) (*exec.Cmd, error) {
+	cmd, err := m.Command(ctx, id, logTailArgv(unit)...)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdin = nil
+	return cmd, nil
+}
@@ -0,0 +1,83 @@
+package terminal
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidLogUnit(t *testing.T) {
+	tests := []struct {
+		unit string
+		want bool
+	}{
+		{"syslog", true},
+		{"nginx.service", true},
+		{"getty@tty1.service", true},
+		{"sys-fs-fuse-connections.mount", true},
+		{"", false},
+		{"nginx; rm -rf /", false},
+		{"$(reboot)", false},
+		{"a b", false},
+		{"--since=yesterday", false},
+	}
+	for _, tt := range tests {
+		if got := ValidLogUnit(tt.unit); got != tt.want {
+			t.Errorf("ValidLogUnit(%q) = %v, want %v", tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestLogCommand(t *testing.T) {
+	ssh := []string{"ssh", "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=no", "root@10.0.0.2"}
+	journal := []string{"journalctl", "-f", "-n", "100", "--no-pager", "-u", "nginx.service"}
+	tests := []struct {
+		id      string
+		want    []string
+		wantErr error
+	}{
+		{"host", journal, nil},
+		{"node:pve2", append(slices.Clone(ssh), journal...), nil},
+		{"lxc/pve2/100", append(append(slices.Clone(ssh), "pct", "exec", "100", "--"), journal...), nil},
+		{"lxc/pve2/100#2", append(append(slices.Clone(ssh), "pct", "exec", "100", "--"), journal...), nil},
+		{"100", append([]string{"pct", "exec", "100", "--"}, journal...), nil},
+		{"qemu/pve2/200", nil, ErrUnsupportedTarget},
+	}
+	m := NewManager(func(string) string { return "10.0.0.2" })
+	for _, tt := range tests {
+		cmd, err := m.LogCommand(context.Background(), tt.id, "nginx.service")
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("LogCommand(%q): err = %v, want %v", tt.id, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !slices.Equal(cmd.Args, tt.want) {
+			t.Errorf("LogCommand(%q) args = %q\nwant %q", tt.id, cmd.Args, tt.want)
+		}
+		if cmd.Stdin != nil {
+			t.Errorf("LogCommand(%q) has a stdin", tt.id)
+		}
+	}
+}
+
+func TestLogTailArgv(t *testing.T) {
+	// The syslog script is fixed; only journalctl and tail are run, and
+	// neither with anything that writes.
+	argv := logTailArgv("syslog")
+	if len(argv) != 3 || argv[0] != "sh" || argv[1] != "-c" {
+		t.Fatalf("syslog argv = %q, want sh -c {script}", argv)
+	}
+	for _, want := range []string{"exec journalctl -f", "exec tail -n 100 -F"} {
+		if !strings.Contains(argv[2], want) {
+			t.Errorf("syslog script doesn't %s:\n%s", want, argv[2])
+		}
+	}
+	// A unit is a single argument to -u, even one that looks like an option.
+	if got := logTailArgv("-x"); got[len(got)-2] != "-u" || got[len(got)-1] != "-x" {
+		t.Errorf("unit argv = %q", got)
+	}
+}
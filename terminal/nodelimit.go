@@ -0,0 +1,68 @@
+package terminal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/chris/termbrowser/ids"
+)
+
+// ErrNodeBusy is returned when starting a session would exceed
+// MaxSessionsPerNode.
+var ErrNodeBusy = errors.New("node busy")
+
+// sshNode returns the ssh destination a terminal id's sessions run over:
+// the node name for node, lxc and qemu ids, "ssh:{name}" for ssh hosts, or
+// "" for local ones and invalid ids.
+func sshNode(id string) string {
+	p, err := ids.Parse(id)
+	if err != nil {
+		return ""
+	}
+	switch p.Kind {
+	case ids.Node, ids.LXC, ids.QEMU:
+		return p.Node
+	case ids.SSH:
+		return "ssh:" + p.Node
+	}
+	return ""
+}
+
+// nodeLimitKey returns what MaxSessionsPerNode counts a new session of id
+// against: the address its ssh connects to, so that node names resolving
+// to one machine, ssh hosts and addr overrides (see shellCommand) share
+// that machine's budget. It is "" for local targets and when there is no
+// limit, which spares the resolver.
+func (m *Manager) nodeLimitKey(id, addr string) string {
+	node := sshNode(id)
+	if m.MaxSessionsPerNode <= 0 || node == "" {
+		return ""
+	}
+	if addr != "" {
+		return addr
+	}
+	if name, ok := strings.CutPrefix(node, "ssh:"); ok {
+		return m.SSHHosts[name].Address
+	}
+	return m.nodeAddr(node)
+}
+
+// checkNodeLimitLocked returns ErrNodeBusy, with the current count, if a
+// new session counted against key (see nodeLimitKey) would exceed
+// MaxSessionsPerNode. Callers must hold m.mu (read or write).
+func (m *Manager) checkNodeLimitLocked(key string) error {
+	if m.MaxSessionsPerNode <= 0 || key == "" {
+		return nil
+	}
+	n := 0
+	for _, s := range m.sessions {
+		if s.nodeKey == key {
+			n++
+		}
+	}
+	if n >= m.MaxSessionsPerNode {
+		return fmt.Errorf("%w: %s already has %d of %d sessions open", ErrNodeBusy, key, n, m.MaxSessionsPerNode)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package terminal
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSSHNode(t *testing.T) {
+	tests := []struct {
+		id, want string
+	}{
+		{"host", ""},
+		{"host#2", ""},
+		{"100", ""},
+		{"node:pve", "pve"},
+		{"node:pve#2", "pve"},
+		{"lxc/pve2/100", "pve2"},
+		{"lxc/pve2/100#x", "pve2"},
+		{"qemu/pve3/200", "pve3"},
+		{"ssh:pbs", "ssh:pbs"},
+		{"ssh:pbs#2", "ssh:pbs"},
+		{"node:pve;id", ""},
+		{"lxc/pve/100#a#b", ""},
+		{"qemu/pve3/200#2", ""},
+	}
+	for _, tt := range tests {
+		if got := sshNode(tt.id); got != tt.want {
+			t.Errorf("sshNode(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestNodeLimit(t *testing.T) {
+	m := newTestManager(t)
+	m.MaxSessionsPerNode = 2
+
+	steps := []struct {
+		id       string
+		wantBusy bool
+	}{
+		{"lxc/pve/100", false},
+		{"node:pve", false},
+		{"lxc/pve/101", true},   // pve is full
+		{"lxc/pve/100#2", true}, // instances are sessions of their own
+		{"lxc/pve/100", false},  // reattaching doesn't count
+		{"lxc/pve2/100", false}, // other nodes are counted separately
+		{"node:pve2", false},
+		{"qemu/pve2/200", true},
+		{"host", false}, // local sessions aren't limited
+		{"host#2", false},
+		{"100", false},
+	}
+	for _, st := range steps {
+		_, err := m.GetOrCreate(st.id)
+		if st.wantBusy {
+			if !errors.Is(err, ErrNodeBusy) {
+				t.Errorf("GetOrCreate(%q): err = %v, want ErrNodeBusy", st.id, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("GetOrCreate(%q): %v", st.id, err)
+		}
+	}
+	if n := len(m.Sessions()); n != 7 {
+		t.Errorf("%d sessions running, want 7", n)
+	}
+}
+
+func TestNodeLimitByAddress(t *testing.T) {
+	m := newTestManager(t)
+	m.MaxSessionsPerNode = 2
+	addrs := map[string]string{"pve": "10.0.0.1", "pve-alias": "10.0.0.1", "pve2": "10.0.0.2"}
+	m.resolveNode = func(name string) string { return addrs[name] }
+	m.SSHHosts = map[string]SSHHost{"pbs": {Address: "10.0.0.1"}}
+
+	steps := []struct {
+		id, addr string
+		wantBusy bool
+	}{
+		{"node:pve", "", false},
+		{"node:pve-alias", "", false},      // another name for the same machine
+		{"lxc/pve/100", "", true},          // 10.0.0.1 is full
+		{"ssh:pbs", "", true},              // so is an ssh host at that address
+		{"lxc/pve2/100", "10.0.0.1", true}, // and an override pointing at it
+		{"lxc/pve2/100", "", false},
+		{"node:pve2", "", false},
+	}
+	for _, st := range steps {
+		_, err := m.getOrCreate(st.id, "", st.addr)
+		if st.wantBusy {
+			if !errors.Is(err, ErrNodeBusy) {
+				t.Errorf("getOrCreate(%q, addr %q): err = %v, want ErrNodeBusy", st.id, st.addr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("getOrCreate(%q, addr %q): %v", st.id, st.addr, err)
+		}
+	}
+	_, err := m.GetOrCreate("lxc/pve/101")
+	if want := "node busy: 10.0.0.1 already has 2 of 2 sessions open"; err == nil || err.Error() != want {
+		t.Errorf("err = %v, want %q", err, want)
+	}
+}
+
+func TestNodeLimitMessage(t *testing.T) {
+	m := newTestManager(t)
+	m.MaxSessionsPerNode = 1
+	if _, err := m.GetOrCreate("node:pve"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := m.GetOrCreate("lxc/pve/100")
+	if want := "node busy: pve already has 1 of 1 sessions open"; err == nil || err.Error() != want {
+		t.Errorf("err = %v, want %q", err, want)
+	}
+}
+
+func TestNodeLimitOverWebSocket(t *testing.T) {
+	m := newTestManager(t)
+	m.MaxSessionsPerNode = 1
+	if _, err := m.GetOrCreate("node:pve"); err != nil {
+		t.Fatal(err)
+	}
+	conn := dialWS(t, serveWS(t, m), "lxc/pve/100")
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Error: node busy: pve already has 1 of 1 sessions open"; string(data) != want {
+		t.Errorf("message %q, want %q", data, want)
+	}
+	if ce := readCloseFrame(t, conn); ce.Code != CloseTryAgain {
+		t.Errorf("closed with %d %q, want %d", ce.Code, ce.Text, CloseTryAgain)
+	}
+}
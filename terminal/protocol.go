@@ -0,0 +1,231 @@
+package terminal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/sys/unix"
+)
+
+// Subprotocol is the WebSocket subprotocol clients may request. Version 1
+// framing: binary frames carry raw PTY bytes in both directions, text frames
+// carry JSON control messages.
+const Subprotocol = "termbrowser.v1"
+
+// ProtocolVersion is the control-message protocol version, reported in
+// pong replies so clients can detect what the server understands.
+const ProtocolVersion = 1
+
+// Close codes the server uses when it ends a terminal WebSocket, so clients
+// can tell whether reconnecting is worthwhile.
+const (
+	// CloseSessionEnded means the shell exited. The reason is
+	// "session ended"; reconnecting would start a fresh shell, so clients
+	// shouldn't do it automatically.
+	CloseSessionEnded = websocket.CloseNormalClosure
+
+	// CloseTryAgain means a server-side condition, such as failing to
+	// start the session, stopped the connection. The reason is
+	// "retry-after=N", a suggested delay in seconds before reconnecting.
+	CloseTryAgain = 4503
+
+	// CloseSessionInUse means the session already has a connection and
+	// the server is configured to reject others ("session in use").
+	CloseSessionInUse = 4409
+
+	// CloseTakenOver means another connection to the session replaced
+	// this one ("taken over"), under on_duplicate_connect: takeover.
+	// Reconnecting automatically would take it back, so clients shouldn't.
+	CloseTakenOver = 4000
+
+	// CloseClientIdle means the connection sent no input for
+	// ClientIdleTimeout ("idle"). The session keeps running; reconnect
+	// when the user comes back rather than automatically.
+	CloseClientIdle = 4408
+)
+
+// retryAfterSeconds is the delay suggested with CloseTryAgain.
+const retryAfterSeconds = 5
+
+// controlMsg is the envelope for JSON text frames in both directions. Type
+// selects the message; the remaining fields are used by specific types:
+//
+//	{"type":"resize","cols":N,"rows":N}  client → server
+//	{"type":"ping"}                      client → server
+//	{"type":"pong","version":N}          server → client
+//	{"type":"signal","signal":"INT"}     client → server, see signalForeground
+//	{"type":"bell"}                      server → client
+//	{"type":"title","title":"..."}       server → client
+//	{"type":"session","token":"..."}     server → client, on attach
+//
+// Unknown types are logged and ignored so older servers tolerate newer
+// clients.
+type controlMsg struct {
+	Type    string `json:"type"`
+	Cols    uint16 `json:"cols,omitempty"`
+	Rows    uint16 `json:"rows,omitempty"`
+	Signal  string `json:"signal,omitempty"`
+	Version int    `json:"version,omitempty"`
+	Title   string `json:"title,omitempty"`
+	Token   string `json:"token,omitempty"`
+}
+
+// signalSpec is how a signal named in a signal message is delivered.
+type signalSpec struct {
+	sig  syscall.Signal
+	key  string // tmux name of the key that raises sig, or "" if none does
+	ctrl byte   // the control character typed by key
+}
+
+// signals is the allowlist of names accepted in signal messages. Only
+// signals a user could reasonably deliver from a keyboard or to end a job
+// are included; SIGKILL and friends are deliberately absent.
+var signals = map[string]signalSpec{
+	"INT":  {syscall.SIGINT, "C-c", 0x03},
+	"QUIT": {syscall.SIGQUIT, `C-\`, 0x1c},
+	"TSTP": {syscall.SIGTSTP, "C-z", 0x1a},
+	"TERM": {sig: syscall.SIGTERM},
+	"HUP":  {sig: syscall.SIGHUP},
+	"CONT": {sig: syscall.SIGCONT},
+}
+
+// Signaller delivers sig to pid, with the same meaning as syscall.Kill: a
+// negative pid addresses a whole process group.
+type Signaller func(pid int, sig syscall.Signal) error
+
+// handleControl processes one JSON text frame from c.
+func (s *Session) handleControl(c *client, data []byte) {
+	var msg controlMsg
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Printf("[WS] S%d (%q) C%d req=%s: ignoring malformed control message: %v", s.seqNo, s.id, c.seq, c.info.RequestID, err)
+		return
+	}
+
+	switch msg.Type {
+	case "resize":
+		log.Printf("[WS] S%d (%q) C%d req=%s: resize %dx%d", s.seqNo, s.id, c.seq, c.info.RequestID, msg.Cols, msg.Rows)
+		if cols, rows := clampSize(msg.Cols, s.maxCols), clampSize(msg.Rows, s.maxRows); cols != msg.Cols || rows != msg.Rows {
+			log.Printf("[WS] S%d (%q) C%d req=%s: clamped resize to %dx%d", s.seqNo, s.id, c.seq, c.info.RequestID, cols, rows)
+			msg.Cols, msg.Rows = cols, rows
+		}
+		s.mu.Lock()
+		s.sizeSeq++
+		c.cols, c.rows, c.sizedAt = msg.Cols, msg.Rows, s.sizeSeq
+		s.applySizeLocked()
+		s.mu.Unlock()
+
+	case "ping":
+		reply, _ := json.Marshal(controlMsg{Type: "pong", Version: ProtocolVersion})
+		if err := c.WriteMessage(websocket.TextMessage, reply); err != nil {
+			log.Printf("[WS] S%d (%q) C%d req=%s: writing pong: %v", s.seqNo, s.id, c.seq, c.info.RequestID, err)
+		}
+
+	case "signal":
+		if err := s.signalForeground(msg.Signal); err != nil {
+			log.Printf("[WS] S%d (%q) C%d req=%s: signal %q: %v", s.seqNo, s.id, c.seq, c.info.RequestID, msg.Signal, err)
+			return
+		}
+		log.Printf("[WS] S%d (%q) C%d req=%s: delivered SIG%s", s.seqNo, s.id, c.seq, c.info.RequestID, msg.Signal)
+
+	default:
+		log.Printf("[WS] S%d (%q) C%d req=%s: ignoring unknown control message type %q", s.seqNo, s.id, c.seq, c.info.RequestID, msg.Type)
+	}
+}
+
+// clampSize limits a requested terminal dimension to 1..limit.
+func clampSize(n, limit uint16) uint16 {
+	return min(max(n, 1), limit)
+}
+
+// signalForeground delivers the named signal to the job in the
+// foreground of the session's terminal.
+//
+// When the PTY runs a client that relays to another terminal (tmux, ssh
+// or pct), its foreground process group is that client, which a signal
+// would kill or be ignored by, rather than the user's job. INT, QUIT and
+// TSTP are then typed as their keys instead: with tmux send-keys into the
+// pane, which works even when no client is attached, or else as the
+// control character written to the PTY for the client to pass on. TERM,
+// HUP and CONT have no key and are refused. Otherwise the signal goes to
+// the PTY's foreground process group, or the session's own process group
+// if the PTY can't be queried.
+func (s *Session) signalForeground(name string) error {
+	spec, ok := signals[name]
+	if !ok {
+		return fmt.Errorf("signal not allowed")
+	}
+	if s.relayed {
+		if spec.key == "" {
+			return errRelayedSignal
+		}
+		if s.sendKeys != nil {
+			err := s.sendKeys(spec.key)
+			if err == nil {
+				return nil
+			}
+			log.Printf("[SESSION] S%d (%q): tmux send-keys %s: %v, writing it to the PTY instead", s.seqNo, s.id, spec.key, err)
+		}
+		_, err := s.ptmx.Write([]byte{spec.ctrl})
+		return err
+	}
+	pgrp, err := foregroundPgrp(s)
+	if err != nil {
+		if s.cmd.Process == nil {
+			return err
+		}
+		log.Printf("[SESSION] S%d (%q): %v, signalling child pid %d instead", s.seqNo, s.id, err, s.cmd.Process.Pid)
+		// pty.Start makes the child a session leader, so its pid is
+		// also its process group id.
+		pgrp = s.cmd.Process.Pid
+	}
+	return s.signal(-pgrp, spec.sig)
+}
+
+// errRelayedSignal is returned for a signal without a key equivalent sent
+// to a session whose PTY runs tmux, ssh or pct.
+var errRelayedSignal = errors.New("only INT, QUIT and TSTP reach the job in a session relayed through tmux, ssh or pct")
+
+// relayPrograms are the clients whose PTY's foreground process group is
+// the client itself rather than the job the user is running.
+var relayPrograms = []string{"tmux", "ssh", "pct"}
+
+// argvRuns reports whether argv runs the program name, either as an
+// argument of its own or as a word of one carrying a command line, as
+// session wrappers and remote commands may.
+func argvRuns(argv []string, name string) bool {
+	for _, a := range argv {
+		for _, w := range strings.Fields(strings.Trim(a, "'")) {
+			if filepath.Base(w) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// foregroundPgrp returns the foreground process group of the session's PTY.
+// It goes through SyscallConn rather than Fd, which would switch the PTY to
+// blocking mode and stop Close from interrupting the reader.
+func foregroundPgrp(s *Session) (int, error) {
+	rc, err := s.ptmx.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var pgrp int
+	var ioctlErr error
+	if err := rc.Control(func(fd uintptr) {
+		pgrp, ioctlErr = unix.IoctlGetInt(int(fd), unix.TIOCGPGRP)
+	}); err != nil {
+		return 0, err
+	}
+	if ioctlErr != nil {
+		return 0, fmt.Errorf("reading foreground process group: %w", ioctlErr)
+	}
+	return pgrp, nil
+}
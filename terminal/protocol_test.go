@@ -0,0 +1,508 @@
+package terminal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/gorilla/websocket"
+)
+
+// signalRecorder is a Signaller that records instead of signalling.
+type signalRecorder struct {
+	mu   sync.Mutex
+	sent []sentSignal
+}
+
+type sentSignal struct {
+	pid int
+	sig syscall.Signal
+}
+
+func (r *signalRecorder) signal(pid int, sig syscall.Signal) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, sentSignal{pid, sig})
+	return nil
+}
+
+func (r *signalRecorder) get() []sentSignal {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]sentSignal(nil), r.sent...)
+}
+
+func TestHandleControl(t *testing.T) {
+	tests := []struct {
+		name       string
+		msg        string
+		cols, rows uint16 // PTY size afterwards, starting from 80x24
+		signals    []syscall.Signal
+	}{
+		{"resize", `{"type":"resize","cols":120,"rows":40}`, 120, 40, nil},
+		{"resize clamped", `{"type":"resize","cols":5000,"rows":0}`, 1000, 1, nil},
+		{"signal", `{"type":"signal","signal":"INT"}`, 80, 24, []syscall.Signal{syscall.SIGINT}},
+		{"disallowed signal", `{"type":"signal","signal":"KILL"}`, 80, 24, nil},
+		{"unknown type", `{"type":"teleport","cols":1,"rows":1}`, 80, 24, nil},
+		{"malformed", `{"type":`, 80, 24, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			rec := &signalRecorder{}
+			m.Signal = rec.signal
+			m.DefaultCols, m.DefaultRows = 80, 24
+			s, err := m.GetOrCreate("host")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// A client without a connection; it's detached again before
+			// anything could write to it.
+			c := &client{seq: 1}
+			s.mu.Lock()
+			s.clients = []*client{c}
+			s.mu.Unlock()
+			s.handleControl(c, []byte(tt.msg))
+			s.mu.Lock()
+			s.clients = nil
+			s.mu.Unlock()
+
+			ws, err := pty.GetsizeFull(s.ptmx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ws.Cols != tt.cols || ws.Rows != tt.rows {
+				t.Errorf("size = %dx%d, want %dx%d", ws.Cols, ws.Rows, tt.cols, tt.rows)
+			}
+			sent := rec.get()
+			if len(sent) != len(tt.signals) {
+				t.Fatalf("sent %v, want %v", sent, tt.signals)
+			}
+			for i, sig := range tt.signals {
+				if sent[i].sig != sig {
+					t.Errorf("signal %d = %v, want %v", i, sent[i].sig, sig)
+				}
+			}
+		})
+	}
+}
+
+func TestPingPong(t *testing.T) {
+	m := newTestManager(t)
+	conn := dialWS(t, serveWS(t, m), "host")
+	ping, _ := json.Marshal(controlMsg{Type: "ping"})
+	if err := conn.WriteMessage(websocket.TextMessage, ping); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg controlMsg
+		if typ != websocket.TextMessage || json.Unmarshal(data, &msg) != nil || msg.Type != "pong" {
+			continue
+		}
+		if msg.Version != ProtocolVersion {
+			t.Errorf("pong version = %d, want %d", msg.Version, ProtocolVersion)
+		}
+		return
+	}
+}
+
+func TestSignalForeground(t *testing.T) {
+	tests := []struct {
+		name    string
+		signal  string
+		want    syscall.Signal
+		wantErr bool
+	}{
+		{"INT", "INT", syscall.SIGINT, false},
+		{"TERM", "TERM", syscall.SIGTERM, false},
+		{"TSTP", "TSTP", syscall.SIGTSTP, false},
+		{"KILL is not allowed", "KILL", 0, true},
+		{"lower case is not accepted", "int", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			rec := &signalRecorder{}
+			m.Signal = rec.signal
+			s, err := m.GetOrCreate("host")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.signalForeground(tt.signal)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			sent := rec.get()
+			if tt.wantErr {
+				if len(sent) != 0 {
+					t.Errorf("sent %v for a refused signal", sent)
+				}
+				return
+			}
+			// cat is the PTY's session leader and only process, so it
+			// is the foreground process group.
+			want := sentSignal{pid: -s.cmd.Process.Pid, sig: tt.want}
+			if len(sent) != 1 || sent[0] != want {
+				t.Errorf("sent %v, want [%v]", sent, want)
+			}
+		})
+	}
+}
+
+func TestSignalRelayedSession(t *testing.T) {
+	// The session's tmux or ssh client takes the terminal raw, as the real
+	// ones do, so a control character reaches cat and comes back verbatim.
+	// tmux send-keys records its arguments instead.
+	const client = "stty raw -echo\necho ready\nexec cat\n"
+	tests := []struct {
+		name     string
+		id       string
+		argv     []string
+		sendKeys string // the fake tmux's send-keys
+		signal   string
+		wantKeys string // arguments tmux send-keys got
+		wantByte byte   // control character written to the PTY
+		wantErr  error
+	}{
+		{"tmux INT", "host", []string{"tmux", "new-session", "-A", "-s", "tb-host"}, "exit 0",
+			"INT", "send-keys -t tb-host C-c", 0, nil},
+		{"tmux QUIT", "host", []string{"tmux", "new-session", "-A", "-s", "tb-host"}, "exit 0",
+			"QUIT", `send-keys -t tb-host C-\`, 0, nil},
+		{"tmux send-keys fails", "host", []string{"tmux", "new-session", "-A", "-s", "tb-host"}, "exit 1",
+			"INT", "send-keys -t tb-host C-c", 0x03, nil},
+		{"tmux TERM", "host", []string{"tmux", "new-session", "-A", "-s", "tb-host"}, "exit 0",
+			"TERM", "", 0, errRelayedSignal},
+		{"ssh INT", "qemu/pve/100", []string{"ssh", "-tt", "root@10.0.0.2", "qm", "terminal", "100"}, "exit 0",
+			"INT", "", 0x03, nil},
+		{"ssh TSTP", "qemu/pve/100", []string{"ssh", "-tt", "root@10.0.0.2", "qm", "terminal", "100"}, "exit 0",
+			"TSTP", "", 0x1a, nil},
+		{"ssh HUP", "qemu/pve/100", []string{"ssh", "-tt", "root@10.0.0.2", "qm", "terminal", "100"}, "exit 0",
+			"HUP", "", 0, errRelayedSignal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			keysLog := filepath.Join(dir, "keys.log")
+			script := "#!/bin/sh\nif [ \"$1\" = send-keys ]; then\n\techo \"$@\" >>" + keysLog + "\n\t" + tt.sendKeys + "\nfi\n" + client
+			for _, prog := range []string{"tmux", "ssh"} {
+				if err := os.WriteFile(filepath.Join(dir, prog), []byte(script), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+			m := newTestManager(t)
+			rec := &signalRecorder{}
+			m.Signal = rec.signal
+			m.BuildCommand = func(string) *exec.Cmd { return exec.Command(tt.argv[0], tt.argv[1:]...) }
+			conn := dialWS(t, serveWS(t, m), tt.id)
+			readUntil(t, conn, "ready", nil)
+			m.mu.RLock()
+			s := m.sessions[tt.id]
+			m.mu.RUnlock()
+
+			if err := s.signalForeground(tt.signal); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			// Signalling the relaying client would kill it or be ignored.
+			if sent := rec.get(); len(sent) != 0 {
+				t.Errorf("sent %v to the %s client", sent, tt.argv[0])
+			}
+			keys, _ := os.ReadFile(keysLog)
+			if got := strings.TrimSpace(string(keys)); got != tt.wantKeys {
+				t.Errorf("tmux got %q, want %q", got, tt.wantKeys)
+			}
+			if tt.wantByte != 0 {
+				readUntil(t, conn, string(tt.wantByte), nil)
+			}
+			// The session is still there to type into.
+			if err := conn.WriteMessage(websocket.BinaryMessage, []byte("still here")); err != nil {
+				t.Fatal(err)
+			}
+			readUntil(t, conn, "still here", nil)
+		})
+	}
+}
+
+// readCloseFrame reads from conn until it is closed and returns the close
+// frame the server sent.
+func readCloseFrame(t *testing.T, conn *websocket.Conn) *websocket.CloseError {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var ce *websocket.CloseError
+		if !errors.As(err, &ce) {
+			t.Fatalf("connection ended without a close frame: %v", err)
+		}
+		return ce
+	}
+}
+
+func TestCloseCodes(t *testing.T) {
+	// A stand-in for ssh failing to reach the node, which exits 255.
+	fakeSSH := filepath.Join(t.TempDir(), "ssh")
+	if err := os.WriteFile(fakeSSH, []byte("#!/bin/sh\nsleep 0.2\nexit 255\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		cmd        func() *exec.Cmd
+		duplicate  DuplicatePolicy
+		second     bool // the close is read on a second connection (first for takeover)
+		wantCode   int
+		wantReason string
+	}{
+		{"shell exits", func() *exec.Cmd { return exec.Command("sh", "-c", "sleep 0.2; exit 1") },
+			DuplicateTakeover, false, CloseSessionEnded, "session ended"},
+		{"ssh can't connect", func() *exec.Cmd { return exec.Command(fakeSSH) },
+			DuplicateTakeover, false, CloseTryAgain, "retry-after=5"},
+		{"session won't start", func() *exec.Cmd { return exec.Command("/nonexistent/shell") },
+			DuplicateTakeover, false, CloseTryAgain, "retry-after=5"},
+		{"taken over", func() *exec.Cmd { return exec.Command("cat") },
+			DuplicateTakeover, true, CloseTakenOver, "taken over"},
+		{"in use", func() *exec.Cmd { return exec.Command("cat") },
+			DuplicateReject, true, CloseSessionInUse, "session in use"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			m.BuildCommand = func(string) *exec.Cmd { return tt.cmd() }
+			m.OnDuplicate = tt.duplicate
+			ts := serveWS(t, m)
+			conn := dialWS(t, ts, "host")
+			if tt.second {
+				// Make sure the first connection is attached before the
+				// second arrives.
+				conn.WriteMessage(websocket.BinaryMessage, []byte("ready\n"))
+				readUntil(t, conn, "ready\r\nready\r\n", nil)
+				second := dialWS(t, ts, "host")
+				if tt.duplicate == DuplicateReject {
+					conn = second
+				}
+			}
+			ce := readCloseFrame(t, conn)
+			if ce.Code != tt.wantCode || ce.Text != tt.wantReason {
+				t.Errorf("closed with %d %q, want %d %q", ce.Code, ce.Text, tt.wantCode, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestClientCloseHandshake(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  []byte
+		wantCode int
+	}{
+		{"normal", websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"), websocket.CloseNormalClosure},
+		{"going away", websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), websocket.CloseGoingAway},
+		{"application code", websocket.FormatCloseMessage(4000, "switching tabs"), 4000},
+		{"no status", nil, websocket.CloseNoStatusReceived},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			ts := serveWS(t, m)
+			conn := dialWS(t, ts, "host")
+			conn.WriteMessage(websocket.BinaryMessage, []byte("ready\n"))
+			readUntil(t, conn, "ready\r\nready\r\n", nil)
+
+			if err := conn.WriteControl(websocket.CloseMessage, tt.payload, time.Now().Add(time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			// The server answers with the same code rather than just
+			// dropping the connection, which the client would see as 1006.
+			if ce := readCloseFrame(t, conn); ce.Code != tt.wantCode {
+				t.Errorf("server replied with %d %q, want %d", ce.Code, ce.Text, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestReplyClose(t *testing.T) {
+	afterClose := make(chan error, 1)
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		c := &client{conn: conn}
+		conn.SetCloseHandler(c.replyClose)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				break
+			}
+		}
+		// Output arriving after the handshake isn't written.
+		afterClose <- c.WriteMessage(websocket.BinaryMessage, []byte("late"))
+	}))
+	t.Cleanup(ts.Close)
+
+	conn := dialWS(t, ts, "")
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "bye"), time.Now().Add(time.Second))
+	if ce := readCloseFrame(t, conn); ce.Code != websocket.CloseGoingAway {
+		t.Errorf("server replied with %d %q, want %d", ce.Code, ce.Text, websocket.CloseGoingAway)
+	}
+	select {
+	case err := <-afterClose:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("write after the close handshake: err = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read loop didn't end after the close frame")
+	}
+}
+
+func TestResizeClamped(t *testing.T) {
+	tests := []struct {
+		name               string
+		cols, rows         uint16
+		wantCols, wantRows uint16
+	}{
+		{"within bounds", 120, 40, 120, 40},
+		{"at the maxima", 200, 100, 200, 100},
+		{"oversized", 65535, 65535, 200, 100},
+		{"zero", 0, 0, 1, 1},
+		{"zero cols only", 0, 50, 1, 50},
+		{"oversized rows only", 80, 101, 80, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			m.MaxCols, m.MaxRows = 200, 100
+			s, err := m.GetOrCreate("host")
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &client{seq: 1}
+			s.mu.Lock()
+			s.clients = []*client{c}
+			s.mu.Unlock()
+			msg, _ := json.Marshal(controlMsg{Type: "resize", Cols: tt.cols, Rows: tt.rows})
+			s.handleControl(c, msg)
+			s.mu.Lock()
+			s.clients = nil
+			s.mu.Unlock()
+
+			if c.cols != tt.wantCols || c.rows != tt.wantRows {
+				t.Errorf("client size = %dx%d, want %dx%d", c.cols, c.rows, tt.wantCols, tt.wantRows)
+			}
+			ws, err := pty.GetsizeFull(s.ptmx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ws.Cols != tt.wantCols || ws.Rows != tt.wantRows {
+				t.Errorf("PTY size = %dx%d, want %dx%d", ws.Cols, ws.Rows, tt.wantCols, tt.wantRows)
+			}
+		})
+	}
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		wantClose bool
+	}{
+		{"under the limit", 63, false},
+		{"at the limit", 64, false},
+		{"over the limit", 65, true},
+		{"far over the limit", 1 << 20, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			m.MaxMessageBytes = 64
+			conn := dialWS(t, serveWS(t, m), "host")
+			// A single line, so cat echoes it back whole.
+			msg := append(bytes.Repeat([]byte("a"), tt.size-1), '\n')
+			// The server may hang up before a big message is all sent.
+			if err := conn.WriteMessage(websocket.BinaryMessage, msg); err != nil && !tt.wantClose {
+				t.Fatal(err)
+			}
+			if !tt.wantClose {
+				readUntil(t, conn, string(msg[:tt.size-1])+"\r\n", nil)
+				return
+			}
+			ce := readCloseFrame(t, conn)
+			if ce.Code != websocket.CloseMessageTooBig {
+				t.Errorf("closed with %d %q, want %d", ce.Code, ce.Text, websocket.CloseMessageTooBig)
+			}
+		})
+	}
+}
+
+func TestDuplicatePolicy(t *testing.T) {
+	tests := []struct {
+		policy DuplicatePolicy
+		// which connections see what the second one types, and how the
+		// others are closed
+		firstSees, secondSees bool
+		firstClose            int
+		secondClose           int
+		wantClients           int
+	}{
+		{DuplicateTakeover, false, true, CloseTakenOver, 0, 1},
+		{DuplicateReject, true, false, 0, CloseSessionInUse, 1},
+		{DuplicateShare, true, true, 0, 0, 2},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			m := newTestManager(t)
+			m.OnDuplicate = tt.policy
+			ts := serveWS(t, m)
+			first := dialWS(t, ts, "host")
+			first.WriteMessage(websocket.BinaryMessage, []byte("one\n"))
+			readUntil(t, first, "one\r\none\r\n", nil)
+			second := dialWS(t, ts, "host")
+
+			typist := second
+			if !tt.secondSees {
+				typist = first // the second connection never attached
+			}
+			typist.WriteMessage(websocket.BinaryMessage, []byte("two\n"))
+			for _, c := range []struct {
+				conn      *websocket.Conn
+				sees      bool
+				wantClose int
+			}{{first, tt.firstSees, tt.firstClose}, {second, tt.secondSees, tt.secondClose}} {
+				if c.sees {
+					readUntil(t, c.conn, "two\r\ntwo\r\n", nil)
+				}
+				if c.wantClose != 0 {
+					if ce := readCloseFrame(t, c.conn); ce.Code != c.wantClose {
+						t.Errorf("closed with %d %q, want %d", ce.Code, ce.Text, c.wantClose)
+					}
+				}
+			}
+			if got := m.Sessions()[0].Clients; got != tt.wantClients {
+				t.Errorf("%d clients attached, want %d", got, tt.wantClients)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package terminal
+
+import "time"
+
+// tokenBucket limits a byte stream to rate bytes per second, allowing bursts
+// of up to burst bytes. It is not safe for concurrent use; each connection's
+// read loop, and each session's PTY reader, owns its own bucket.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst int) *tokenBucket {
+	if burst < rate {
+		burst = rate
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// take consumes n tokens and returns how long the caller must wait before
+// the bytes fit within the rate. A message larger than the burst is let
+// through after a proportionally longer wait rather than rejected.
+func (b *tokenBucket) take(n int) time.Duration {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,99 @@
+package terminal
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     int
+		burst    int
+		takes    []int
+		wantWait []bool // whether each take has to wait
+	}{
+		{"normal typing", 1000, 4000, []int{1, 1, 1, 10, 1}, []bool{false, false, false, false, false}},
+		{"paste within burst", 1000, 4000, []int{3000, 500}, []bool{false, false}},
+		{"burst above limit", 1000, 4000, []int{3000, 2000}, []bool{false, true}},
+		{"one message above burst", 1000, 4000, []int{10000}, []bool{true}},
+		{"burst defaults to rate", 1000, 0, []int{1000, 100}, []bool{false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket(tt.rate, tt.burst)
+			for i, n := range tt.takes {
+				if wait := b.take(n); (wait > 0) != tt.wantWait[i] {
+					t.Errorf("take %d (%d bytes): wait %v, want wait %v", i, n, wait, tt.wantWait[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucketWaitMatchesRate(t *testing.T) {
+	b := newTokenBucket(1000, 1000)
+	b.take(1000)
+	// 500 bytes past an empty bucket at 1000/s take half a second.
+	wait := b.take(500)
+	if wait < 450*time.Millisecond || wait > 550*time.Millisecond {
+		t.Errorf("wait = %v, want about 500ms", wait)
+	}
+}
+
+func TestTokenBucketRefills(t *testing.T) {
+	b := newTokenBucket(1000, 1000)
+	b.take(1000)
+	b.last = b.last.Add(-time.Second) // as if a second had passed
+	if wait := b.take(900); wait != 0 {
+		t.Errorf("wait = %v after refilling, want 0", wait)
+	}
+}
+
+// outputRate reads a session whose process writes as fast as it can for
+// about d and returns the output bytes delivered per second.
+func outputRate(t *testing.T, m *Manager, d time.Duration) float64 {
+	t.Helper()
+	m.BuildCommand = func(string) *exec.Cmd { return exec.Command("yes") }
+	conn := dialWS(t, serveWS(t, m), "host")
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(d))
+	var n int
+	for {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if typ == websocket.BinaryMessage {
+			n += len(data)
+		}
+	}
+	return float64(n) / time.Since(start).Seconds()
+}
+
+func TestOutputRateLimit(t *testing.T) {
+	const rate = 64 << 10
+	m := newTestManager(t)
+	m.OutputRate, m.OutputBurst = rate, rate
+	d := 2 * time.Second
+	got := outputRate(t, m, d)
+	// The burst and one read's worth of bytes can arrive on top of the rate.
+	limit := rate + float64(rate+4096)/d.Seconds()
+	if got > limit {
+		t.Errorf("delivered %.0f bytes/s, want at most %.0f", got, limit)
+	}
+	if got < rate/2 {
+		t.Errorf("delivered %.0f bytes/s, want close to %d", got, rate)
+	}
+}
+
+func TestOutputRateUnlimited(t *testing.T) {
+	m := newTestManager(t)
+	m.OutputRate = 0
+	if got := outputRate(t, m, 500*time.Millisecond); got <= 4*(64<<10) {
+		t.Errorf("delivered %.0f bytes/s with no limit, want well above 64KiB/s", got)
+	}
+}
@@ -0,0 +1,32 @@
+package terminal
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// newResumeToken returns a random token identifying one session.
+func newResumeToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// checkResumeToken reports whether token is the session's resume token.
+func (s *Session) checkResumeToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.resumeToken)) == 1
+}
+
+// sendSessionLocked tells a newly attached client the session's resume
+// token. Callers must hold s.mu, so it arrives before any output.
+func (s *Session) sendSessionLocked(c *client) {
+	msg, _ := json.Marshal(controlMsg{Type: "session", Token: s.resumeToken})
+	if err := c.WriteMessage(websocket.TextMessage, msg); err != nil {
+		log.Printf("[WS] S%d (%q) C%d req=%s: sending session message: %v", s.seqNo, s.id, c.seq, c.info.RequestID, err)
+	}
+}
@@ -0,0 +1,100 @@
+package terminal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// serveResumeWS is serveWS passing the "resume" query parameter on as the
+// connection's resume token, as the server does.
+func serveResumeWS(t *testing.T, m *Manager) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		m.ServeWebSocket(conn, strings.TrimPrefix(r.URL.Path, "/"), ConnInfo{
+			ClientIP: "192.0.2.1", RequestID: "test", ResumeToken: r.URL.Query().Get("resume"),
+		})
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// attach connects to id and returns the resume token from the session
+// message, once the connection is known to be attached.
+func attach(t *testing.T, ts *httptest.Server, id, token string) (*websocket.Conn, string) {
+	t.Helper()
+	conn := dialWS(t, ts, id+"?resume="+token)
+	conn.WriteMessage(websocket.BinaryMessage, []byte("ping\n"))
+	var got string
+	readUntil(t, conn, "ping\r\nping\r\n", func(data []byte) {
+		var msg controlMsg
+		if json.Unmarshal(data, &msg) == nil && msg.Type == "session" {
+			got = msg.Token
+		}
+	})
+	return conn, got
+}
+
+func TestResumeToken(t *testing.T) {
+	tokenRe := regexp.MustCompile(`^[0-9a-f]{32}$`)
+	tests := []struct {
+		name       string
+		require    bool
+		token      func(first string) string // presented on reconnect
+		wantAttach bool
+	}{
+		{"valid token", true, func(first string) string { return first }, true},
+		{"wrong token", true, func(first string) string { return strings.Repeat("0", 32) }, false},
+		{"token of another length", true, func(first string) string { return first[:16] }, false},
+		{"no token", true, func(string) string { return "" }, false},
+		{"not required", false, func(string) string { return "" }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			m.RequireResumeToken = tt.require
+			ts := serveResumeWS(t, m)
+
+			// The first connection needs no token and is issued one.
+			first, token := attach(t, ts, "host", "")
+			if !tokenRe.MatchString(token) {
+				t.Fatalf("first connect got token %q", token)
+			}
+			first.Close()
+
+			if !tt.wantAttach {
+				ce := readCloseFrame(t, dialWS(t, ts, "host?resume="+tt.token(token)))
+				if ce.Code != websocket.ClosePolicyViolation || ce.Text != "invalid resume token" {
+					t.Errorf("closed with %d %q, want %d %q", ce.Code, ce.Text, websocket.ClosePolicyViolation, "invalid resume token")
+				}
+				return
+			}
+			_, again := attach(t, ts, "host", tt.token(token))
+			if again != token {
+				t.Errorf("reattach got token %q, want the session's %q", again, token)
+			}
+		})
+	}
+}
+
+func TestResumeTokenPerSession(t *testing.T) {
+	m := newTestManager(t)
+	m.RequireResumeToken = true
+	ts := serveResumeWS(t, m)
+	_, a := attach(t, ts, "host", "")
+	_, b := attach(t, ts, "host%232", "")
+	if a == "" || a == b {
+		t.Errorf("sessions got tokens %q and %q, want distinct ones", a, b)
+	}
+}
@@ -0,0 +1,231 @@
+package terminal
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Screen returns the text currently on the screen of session id, without
+// attaching to it. Sessions in tmux are captured with capture-pane; others
+// are rebuilt from their scrollback, which needs ScrollbackDir, by
+// replaying it through a minimal terminal emulator that understands
+// cursor movement and erasing but not colours or alternate screens.
+func (m *Manager) Screen(id string) (string, error) {
+	m.mu.RLock()
+	s := m.sessions[id]
+	m.mu.RUnlock()
+	if s == nil {
+		return "", ErrNoSession
+	}
+	if session := m.tmuxSession(id); session != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		cmd, err := m.Command(ctx, id, "tmux", "capture-pane", "-p", "-t", session)
+		if err == nil {
+			var out []byte
+			if out, err = cmd.Output(); err == nil {
+				return string(out), nil
+			}
+		}
+		log.Printf("[SESSION] S%d (%q): capturing tmux pane: %v, using scrollback", s.seqNo, id, err)
+	}
+
+	data, err := m.Scrollback(id)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	cols, rows := int(s.winsize.Cols), int(s.winsize.Rows)
+	s.mu.Unlock()
+	if cols == 0 || rows == 0 {
+		cols, rows = 80, 24
+	}
+	return renderScreen(data, cols, rows), nil
+}
+
+// screen is the grid kept by renderScreen.
+type screen struct {
+	cells    [][]rune
+	row, col int
+}
+
+func (sc *screen) newline() {
+	sc.row++
+	if sc.row == len(sc.cells) {
+		copy(sc.cells, sc.cells[1:])
+		sc.cells[len(sc.cells)-1] = blankRow(len(sc.cells[0]))
+		sc.row--
+	}
+}
+
+// erase blanks columns [from, to) of row r.
+func (sc *screen) erase(r, from, to int) {
+	for c := from; c < to; c++ {
+		sc.cells[r][c] = ' '
+	}
+}
+
+func blankRow(cols int) []rune {
+	row := make([]rune, cols)
+	for i := range row {
+		row[i] = ' '
+	}
+	return row
+}
+
+// renderScreen replays terminal output onto a cols x rows grid and returns
+// the final screen as lines of text, with trailing blanks removed.
+func renderScreen(data []byte, cols, rows int) string {
+	sc := &screen{cells: make([][]rune, rows)}
+	for i := range sc.cells {
+		sc.cells[i] = blankRow(cols)
+	}
+	clamp := func() {
+		sc.row = min(max(sc.row, 0), rows-1)
+		sc.col = min(max(sc.col, 0), cols-1)
+	}
+
+	for i := 0; i < len(data); {
+		b := data[i]
+		switch {
+		case b == 0x1b && i+1 < len(data) && data[i+1] == '[':
+			// CSI: parameters, then a final byte in 0x40-0x7e.
+			j := i + 2
+			for j < len(data) && (data[j] < 0x40 || data[j] > 0x7e) {
+				j++
+			}
+			if j == len(data) {
+				i = j
+				continue
+			}
+			sc.csi(string(data[i+2:j]), data[j], clamp)
+			i = j + 1
+		case b == 0x1b && i+1 < len(data) && data[i+1] == ']':
+			// OSC, such as a title: skip to BEL or ST.
+			j := i + 2
+			for j < len(data) && data[j] != 0x07 && !(data[j] == 0x1b && j+1 < len(data) && data[j+1] == '\\') {
+				j++
+			}
+			if j < len(data) && data[j] == 0x1b {
+				j++
+			}
+			i = j + 1
+		case b == 0x1b:
+			// Other escapes are two bytes, or three for charset selection.
+			i += 2
+			if i-1 < len(data) && strings.IndexByte("()*+", data[i-1]) >= 0 {
+				i++
+			}
+		case b == '\r':
+			sc.col = 0
+			i++
+		case b == '\n', b == 0x0b, b == 0x0c:
+			sc.newline()
+			i++
+		case b == '\b':
+			sc.col = max(sc.col-1, 0)
+			i++
+		case b == '\t':
+			sc.col = min((sc.col/8+1)*8, cols-1)
+			i++
+		case b < 0x20 || b == 0x7f:
+			i++
+		default:
+			r, size := utf8.DecodeRune(data[i:])
+			if sc.col == cols {
+				sc.col = 0
+				sc.newline()
+			}
+			sc.cells[sc.row][sc.col] = r
+			sc.col++
+			i += size
+		}
+	}
+
+	lines := make([]string, rows)
+	for i, row := range sc.cells {
+		lines[i] = strings.TrimRight(string(row), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// csi applies one CSI sequence with parameters params and final byte
+// final. Private sequences (starting with '?' and the like) and SGR are
+// ignored.
+func (sc *screen) csi(params string, final byte, clamp func()) {
+	if params != "" && strings.IndexByte("?<=>", params[0]) >= 0 {
+		return
+	}
+	var n []int
+	for _, p := range strings.Split(params, ";") {
+		v, _ := strconv.Atoi(p)
+		n = append(n, v)
+	}
+	arg := func(i, def int) int {
+		if i < len(n) && n[i] > 0 {
+			return n[i]
+		}
+		return def
+	}
+	rows, cols := len(sc.cells), len(sc.cells[0])
+	sc.col = min(sc.col, cols-1) // a pending wrap ends with any movement
+	switch final {
+	case 'A':
+		sc.row -= arg(0, 1)
+	case 'B', 'e':
+		sc.row += arg(0, 1)
+	case 'C', 'a':
+		sc.col += arg(0, 1)
+	case 'D':
+		sc.col -= arg(0, 1)
+	case 'E':
+		sc.row, sc.col = sc.row+arg(0, 1), 0
+	case 'F':
+		sc.row, sc.col = sc.row-arg(0, 1), 0
+	case 'G', '`':
+		sc.col = arg(0, 1) - 1
+	case 'd':
+		sc.row = arg(0, 1) - 1
+	case 'H', 'f':
+		sc.row, sc.col = arg(0, 1)-1, arg(1, 1)-1
+	case 'J':
+		switch arg(0, 0) {
+		case 0:
+			sc.erase(sc.row, sc.col, cols)
+			for r := sc.row + 1; r < rows; r++ {
+				sc.erase(r, 0, cols)
+			}
+		case 1:
+			for r := 0; r < sc.row; r++ {
+				sc.erase(r, 0, cols)
+			}
+			sc.erase(sc.row, 0, sc.col+1)
+		case 2, 3:
+			for r := range rows {
+				sc.erase(r, 0, cols)
+			}
+		}
+	case 'K':
+		switch arg(0, 0) {
+		case 0:
+			sc.erase(sc.row, sc.col, cols)
+		case 1:
+			sc.erase(sc.row, 0, sc.col+1)
+		case 2:
+			sc.erase(sc.row, 0, cols)
+		}
+	case 'X':
+		sc.erase(sc.row, sc.col, min(sc.col+arg(0, 1), cols))
+	}
+	clamp()
+}
@@ -0,0 +1,93 @@
+package terminal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRenderScreen(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"empty", "", ""},
+		{"lines", "one\r\ntwo\r\n", "one\ntwo\n"},
+		{"carriage return overwrites", "hello\rJ", "Jello\n"},
+		{"backspace", "ab\bc", "ac\n"},
+		{"tab stops at the last column", "a\tb", "a      b\n"},
+		{"wraps", "abcdefghij", "abcdefgh\nij\n"},
+		{"scrolls", "1\r\n2\r\n3\r\n4\r\n5", "2\n3\n4\n5\n"},
+		{"cursor position", "\x1b[2;3Hx", "\n  x\n"},
+		{"cursor moves", "abc\x1b[2DX\x1b[BY", "aXc\n  Y\n"},
+		{"clear screen", "junk\r\nmore\x1b[2J\x1b[Hclean", "clean\n"},
+		{"erase to end of line", "hello\x1b[3D\x1b[K", "he\n"},
+		{"erase characters", "hello\r\x1b[2X", "  llo\n"},
+		{"colours ignored", "\x1b[1;31mred\x1b[0m", "red\n"},
+		{"private modes ignored", "\x1b[?25lhidden cursor", "hidden c\nursor\n"},
+		{"title skipped", "\x1b]0;my title\x07prompt$ ", "prompt$\n"},
+		{"charset selection skipped", "\x1b(Bok", "ok\n"},
+		{"UTF-8", "grüße", "grüße\n"},
+		{"movement clamped", "\x1b[99;99Hx\x1b[99Ay", "       y\n\n\n       x\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderScreen([]byte(tt.data), 8, 4); got != tt.want {
+				t.Errorf("renderScreen(%q) = %q, want %q", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScreen(t *testing.T) {
+	tests := []struct {
+		name string
+		tmux string // the fake tmux script's body
+		want string
+	}{
+		{"tmux capture", "[ \"$*\" = 'capture-pane -p -t tb-host' ] && echo 'from tmux' && exit 0\nexit 1\n", "from tmux\n"},
+		{"tmux fails, scrollback", "exit 1\n", "hello\nhello\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "tmux"), []byte("#!/bin/sh\n"+tt.tmux), 0755); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+			m := newTestManager(t)
+			m.ScrollbackDir = t.TempDir()
+			ts := serveWS(t, m)
+			if _, err := m.Screen("host"); !errors.Is(err, ErrNoSession) {
+				t.Errorf("Screen with no session: err = %v, want ErrNoSession", err)
+			}
+			conn := dialWS(t, ts, "host")
+			conn.WriteMessage(websocket.BinaryMessage, []byte("hello\n"))
+			readUntil(t, conn, "hello\r\nhello\r\n", nil)
+			got, err := m.Screen("host")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Screen = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScreenWithoutTmuxOrScrollback(t *testing.T) {
+	m := newTestManager(t)
+	m.LXCMode = LXCEnter // no tmux
+	ts := serveWS(t, m)
+	conn := dialWS(t, ts, "100")
+	conn.WriteMessage(websocket.BinaryMessage, []byte("hello\n"))
+	readUntil(t, conn, "hello\r\n", nil)
+	if _, err := m.Screen("100"); !errors.Is(err, ErrNoScrollback) {
+		t.Errorf("err = %v, want ErrNoScrollback", err)
+	}
+}
@@ -0,0 +1,111 @@
+package terminal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrNoScrollback is returned by Manager.Scrollback when nothing has been
+// recorded for an id, or recording is disabled.
+var ErrNoScrollback = errors.New("no scrollback recorded")
+
+// scrollbackLog appends a session's PTY output to a file capped at max
+// bytes. When the cap is exceeded the oldest output is dropped, keeping the
+// most recent three quarters, so trimming happens occasionally rather than
+// on every write.
+type scrollbackLog struct {
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	max  int64
+}
+
+// scrollbackPath returns the file used for id's scrollback in dir. Ids are
+// path-escaped so "lxc/pve/100" becomes a single file name.
+func scrollbackPath(dir, id string) string {
+	return filepath.Join(dir, url.PathEscape(id)+".log")
+}
+
+func openScrollback(dir, id string, max int64) (*scrollbackLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(scrollbackPath(dir, id), os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &scrollbackLog{f: f, max: max}, nil
+}
+
+func (l *scrollbackLog) Write(p []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	if err == nil && l.size > l.max {
+		err = l.trimLocked()
+	}
+	if err != nil {
+		log.Printf("[SCROLLBACK] %s: %v, disabling", l.f.Name(), err)
+		l.f.Close()
+		l.f = nil
+	}
+}
+
+func (l *scrollbackLog) trimLocked() error {
+	keep := l.max * 3 / 4
+	buf := make([]byte, keep)
+	if _, err := l.f.ReadAt(buf, l.size-keep); err != nil && err != io.EOF {
+		return fmt.Errorf("trimming: %w", err)
+	}
+	if err := l.f.Truncate(0); err != nil {
+		return fmt.Errorf("trimming: %w", err)
+	}
+	// O_APPEND puts this at the new end of file, i.e. offset 0.
+	if _, err := l.f.Write(buf); err != nil {
+		return fmt.Errorf("trimming: %w", err)
+	}
+	l.size = keep
+	return nil
+}
+
+func (l *scrollbackLog) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+}
+
+// Scrollback returns the recorded output for id. The file outlives the
+// session, so output can be reviewed after the process has exited, until a
+// new session for the same id replaces it.
+func (m *Manager) Scrollback(id string) ([]byte, error) {
+	if m.ScrollbackDir == "" {
+		return nil, ErrNoScrollback
+	}
+	m.mu.RLock()
+	s := m.sessions[id]
+	m.mu.RUnlock()
+	if s != nil && s.scrollback != nil {
+		// Hold the lock so a concurrent trim isn't observed half-done.
+		s.scrollback.mu.Lock()
+		defer s.scrollback.mu.Unlock()
+	}
+
+	data, err := os.ReadFile(scrollbackPath(m.ScrollbackDir, id))
+	if os.IsNotExist(err) {
+		return nil, ErrNoScrollback
+	}
+	return data, err
+}
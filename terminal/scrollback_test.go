@@ -0,0 +1,102 @@
+package terminal
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestScrollbackCap(t *testing.T) {
+	tests := []struct {
+		name   string
+		max    int64
+		writes []string
+		want   string
+	}{
+		{"under the cap", 16, []string{"abc", "def"}, "abcdef"},
+		{"exactly the cap", 8, []string{"abcd", "efgh"}, "abcdefgh"},
+		{"trims to three quarters", 8, []string{"abcd", "efgh", "i"}, "defghi"},
+		{"one oversized write", 8, []string{"0123456789"}, "456789"},
+		{"repeated trims", 4, []string{"ab", "cd", "ef", "gh", "ij"}, "hij"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, err := openScrollback(dir, "lxc/pve/100", tt.max)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range tt.writes {
+				l.Write([]byte(w))
+			}
+			l.Close()
+			got, err := os.ReadFile(scrollbackPath(dir, "lxc/pve/100"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("file = %q, want %q", got, tt.want)
+			}
+			if int64(len(got)) > tt.max {
+				t.Errorf("file is %d bytes, over the %d byte cap", len(got), tt.max)
+			}
+		})
+	}
+}
+
+func TestScrollbackPersisted(t *testing.T) {
+	m := newTestManager(t)
+	m.ScrollbackDir = t.TempDir()
+	m.ScrollbackMax = 64
+	ts := serveWS(t, m)
+	conn := dialWS(t, ts, "host")
+
+	if _, err := m.Scrollback("host#2"); !errors.Is(err, ErrNoScrollback) {
+		t.Errorf("Scrollback of an unknown id: err = %v, want ErrNoScrollback", err)
+	}
+
+	conn.WriteMessage(websocket.BinaryMessage, []byte("hello\n"))
+	readUntil(t, conn, "hello\r\nhello\r\n", nil)
+	waitFor(t, "scrollback", func() bool {
+		data, _ := m.Scrollback("host")
+		return bytes.Contains(data, []byte("hello\r\nhello\r\n"))
+	})
+
+	// Past the cap only the most recent output is kept.
+	long := strings.Repeat("x", 100)
+	conn.WriteMessage(websocket.BinaryMessage, []byte(long+"\n"))
+	readUntil(t, conn, long+"\r\n"+long+"\r\n", nil)
+	conn.WriteMessage(websocket.BinaryMessage, []byte("end\n"))
+	readUntil(t, conn, "end\r\nend\r\n", nil)
+	waitFor(t, "trimmed scrollback", func() bool {
+		data, _ := m.Scrollback("host")
+		return bytes.HasSuffix(data, []byte("end\r\nend\r\n"))
+	})
+	data, err := m.Scrollback("host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > 64 {
+		t.Errorf("scrollback is %d bytes, over the 64 byte cap", len(data))
+	}
+	if bytes.Contains(data, []byte("hello")) {
+		t.Errorf("scrollback %q still has output from before the trim", data)
+	}
+
+	// The file outlives the session.
+	killSessions(t, m)
+	if data, err := m.Scrollback("host"); err != nil || len(data) == 0 {
+		t.Errorf("after exit: %d bytes, err %v", len(data), err)
+	}
+}
+
+func TestScrollbackDisabled(t *testing.T) {
+	m := newTestManager(t)
+	if _, err := m.Scrollback("host"); !errors.Is(err, ErrNoScrollback) {
+		t.Errorf("err = %v, want ErrNoScrollback", err)
+	}
+}
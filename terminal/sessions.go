@@ -0,0 +1,147 @@
+package terminal
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// ErrNoSession is returned for operations on a session that isn't running.
+var ErrNoSession = errors.New("no such session")
+
+// SessionInfo describes a running session for listings.
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	PID       int       `json:"pid"`
+	CreatedAt time.Time `json:"created_at"`
+	Clients   int       `json:"clients"`
+	BytesIn   int64     `json:"bytes_in"`  // written to the PTY by clients
+	BytesOut  int64     `json:"bytes_out"` // produced by the PTY
+	Label     string    `json:"label,omitempty"`
+}
+
+// Sessions returns the running sessions, oldest first.
+func (m *Manager) Sessions() []SessionInfo {
+	m.mu.RLock()
+	list := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		list = append(list, s)
+	}
+	m.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].seqNo < list[j].seqNo })
+
+	out := make([]SessionInfo, 0, len(list))
+	for _, s := range list {
+		s.mu.Lock()
+		clients, label := len(s.clients), s.label
+		s.mu.Unlock()
+		out = append(out, SessionInfo{
+			ID:        s.id,
+			PID:       s.cmd.Process.Pid,
+			CreatedAt: s.createdAt,
+			Clients:   clients,
+			BytesIn:   s.bytesIn.Load(),
+			BytesOut:  s.bytesOut.Load(),
+			Label:     label,
+		})
+	}
+	return out
+}
+
+// Close asks the shell of session id to exit by typing "exit" at its
+// prompt (after clearing any half-typed line), so tmux and the shell shut
+// down normally. If the process is still running after grace, it is sent
+// SIGTERM. Close returns once the process has exited or the SIGTERM has
+// been sent, reporting whether the signal was needed.
+func (m *Manager) Close(id string, grace time.Duration) (forced bool, err error) {
+	m.mu.RLock()
+	s := m.sessions[id]
+	m.mu.RUnlock()
+	if s == nil {
+		return false, ErrNoSession
+	}
+	return s.close(grace)
+}
+
+// Input writes data to the PTY of session id as if a client had typed it.
+func (m *Manager) Input(id string, data []byte) error {
+	m.mu.RLock()
+	s := m.sessions[id]
+	m.mu.RUnlock()
+	if s == nil {
+		return ErrNoSession
+	}
+	s.markInput()
+	if _, err := s.ptmx.Write(data); err != nil {
+		return err
+	}
+	s.bytesIn.Add(int64(len(data)))
+	log.Printf("[SESSION] S%d (%q): %d bytes of input from the API", s.seqNo, s.id, len(data))
+	return nil
+}
+
+// close is Close for a session already looked up.
+func (s *Session) close(grace time.Duration) (forced bool, err error) {
+	log.Printf("[SESSION] S%d (%q): closing, grace %v", s.seqNo, s.id, grace)
+	// ^U clears the line so leftover input can't turn "exit" into
+	// something else; \r is Enter in raw mode.
+	if _, err := s.ptmx.Write([]byte("\x15exit\r")); err != nil {
+		log.Printf("[SESSION] S%d (%q): writing exit: %v", s.seqNo, s.id, err)
+	}
+
+	select {
+	case <-s.done:
+		return false, nil
+	case <-time.After(grace):
+	}
+	log.Printf("[SESSION] S%d (%q): still running after %v, sending SIGTERM", s.seqNo, s.id, grace)
+	if err := s.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		select {
+		case <-s.done:
+			return false, nil
+		default:
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// DumpState logs a snapshot of every running session and its attached
+// connections, one line each, for debugging a live server without going
+// through HTTP. It takes each lock only long enough to copy what it needs.
+func (m *Manager) DumpState() {
+	m.mu.RLock()
+	list := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		list = append(list, s)
+	}
+	m.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].seqNo < list[j].seqNo })
+
+	now := time.Now()
+	log.Printf("[STATE] %d session(s)", len(list))
+	for _, s := range list {
+		type conn struct {
+			c          *client
+			cols, rows uint16
+		}
+		s.mu.Lock()
+		clients := make([]conn, len(s.clients))
+		for i, c := range s.clients {
+			clients[i] = conn{c, c.cols, c.rows}
+		}
+		s.mu.Unlock()
+		log.Printf("[STATE] S%d (%q): pid=%d age=%v clients=%d bytes_in=%d bytes_out=%d",
+			s.seqNo, s.id, s.cmd.Process.Pid, now.Sub(s.createdAt).Round(time.Second),
+			len(clients), s.bytesIn.Load(), s.bytesOut.Load())
+		for _, cc := range clients {
+			c := cc.c
+			log.Printf("[STATE] S%d C%d: ip=%s user=%q req=%s age=%v size=%dx%d bytes_in=%d bytes_out=%d",
+				s.seqNo, c.seq, c.info.ClientIP, c.info.User, c.info.RequestID,
+				now.Sub(c.connectedAt).Round(time.Second), cc.cols, cc.rows,
+				c.bytesIn.Load(), c.bytesOut.Load())
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package terminal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClose(t *testing.T) {
+	tests := []struct {
+		name       string
+		cmd        func() *exec.Cmd
+		id         string // closed instead of "host" when set
+		wantForced bool
+		wantErr    error
+	}{
+		{"shell exits", func() *exec.Cmd { return exec.Command("sh") }, "", false, nil},
+		// cat copies "exit" like anything else, so only SIGTERM ends it.
+		{"program ignores exit", func() *exec.Cmd { return exec.Command("sh", "-c", "exec cat >/dev/null") }, "", true, nil},
+		{"no session", func() *exec.Cmd { return exec.Command("cat") }, "lxc/pve/100", false, ErrNoSession},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			m.BuildCommand = func(string) *exec.Cmd { return tt.cmd() }
+			if _, err := m.GetOrCreate("host"); err != nil {
+				t.Fatal(err)
+			}
+			id := "host"
+			if tt.id != "" {
+				id = tt.id
+			}
+
+			start := time.Now()
+			forced, err := m.Close(id, 300*time.Millisecond)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if forced != tt.wantForced {
+				t.Errorf("forced = %v, want %v", forced, tt.wantForced)
+			}
+			if !forced && time.Since(start) >= 300*time.Millisecond {
+				t.Errorf("clean exit took %v, the whole grace period", time.Since(start))
+			}
+			waitFor(t, "the session to be removed", func() bool { return len(m.Sessions()) == 0 })
+		})
+	}
+}
+
+func TestByteCounters(t *testing.T) {
+	m := newTestManager(t)
+	ts := serveWS(t, m)
+	conn := dialWS(t, ts, "host")
+
+	// cat under a PTY: each line comes back twice, once as the terminal's
+	// echo and once from cat, with \n turned into \r\n.
+	conn.WriteMessage(websocket.BinaryMessage, []byte("hello\n"))
+	readUntil(t, conn, "hello\r\nhello\r\n", nil)
+	if err := m.Input("host", []byte("abc\n")); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, conn, "abc\r\nabc\r\n", nil)
+
+	const wantIn, wantOut = 6 + 4, 14 + 10
+	var info SessionInfo
+	waitFor(t, "the byte counters", func() bool {
+		list := m.Sessions()
+		if len(list) != 1 {
+			return false
+		}
+		info = list[0]
+		return info.BytesIn >= wantIn && info.BytesOut >= wantOut
+	})
+	if info.BytesIn != wantIn || info.BytesOut != wantOut {
+		t.Errorf("bytes in/out = %d/%d, want %d/%d", info.BytesIn, info.BytesOut, wantIn, wantOut)
+	}
+}
+
+func TestDumpState(t *testing.T) {
+	m := newTestManager(t)
+	conn := dialWS(t, serveWS(t, m), "host")
+	conn.WriteMessage(websocket.BinaryMessage, []byte("hi\n"))
+	readUntil(t, conn, "hi\r\nhi\r\n", nil)
+	idle, err := m.GetOrCreate("node:pve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := m.Sessions()[0]
+	waitFor(t, "the output to be counted", func() bool { return m.Sessions()[0].BytesOut == 8 })
+
+	// log.Logger serialises writes, so the buffer is safe to read once the
+	// output has been switched back.
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	m.DumpState()
+	log.SetOutput(os.Stderr)
+	log.SetFlags(log.LstdFlags)
+
+	var lines []string
+	for _, l := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(l, "[STATE]") {
+			lines = append(lines, l)
+		}
+	}
+	want := []*regexp.Regexp{
+		regexp.MustCompile(`^\[STATE\] 2 session\(s\)$`),
+		regexp.MustCompile(fmt.Sprintf(`^\[STATE\] S\d+ \("host"\): pid=%d age=\d+s clients=1 bytes_in=3 bytes_out=8$`, host.PID)),
+		regexp.MustCompile(`^\[STATE\] S\d+ C1: ip=192\.0\.2\.1 user="" req=test age=\d+s size=\d+x\d+ bytes_in=3 bytes_out=\d+$`),
+		regexp.MustCompile(fmt.Sprintf(`^\[STATE\] S\d+ \("node:pve"\): pid=%d age=\d+s clients=0 bytes_in=0 bytes_out=0$`, idle.cmd.Process.Pid)),
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("dumped %d lines, want %d:\n%s", len(lines), len(want), strings.Join(lines, "\n"))
+	}
+	for i, re := range want {
+		if !re.MatchString(lines[i]) {
+			t.Errorf("line %d = %q, want it to match %s", i, lines[i], re)
+		}
+	}
+}
@@ -1,65 +1,449 @@
 package terminal
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	"github.com/chris/termbrowser/ids"
 	"github.com/creack/pty"
 	"github.com/gorilla/websocket"
 )
 
-type resizeMsg struct {
-	Type string `json:"type"`
-	Cols uint16 `json:"cols"`
-	Rows uint16 `json:"rows"`
-}
-
 // NodeResolver maps a Proxmox node name to a routable address (IP or FQDN).
 // It is called when building SSH commands for remote nodes/containers.
 type NodeResolver func(name string) string
 
+// CommandBuilder returns the unstarted command that provides the shell for
+// a terminal id. The manager runs it on a PTY.
+type CommandBuilder func(id string) *exec.Cmd
+
+// ResizePolicy decides which size the PTY takes when several attached
+// connections report different terminal sizes.
+type ResizePolicy string
+
+const (
+	// ResizeSmallest uses the smallest cols and rows reported by any
+	// connection, so output fits every viewer.
+	ResizeSmallest ResizePolicy = "smallest"
+	// ResizeController uses the size of the longest-attached connection.
+	ResizeController ResizePolicy = "controller"
+	// ResizeLatest uses whichever connection resized most recently.
+	ResizeLatest ResizePolicy = "latest"
+)
+
+// DuplicatePolicy decides what happens when a connection attaches to a
+// session that already has one.
+type DuplicatePolicy string
+
+const (
+	// DuplicateTakeover closes the existing connections in favour of the
+	// new one.
+	DuplicateTakeover DuplicatePolicy = "takeover"
+	// DuplicateReject refuses the new connection with CloseSessionInUse.
+	DuplicateReject DuplicatePolicy = "reject"
+	// DuplicateShare attaches the new connection alongside the others;
+	// all of them see the output and can type. ResizePolicy decides the
+	// PTY size.
+	DuplicateShare DuplicatePolicy = "share"
+)
+
+// LXCMode selects how a shell is opened inside an LXC container.
+type LXCMode string
+
+const (
+	// LXCExec runs tmux via "pct exec", giving a persistent session.
+	LXCExec LXCMode = "exec"
+	// LXCEnter uses "pct enter", which some setups find more reliable
+	// interactively but which doesn't persist across disconnects.
+	LXCEnter LXCMode = "enter"
+)
+
 type Session struct {
-	id    string
-	seqNo int // unique session sequence number for logging
-	cmd   *exec.Cmd
-	ptmx  *os.File
+	id     string
+	seqNo  int    // unique session sequence number for logging
+	reqID  string // ID of the request that created the session
+	cmd    *exec.Cmd
+	ptmx   *os.File
+	policy ResizePolicy
+
+	writeRetries int       // see Manager.WriteRetries
+	signal       Signaller // see Manager.Signal
+
+	maxCols, maxRows uint16 // see Manager.MaxCols and MaxRows
+	nodeKey          string // counted against Manager.MaxSessionsPerNode; see nodeLimitKey
+
+	relayed  bool               // the process is a tmux, ssh or pct client; see signalForeground
+	sendKeys func(string) error // types tmux keys into the session's pane; nil without tmux
+
+	scrollback *scrollbackLog // nil unless Manager.ScrollbackDir is set
+	motd       []byte         // sent to the first connection, then cleared; guarded by mu
+	events     *eventScanner  // nil unless Manager.TerminalEvents; used only by the PTY reader
+	viaSSH     bool           // the session's process is an ssh client
+	gotOutput  bool           // the PTY has produced output; guarded by mu
+	done       chan struct{}  // closed once the process has exited and the session is torn down
 
-	mu   sync.Mutex
-	conn *websocket.Conn // current active WebSocket, guarded by mu
-	connSeq int          // incremented on each WebSocket swap
+	resumeToken string // must be presented to attach once a client has; see Manager.RequireResumeToken
+	label       string // free-form tag from clients, see SetLabel; guarded by mu
+
+	latency *Histogram   // nil unless Manager.MeasureLatency
+	inputAt atomic.Int64 // unix nanos of the oldest input not yet followed by output, or 0
+
+	createdAt time.Time
+	bytesIn   atomic.Int64 // written to the PTY by all clients
+	bytesOut  atomic.Int64 // read from the PTY
+
+	mu      sync.Mutex
+	clients []*client   // attached WebSockets in attach order, guarded by mu; never closed while listed
+	connSeq int         // incremented on each WebSocket attach
+	sizeSeq int         // incremented on each resize, orders clients for ResizeLatest
+	winsize pty.Winsize // size last applied to the PTY
+}
+
+// client is one WebSocket attached to a session, along with the terminal
+// size it last reported.
+type client struct {
+	conn    *websocket.Conn
+	seq     int
+	cols    uint16 // zero until the first resize message
+	rows    uint16
+	sizedAt int // Session.sizeSeq at the last resize
+
+	writeMu sync.Mutex // gorilla allows only one concurrent writer
+	closed  bool       // set by close, guarded by writeMu
+
+	info        ConnInfo
+	connectedAt time.Time
+	bytesIn     atomic.Int64 // client → PTY
+	bytesOut    atomic.Int64 // PTY → client
+}
+
+// SSHHost is an ssh-reachable machine outside the cluster.
+type SSHHost struct {
+	Address string // host name or IP
+	User    string // defaults to root
+}
+
+// ConnInfo describes who is behind a WebSocket connection, as determined
+// by the HTTP layer.
+type ConnInfo struct {
+	ClientIP    string
+	User        string
+	RequestID   string // ID of the HTTP upgrade request, for correlating logs
+	ResumeToken string // presented by the client to reattach; see Manager.RequireResumeToken
+	Window      string // tmux window to switch to, if any; see ValidWindowName
+	NodeAddr    string // address to ssh to instead of the resolver's, for a new session; see shellCommand
+	Label       string // replaces the session's label if set; see CleanLabel
+}
+
+// ConnEvent reports a WebSocket attaching to or detaching from a session.
+type ConnEvent struct {
+	Type        string // "connect" or "disconnect"
+	SessionID   string
+	Conn        int // per-session connection number (the C in log lines)
+	Info        ConnInfo
+	Time        time.Time
+	ConnectedAt time.Time // disconnect only
+
+	// Byte counts for the connection's lifetime, disconnect only.
+	BytesIn, BytesOut int64
+}
+
+// WriteMessage sends a frame to the client, serialising writes from the
+// PTY reader and the connection's own read loop. Writes after close fail
+// with net.ErrClosed instead of touching the connection.
+func (c *client) WriteMessage(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// closeWith sends a close frame with code and reason, then closes the
+// connection like close.
+func (c *client) closeWith(code int, reason string) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if !c.closed {
+		c.closed = true
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+		c.conn.Close()
+	}
+}
+
+// replyClose answers a close frame from the client with one carrying the
+// same code, completing the close handshake, and stops further writes.
+// The read loop then ends and the connection is closed as usual. It is the
+// connection's close handler, which gorilla calls from ReadMessage.
+func (c *client) replyClose(code int, text string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if !c.closed {
+		c.closed = true
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(time.Second))
+	}
+	return nil
+}
+
+// close closes the connection once no write is in progress, so a writer
+// never sees the connection torn down underneath it.
+func (c *client) close() {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if !c.closed {
+		c.closed = true
+		c.conn.Close()
+	}
 }
 
 type Manager struct {
 	mu          sync.RWMutex
 	sessions    map[string]*Session
 	resolveNode NodeResolver
-	nextSeq     int // global session sequence counter
+	nextSeq     int                      // global session sequence counter
+	ended       map[string]*endedSession // lingering exited sessions; see DeadSessionLinger
+
+	// ResizePolicy reconciles resize messages from multiple connections.
+	// Defaults to ResizeLatest.
+	ResizePolicy ResizePolicy
+
+	// MaxSessionsPerNode caps the sessions running over ssh to any one
+	// node (or ssh host), by the address ssh connects to, so a rush of
+	// terminals can't exceed its sshd's MaxStartups. Starting another
+	// fails with ErrNodeBusy; attaching to a running session isn't
+	// affected. Zero means no limit.
+	MaxSessionsPerNode int
+
+	// OnDuplicate decides what a second connection to a session does.
+	// Defaults to DuplicateTakeover.
+	OnDuplicate DuplicatePolicy
+
+	// MaxCols and MaxRows bound the terminal size a client may request;
+	// larger (and zero) sizes are clamped. Default 1000x1000.
+	MaxCols uint16
+	MaxRows uint16
+
+	// DefaultCols and DefaultRows, if both set, are the PTY size a new
+	// session starts with, until a client sends a resize.
+	DefaultCols uint16
+	DefaultRows uint16
+
+	// WriteRetries is how many times a failed, non-fatal write of PTY
+	// output to a WebSocket is retried before the connection is detached.
+	WriteRetries int
+
+	// InputRate caps the bytes per second each connection may write to the
+	// PTY, with bursts up to InputBurst. Zero disables the limit. Reads
+	// pause when the limit is exceeded, pushing back on the client.
+	InputRate  int
+	InputBurst int
+
+	// OutputRate caps the bytes per second read from each session's PTY,
+	// with bursts up to OutputBurst, so a runaway process can't flood the
+	// browser. When it is exceeded the reader pauses and the kernel blocks
+	// the process once the PTY buffer fills. Zero disables the limit.
+	OutputRate  int
+	OutputBurst int
+
+	// SSHHosts are extra machines reachable over ssh, such as Proxmox
+	// Backup Servers, keyed by name and opened with the id "ssh:{name}".
+	// They are treated like nodes: tmux if available, Env applied.
+	// SSHJumpHosts entries are looked up by the full "ssh:{name}" id.
+	SSHHosts map[string]SSHHost
+
+	// Locale, if set, is exported as LANG and LC_ALL wherever TERM is, so
+	// TUIs in minimal containers get UTF-8 rather than the C locale.
+	Locale string
+
+	// SessionMaxLifetime, if positive, closes sessions this long after
+	// they started regardless of activity, warning attached clients a
+	// minute beforehand. A tmux session on the target outlives the
+	// terminal, as it does when a client disconnects.
+	SessionMaxLifetime time.Duration
+
+	// ClientIdleTimeout, if positive, closes a connection that has sent no
+	// input for this long with CloseClientIdle, leaving the session
+	// running for a later reattach.
+	ClientIdleTimeout time.Duration
+
+	// RequireResumeToken refuses to attach a connection to a session that
+	// already had one unless it presents the session's resume token, which
+	// is sent in a "session" message to every connection that attaches.
+	// Without it, anyone authenticated can take over a session by id.
+	RequireResumeToken bool
+
+	// Env is extra environment for every terminal, and TargetEnv for
+	// terminals matching a pattern (later entries win). It is set on the
+	// local process and passed through "env" on nodes and in containers;
+	// VM serial consoles and ssh login shells without tmux don't get it.
+	Env       map[string]string
+	TargetEnv []TargetEnv
+
+	// InheritEnv, if non-nil, limits the server's own environment passed
+	// to local processes (the host shell, ssh, pct) to these names; an
+	// entry ending in "*" matches a prefix. nil passes everything through.
+	InheritEnv []string
+
+	// OutputFlushInterval, if positive, batches PTY output arriving within
+	// this long of a previous send into one WebSocket frame. The first
+	// bytes after a pause still go out at once. Zero sends every read as
+	// it happens.
+	OutputFlushInterval time.Duration
+
+	// MaxMessageBytes caps the size of a single WebSocket message from a
+	// client. A larger one closes the connection with 1009 (message too
+	// big) instead of being buffered. Default 1 MiB.
+	MaxMessageBytes int64
+
+	// LXCMode chooses between "pct exec" + tmux and "pct enter" for
+	// containers, both local and over ssh. Defaults to LXCExec.
+	LXCMode LXCMode
+
+	// ScrollbackDir, if set, is where each session's output is recorded,
+	// capped at ScrollbackMax bytes per session.
+	ScrollbackDir string
+	ScrollbackMax int64
+
+	// DeadSessionLinger, if positive, keeps a session that has exited
+	// around this long when it recorded scrollback, so the first client
+	// to reconnect in that time is shown its final output and told it
+	// ended, rather than silently getting a new shell.
+	DeadSessionLinger time.Duration
+
+	// SessionWrapper, if set, is an argv the shell command of host and
+	// container sessions is run under, such as a recorder or "sudo -u
+	// someone"; see CheckSessionWrapper and wrap for its placeholders.
+	// For containers on other nodes it runs on that node, inside the ssh
+	// session. It applies with and without tmux.
+	SessionWrapper []string
+
+	// MeasureLatency records, in InputLatency, the time from a client's
+	// input to the next PTY output as a rough interactivity measure. It's
+	// heuristic: output that wasn't caused by the input counts too.
+	MeasureLatency bool
+	InputLatency   *Histogram
+
+	// SSHConnectTimeout bounds how long ssh waits for a node to accept
+	// the connection. Zero leaves ssh's default (the OS TCP timeout).
+	SSHConnectTimeout time.Duration
+
+	// SSHJumpHost, if set, is passed to ssh as -J ([user@]host[:port],
+	// comma-separated for several hops) to reach nodes through a bastion.
+	// SSHJumpHosts overrides it per node name; an empty entry connects
+	// to that node directly.
+	SSHJumpHost  string
+	SSHJumpHosts map[string]string
+
+	// SSHIdentityFile, if set, is passed to ssh as -i with
+	// IdentitiesOnly=yes. SSHIdentityFiles overrides it per node name (or
+	// "ssh:{name}"); an empty entry leaves that node to ssh's defaults.
+	SSHIdentityFile  string
+	SSHIdentityFiles map[string]string
+
+	// OnConnEvent, if set, is called synchronously when a WebSocket
+	// attaches to or leaves a session. It must not block.
+	OnConnEvent func(ConnEvent)
+
+	// MOTD, if set, is shown to the first connection of each new session
+	// ahead of any shell output. It is terminal text, so ANSI escapes
+	// work; bare newlines are sent as CRLF.
+	MOTD string
+
+	// TerminalEvents reports bells and OSC window-title changes in the
+	// output as JSON control messages, after the binary frame that
+	// carried them. Off by default since it scans every byte.
+	TerminalEvents bool
+
+	// CheckTmux verifies that tmux is installed on the target before
+	// starting a session that would use it, caching the answer per target.
+	// If it's missing, the session fails with ErrNoTmux, or with
+	// TmuxFallback runs a plain shell instead. TmuxChecker performs the
+	// check; it defaults to running "command -v tmux" on the target.
+	CheckTmux    bool
+	TmuxFallback bool
+	TmuxChecker  func(ctx context.Context, id string) (bool, error)
+
+	tmuxMu    sync.Mutex
+	tmuxCache map[string]tmuxResult
+
+	// TmuxLayouts are applied to newly created tmux sessions; the first
+	// whose Match pattern fits the id is used.
+	TmuxLayouts []TmuxLayout
+
+	// OnSessionStart and OnSessionEnd, if set, are called when a session's
+	// process starts and exits. They run in their own goroutine, so they
+	// may block without holding up terminals. exitCode is -1 if the process
+	// was killed by a signal.
+	OnSessionStart func(id string, pid int)
+	OnSessionEnd   func(id string, exitCode int)
+
+	// Signal delivers signals requested by clients. Defaults to
+	// syscall.Kill; tests can substitute a recorder.
+	Signal Signaller
+
+	// BuildCommand creates the shell command for new sessions. Defaults
+	// to the Proxmox routing described on buildCommand; tests can
+	// substitute something local such as cat.
+	BuildCommand CommandBuilder
 }
 
 func NewManager(resolve NodeResolver) *Manager {
-	return &Manager{
-		sessions:    make(map[string]*Session),
-		resolveNode: resolve,
+	m := &Manager{
+		sessions:     make(map[string]*Session),
+		resolveNode:  resolve,
+		ResizePolicy: ResizeLatest,
+		OnDuplicate:  DuplicateTakeover,
+		WriteRetries: 3,
+		Signal:       syscall.Kill,
+		LXCMode:      LXCExec,
+		InputRate:    1 << 20,
+		InputBurst:   4 << 20,
+		OutputRate:   8 << 20,
+		OutputBurst:  8 << 20,
+
+		ScrollbackMax:   1 << 20,
+		MaxCols:         1000,
+		MaxRows:         1000,
+		MaxMessageBytes: 1 << 20,
 	}
+	m.InputLatency = newHistogram()
+	m.BuildCommand = m.buildCommand
+	m.TmuxChecker = m.probeTmux
+	return m
 }
 
-// buildEnv returns os.Environ() with any existing TERM removed, then
-// TERM=xterm-256color appended. On Linux, getenv() returns the first
-// match, so duplicate TERM entries would silently override our value.
-func buildEnv() []string {
-	env := make([]string, 0, len(os.Environ())+1)
+// buildEnv returns os.Environ(), filtered by InheritEnv, with any existing
+// TERM removed, then TERM=xterm-256color and the configured variables for
+// id appended. On Linux, getenv() returns the first match, so duplicate
+// TERM entries would silently override our value; for the same reason
+// configured names are removed from the inherited environment.
+func (m *Manager) buildEnv(id string) []string {
+	extra := append([]string{"TERM=xterm-256color"}, m.envVars(id)...)
+	env := make([]string, 0, len(os.Environ())+len(extra))
 	for _, e := range os.Environ() {
-		if !strings.HasPrefix(e, "TERM=") {
+		name, _, _ := strings.Cut(e, "=")
+		if m.InheritEnv != nil && !inherited(m.InheritEnv, name) {
+			continue
+		}
+		if !slices.ContainsFunc(extra, func(x string) bool { return strings.HasPrefix(x, name+"=") }) {
 			env = append(env, e)
 		}
 	}
-	return append(env, "TERM=xterm-256color")
+	return append(env, extra...)
 }
 
 // nodeAddr resolves a Proxmox node name to a routable address.
@@ -73,49 +457,204 @@ func (m *Manager) nodeAddr(name string) string {
 	return name
 }
 
+// sshArgs returns the ssh options and destination shared by every
+// connection to node (reached as dest, i.e. user@addr), without the
+// remote command. node may also be an "ssh:{name}" id for an SSHHosts
+// entry.
+func (m *Manager) sshArgs(node, dest string) []string {
+	args := []string{"-o", "StrictHostKeyChecking=no"}
+	if m.SSHConnectTimeout > 0 {
+		secs := max(int(m.SSHConnectTimeout.Round(time.Second)/time.Second), 1)
+		args = append(args, "-o", fmt.Sprintf("ConnectTimeout=%d", secs))
+	}
+	if jump := m.jumpHost(node); jump != "" {
+		args = append(args, "-J", jump)
+	}
+	if key := m.identityFile(node); key != "" {
+		args = append(args, "-i", key, "-o", "IdentitiesOnly=yes")
+	}
+	return append(args, dest)
+}
+
+// sshDest returns the user@addr ssh connects to for target, a node name
+// or an "ssh:{name}" id.
+func (m *Manager) sshDest(target string) string {
+	if name, ok := strings.CutPrefix(target, "ssh:"); ok {
+		h := m.SSHHosts[name]
+		user := h.User
+		if user == "" {
+			user = "root"
+		}
+		return user + "@" + h.Address
+	}
+	return "root@" + m.nodeAddr(target)
+}
+
+// jumpHost returns the ProxyJump destination for node: its entry in
+// SSHJumpHosts if it has one (an empty entry meaning direct), otherwise
+// SSHJumpHost.
+func (m *Manager) jumpHost(node string) string {
+	if jump, ok := m.SSHJumpHosts[node]; ok {
+		return jump
+	}
+	return m.SSHJumpHost
+}
+
+// identityFile returns the private key for node: its entry in
+// SSHIdentityFiles if it has one, otherwise SSHIdentityFile.
+func (m *Manager) identityFile(node string) string {
+	if key, ok := m.SSHIdentityFiles[node]; ok {
+		return key
+	}
+	return m.SSHIdentityFile
+}
+
+// sshCommand builds an interactive ssh command running remote on node.
+// The remote side joins the arguments into a shell command line, so each
+// one is quoted.
+func (m *Manager) sshCommand(node string, remote ...string) *exec.Cmd {
+	return m.sshCommandTo(node, m.sshDest(node), remote...)
+}
+
+// sshCommandTo is sshCommand connecting to dest (user@addr) rather than
+// node's usual destination.
+func (m *Manager) sshCommandTo(node, dest string, remote ...string) *exec.Cmd {
+	args := append([]string{"-tt"}, m.sshArgs(node, dest)...)
+	for _, a := range remote {
+		args = append(args, shellQuote(a))
+	}
+	return exec.Command("ssh", args...)
+}
+
+// ProbeNode checks that node is reachable over ssh with the same options
+// used for terminals, by running "true" non-interactively. It returns the
+// address that was tried.
+func (m *Manager) ProbeNode(ctx context.Context, node string) (string, error) {
+	if !ids.ValidNodeName(node) {
+		return "", fmt.Errorf("invalid node name %q", node)
+	}
+	addr := m.nodeAddr(node)
+	args := append([]string{"-o", "BatchMode=yes"}, m.sshArgs(node, "root@"+addr)...)
+	out, err := exec.CommandContext(ctx, "ssh", append(args, "true")...).CombinedOutput()
+	if ctx.Err() != nil {
+		return addr, fmt.Errorf("timed out")
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return addr, fmt.Errorf("%v: %s", err, msg)
+		}
+		return addr, err
+	}
+	return addr, nil
+}
+
+// tmuxName returns the tmux session name for a target, with the instance
+// suffix appended when present.
+func tmuxName(name, instance string) string {
+	if instance == "" {
+		return name
+	}
+	return name + "-" + instance
+}
+
+// lxcShell returns the argv that opens a shell in container vmid on the
+// node it runs on, according to m.LXCMode, with env as the "env ..."
+// prefix. Without tmux it always uses pct enter.
+func (m *Manager) lxcShell(vmid, instance string, tmux bool, env []string) []string {
+	if m.LXCMode == LXCEnter || !tmux {
+		// pct enter takes no command, so set the environment on pct itself.
+		return append(env, "pct", "enter", vmid)
+	}
+	argv := append([]string{"pct", "exec", vmid, "--"}, env...)
+	return append(argv, "tmux", "new-session", "-A", "-s", tmuxName("tb-"+vmid, instance), "--", "/bin/bash")
+}
+
+// buildCommand is the default CommandBuilder. It opens tmux on the host,
+// ssh to a node, pct in a container or qm terminal on a VM, according to
+// the id format accepted by the server.
 func (m *Manager) buildCommand(id string) *exec.Cmd {
+	return m.shellCommand(id, true, "")
+}
+
+// directCommand is buildCommand without tmux, for targets that don't have
+// it installed. Sessions don't survive the process exiting.
+func (m *Manager) directCommand(id string) *exec.Cmd {
+	return m.shellCommand(id, false, "")
+}
+
+// shellCommand builds the command for a session's shell, in tmux if tmux
+// is set. A non-empty addr is ssh'd to in place of the node's resolved
+// address, for diagnosing the resolver; it doesn't apply to ssh_hosts.
+func (m *Manager) shellCommand(id string, tmux bool, addr string) *exec.Cmd {
+	p, err := ids.Parse(id)
+	if err != nil {
+		// Start fails with err, so nothing runs for a bad id.
+		return &exec.Cmd{Err: err}
+	}
+	env := m.envPrefix(id)
+	sshCommand := m.sshCommand
+	if addr != "" {
+		sshCommand = func(node string, remote ...string) *exec.Cmd {
+			return m.sshCommandTo(node, "root@"+addr, remote...)
+		}
+	}
+
 	var cmd *exec.Cmd
-	switch {
-	case id == "host":
-		cmd = exec.Command("tmux", "new-session", "-A", "-s", "tb-host", "--", "/bin/bash")
-
-	case strings.HasPrefix(id, "node:"):
-		node := id[5:]
-		addr := m.nodeAddr(node)
-		session := "tb-" + strings.ReplaceAll(node, ".", "-")
-		cmd = exec.Command("ssh", "-tt", "-o", "StrictHostKeyChecking=no", "root@"+addr,
-			"env", "TERM=xterm-256color",
-			"tmux", "new-session", "-A", "-s", session, "--", "/bin/bash")
-
-	case strings.HasPrefix(id, "lxc/"):
-		// Format: lxc/{node}/{vmid}
-		parts := strings.SplitN(id[4:], "/", 2)
-		node, vmid := parts[0], parts[1]
-		addr := m.nodeAddr(node)
-		cmd = exec.Command("ssh", "-tt", "-o", "StrictHostKeyChecking=no", "root@"+addr,
-			"pct", "exec", vmid, "--",
-			"env", "TERM=xterm-256color",
-			"tmux", "new-session", "-A", "-s", "tb-"+vmid, "--", "/bin/bash")
-
-	case strings.HasPrefix(id, "qemu/"):
-		// Format: qemu/{node}/{vmid} — serial console via qm terminal
-		parts := strings.SplitN(id[5:], "/", 2)
-		node, vmid := parts[0], parts[1]
-		addr := m.nodeAddr(node)
-		cmd = exec.Command("ssh", "-tt", "-o", "StrictHostKeyChecking=no", "root@"+addr,
-			"qm", "terminal", vmid, "-iface", "serial0")
-
-	default:
-		// Legacy: bare numeric ctid for local LXC container
-		cmd = exec.Command("pct", "exec", id, "--",
-			"env", "TERM=xterm-256color",
-			"tmux", "new-session", "-A", "-s", "tb-"+id, "--", "/bin/bash")
-	}
-
-	cmd.Env = buildEnv()
+	switch p.Kind {
+	case ids.Host:
+		argv := []string{"/bin/bash", "-l"}
+		if tmux {
+			argv = []string{"tmux", "new-session", "-A", "-s", tmuxName("tb-host", p.Instance), "--", "/bin/bash"}
+		}
+		argv = m.wrap(id, argv)
+		cmd = exec.Command(argv[0], argv[1:]...)
+
+	case ids.Node:
+		if !tmux {
+			// With no remote command ssh starts the login shell.
+			cmd = sshCommand(p.Node)
+			break
+		}
+		session := tmuxName("tb-"+strings.ReplaceAll(p.Node, ".", "-"), p.Instance)
+		cmd = sshCommand(p.Node, append(env,
+			"tmux", "new-session", "-A", "-s", session, "--", "/bin/bash")...)
+
+	case ids.SSH:
+		// An SSHHosts entry such as a PBS server.
+		target := "ssh:" + p.Node
+		if !tmux {
+			cmd = m.sshCommand(target)
+			break
+		}
+		session := tmuxName("tb-ssh-"+strings.ReplaceAll(p.Node, ".", "-"), p.Instance)
+		cmd = m.sshCommand(target, append(env,
+			"tmux", "new-session", "-A", "-s", session, "--", "/bin/bash")...)
+
+	case ids.LXC:
+		cmd = sshCommand(p.Node, m.wrap(id, m.lxcShell(p.VMID, p.Instance, tmux, env))...)
+
+	case ids.QEMU:
+		// Serial console via qm terminal.
+		cmd = sshCommand(p.Node,
+			"qm", "terminal", p.VMID, "-iface", "serial0")
+
+	case ids.LocalLXC:
+		argv := m.wrap(id, m.lxcShell(p.VMID, p.Instance, tmux, env))
+		cmd = exec.Command(argv[0], argv[1:]...)
+	}
+
+	cmd.Env = m.buildEnv(id)
 	return cmd
 }
 
+// motdBytes converts a configured message to terminal output, turning
+// line feeds into CRLF and ending with one.
+func motdBytes(msg string) []byte {
+	msg = strings.ReplaceAll(msg, "\r\n", "\n")
+	msg = strings.TrimSuffix(msg, "\n")
+	return []byte(strings.ReplaceAll(msg, "\n", "\r\n") + "\r\n")
+}
+
 func isAlive(s *Session) bool {
 	if s.cmd.Process == nil {
 		log.Printf("[SESSION] isAlive S%d (%q): Process is nil → false", s.seqNo, s.id)
@@ -130,6 +669,18 @@ func isAlive(s *Session) bool {
 }
 
 func (m *Manager) GetOrCreate(id string) (*Session, error) {
+	return m.getOrCreate(id, "", "")
+}
+
+// getOrCreate is GetOrCreate with the ID of the request that triggered it,
+// which is recorded on a newly created session and carried in its logs,
+// and an optional address overriding the node's (see shellCommand). With
+// an override the shell is built by shellCommand even if BuildCommand has
+// been replaced; it has no effect on a session that is already running.
+func (m *Manager) getOrCreate(id, reqID, addr string) (*Session, error) {
+	if _, err := ids.Parse(id); err != nil {
+		return nil, err
+	}
 	m.mu.RLock()
 	s, ok := m.sessions[id]
 	m.mu.RUnlock()
@@ -146,6 +697,37 @@ func (m *Manager) GetOrCreate(id string) (*Session, error) {
 		log.Printf("[SESSION] GetOrCreate(%q): no session in map, will create new", id)
 	}
 
+	// Checked early to spare a busy node the tmux probe, and again under
+	// the write lock below. Resolving the key may look the node up, so
+	// it's done without the lock.
+	nodeKey := m.nodeLimitKey(id, addr)
+	m.mu.RLock()
+	err := m.checkNodeLimitLocked(nodeKey)
+	m.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// The tmux check may take an ssh round trip, so do it before taking
+	// the manager lock.
+	build, direct, err := m.commandFor(id)
+	if err != nil {
+		return nil, err
+	}
+	if addr != "" {
+		log.Printf("[SESSION] GetOrCreate(%q): connecting to %s instead of the resolved address req=%s", id, addr, reqID)
+		build = func(id string) *exec.Cmd { return m.shellCommand(id, !direct, addr) }
+	}
+	var layout [][]string
+	session := m.tmuxSession(id)
+	if cmds := m.layoutFor(id); cmds != nil && session != "" && !direct {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if !m.tmuxSessionExists(ctx, id, session) {
+			layout = cmds
+		}
+		cancel()
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -155,48 +737,125 @@ func (m *Manager) GetOrCreate(id string) (*Session, error) {
 		log.Printf("[SESSION] GetOrCreate(%q): double-check found alive session S%d, reusing", id, s.seqNo)
 		return s, nil
 	}
+	if err := m.checkNodeLimitLocked(nodeKey); err != nil {
+		return nil, err
+	}
 
 	m.nextSeq++
 	seqNo := m.nextSeq
+	delete(m.ended, id)
 
-	cmd := m.buildCommand(id)
-	ptmx, err := pty.Start(cmd)
+	cmd := build(id)
+	var size *pty.Winsize // nil leaves the PTY's own default
+	if m.DefaultCols > 0 && m.DefaultRows > 0 {
+		size = &pty.Winsize{Cols: m.DefaultCols, Rows: m.DefaultRows}
+	}
+	ptmx, err := pty.StartWithSize(cmd, size)
 	if err != nil {
 		return nil, fmt.Errorf("starting pty for %s: %w", id, err)
 	}
 
-	log.Printf("[SESSION] GetOrCreate(%q): CREATED new session S%d (pid=%d)", id, seqNo, cmd.Process.Pid)
+	log.Printf("[SESSION] GetOrCreate(%q): CREATED new session S%d (pid=%d) req=%s", id, seqNo, cmd.Process.Pid, reqID)
 
 	s = &Session{
-		id:    id,
-		seqNo: seqNo,
-		cmd:   cmd,
-		ptmx:  ptmx,
+		id:     id,
+		seqNo:  seqNo,
+		reqID:  reqID,
+		cmd:    cmd,
+		ptmx:   ptmx,
+		policy: m.ResizePolicy,
+
+		writeRetries: m.WriteRetries,
+		signal:       m.Signal,
+		done:         make(chan struct{}),
+		createdAt:    time.Now(),
+
+		maxCols: m.MaxCols,
+		maxRows: m.MaxRows,
+		nodeKey: nodeKey,
+	}
+	if size != nil {
+		s.winsize = *size
+	}
+	if m.MOTD != "" {
+		s.motd = motdBytes(m.MOTD)
+	}
+	if m.TerminalEvents {
+		s.events = &eventScanner{}
+	}
+	s.viaSSH = filepath.Base(cmd.Path) == "ssh"
+	s.relayed = slices.ContainsFunc(relayPrograms, func(prog string) bool { return argvRuns(cmd.Args, prog) })
+	if session != "" && argvRuns(cmd.Args, "tmux") {
+		s.sendKeys = func(keys string) error { return m.tmuxSendKeys(id, session, keys) }
+	}
+	s.resumeToken = newResumeToken()
+	if m.MeasureLatency {
+		s.latency = m.InputLatency
+	}
+	if m.ScrollbackDir != "" {
+		if s.scrollback, err = openScrollback(m.ScrollbackDir, id, m.ScrollbackMax); err != nil {
+			log.Printf("[SESSION] S%d (%q): scrollback disabled: %v", seqNo, id, err)
+		}
 	}
 	m.sessions[id] = s
+	if layout != nil {
+		go m.applyLayout(id, session, layout)
+	}
+	if m.OnSessionStart != nil {
+		go m.OnSessionStart(id, cmd.Process.Pid)
+	}
+	if m.SessionMaxLifetime > 0 {
+		go m.enforceLifetime(s)
+	}
 
 	// Persistent PTY reader: reads from PTY and writes to whatever
 	// WebSocket connection is currently active. This goroutine lives
 	// for the lifetime of the session, preventing duplicate readers
 	// when clients reconnect.
+	readerDone := make(chan struct{})
 	go func() {
-		log.Printf("[PTY-READER] S%d (%q): goroutine started", seqNo, id)
+		log.Printf("[PTY-READER] S%d (%q) req=%s: goroutine started", seqNo, id, reqID)
+		var out *coalescer
+		if m.OutputFlushInterval > 0 {
+			out = newCoalescer(m.OutputFlushInterval, s.broadcast)
+		}
+		var limiter *tokenBucket
+		if m.OutputRate > 0 {
+			limiter = newTokenBucket(m.OutputRate, m.OutputBurst)
+		}
+		throttled := false
 		buf := make([]byte, 4096)
 		for {
 			n, err := s.ptmx.Read(buf)
-			if n > 0 {
-				s.mu.Lock()
-				if s.conn != nil {
-					if werr := s.conn.WriteMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
-						log.Printf("[PTY-READER] S%d (%q): write to WS C%d failed: %v, clearing conn",
-							seqNo, id, s.connSeq, werr)
-						s.conn = nil
+			if n > 0 && limiter != nil {
+				if wait := limiter.take(n); wait > 0 {
+					if !throttled {
+						log.Printf("[PTY-READER] S%d (%q) req=%s: output rate limit exceeded, throttling", seqNo, id, reqID)
+						throttled = true
 					}
+					time.Sleep(wait)
+				} else {
+					throttled = false
+				}
+			}
+			if n > 0 {
+				s.markOutput()
+				s.bytesOut.Add(int64(n))
+				if s.scrollback != nil {
+					s.scrollback.Write(buf[:n])
+				}
+				if out != nil {
+					out.Write(buf[:n])
+				} else {
+					s.broadcast(buf[:n])
 				}
-				s.mu.Unlock()
 			}
 			if err != nil {
-				log.Printf("[PTY-READER] S%d (%q): PTY read error (goroutine exiting): %v", seqNo, id, err)
+				log.Printf("[PTY-READER] S%d (%q) req=%s: PTY read error (goroutine exiting): %v", seqNo, id, reqID, err)
+				if out != nil {
+					out.Close()
+				}
+				close(readerDone)
 				return
 			}
 		}
@@ -205,77 +864,352 @@ func (m *Manager) GetOrCreate(id string) (*Session, error) {
 	// Cleanup: remove session from map when process exits.
 	go func() {
 		err := cmd.Wait()
-		log.Printf("[SESSION] S%d (%q): process exited (err=%v, state=%v)", seqNo, id, err, cmd.ProcessState)
+		log.Printf("[SESSION] S%d (%q) req=%s: process exited (err=%v, state=%v)", seqNo, id, reqID, err, cmd.ProcessState)
+		// Let the reader drain output still buffered in the PTY, but don't
+		// wait forever on a background process holding it open.
+		select {
+		case <-readerDone:
+		case <-time.After(time.Second):
+		}
+		// Under s.mu, so a resize can't be using the descriptor.
+		s.mu.Lock()
 		ptmx.Close()
+		s.mu.Unlock()
+		<-readerDone
+		s.end(cmd.ProcessState.ExitCode())
+		if s.scrollback != nil {
+			s.scrollback.Close()
+		}
 		m.mu.Lock()
 		if m.sessions[id] == s {
 			delete(m.sessions, id)
 			log.Printf("[SESSION] S%d (%q): removed from session map", seqNo, id)
+			m.lingerLocked(s, cmd.ProcessState.ExitCode())
 		} else {
 			log.Printf("[SESSION] S%d (%q): already replaced in session map, not removing", seqNo, id)
 		}
 		m.mu.Unlock()
+		close(s.done)
+		if m.OnSessionEnd != nil {
+			go m.OnSessionEnd(id, cmd.ProcessState.ExitCode())
+		}
 	}()
 
 	return s, nil
 }
 
-func (m *Manager) ServeWebSocket(conn *websocket.Conn, id string) {
-	s, err := m.GetOrCreate(id)
+// broadcast sends PTY output to every attached client, detaching any
+// that can't keep up.
+func (s *Session) broadcast(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gotOutput = true
+	for _, c := range s.clients {
+		if werr := s.writeOutput(c, data); werr != nil {
+			log.Printf("[PTY-READER] S%d (%q): write to WS C%d req=%s failed: %v, detaching conn",
+				s.seqNo, s.id, c.seq, c.info.RequestID, werr)
+			s.detachLocked(c)
+			// Closing ends the connection's read loop so the
+			// browser notices and reconnects, rather than
+			// sitting on a conn that no longer gets output.
+			c.close()
+			continue
+		}
+		c.bytesOut.Add(int64(len(data)))
+	}
+	if s.events != nil {
+		s.sendEventsLocked(s.events.scan(data))
+	}
+}
+
+func (m *Manager) ServeWebSocket(conn *websocket.Conn, id string, info ConnInfo) {
+	if m.serveEnded(conn, id, info) {
+		return
+	}
+	s, err := m.getOrCreate(id, info.RequestID, info.NodeAddr)
 	if err != nil {
-		log.Printf("[WS] terminal %s: %v", id, err)
+		log.Printf("[WS] terminal %s req=%s: %v", id, info.RequestID, err)
 		conn.WriteMessage(websocket.TextMessage, []byte("Error: "+err.Error()))
+		closeMsg := websocket.FormatCloseMessage(CloseTryAgain, fmt.Sprintf("retry-after=%d", retryAfterSeconds))
+		if errors.Is(err, ErrNoTmux) {
+			// Retrying won't help until someone installs it.
+			closeMsg = websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "tmux not installed")
+		}
+		conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
 		conn.Close()
 		return
 	}
 
-	// Swap in the new connection; close the old one so its client-side
-	// onmessage handler stops firing (prevents duplicate output).
+	// Under DuplicateTakeover, swap in the new connection and close the
+	// old one so its client-side onmessage handler stops firing (prevents
+	// duplicate output). Old connections are removed from s.clients under
+	// s.mu first, so the PTY reader (which writes while holding s.mu) can
+	// no longer pick them up, and only then closed.
 	s.mu.Lock()
-	old := s.conn
+	if m.RequireResumeToken && s.connSeq > 0 && !s.checkResumeToken(info.ResumeToken) {
+		s.mu.Unlock()
+		log.Printf("[WS] S%d (%q) req=%s: refusing attach from %s: invalid resume token", s.seqNo, id, info.RequestID, info.ClientIP)
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "invalid resume token"), time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
+	if m.OnDuplicate == DuplicateReject && len(s.clients) > 0 {
+		s.mu.Unlock()
+		log.Printf("[WS] S%d (%q) req=%s: refusing attach from %s: session in use", s.seqNo, id, info.RequestID, info.ClientIP)
+		conn.WriteMessage(websocket.BinaryMessage, []byte("\x1b[31mThis session is already in use by another connection.\x1b[0m\r\n"))
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(CloseSessionInUse, "session in use"), time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
+	var old []*client
 	s.connSeq++
 	cseq := s.connSeq
-	s.conn = conn
+	c := &client{conn: conn, seq: cseq, info: info, connectedAt: time.Now()}
+	conn.SetCloseHandler(c.replyClose)
+	if m.OnDuplicate == DuplicateShare {
+		s.clients = append(s.clients, c)
+	} else {
+		old = s.clients
+		s.clients = []*client{c}
+	}
+	if info.Label != "" {
+		s.label = info.Label
+	}
+	s.sendSessionLocked(c)
+	// The PTY reader writes under s.mu too, so the MOTD is guaranteed to
+	// reach the client before any shell output.
+	if s.motd != nil {
+		if err := s.writeOutput(c, s.motd); err != nil {
+			log.Printf("[WS] S%d (%q) C%d req=%s: sending motd: %v", s.seqNo, id, cseq, info.RequestID, err)
+		}
+		s.motd = nil
+	}
+	// ssh can take a while to reach a slow node; say so rather than
+	// showing a blank terminal until the first output arrives.
+	if s.viaSSH && !s.gotOutput {
+		s.writeOutput(c, []byte("\x1b[2mConnecting...\x1b[0m\r\n"))
+	}
 	s.mu.Unlock()
+	m.emitConnEvent(s, c, "connect")
+	if info.Window != "" {
+		if session := m.tmuxSession(id); session != "" && ValidWindowName(info.Window) {
+			go m.selectWindow(id, session, info.Window)
+		} else {
+			log.Printf("[WS] S%d (%q) C%d req=%s: ignoring window %q: no tmux session or invalid name", s.seqNo, id, cseq, info.RequestID, info.Window)
+		}
+	}
 
-	hadOld := old != nil
-	if old != nil {
-		log.Printf("[WS] S%d (%q): swapped conn C%d → C%d (closing old)", s.seqNo, id, cseq-1, cseq)
-		old.Close()
+	if len(old) > 0 {
+		for _, oc := range old {
+			log.Printf("[WS] S%d (%q): swapped conn C%d → C%d req=%s (closing old)", s.seqNo, id, oc.seq, cseq, info.RequestID)
+			oc.closeWith(CloseTakenOver, "taken over")
+		}
 	} else {
-		log.Printf("[WS] S%d (%q): set conn C%d (no previous conn)", s.seqNo, id, cseq)
+		log.Printf("[WS] S%d (%q): set conn C%d req=%s (no previous conn to close)", s.seqNo, id, cseq, info.RequestID)
 	}
-	_ = hadOld
 
-	// Read input from this WebSocket and forward to PTY.
-	log.Printf("[WS] S%d (%q) C%d: entering read loop", s.seqNo, id, cseq)
+	// Read input from this WebSocket and forward to PTY. gorilla closes
+	// the connection with CloseMessageTooBig past the read limit.
+	if m.MaxMessageBytes > 0 {
+		conn.SetReadLimit(m.MaxMessageBytes)
+	}
+	var limiter *tokenBucket
+	if m.InputRate > 0 {
+		limiter = newTokenBucket(m.InputRate, m.InputBurst)
+	}
+	var idle *time.Timer
+	if m.ClientIdleTimeout > 0 {
+		idle = time.AfterFunc(m.ClientIdleTimeout, func() {
+			log.Printf("[WS] S%d (%q) C%d req=%s: no input for %v, disconnecting", s.seqNo, id, cseq, info.RequestID, m.ClientIdleTimeout)
+			c.closeWith(CloseClientIdle, "idle")
+		})
+		defer idle.Stop()
+	}
+	log.Printf("[WS] S%d (%q) C%d req=%s: entering read loop", s.seqNo, id, cseq, info.RequestID)
 	for {
 		msgType, data, err := conn.ReadMessage()
 		if err != nil {
-			log.Printf("[WS] S%d (%q) C%d: read loop exiting: %v", s.seqNo, id, cseq, err)
+			log.Printf("[WS] S%d (%q) C%d req=%s: read loop exiting: %v", s.seqNo, id, cseq, info.RequestID, err)
 			break
 		}
 		switch msgType {
 		case websocket.BinaryMessage:
+			if limiter != nil {
+				if wait := limiter.take(len(data)); wait > 0 {
+					log.Printf("[WS] S%d (%q) C%d req=%s: input rate limit exceeded, pausing %v", s.seqNo, id, cseq, info.RequestID, wait)
+					time.Sleep(wait)
+				}
+			}
+			if idle != nil {
+				idle.Reset(m.ClientIdleTimeout)
+			}
+			s.markInput()
 			s.ptmx.Write(data)
+			c.bytesIn.Add(int64(len(data)))
+			s.bytesIn.Add(int64(len(data)))
 		case websocket.TextMessage:
-			var msg resizeMsg
-			if json.Unmarshal(data, &msg) == nil && msg.Type == "resize" {
-				log.Printf("[WS] S%d (%q) C%d: resize %dx%d", s.seqNo, id, cseq, msg.Cols, msg.Rows)
-				pty.Setsize(s.ptmx, &pty.Winsize{
-					Cols: msg.Cols,
-					Rows: msg.Rows,
-				})
-			}
+			s.handleControl(c, data)
 		}
 	}
 
-	// If we're still the active connection, nil it out.
+	// If we're still attached, detach so the PTY size is recomputed from
+	// the remaining connections.
 	s.mu.Lock()
-	wasActive := s.conn == conn
-	if wasActive {
-		s.conn = nil
+	wasActive := s.detachLocked(c)
+	s.mu.Unlock()
+	log.Printf("[WS] S%d (%q) C%d req=%s: cleanup, wasActiveConn=%v", s.seqNo, id, cseq, info.RequestID, wasActive)
+	m.emitConnEvent(s, c, "disconnect")
+}
+
+func (m *Manager) emitConnEvent(s *Session, c *client, typ string) {
+	if m.OnConnEvent == nil {
+		return
+	}
+	ev := ConnEvent{
+		Type:      typ,
+		SessionID: s.id,
+		Conn:      c.seq,
+		Info:      c.info,
+		Time:      time.Now(),
+	}
+	if typ == "disconnect" {
+		ev.ConnectedAt = c.connectedAt
+		ev.BytesIn = c.bytesIn.Load()
+		ev.BytesOut = c.bytesOut.Load()
 	}
+	m.OnConnEvent(ev)
+}
+
+// end detaches every client once the session's process has exited and
+// all its output has been sent, telling them why with the close code. An
+// ssh exit status of 255 means ssh itself failed (e.g. the node timed out
+// or refused the connection), which is worth retrying.
+func (s *Session) end(exitCode int) {
+	s.mu.Lock()
+	ended := s.clients
+	s.clients = nil
 	s.mu.Unlock()
-	log.Printf("[WS] S%d (%q) C%d: cleanup, wasActiveConn=%v", s.seqNo, id, cseq, wasActive)
+	for _, c := range ended {
+		if s.viaSSH && exitCode == 255 {
+			c.WriteMessage(websocket.BinaryMessage, []byte("\r\n\x1b[31mCould not connect to the node over ssh.\x1b[0m\r\n"))
+			c.closeWith(CloseTryAgain, fmt.Sprintf("retry-after=%d", retryAfterSeconds))
+			continue
+		}
+		c.closeWith(CloseSessionEnded, "session ended")
+	}
+}
+
+// sendEventsLocked sends control messages produced by the event scanner
+// to every attached client. A failed write is left for the next output
+// write to detect. Callers must hold s.mu.
+func (s *Session) sendEventsLocked(events []controlMsg) {
+	for _, ev := range events {
+		msg, _ := json.Marshal(ev)
+		for _, c := range s.clients {
+			c.WriteMessage(websocket.TextMessage, msg)
+		}
+	}
+}
+
+// detachLocked removes c from the session's attached connections and
+// recomputes the PTY size. It reports whether c was attached. Callers must
+// hold s.mu.
+func (s *Session) detachLocked(c *client) bool {
+	for i, cc := range s.clients {
+		if cc == c {
+			s.clients = append(s.clients[:i:i], s.clients[i+1:]...)
+			s.applySizeLocked()
+			return true
+		}
+	}
+	return false
+}
+
+// applySizeLocked sets the PTY size from the attached connections according
+// to the session's ResizePolicy. Connections that haven't reported a size
+// yet are ignored. Callers must hold s.mu.
+func (s *Session) applySizeLocked() {
+	var ws pty.Winsize
+	var latest int
+	for _, c := range s.clients {
+		if c.cols == 0 || c.rows == 0 {
+			continue
+		}
+		switch s.policy {
+		case ResizeSmallest:
+			if ws.Cols == 0 || c.cols < ws.Cols {
+				ws.Cols = c.cols
+			}
+			if ws.Rows == 0 || c.rows < ws.Rows {
+				ws.Rows = c.rows
+			}
+		case ResizeController:
+			if ws.Cols == 0 {
+				ws.Cols, ws.Rows = c.cols, c.rows
+			}
+		default: // ResizeLatest
+			if c.sizedAt > latest {
+				latest = c.sizedAt
+				ws.Cols, ws.Rows = c.cols, c.rows
+			}
+		}
+	}
+	if ws.Cols == 0 || ws == s.winsize {
+		return
+	}
+	if err := pty.Setsize(s.ptmx, &ws); err != nil {
+		log.Printf("[SESSION] S%d (%q): setting size %dx%d: %v", s.seqNo, s.id, ws.Cols, ws.Rows, err)
+		return
+	}
+	s.winsize = ws
+}
+
+// messageWriter is the part of *websocket.Conn used to send PTY output.
+type messageWriter interface {
+	WriteMessage(messageType int, data []byte) error
+}
+
+// writeOutput sends PTY output to c, retrying non-fatal errors with a
+// short exponential backoff up to s.writeRetries times.
+//
+// gorilla/websocket treats most network errors as sticky, so a retry only
+// helps for errors that didn't poison the connection; fatal ones (closed
+// connection, peer reset, close frame sent) are returned immediately.
+func (s *Session) writeOutput(c *client, data []byte) error {
+	return writeWithRetry(c, data, s.writeRetries, func(attempt int, err error) {
+		log.Printf("[PTY-READER] S%d (%q): transient write error to WS C%d req=%s (attempt %d/%d): %v",
+			s.seqNo, s.id, c.seq, c.info.RequestID, attempt, s.writeRetries, err)
+	})
+}
+
+func writeWithRetry(w messageWriter, data []byte, retries int, onRetry func(attempt int, err error)) error {
+	backoff := 5 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := w.WriteMessage(websocket.BinaryMessage, data)
+		if err == nil {
+			return nil
+		}
+		if isFatalWriteError(err) {
+			return fmt.Errorf("fatal: %w", err)
+		}
+		if attempt > retries {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		onRetry(attempt, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isFatalWriteError reports whether err means the connection is gone for
+// good, as opposed to a condition that may clear on retry.
+func isFatalWriteError(err error) bool {
+	var closeErr *websocket.CloseError
+	return errors.Is(err, websocket.ErrCloseSent) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.As(err, &closeErr)
 }
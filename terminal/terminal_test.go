@@ -0,0 +1,641 @@
+package terminal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/gorilla/websocket"
+)
+
+// newPTYSession returns a session with a real PTY, not attached to any
+// process, for tests that only look at the terminal side.
+func newPTYSession(t *testing.T, policy ResizePolicy) *Session {
+	t.Helper()
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("no PTY available: %v", err)
+	}
+	t.Cleanup(func() {
+		ptmx.Close()
+		tty.Close()
+	})
+	return &Session{id: "host", ptmx: ptmx, policy: policy}
+}
+
+func TestApplySizePolicies(t *testing.T) {
+	// Connection 1 attaches first at 100x40 and resizes first; connection
+	// 2 attaches second at 80x50 and resizes last.
+	tests := []struct {
+		policy     ResizePolicy
+		cols, rows uint16
+		// after connection 1 detaches
+		afterCols, afterRows uint16
+	}{
+		{ResizeSmallest, 80, 40, 80, 50},
+		{ResizeController, 100, 40, 80, 50},
+		{ResizeLatest, 80, 50, 80, 50},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			s := newPTYSession(t, tt.policy)
+			first := &client{seq: 1, cols: 100, rows: 40, sizedAt: 1}
+			second := &client{seq: 2, cols: 80, rows: 50, sizedAt: 2}
+			s.clients = []*client{first, second}
+
+			s.applySizeLocked()
+			ws, err := pty.GetsizeFull(s.ptmx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ws.Cols != tt.cols || ws.Rows != tt.rows {
+				t.Errorf("size = %dx%d, want %dx%d", ws.Cols, ws.Rows, tt.cols, tt.rows)
+			}
+
+			s.detachLocked(first)
+			ws, _ = pty.GetsizeFull(s.ptmx)
+			if ws.Cols != tt.afterCols || ws.Rows != tt.afterRows {
+				t.Errorf("size after detach = %dx%d, want %dx%d", ws.Cols, ws.Rows, tt.afterCols, tt.afterRows)
+			}
+		})
+	}
+}
+
+func TestApplySizeIgnoresUnsized(t *testing.T) {
+	s := newPTYSession(t, ResizeSmallest)
+	s.clients = []*client{
+		{seq: 1}, // hasn't sent a resize yet
+		{seq: 2, cols: 120, rows: 30, sizedAt: 1},
+	}
+	s.applySizeLocked()
+	ws, _ := pty.GetsizeFull(s.ptmx)
+	if ws.Cols != 120 || ws.Rows != 30 {
+		t.Errorf("size = %dx%d, want 120x30", ws.Cols, ws.Rows)
+	}
+}
+
+// flakyWriter fails its first failures writes with err, then succeeds.
+type flakyWriter struct {
+	failures int
+	err      error
+	calls    int
+	got      [][]byte
+}
+
+func (w *flakyWriter) WriteMessage(_ int, data []byte) error {
+	w.calls++
+	if w.calls <= w.failures {
+		return w.err
+	}
+	w.got = append(w.got, data)
+	return nil
+}
+
+func TestWriteWithRetry(t *testing.T) {
+	transient := errors.New("i/o timeout")
+	tests := []struct {
+		name        string
+		failures    int
+		err         error
+		retries     int
+		wantErr     bool
+		wantCalls   int
+		wantRetries int
+	}{
+		{"no failure", 0, nil, 3, false, 1, 0},
+		{"transient then recovers", 2, transient, 3, false, 3, 2},
+		{"transient past retries", 5, transient, 3, true, 4, 3},
+		{"no retries", 1, transient, 0, true, 1, 0},
+		{"fatal closed connection", 1, net.ErrClosed, 3, true, 1, 0},
+		{"fatal close sent", 1, websocket.ErrCloseSent, 3, true, 1, 0},
+		{"fatal broken pipe", 1, fmt.Errorf("write: %w", syscall.EPIPE), 3, true, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &flakyWriter{failures: tt.failures, err: tt.err}
+			var retried int
+			err := writeWithRetry(w, []byte("out"), tt.retries, func(int, error) { retried++ })
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if w.calls != tt.wantCalls {
+				t.Errorf("%d write attempts, want %d", w.calls, tt.wantCalls)
+			}
+			if retried != tt.wantRetries {
+				t.Errorf("onRetry called %d times, want %d", retried, tt.wantRetries)
+			}
+			if !tt.wantErr && (len(w.got) != 1 || string(w.got[0]) != "out") {
+				t.Errorf("delivered %q, want one \"out\"", w.got)
+			}
+		})
+	}
+}
+
+// newTestManager returns a manager whose sessions run cat, with every
+// session killed at the end of the test.
+func newTestManager(t *testing.T) *Manager {
+	t.Helper()
+	m := NewManager(nil)
+	m.BuildCommand = func(string) *exec.Cmd { return exec.Command("cat") }
+	t.Cleanup(func() { killSessions(t, m) })
+	return m
+}
+
+// killSessions kills the process of every running session and waits for
+// it to be torn down.
+func killSessions(t *testing.T, m *Manager) {
+	m.mu.RLock()
+	var all []*Session
+	for _, s := range m.sessions {
+		all = append(all, s)
+	}
+	m.mu.RUnlock()
+	for _, s := range all {
+		s.cmd.Process.Kill()
+		select {
+		case <-s.done:
+		case <-time.After(5 * time.Second):
+			t.Errorf("session %q didn't end after being killed", s.id)
+		}
+	}
+}
+
+// serveWS starts an HTTP server that attaches each WebSocket to m, using
+// the request path without its leading slash as the terminal id.
+func serveWS(t *testing.T, m *Manager) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		m.ServeWebSocket(conn, strings.TrimPrefix(r.URL.Path, "/"), ConnInfo{ClientIP: "192.0.2.1", RequestID: "test"})
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// dialWS connects to session id on ts.
+func dialWS(t *testing.T, ts *httptest.Server, id string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/"+id, nil)
+	if err != nil {
+		t.Fatalf("dialing %s: %v", id, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readUntil reads frames from conn until the binary ones, concatenated,
+// contain want, and returns them. Text frames are passed to onText if it
+// isn't nil.
+func readUntil(t *testing.T, conn *websocket.Conn, want string, onText func([]byte)) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	var got strings.Builder
+	for !strings.Contains(got.String(), want) {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %q, got %q: %v", want, got.String(), err)
+		}
+		switch {
+		case typ == websocket.BinaryMessage:
+			got.Write(data)
+		case onText != nil:
+			onText(data)
+		}
+	}
+	return got.String()
+}
+
+// waitFor polls cond until it is true, failing the test after a few
+// seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShellCommandLXCMode(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		mode LXCMode
+		tmux bool
+		want []string
+	}{
+		{"remote exec", "lxc/pve2/100", LXCExec, true, []string{
+			"ssh", "-tt", "-o", "StrictHostKeyChecking=no", "root@10.0.0.2",
+			"pct", "exec", "100", "--", "env", "TERM=xterm-256color", "tmux", "new-session", "-A", "-s", "tb-100", "--", "/bin/bash"}},
+		{"remote enter", "lxc/pve2/100", LXCEnter, true, []string{
+			"ssh", "-tt", "-o", "StrictHostKeyChecking=no", "root@10.0.0.2", "env", "TERM=xterm-256color", "pct", "enter", "100"}},
+		{"remote exec without tmux", "lxc/pve2/100", LXCExec, false, []string{
+			"ssh", "-tt", "-o", "StrictHostKeyChecking=no", "root@10.0.0.2", "env", "TERM=xterm-256color", "pct", "enter", "100"}},
+		{"local exec", "100", LXCExec, true, []string{
+			"pct", "exec", "100", "--", "env", "TERM=xterm-256color", "tmux", "new-session", "-A", "-s", "tb-100", "--", "/bin/bash"}},
+		{"local enter", "100", LXCEnter, true, []string{"env", "TERM=xterm-256color", "pct", "enter", "100"}},
+		{"local exec, second instance", "100#2", LXCExec, true, []string{
+			"pct", "exec", "100", "--", "env", "TERM=xterm-256color", "tmux", "new-session", "-A", "-s", "tb-100-2", "--", "/bin/bash"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(func(node string) string { return map[string]string{"pve2": "10.0.0.2"}[node] })
+			m.LXCMode = tt.mode
+			cmd := m.shellCommand(tt.id, tt.tmux, "")
+			if cmd.Err != nil && !errors.Is(cmd.Err, exec.ErrNotFound) {
+				t.Fatalf("building command: %v", cmd.Err)
+			}
+			if !slices.Equal(cmd.Args, tt.want) {
+				t.Errorf("args = %q\nwant   %q", cmd.Args, tt.want)
+			}
+		})
+	}
+}
+
+func TestShellCommandAddr(t *testing.T) {
+	tests := []struct {
+		id   string
+		addr string
+		want string // the ssh destination, or "" for a local command
+	}{
+		{"node:pve2", "", "root@10.0.0.2"},
+		{"node:pve2", "10.9.9.9", "root@10.9.9.9"},
+		{"lxc/pve2/100", "10.9.9.9", "root@10.9.9.9"},
+		{"qemu/pve2/200", "10.9.9.9", "root@10.9.9.9"},
+		{"qemu/pve2/200", "fd00::9", "root@fd00::9"},
+		// ssh_hosts and local targets keep their own routing.
+		{"ssh:pbs", "10.9.9.9", "backup@192.0.2.5"},
+		{"host", "10.9.9.9", ""},
+	}
+	for _, tt := range tests {
+		m := NewManager(func(node string) string { return map[string]string{"pve2": "10.0.0.2"}[node] })
+		m.SSHHosts = map[string]SSHHost{"pbs": {Address: "192.0.2.5", User: "backup"}}
+		args := m.shellCommand(tt.id, true, tt.addr).Args
+		got := ""
+		if args[0] == "ssh" {
+			got = args[slices.IndexFunc(args, func(a string) bool { return strings.Contains(a, "@") })]
+		}
+		if got != tt.want {
+			t.Errorf("%s with addr %q: ssh to %q, want %q (args %q)", tt.id, tt.addr, got, tt.want, args)
+		}
+	}
+}
+
+func TestDefaultSize(t *testing.T) {
+	tests := []struct {
+		name       string
+		cols, rows uint16
+		want       string // what stty size says before any resize
+	}{
+		{"configured", 120, 40, "40 120"},
+		{"unset", 0, 0, "0 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			m.BuildCommand = func(string) *exec.Cmd { return exec.Command("sh", "-c", "stty size; exec cat") }
+			m.DefaultCols, m.DefaultRows = tt.cols, tt.rows
+			ts := serveWS(t, m)
+			conn := dialWS(t, ts, "host")
+			readUntil(t, conn, tt.want+"\r\n", nil)
+
+			// A client's resize still wins.
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"resize","cols":100,"rows":30}`))
+			m.mu.RLock()
+			s := m.sessions["host"]
+			m.mu.RUnlock()
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				s.mu.Lock()
+				ws, err := pty.GetsizeFull(s.ptmx)
+				s.mu.Unlock()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ws.Cols == 100 && ws.Rows == 30 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("size %dx%d after resizing to 100x30", ws.Cols, ws.Rows)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestConnEvents(t *testing.T) {
+	m := newTestManager(t)
+	var mu sync.Mutex
+	var events []ConnEvent
+	m.OnConnEvent = func(ev ConnEvent) {
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	}
+	ts := serveWS(t, m)
+	conn := dialWS(t, ts, "host")
+	conn.WriteMessage(websocket.BinaryMessage, []byte("abc\n"))
+	readUntil(t, conn, "abc\r\nabc\r\n", nil) // the echo, then cat
+	conn.Close()
+	waitFor(t, "disconnect event", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events) == 2
+	})
+
+	connect, disconnect := events[0], events[1]
+	for _, ev := range events {
+		if ev.SessionID != "host" || ev.Conn != 1 || ev.Info.ClientIP != "192.0.2.1" || ev.Info.RequestID != "test" {
+			t.Errorf("%s event has session %q, conn %d, info %+v", ev.Type, ev.SessionID, ev.Conn, ev.Info)
+		}
+		if ev.Time.IsZero() {
+			t.Errorf("%s event has no time", ev.Type)
+		}
+	}
+	if connect.Type != "connect" || disconnect.Type != "disconnect" {
+		t.Fatalf("event types %q, %q, want connect, disconnect", connect.Type, disconnect.Type)
+	}
+	if !connect.ConnectedAt.IsZero() || connect.BytesIn != 0 || connect.BytesOut != 0 {
+		t.Errorf("connect event carries disconnect fields: %+v", connect)
+	}
+	if disconnect.ConnectedAt.IsZero() || disconnect.ConnectedAt.After(disconnect.Time) {
+		t.Errorf("disconnect ConnectedAt = %v, Time = %v", disconnect.ConnectedAt, disconnect.Time)
+	}
+	if disconnect.BytesIn != 4 {
+		t.Errorf("BytesIn = %d, want 4", disconnect.BytesIn)
+	}
+	if disconnect.BytesOut < 10 {
+		t.Errorf("BytesOut = %d, want at least the 10 bytes read", disconnect.BytesOut)
+	}
+}
+
+// TestTakeoverWhileStreaming swaps connections as fast as several clients
+// can dial while the shell floods output, so the PTY reader is always
+// mid-write when a connection is closed. Run with -race.
+func TestTakeoverWhileStreaming(t *testing.T) {
+	m := newTestManager(t)
+	m.BuildCommand = func(string) *exec.Cmd { return exec.Command("yes") }
+	ts := serveWS(t, m)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/host"
+
+	readUntil(t, dialWS(t, ts, "host"), "y\r\ny\r\n", nil)
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 25 {
+				conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+				if err != nil {
+					t.Errorf("dialing: %v", err)
+					return
+				}
+				// Read a little so the swap races with live output, then
+				// leave the connection to be taken over.
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				conn.ReadMessage()
+				defer conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	readUntil(t, dialWS(t, ts, "host"), "y\r\ny\r\n", nil)
+	if n := len(m.Sessions()); n != 1 {
+		t.Errorf("%d sessions after takeovers, want 1", n)
+	}
+}
+
+func TestTmuxSessionInstances(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"host", "tb-host"},
+		{"host#1", "tb-host-1"},
+		{"host#2", "tb-host-2"},
+		{"node:pve2", "tb-pve2"},
+		{"node:pve2#work", "tb-pve2-work"},
+		{"node:10.0.0.2#2", "tb-10-0-0-2-2"},
+		{"lxc/pve/100", "tb-100"},
+		{"lxc/pve/100#2", "tb-100-2"},
+		{"100#3", "tb-100-3"},
+		{"ssh:pbs.lan#2", "tb-ssh-pbs-lan-2"},
+		{"qemu/pve/200", ""},
+		{"qemu/pve/200#2", ""},
+		{"host#a#b", ""},
+		{"node:-pve", ""},
+	}
+	m := NewManager(nil)
+	for _, tt := range tests {
+		if got := m.tmuxSession(tt.id); got != tt.want {
+			t.Errorf("tmuxSession(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestInstancesAreDistinctSessions(t *testing.T) {
+	m := newTestManager(t)
+	s1, err := m.GetOrCreate("host#1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := m.GetOrCreate("host#2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := m.GetOrCreate("host#1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s1 == s2 {
+		t.Error("host#1 and host#2 share a session")
+	}
+	if again != s1 {
+		t.Error("host#1 didn't reuse its session")
+	}
+	if s1.cmd.Process.Pid == s2.cmd.Process.Pid {
+		t.Error("host#1 and host#2 share a process")
+	}
+	if n := len(m.Sessions()); n != 2 {
+		t.Errorf("%d sessions, want 2", n)
+	}
+}
+
+func TestInjectedBuildCommand(t *testing.T) {
+	m := newTestManager(t)
+	var mu sync.Mutex
+	var built []string
+	m.BuildCommand = func(id string) *exec.Cmd {
+		mu.Lock()
+		built = append(built, id)
+		mu.Unlock()
+		return exec.Command("cat")
+	}
+
+	s, err := m.GetOrCreate("lxc/pve/100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := m.GetOrCreate("lxc/pve/100"); err != nil || again != s {
+		t.Errorf("second GetOrCreate = %p, %v; want the same session %p", again, err, s)
+	}
+	if _, err := m.GetOrCreate("not an id"); err == nil {
+		t.Error("GetOrCreate accepted an invalid id")
+	}
+
+	ts := serveWS(t, m)
+	conn := dialWS(t, ts, "lxc/pve/100")
+	conn.WriteMessage(websocket.BinaryMessage, []byte("round trip\n"))
+	readUntil(t, conn, "round trip\r\nround trip\r\n", nil)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(built, []string{"lxc/pve/100"}) {
+		t.Errorf("BuildCommand called with %q, want one call for lxc/pve/100", built)
+	}
+}
+
+func TestSessionHooks(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		wantExit int
+	}{
+		{"clean exit", "exit 0", 0},
+		{"failure", "exit 3", 3},
+		{"killed by a signal", "kill -9 $$", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			m.BuildCommand = func(string) *exec.Cmd { return exec.Command("sh", "-c", "sleep 0.2; "+tt.script) }
+			type hookCall struct {
+				id string
+				n  int
+			}
+			started := make(chan hookCall, 1)
+			ended := make(chan hookCall, 1)
+			m.OnSessionStart = func(id string, pid int) { started <- hookCall{id, pid} }
+			m.OnSessionEnd = func(id string, exitCode int) { ended <- hookCall{id, exitCode} }
+
+			s, err := m.GetOrCreate("host#hooks")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, hook := range []struct {
+				name string
+				ch   chan hookCall
+				want hookCall
+			}{
+				{"OnSessionStart", started, hookCall{"host#hooks", s.cmd.Process.Pid}},
+				{"OnSessionEnd", ended, hookCall{"host#hooks", tt.wantExit}},
+			} {
+				select {
+				case got := <-hook.ch:
+					if got != hook.want {
+						t.Errorf("%s(%q, %d), want (%q, %d)", hook.name, got.id, got.n, hook.want.id, hook.want.n)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("%s wasn't called", hook.name)
+				}
+			}
+		})
+	}
+}
+
+func TestMOTD(t *testing.T) {
+	tests := []struct {
+		name string
+		motd string
+		want string
+	}{
+		{"unset", "", ""},
+		{"one line", "Authorized use only", "Authorized use only\r\n"},
+		{"ANSI and newlines", "\x1b[1mAuthorized use only\x1b[0m\nactivity is logged\n", "\x1b[1mAuthorized use only\x1b[0m\r\nactivity is logged\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			m.MOTD = tt.motd
+			m.BuildCommand = func(string) *exec.Cmd {
+				return exec.Command("sh", "-c", "sleep 0.2; echo shell-output; exec cat")
+			}
+			ts := serveWS(t, m)
+			got := readUntil(t, dialWS(t, ts, "host"), "shell-output\r\n", nil)
+			if want := tt.want + "shell-output\r\n"; got != want {
+				t.Errorf("first output %q, want %q", got, want)
+			}
+
+			// Only the first connection of a session sees it.
+			conn := dialWS(t, ts, "host")
+			conn.WriteMessage(websocket.BinaryMessage, []byte("again\n"))
+			if got := readUntil(t, conn, "again\r\nagain\r\n", nil); tt.want != "" && strings.Contains(got, tt.want) {
+				t.Errorf("reconnect got the MOTD again: %q", got)
+			}
+		})
+	}
+}
+
+func TestConnectingMessage(t *testing.T) {
+	// A stand-in for ssh that takes a moment to connect before the shell
+	// produces any output.
+	fakeSSH := filepath.Join(t.TempDir(), "ssh")
+	if err := os.WriteFile(fakeSSH, []byte("#!/bin/sh\nsleep 0.3\necho remote-prompt\nexec cat\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	const connecting = "\x1b[2mConnecting...\x1b[0m\r\n"
+	tests := []struct {
+		name string
+		cmd  string
+		want bool
+	}{
+		{"over ssh", fakeSSH, true},
+		{"local", "cat", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			m.BuildCommand = func(string) *exec.Cmd { return exec.Command(tt.cmd) }
+			ts := serveWS(t, m)
+			conn := dialWS(t, ts, "host")
+			conn.WriteMessage(websocket.BinaryMessage, []byte("typed\n"))
+			got := readUntil(t, conn, "typed\r\n", nil)
+			if strings.HasPrefix(got, connecting) != tt.want {
+				t.Errorf("output %q; want connecting message first: %v", got, tt.want)
+			}
+
+			// Once output has arrived, later connections don't get it.
+			if tt.want {
+				readUntil(t, conn, "remote-prompt", nil)
+				again := dialWS(t, ts, "host")
+				again.WriteMessage(websocket.BinaryMessage, []byte("more\n"))
+				if got := readUntil(t, again, "more\r\n", nil); strings.Contains(got, "Connecting") {
+					t.Errorf("reconnect got the connecting message: %q", got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package terminal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"time"
+
+	"github.com/chris/termbrowser/ids"
+)
+
+// ErrNoTmux is returned when Manager.CheckTmux finds that a target which
+// would run its shell under tmux doesn't have tmux installed.
+var ErrNoTmux = errors.New("tmux is not installed on the target")
+
+// tmuxCheckTTL is how long a tmux check result is reused for a target.
+const tmuxCheckTTL = 5 * time.Minute
+
+// tmuxCheckTimeout bounds a single tmux check.
+const tmuxCheckTimeout = 10 * time.Second
+
+type tmuxResult struct {
+	ok bool
+	at time.Time
+}
+
+// usesTmux reports whether the default command for id runs tmux. An
+// invalid id runs nothing, so it doesn't.
+func (m *Manager) usesTmux(id string) bool {
+	p, err := ids.Parse(id)
+	if err != nil {
+		return false
+	}
+	switch p.Kind {
+	case ids.Host, ids.Node, ids.SSH:
+		return true
+	case ids.LXC, ids.LocalLXC:
+		return m.LXCMode != LXCEnter
+	}
+	return false
+}
+
+// commandFor picks the builder for a new session of id: BuildCommand, or
+// the tmux-less direct command when CheckTmux finds tmux missing and
+// TmuxFallback is set, in which case direct is true. A failed check is
+// logged and the session started as usual, so the real error shows in the
+// terminal.
+func (m *Manager) commandFor(id string) (build CommandBuilder, direct bool, err error) {
+	if !m.CheckTmux || !m.usesTmux(id) {
+		return m.BuildCommand, false, nil
+	}
+	ok, err := m.hasTmux(id)
+	if err != nil {
+		log.Printf("[SESSION] tmux check for %q failed, connecting anyway: %v", id, err)
+		return m.BuildCommand, false, nil
+	}
+	if ok {
+		return m.BuildCommand, false, nil
+	}
+	if m.TmuxFallback {
+		log.Printf("[SESSION] tmux not found for %q, using a plain shell", id)
+		return m.directCommand, true, nil
+	}
+	return nil, false, fmt.Errorf("%w; install it there or enable tmux_fallback", ErrNoTmux)
+}
+
+// hasTmux runs TmuxChecker for id's target, caching successful answers.
+func (m *Manager) hasTmux(id string) (bool, error) {
+	base, _ := ids.SplitInstance(id)
+	m.tmuxMu.Lock()
+	r, cached := m.tmuxCache[base]
+	m.tmuxMu.Unlock()
+	if cached && time.Since(r.at) < tmuxCheckTTL {
+		return r.ok, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tmuxCheckTimeout)
+	defer cancel()
+	ok, err := m.TmuxChecker(ctx, base)
+	if err != nil {
+		return false, err
+	}
+	m.tmuxMu.Lock()
+	if m.tmuxCache == nil {
+		m.tmuxCache = make(map[string]tmuxResult)
+	}
+	m.tmuxCache[base] = tmuxResult{ok: ok, at: time.Now()}
+	m.tmuxMu.Unlock()
+	return ok, nil
+}
+
+// probeTmux is the default TmuxChecker. "command -v" exits 1 (bash) or 127
+// (dash) when tmux isn't on the PATH; any other failure (ssh, pct) is an
+// error.
+func (m *Manager) probeTmux(ctx context.Context, id string) (bool, error) {
+	cmd, err := m.Command(ctx, id, "sh", "-c", "command -v tmux")
+	if err != nil {
+		return false, err
+	}
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && (exitErr.ExitCode() == 1 || exitErr.ExitCode() == 127) {
+		return false, nil
+	}
+	return err == nil, err
+}
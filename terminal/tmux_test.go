@@ -0,0 +1,171 @@
+package terminal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeTmuxChecker answers tmux checks from a fixed result and counts them.
+type fakeTmuxChecker struct {
+	ok  bool
+	err error
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *fakeTmuxChecker) check(_ context.Context, id string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, id)
+	return f.ok, f.err
+}
+
+func TestUsesTmux(t *testing.T) {
+	tests := []struct {
+		id   string
+		mode LXCMode
+		want bool
+	}{
+		{"host", LXCExec, true},
+		{"host#2", LXCExec, true},
+		{"node:pve2", LXCExec, true},
+		{"ssh:pbs", LXCEnter, true},
+		{"lxc/pve2/100", LXCExec, true},
+		{"lxc/pve2/100", LXCEnter, false},
+		{"100#2", LXCExec, true},
+		{"100", LXCEnter, false},
+		{"qemu/pve2/200", LXCExec, false},
+		{"node:pve2;id", LXCExec, false},
+		{"bogus", LXCExec, false},
+	}
+	for _, tt := range tests {
+		m := NewManager(nil)
+		m.LXCMode = tt.mode
+		if got := m.usesTmux(tt.id); got != tt.want {
+			t.Errorf("usesTmux(%q) with %s = %v, want %v", tt.id, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestCommandForTmuxCheck(t *testing.T) {
+	errSSH := errors.New("ssh: connect to host pve2: timed out")
+	tests := []struct {
+		name       string
+		check      bool
+		fallback   bool
+		id         string
+		hasTmux    bool
+		checkErr   error
+		wantChecks int
+		wantDirect bool
+		wantErr    error
+	}{
+		{"checking off", false, false, "node:pve2", false, nil, 0, false, nil},
+		{"target without tmux", true, false, "qemu/pve2/200", false, nil, 0, false, nil},
+		{"tmux present", true, false, "node:pve2", true, nil, 1, false, nil},
+		{"tmux missing", true, false, "node:pve2", false, nil, 1, false, ErrNoTmux},
+		{"tmux missing, fallback", true, true, "lxc/pve2/100", false, nil, 1, true, nil},
+		{"check failed", true, false, "node:pve2", false, errSSH, 1, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(func(string) string { return "10.0.0.2" })
+			m.BuildCommand = func(string) *exec.Cmd { return exec.Command("default-builder") }
+			m.CheckTmux = tt.check
+			m.TmuxFallback = tt.fallback
+			checker := &fakeTmuxChecker{ok: tt.hasTmux, err: tt.checkErr}
+			m.TmuxChecker = checker.check
+
+			build, direct, err := m.commandFor(tt.id)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if len(checker.calls) != tt.wantChecks {
+				t.Errorf("%d checks, want %d", len(checker.calls), tt.wantChecks)
+			}
+			if err != nil {
+				return
+			}
+			if direct != tt.wantDirect {
+				t.Errorf("direct = %v, want %v", direct, tt.wantDirect)
+			}
+			if usedDefault := build(tt.id).Args[0] == "default-builder"; usedDefault == tt.wantDirect {
+				t.Errorf("used BuildCommand = %v with direct = %v", usedDefault, tt.wantDirect)
+			}
+		})
+	}
+}
+
+func TestTmuxCheckCached(t *testing.T) {
+	tests := []struct {
+		name      string
+		checkErr  error
+		wantCalls int
+	}{
+		{"answers are cached per target", nil, 1},
+		{"failures aren't", errors.New("ssh failed"), 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(nil)
+			m.CheckTmux = true
+			checker := &fakeTmuxChecker{ok: true, err: tt.checkErr}
+			m.TmuxChecker = checker.check
+			for _, id := range []string{"node:pve2", "node:pve2#2", "node:pve2#3"} {
+				m.commandFor(id)
+			}
+			if len(checker.calls) != tt.wantCalls {
+				t.Errorf("checker called %d times (%q), want %d", len(checker.calls), checker.calls, tt.wantCalls)
+			}
+			for _, id := range checker.calls {
+				if id != "node:pve2" {
+					t.Errorf("checked %q, want the id without its instance", id)
+				}
+			}
+		})
+	}
+}
+
+func TestNoTmuxCloses(t *testing.T) {
+	m := newTestManager(t)
+	m.CheckTmux = true
+	m.TmuxChecker = (&fakeTmuxChecker{ok: false}).check
+	ts := serveWS(t, m)
+	ce := readCloseFrame(t, dialWS(t, ts, "host"))
+	if ce.Code != websocket.CloseInternalServerErr || ce.Text != "tmux not installed" {
+		t.Errorf("closed with %d %q, want %d %q", ce.Code, ce.Text, websocket.CloseInternalServerErr, "tmux not installed")
+	}
+}
+
+func TestProbeTmux(t *testing.T) {
+	_, lookErr := exec.LookPath("tmux")
+	ok, err := NewManager(nil).probeTmux(context.Background(), "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := lookErr == nil; ok != want {
+		t.Errorf("probeTmux(host) = %v, want %v", ok, want)
+	}
+
+	// A PATH with a shell but no tmux.
+	bin := t.TempDir()
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip(err)
+	}
+	if err := os.Symlink(sh, filepath.Join(bin, "sh")); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+	if ok, err := NewManager(nil).probeTmux(context.Background(), "host"); ok || err != nil {
+		t.Errorf("with tmux off the PATH: %v, %v; want false, nil", ok, err)
+	}
+}
@@ -0,0 +1,54 @@
+package terminal
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"time"
+)
+
+// windowRe matches tmux window names accepted from clients. '.' and ':'
+// are left out since tmux reads them as pane and session separators in a
+// target.
+var windowRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// ValidWindowName reports whether s can be used as a tmux window name in
+// ConnInfo.Window.
+func ValidWindowName(s string) bool { return windowRe.MatchString(s) }
+
+// selectWindow switches the tmux session of id to the window named name,
+// creating it if there isn't one, once the session is up. Windows belong
+// to the tmux session, so other clients attached to it switch too.
+func (m *Manager) selectWindow(id, session, name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if !m.waitTmuxSession(ctx, id, session) {
+		log.Printf("[SESSION] %q: tmux session %s never appeared, not selecting window %s", id, session, name)
+		return
+	}
+	// select-window fails if there's no such window; new-window then
+	// creates and selects it. new-window -S does both but needs tmux 3.2.
+	cmd, err := m.Command(ctx, id, "tmux", "select-window", "-t", session+":"+name)
+	if err == nil && cmd.Run() == nil {
+		return
+	}
+	cmd, err = m.Command(ctx, id, "tmux", "new-window", "-t", session+":", "-n", name)
+	if err == nil {
+		err = cmd.Run()
+	}
+	if err != nil {
+		log.Printf("[SESSION] %q: creating tmux window %s: %v", id, name, err)
+	}
+}
+
+// tmuxSendKeys types keys, in tmux's key syntax, into the active pane of
+// the tmux session for id.
+func (m *Manager) tmuxSendKeys(id, session, keys string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cmd, err := m.Command(ctx, id, "tmux", "send-keys", "-t", session, keys)
+	if err != nil {
+		return err
+	}
+	return cmd.Run()
+}
@@ -0,0 +1,76 @@
+package terminal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidWindowName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"deploy", true},
+		{"build_2", true},
+		{"logs-web", true},
+		{strings.Repeat("w", 32), true},
+		{strings.Repeat("w", 33), false},
+		{"", false},
+		{"pane.1", false},
+		{"sess:win", false},
+		{"two words", false},
+		{"$(reboot)", false},
+		{"-t", true}, // passed as part of "session:name", never on its own
+	}
+	for _, tt := range tests {
+		if got := ValidWindowName(tt.name); got != tt.want {
+			t.Errorf("ValidWindowName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSelectWindow(t *testing.T) {
+	tests := []struct {
+		name   string
+		exists bool // whether select-window finds the window
+		want   string
+	}{
+		{"existing window", true, "has-session -t tb-pve2\n" +
+			"select-window -t tb-pve2:deploy\n"},
+		{"new window", false, "has-session -t tb-pve2\n" +
+			"select-window -t tb-pve2:deploy\n" +
+			"new-window -t tb-pve2: -n deploy\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A stand-in for ssh that runs the remote command locally, and
+			// a tmux that records its arguments.
+			dir := t.TempDir()
+			calls := filepath.Join(dir, "calls")
+			tmux := "#!/bin/sh\necho \"$*\" >> " + calls + "\n"
+			if !tt.exists {
+				tmux += "[ \"$1\" = select-window ] && exit 1\n"
+			}
+			tmux += "exit 0\n"
+			ssh := "#!/bin/sh\nwhile [ \"$1\" != root@10.0.0.2 ]; do shift; done\nshift\nexec \"$@\"\n"
+			for name, script := range map[string]string{"tmux": tmux, "ssh": ssh} {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+			m := NewManager(func(string) string { return "10.0.0.2" })
+			m.selectWindow("node:pve2", m.tmuxSession("node:pve2"), "deploy")
+			data, err := os.ReadFile(calls)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("tmux was run with\n%s\nwant\n%s", data, tt.want)
+			}
+		})
+	}
+}
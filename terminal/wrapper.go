@@ -0,0 +1,64 @@
+package terminal
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// CheckSessionWrapper rejects wrapper templates with an empty program or
+// argument, placeholders other than {id} and {command}, or more than one
+// {command}.
+func CheckSessionWrapper(argv []string) error {
+	if len(argv) == 0 || argv[0] == "" {
+		return errors.New("session_wrapper needs a program")
+	}
+	commands := 0
+	for _, a := range argv {
+		if a == "" {
+			return errors.New("session_wrapper has an empty argument")
+		}
+		if a == "{command}" {
+			commands++
+			continue
+		}
+		rest := strings.ReplaceAll(a, "{id}", "")
+		if strings.ContainsAny(rest, "{}") {
+			return fmt.Errorf("session_wrapper argument %q: only {id} and {command} (as a whole argument) are substituted", a)
+		}
+	}
+	if commands > 1 {
+		return errors.New("session_wrapper may contain {command} only once")
+	}
+	return nil
+}
+
+// wrap applies m.SessionWrapper to the argv of a session's shell for id.
+// {id} is replaced by the path-escaped id, as used for scrollback files.
+// An argument that is exactly {command} is replaced by argv joined into a
+// shell command line, for wrappers such as "script -c"; without one, argv
+// is appended to the wrapper.
+func (m *Manager) wrap(id string, argv []string) []string {
+	if len(m.SessionWrapper) == 0 {
+		return argv
+	}
+	out := make([]string, 0, len(m.SessionWrapper)+len(argv))
+	substituted := false
+	for _, a := range m.SessionWrapper {
+		if a == "{command}" {
+			quoted := make([]string, len(argv))
+			for i, c := range argv {
+				quoted[i] = shellQuote(c)
+			}
+			out = append(out, strings.Join(quoted, " "))
+			substituted = true
+			continue
+		}
+		out = append(out, strings.ReplaceAll(a, "{id}", url.PathEscape(id)))
+	}
+	if !substituted {
+		out = append(out, argv...)
+	}
+	return out
+}
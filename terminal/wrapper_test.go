@@ -0,0 +1,78 @@
+package terminal
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckSessionWrapper(t *testing.T) {
+	tests := []struct {
+		argv    []string
+		wantErr string
+	}{
+		{[]string{"sudo", "-u", "someone"}, ""},
+		{[]string{"script", "-q", "-f", "/var/log/tb/{id}.log", "-c", "{command}"}, ""},
+		{nil, "needs a program"},
+		{[]string{""}, "needs a program"},
+		{[]string{"sudo", ""}, "empty argument"},
+		{[]string{"script", "-c", "{command} -x"}, "only {id} and {command}"},
+		{[]string{"script", "{user}"}, "only {id} and {command}"},
+		{[]string{"sh", "-c", "{command}", "{command}"}, "only once"},
+	}
+	for _, tt := range tests {
+		err := CheckSessionWrapper(tt.argv)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("CheckSessionWrapper(%q): %v", tt.argv, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("CheckSessionWrapper(%q) = %v, want an error containing %q", tt.argv, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSessionWrapper(t *testing.T) {
+	sudo := []string{"sudo", "-u", "someone"}
+	script := []string{"script", "-q", "/var/log/tb/{id}.log", "-c", "{command}"}
+	ssh := []string{"ssh", "-tt", "-o", "StrictHostKeyChecking=no", "root@10.0.0.2"}
+	tests := []struct {
+		name    string
+		wrapper []string
+		id      string
+		mode    LXCMode
+		tmux    bool
+		want    []string
+	}{
+		{"host, tmux", sudo, "host", LXCExec, true, []string{
+			"sudo", "-u", "someone", "tmux", "new-session", "-A", "-s", "tb-host", "--", "/bin/bash"}},
+		{"host, direct", sudo, "host", LXCExec, false, []string{"sudo", "-u", "someone", "/bin/bash", "-l"}},
+		{"host, {command}", script, "host#2", LXCExec, false, []string{
+			"script", "-q", "/var/log/tb/host%232.log", "-c", "/bin/bash -l"}},
+		{"local lxc", sudo, "100", LXCExec, true, []string{
+			"sudo", "-u", "someone", "pct", "exec", "100", "--", "env", "TERM=xterm-256color",
+			"tmux", "new-session", "-A", "-s", "tb-100", "--", "/bin/bash"}},
+		{"remote lxc, enter", sudo, "lxc/pve2/100", LXCEnter, true, append(slices.Clone(ssh),
+			"sudo", "-u", "someone", "env", "TERM=xterm-256color", "pct", "enter", "100")},
+		// ssh joins its arguments for the remote shell, so they're quoted.
+		{"remote lxc, {command}", script, "lxc/pve2/100", LXCEnter, true, append(slices.Clone(ssh),
+			"script", "-q", "'/var/log/tb/lxc%2Fpve2%2F100.log'", "-c", "'env TERM=xterm-256color pct enter 100'")},
+		// Node and VM shells aren't wrapped.
+		{"node", sudo, "node:pve2", LXCExec, false, ssh},
+		{"qemu", sudo, "qemu/pve2/200", LXCExec, true, append(slices.Clone(ssh),
+			"qm", "terminal", "200", "-iface", "serial0")},
+		{"no wrapper", nil, "host", LXCExec, false, []string{"/bin/bash", "-l"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(func(string) string { return "10.0.0.2" })
+			m.SessionWrapper = tt.wrapper
+			m.LXCMode = tt.mode
+			if got := m.shellCommand(tt.id, tt.tmux, "").Args; !slices.Equal(got, tt.want) {
+				t.Errorf("args = %q\nwant   %q", got, tt.want)
+			}
+		})
+	}
+}
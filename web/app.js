@@ -17,6 +17,8 @@ const btnLogout = document.getElementById('btn-logout');
 // ─── Init ────────────────────────────────────────────────────────────────────
 
 async function init() {
+    loadUIConfig();
+
     // Check if already authenticated
     try {
         const res = await fetch('/api/containers');
@@ -29,6 +31,17 @@ async function init() {
     showLogin();
 }
 
+// loadUIConfig applies the server's non-secret UI settings. Failure is
+// harmless: the page keeps its built-in defaults.
+async function loadUIConfig() {
+    try {
+        const res = await fetch('/api/config');
+        if (!res.ok) return;
+        const cfg = await res.json();
+        if (cfg.product_name) document.title = cfg.product_name;
+    } catch (_) {}
+}
+
 // ─── Login ───────────────────────────────────────────────────────────────────
 
 function showLogin() {
@@ -91,6 +104,12 @@ function renderSidebar(items) {
     const lxcs  = (items || []).filter(c => c.type === 'lxc');
     const vms   = (items || []).filter(c => c.type === 'qemu');
 
+    function guestItem(c) {
+        const el = makeSidebarItem(c.ctid, c.name || c.vmid || c.ctid, c.status, c.vmid || c.ctid);
+        if (c.ha_state) el.title = 'HA: ' + c.ha_state;
+        return el;
+    }
+
     function appendSection(label, list) {
         const labelEl = document.createElement('div');
         labelEl.className = 'sidebar-section-label';
@@ -105,19 +124,29 @@ function renderSidebar(items) {
         ));
     }
     if (lxcs.length > 0) {
-        appendSection('Containers', lxcs.map(c =>
-            makeSidebarItem(c.ctid, c.name || c.vmid || c.ctid, c.status, c.vmid || c.ctid)
-        ));
+        appendSection('Containers', lxcs.map(guestItem));
     }
     if (vms.length > 0) {
-        appendSection('Virtual Machines', vms.map(c =>
-            makeSidebarItem(c.ctid, c.name || c.vmid || c.ctid, c.status, c.vmid || c.ctid)
-        ));
+        appendSection('Virtual Machines', vms.map(guestItem));
     }
+
+    // Configured ssh_hosts, one section per type (e.g. "PBS").
+    const others = new Map();
+    (items || []).forEach(c => {
+        if (['node', 'lxc', 'qemu'].includes(c.type)) return;
+        if (!others.has(c.type)) others.set(c.type, []);
+        others.get(c.type).push(c);
+    });
+    others.forEach((list, type) => {
+        appendSection(type.toUpperCase(), list.map(c =>
+            makeSidebarItem(c.ctid, c.name || c.ctid, c.status, null)
+        ));
+    });
 }
 
 function makeSidebarItem(id, name, status, ctid) {
-    const isActive = status === 'running' || status === 'online';
+    // ssh_hosts aren't checked, so don't grey them out.
+    const isActive = status === 'running' || status === 'online' || status === 'unknown';
     const el = document.createElement('div');
     el.className = 'sidebar-item' + (isActive ? '' : ' stopped');
     el.dataset.id = id;
@@ -229,8 +258,41 @@ function sendResize() {
     }
 }
 
+// Text frames are JSON control messages ({"type": ...}); anything else is
+// plain text (e.g. an error) to show in the terminal. Returns true if the
+// frame was a control message.
+function handleControlMessage(text) {
+    let msg;
+    try {
+        msg = JSON.parse(text);
+    } catch (_) {
+        return false;
+    }
+    if (!msg || typeof msg.type !== 'string') return false;
+    switch (msg.type) {
+        case 'pong':
+            break;
+        case 'session':
+            // Needed to reattach when the server requires resume tokens.
+            if (currentId) sessionStorage.setItem('resume:' + currentId, msg.token);
+            break;
+        default:
+            console.log(`[WS] ignoring control message type ${msg.type}`);
+    }
+    return true;
+}
+
 let wsSeq = 0; // client-side WebSocket sequence counter
 
+// Close codes sent by the server (see terminal.CloseSessionEnded,
+// terminal.CloseTryAgain and friends).
+const CLOSE_SESSION_ENDED = 1000;
+const CLOSE_TRY_AGAIN = 4503;
+const CLOSE_POLICY_VIOLATION = 1008;
+const CLOSE_SESSION_IN_USE = 4409;
+const CLOSE_CLIENT_IDLE = 4408;
+const CLOSE_TAKEN_OVER = 4000;
+
 function disconnectTerminal() {
     if (ws) {
         console.log(`[WS] disconnectTerminal: closing WS#${ws._seq} for ${currentId}`);
@@ -267,9 +329,13 @@ function connectTerminal(id) {
     wsSeq++;
     const mySeq = wsSeq;
     const proto = location.protocol === 'https:' ? 'wss' : 'ws';
-    const url = `${proto}://${location.host}/ws/terminal/${id}`;
+    // '#' separates an instance suffix (e.g. lxc/pve/100#2) and must be
+    // escaped or the browser treats it as a fragment.
+    let url = `${proto}://${location.host}/ws/terminal/${id.replace(/#/g, '%23')}`;
+    const resume = sessionStorage.getItem('resume:' + id);
+    if (resume) url += '?resume=' + encodeURIComponent(resume);
     console.log(`[WS] connectTerminal(${id}): creating WS#${mySeq} → ${url}`);
-    ws = new WebSocket(url);
+    ws = new WebSocket(url, ['termbrowser.v1']);
     ws._seq = mySeq;
     ws.binaryType = 'arraybuffer';
 
@@ -282,7 +348,7 @@ function connectTerminal(id) {
         if (!term) return;
         if (event.data instanceof ArrayBuffer) {
             term.write(new Uint8Array(event.data));
-        } else {
+        } else if (!handleControlMessage(event.data)) {
             term.write(event.data);
         }
     };
@@ -296,7 +362,25 @@ function connectTerminal(id) {
 
     ws.onclose = (e) => {
         console.log(`[WS] WS#${mySeq} (${id}): onclose code=${e.code} reason=${e.reason} currentId=${currentId}`);
-        if (term && currentId === id) {
+        if (!term || currentId !== id) return;
+        if (e.code === CLOSE_SESSION_ENDED && e.reason === 'session ended') {
+            term.write('\r\n\x1b[33m[session ended]\x1b[0m\r\n');
+        } else if (e.code === CLOSE_POLICY_VIOLATION && e.reason === 'invalid resume token') {
+            term.write('\r\n\x1b[31m[session belongs to another client]\x1b[0m\r\n');
+        } else if (e.code === CLOSE_TAKEN_OVER) {
+            term.write('\r\n\x1b[33m[session opened elsewhere]\x1b[0m\r\n');
+        } else if (e.code === CLOSE_CLIENT_IDLE) {
+            term.write('\r\n\x1b[33m[disconnected after inactivity; the session is still running]\x1b[0m\r\n');
+        } else if (e.code === CLOSE_SESSION_IN_USE) {
+            term.write('\r\n\x1b[33m[session in use]\x1b[0m\r\n');
+        } else if (e.code === CLOSE_TRY_AGAIN) {
+            const m = /retry-after=(\d+)/.exec(e.reason);
+            const secs = m ? parseInt(m[1], 10) : 5;
+            term.write(`\r\n\x1b[33m[server busy, retrying in ${secs}s]\x1b[0m\r\n`);
+            setTimeout(() => {
+                if (currentId === id && ws && ws._seq === mySeq) connectTerminal(id);
+            }, secs * 1000);
+        } else {
             term.write('\r\n\x1b[33m[disconnected]\x1b[0m\r\n');
         }
     };